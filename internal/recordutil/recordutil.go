@@ -0,0 +1,60 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+// Package recordutil holds the record handling shared by the in-memory
+// producers.
+package recordutil
+
+import (
+	"context"
+	"time"
+
+	apmqueue "github.com/elastic/apm-queue/v2"
+	"github.com/elastic/apm-queue/v2/queuecontext"
+)
+
+// Defaults holds the defaults applied to the records produced with a
+// context.
+type Defaults struct {
+	headers []apmqueue.Header
+	now     time.Time
+}
+
+// ContextDefaults returns the defaults of the records produced with ctx: the
+// headers of the context metadata, and the current time.
+func ContextDefaults(ctx context.Context) Defaults {
+	var headers []apmqueue.Header
+	if m, ok := queuecontext.MetadataFromContext(ctx); ok {
+		headers = make([]apmqueue.Header, 0, len(m))
+		for k, v := range m {
+			headers = append(headers, apmqueue.Header{Key: k, Value: []byte(v)})
+		}
+	}
+	return Defaults{headers: headers, now: time.Now()}
+}
+
+// Apply returns r with the context metadata headers followed by its own
+// headers, and timestamped with the current time if it has no Timestamp.
+func (d Defaults) Apply(r apmqueue.Record) apmqueue.Record {
+	if len(d.headers) > 0 {
+		r.Headers = append(append([]apmqueue.Header(nil), d.headers...), r.Headers...)
+	}
+	if r.Timestamp.IsZero() {
+		r.Timestamp = d.now
+	}
+	return r
+}
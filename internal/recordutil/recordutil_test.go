@@ -0,0 +1,46 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package recordutil
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	apmqueue "github.com/elastic/apm-queue/v2"
+	"github.com/elastic/apm-queue/v2/queuecontext"
+)
+
+func TestContextDefaults(t *testing.T) {
+	ctx := queuecontext.WithMetadata(context.Background(), map[string]string{"a": "b"})
+	defaults := ContextDefaults(ctx)
+	own := []apmqueue.Header{{Key: "c", Value: []byte("d")}}
+	r := defaults.Apply(apmqueue.Record{Headers: own})
+	assert.Equal(t, []apmqueue.Header{
+		{Key: "a", Value: []byte("b")}, {Key: "c", Value: []byte("d")},
+	}, r.Headers)
+	assert.Len(t, own, 1, "the record's headers shouldn't be modified")
+	assert.False(t, r.Timestamp.IsZero())
+
+	ts := time.Unix(1, 0)
+	r = ContextDefaults(context.Background()).Apply(apmqueue.Record{Timestamp: ts})
+	assert.Nil(t, r.Headers)
+	assert.Equal(t, ts, r.Timestamp)
+}
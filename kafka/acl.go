@@ -0,0 +1,477 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package kafka
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/twmb/franz-go/pkg/kadm"
+	"github.com/twmb/franz-go/pkg/kmsg"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	semconv "go.opentelemetry.io/otel/semconv/v1.4.0"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+)
+
+// ACLResourceType identifies the type of resource an ACL applies to.
+type ACLResourceType uint8
+
+const (
+	// ACLResourceAny matches any resource type when listing ACLs. It can't
+	// be used to create or delete ACLs.
+	ACLResourceAny ACLResourceType = iota
+	// ACLResourceTopic is a topic. Topic names are namespaced.
+	ACLResourceTopic
+	// ACLResourceGroup is a consumer group.
+	ACLResourceGroup
+	// ACLResourceCluster is the cluster, the resource name is ignored.
+	ACLResourceCluster
+	// ACLResourceTransactionalID is a producer transactional ID.
+	ACLResourceTransactionalID
+)
+
+var aclResourceTypes = map[ACLResourceType]kmsg.ACLResourceType{
+	ACLResourceAny:             kmsg.ACLResourceTypeAny,
+	ACLResourceTopic:           kmsg.ACLResourceTypeTopic,
+	ACLResourceGroup:           kmsg.ACLResourceTypeGroup,
+	ACLResourceCluster:         kmsg.ACLResourceTypeCluster,
+	ACLResourceTransactionalID: kmsg.ACLResourceTypeTransactionalId,
+}
+
+func (t ACLResourceType) String() string {
+	if kt, ok := aclResourceTypes[t]; ok {
+		return strings.ToLower(kt.String())
+	}
+	return fmt.Sprintf("ACLResourceType(%d)", t)
+}
+
+// ACLOperation identifies the operation an ACL allows or denies.
+type ACLOperation uint8
+
+const (
+	// ACLOperationAny matches any operation when listing ACLs. It can't be
+	// used to create or delete ACLs.
+	ACLOperationAny ACLOperation = iota
+	// ACLOperationAll is any operation, when creating ACLs. The others are
+	// the Kafka ACL operations of the same name.
+	ACLOperationAll
+	ACLOperationRead
+	ACLOperationWrite
+	ACLOperationCreate
+	ACLOperationDelete
+	ACLOperationAlter
+	ACLOperationDescribe
+	ACLOperationDescribeConfigs
+	ACLOperationAlterConfigs
+	ACLOperationIdempotentWrite
+)
+
+var aclOperations = map[ACLOperation]kmsg.ACLOperation{
+	ACLOperationAny:             kmsg.ACLOperationAny,
+	ACLOperationAll:             kmsg.ACLOperationAll,
+	ACLOperationRead:            kmsg.ACLOperationRead,
+	ACLOperationWrite:           kmsg.ACLOperationWrite,
+	ACLOperationCreate:          kmsg.ACLOperationCreate,
+	ACLOperationDelete:          kmsg.ACLOperationDelete,
+	ACLOperationAlter:           kmsg.ACLOperationAlter,
+	ACLOperationDescribe:        kmsg.ACLOperationDescribe,
+	ACLOperationDescribeConfigs: kmsg.ACLOperationDescribeConfigs,
+	ACLOperationAlterConfigs:    kmsg.ACLOperationAlterConfigs,
+	ACLOperationIdempotentWrite: kmsg.ACLOperationIdempotentWrite,
+}
+
+func (o ACLOperation) String() string {
+	if ko, ok := aclOperations[o]; ok {
+		return strings.ToLower(ko.String())
+	}
+	return fmt.Sprintf("ACLOperation(%d)", o)
+}
+
+// ACLPermission identifies whether an ACL allows or denies its operation.
+type ACLPermission uint8
+
+const (
+	// ACLPermissionAny matches any permission when listing ACLs. It can't
+	// be used to create or delete ACLs.
+	ACLPermissionAny ACLPermission = iota
+	// ACLAllow allows the operation.
+	ACLAllow
+	// ACLDeny denies the operation, taking precedence over ACLs which
+	// allow it.
+	ACLDeny
+)
+
+var aclPermissions = map[ACLPermission]kmsg.ACLPermissionType{
+	ACLPermissionAny: kmsg.ACLPermissionTypeAny,
+	ACLAllow:         kmsg.ACLPermissionTypeAllow,
+	ACLDeny:          kmsg.ACLPermissionTypeDeny,
+}
+
+func (p ACLPermission) String() string {
+	if kp, ok := aclPermissions[p]; ok {
+		return strings.ToLower(kp.String())
+	}
+	return fmt.Sprintf("ACLPermission(%d)", p)
+}
+
+// ACL is an access control list entry, which allows or denies a principal
+// to perform an operation on a resource.
+type ACL struct {
+	// Principal is the principal the ACL applies to, e.g. "User:apm".
+	Principal string
+	// Host is the host the principal connects from. If empty, the ACL
+	// applies to all hosts, "*".
+	Host string
+	// ResourceType is the type of resource the ACL applies to.
+	ResourceType ACLResourceType
+	// ResourceName is the name of the resource. Topic names are namespaced
+	// with the configured namespace.
+	ResourceName string
+	// Prefixed makes the ACL apply to all the resources whose name starts
+	// with ResourceName, instead of only the resource named ResourceName.
+	Prefixed bool
+	// Operation is the operation which is allowed or denied.
+	Operation ACLOperation
+	// Permission is whether the operation is allowed or denied.
+	Permission ACLPermission
+}
+
+// ACLFilter filters the ACLs listed by Manager.ListACLs. The zero value
+// matches all ACLs.
+type ACLFilter struct {
+	// ResourceType, if set, only matches the ACLs of the resource type.
+	ResourceType ACLResourceType
+	// ResourceName, if set, only matches the literal or prefixed ACLs with
+	// the exact resource name.
+	ResourceName string
+	// Principal, if set, only matches the ACLs of the principal.
+	Principal string
+	// Operation, if set, only matches the ACLs of the operation.
+	Operation ACLOperation
+	// Permission, if set, only matches the ACLs with the permission.
+	Permission ACLPermission
+}
+
+// CreateACLs creates the ACLs. Creating an ACL which already exists is a
+// no-op.
+func (m *Manager) CreateACLs(ctx context.Context, acls ...ACL) error {
+	ctx, span := m.tracer.Start(ctx, "CreateACLs", trace.WithAttributes(
+		semconv.MessagingSystemKey.String("kafka"),
+		attribute.Int("acls", len(acls)),
+	))
+	defer span.End()
+
+	var errs []error
+	for _, acl := range acls {
+		if err := m.createACL(ctx, acl); err != nil {
+			errs = append(errs, fmt.Errorf("failed to create ACL %s: %w", acl, err))
+		}
+	}
+	if err := errors.Join(errs...); err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "failed to create one or more ACLs")
+		return err
+	}
+	return nil
+}
+
+func (m *Manager) createACL(ctx context.Context, acl ACL) error {
+	b, err := m.aclBuilder(acl)
+	if err != nil {
+		return err
+	}
+	results, err := m.adminClient.CreateACLs(ctx, b)
+	if err != nil {
+		return classifyError(err)
+	}
+	for _, r := range results {
+		if r.Err != nil {
+			return classifyError(r.Err)
+		}
+	}
+	m.cfg.Logger.Info("created kafka ACL", zap.Stringer("acl", acl))
+	return nil
+}
+
+// DeleteACLs deletes the ACLs, matching them exactly.
+//
+// No error is returned for ACLs that do not exist.
+func (m *Manager) DeleteACLs(ctx context.Context, acls ...ACL) error {
+	ctx, span := m.tracer.Start(ctx, "DeleteACLs", trace.WithAttributes(
+		semconv.MessagingSystemKey.String("kafka"),
+		attribute.Int("acls", len(acls)),
+	))
+	defer span.End()
+
+	var errs []error
+	for _, acl := range acls {
+		if err := m.deleteACL(ctx, acl); err != nil {
+			errs = append(errs, fmt.Errorf("failed to delete ACL %s: %w", acl, err))
+		}
+	}
+	if err := errors.Join(errs...); err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "failed to delete one or more ACLs")
+		return err
+	}
+	return nil
+}
+
+func (m *Manager) deleteACL(ctx context.Context, acl ACL) error {
+	b, err := m.aclBuilder(acl)
+	if err != nil {
+		return err
+	}
+	results, err := m.adminClient.DeleteACLs(ctx, b)
+	if err != nil {
+		return classifyError(err)
+	}
+	var deleted int
+	for _, r := range results {
+		if r.Err != nil {
+			return classifyError(r.Err)
+		}
+		for _, d := range r.Deleted {
+			if d.Err != nil {
+				return classifyError(d.Err)
+			}
+			deleted++
+		}
+	}
+	if deleted == 0 {
+		m.cfg.Logger.Debug("kafka ACL does not exist", zap.Stringer("acl", acl))
+		return nil
+	}
+	m.cfg.Logger.Info("deleted kafka ACL", zap.Stringer("acl", acl))
+	return nil
+}
+
+// ListACLs returns the ACLs matching filter, sorted by resource type, resource
+// name and principal. Only the topic ACLs of topics within the configured
+// namespace are returned, with the namespace trimmed from their names.
+func (m *Manager) ListACLs(ctx context.Context, filter ACLFilter) ([]ACL, error) {
+	ctx, span := m.tracer.Start(ctx, "ListACLs", trace.WithAttributes(
+		semconv.MessagingSystemKey.String("kafka"),
+	))
+	defer span.End()
+
+	acls, err := m.listACLs(ctx, filter)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return nil, err
+	}
+	return acls, nil
+}
+
+func (m *Manager) listACLs(ctx context.Context, filter ACLFilter) ([]ACL, error) {
+	if _, ok := aclResourceTypes[filter.ResourceType]; !ok {
+		return nil, fmt.Errorf("kafka: unknown ACL resource type %s", filter.ResourceType)
+	}
+	if _, ok := aclOperations[filter.Operation]; !ok {
+		return nil, fmt.Errorf("kafka: unknown ACL operation %s", filter.Operation)
+	}
+	if _, ok := aclPermissions[filter.Permission]; !ok {
+		return nil, fmt.Errorf("kafka: unknown ACL permission %s", filter.Permission)
+	}
+	namespacePrefix := m.cfg.namespacePrefix()
+	b := kadm.NewACLs().Operations(aclOperations[filter.Operation])
+	b.ResourcePatternType(kadm.ACLPatternAny)
+	var names []string
+	if filter.ResourceName != "" {
+		names = []string{filter.ResourceName}
+	}
+	switch filter.ResourceType {
+	case ACLResourceAny:
+		if filter.ResourceName != "" && namespacePrefix != "" {
+			// Topic names are namespaced.
+			names = append(names, namespacePrefix+filter.ResourceName)
+		}
+		b.AnyResource(names...)
+	case ACLResourceTopic:
+		for i, name := range names {
+			names[i] = namespacePrefix + name
+		}
+		b.Topics(names...)
+	case ACLResourceGroup:
+		b.Groups(names...)
+	case ACLResourceCluster:
+		b.Clusters()
+	case ACLResourceTransactionalID:
+		b.TransactionalIDs(names...)
+	}
+	var principals []string
+	if filter.Principal != "" {
+		principals = []string{filter.Principal}
+	}
+	if filter.Permission != ACLDeny {
+		b.Allow(principals...).AllowHosts()
+	}
+	if filter.Permission != ACLAllow {
+		b.Deny(principals...).DenyHosts()
+	}
+	results, err := m.adminClient.DescribeACLs(ctx, b)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list ACLs: %w", classifyError(err))
+	}
+	acls := []ACL{}
+	seen := make(map[ACL]bool)
+	for _, r := range results {
+		if r.Err != nil {
+			return nil, fmt.Errorf("failed to list ACLs: %w", classifyError(r.Err))
+		}
+		for _, d := range r.Described {
+			acl, ok := describedACL(d, namespacePrefix)
+			if !ok || seen[acl] {
+				continue
+			}
+			if filter.ResourceName != "" && acl.ResourceName != filter.ResourceName {
+				// Ignore the unnamespaced topics, and the other resources
+				// named like namespaced topics, matched by any resource.
+				continue
+			}
+			seen[acl] = true
+			acls = append(acls, acl)
+		}
+	}
+	sort.Slice(acls, func(i, j int) bool {
+		a, b := acls[i], acls[j]
+		if a.ResourceType != b.ResourceType {
+			return a.ResourceType < b.ResourceType
+		}
+		if a.ResourceName != b.ResourceName {
+			return a.ResourceName < b.ResourceName
+		}
+		if a.Principal != b.Principal {
+			return a.Principal < b.Principal
+		}
+		if a.Operation != b.Operation {
+			return a.Operation < b.Operation
+		}
+		return a.Permission < b.Permission
+	})
+	return acls, nil
+}
+
+// aclBuilder returns the kadm.ACLBuilder which matches acl exactly.
+func (m *Manager) aclBuilder(acl ACL) (*kadm.ACLBuilder, error) {
+	if acl.Principal == "" {
+		return nil, errors.New("kafka: ACL principal must be set")
+	}
+	op, ok := aclOperations[acl.Operation]
+	if !ok || acl.Operation == ACLOperationAny {
+		return nil, fmt.Errorf("kafka: invalid ACL operation %s", acl.Operation)
+	}
+	host := acl.Host
+	if host == "" {
+		host = "*"
+	}
+	b := kadm.NewACLs().Operations(op)
+	switch acl.Permission {
+	case ACLAllow:
+		b.Allow(acl.Principal).AllowHosts(host)
+	case ACLDeny:
+		b.Deny(acl.Principal).DenyHosts(host)
+	default:
+		return nil, fmt.Errorf("kafka: invalid ACL permission %s", acl.Permission)
+	}
+	if acl.ResourceType != ACLResourceCluster && acl.ResourceName == "" {
+		return nil, errors.New("kafka: ACL resource name must be set")
+	}
+	switch acl.ResourceType {
+	case ACLResourceTopic:
+		b.Topics(m.cfg.namespacePrefix() + acl.ResourceName)
+	case ACLResourceGroup:
+		b.Groups(acl.ResourceName)
+	case ACLResourceCluster:
+		b.Clusters()
+	case ACLResourceTransactionalID:
+		b.TransactionalIDs(acl.ResourceName)
+	default:
+		return nil, fmt.Errorf("kafka: invalid ACL resource type %s", acl.ResourceType)
+	}
+	if acl.Prefixed {
+		b.ResourcePatternType(kadm.ACLPatternPrefixed)
+	} else {
+		b.ResourcePatternType(kadm.ACLPatternLiteral)
+	}
+	return b, nil
+}
+
+// describedACL returns the ACL of d, and false if it's an ACL of an unknown
+// type, or of a topic outside the namespace.
+func describedACL(d kadm.DescribedACL, namespacePrefix string) (ACL, bool) {
+	acl := ACL{
+		Principal:    d.Principal,
+		Host:         d.Host,
+		ResourceName: d.Name,
+		Prefixed:     d.Pattern == kadm.ACLPatternPrefixed,
+	}
+	var ok bool
+	if acl.ResourceType, ok = aclKey(aclResourceTypes, d.Type); !ok {
+		return ACL{}, false
+	}
+	if acl.Operation, ok = aclKey(aclOperations, d.Operation); !ok {
+		return ACL{}, false
+	}
+	if acl.Permission, ok = aclKey(aclPermissions, d.Permission); !ok {
+		return ACL{}, false
+	}
+	switch acl.ResourceType {
+	case ACLResourceTopic:
+		if !strings.HasPrefix(acl.ResourceName, namespacePrefix) {
+			return ACL{}, false
+		}
+		acl.ResourceName = acl.ResourceName[len(namespacePrefix):]
+	case ACLResourceCluster:
+		acl.ResourceName = ""
+	}
+	return acl, true
+}
+
+// aclKey returns the key of v in m.
+func aclKey[K, V comparable](m map[K]V, v V) (K, bool) {
+	for k, mv := range m {
+		if mv == v {
+			return k, true
+		}
+	}
+	var zero K
+	return zero, false
+}
+
+// String returns a human readable representation of acl.
+func (acl ACL) String() string {
+	pattern := "literal"
+	if acl.Prefixed {
+		pattern = "prefixed"
+	}
+	host := acl.Host
+	if host == "" {
+		host = "*"
+	}
+	return fmt.Sprintf("%s %s %s on %s %q (%s) from host %q",
+		acl.Permission, acl.Principal, acl.Operation,
+		acl.ResourceType, acl.ResourceName, pattern, host,
+	)
+}
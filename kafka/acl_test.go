@@ -0,0 +1,234 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package kafka
+
+import (
+	"context"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/twmb/franz-go/pkg/kfake"
+	"github.com/twmb/franz-go/pkg/kmsg"
+	"go.uber.org/zap"
+)
+
+// fakeACLs stores the ACLs created in a kfake cluster, which doesn't
+// implement the ACL requests.
+type fakeACLs struct {
+	mu   sync.Mutex
+	acls []kmsg.CreateACLsRequestCreation
+}
+
+func newFakeACLs(t testing.TB, cluster *kfake.Cluster) *fakeACLs {
+	advertiseKeys(t, cluster, kmsg.CreateACLs, kmsg.DescribeACLs, kmsg.DeleteACLs)
+	f := &fakeACLs{}
+	cluster.ControlKey(kmsg.CreateACLs.Int16(), func(r kmsg.Request) (kmsg.Response, error, bool) {
+		cluster.KeepControl()
+		req := r.(*kmsg.CreateACLsRequest)
+		resp := req.ResponseKind().(*kmsg.CreateACLsResponse)
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		for _, c := range req.Creations {
+			f.acls = append(f.acls, c)
+			resp.Results = append(resp.Results, kmsg.NewCreateACLsResponseResult())
+		}
+		return resp, nil, true
+	})
+	cluster.ControlKey(kmsg.DescribeACLs.Int16(), func(r kmsg.Request) (kmsg.Response, error, bool) {
+		cluster.KeepControl()
+		req := r.(*kmsg.DescribeACLsRequest)
+		resp := req.ResponseKind().(*kmsg.DescribeACLsResponse)
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		for _, acl := range f.acls {
+			if !aclMatches(acl, req.ResourceType, req.ResourceName, req.ResourcePatternType,
+				req.Principal, req.Host, req.Operation, req.PermissionType) {
+				continue
+			}
+			resource := kmsg.NewDescribeACLsResponseResource()
+			resource.ResourceType = acl.ResourceType
+			resource.ResourceName = acl.ResourceName
+			resource.ResourcePatternType = acl.ResourcePatternType
+			described := kmsg.NewDescribeACLsResponseResourceACL()
+			described.Principal = acl.Principal
+			described.Host = acl.Host
+			described.Operation = acl.Operation
+			described.PermissionType = acl.PermissionType
+			resource.ACLs = append(resource.ACLs, described)
+			resp.Resources = append(resp.Resources, resource)
+		}
+		return resp, nil, true
+	})
+	cluster.ControlKey(kmsg.DeleteACLs.Int16(), func(r kmsg.Request) (kmsg.Response, error, bool) {
+		cluster.KeepControl()
+		req := r.(*kmsg.DeleteACLsRequest)
+		resp := req.ResponseKind().(*kmsg.DeleteACLsResponse)
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		for _, filter := range req.Filters {
+			result := kmsg.NewDeleteACLsResponseResult()
+			remaining := f.acls[:0]
+			for _, acl := range f.acls {
+				if !aclMatches(acl, filter.ResourceType, filter.ResourceName, filter.ResourcePatternType,
+					filter.Principal, filter.Host, filter.Operation, filter.PermissionType) {
+					remaining = append(remaining, acl)
+					continue
+				}
+				matching := kmsg.NewDeleteACLsResponseResultMatchingACL()
+				matching.ResourceType = acl.ResourceType
+				matching.ResourceName = acl.ResourceName
+				matching.ResourcePatternType = acl.ResourcePatternType
+				matching.Principal = acl.Principal
+				matching.Host = acl.Host
+				matching.Operation = acl.Operation
+				matching.PermissionType = acl.PermissionType
+				result.MatchingACLs = append(result.MatchingACLs, matching)
+			}
+			f.acls = remaining
+			resp.Results = append(resp.Results, result)
+		}
+		return resp, nil, true
+	})
+	return f
+}
+
+func (f *fakeACLs) len() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return len(f.acls)
+}
+
+// aclMatches returns whether acl matches the filter, with exact name matching.
+func aclMatches(acl kmsg.CreateACLsRequestCreation,
+	resourceType kmsg.ACLResourceType, name *string, pattern kmsg.ACLResourcePatternType,
+	principal, host *string, op kmsg.ACLOperation, perm kmsg.ACLPermissionType,
+) bool {
+	return (resourceType == kmsg.ACLResourceTypeAny || resourceType == acl.ResourceType) &&
+		(name == nil || *name == acl.ResourceName) &&
+		(pattern == kmsg.ACLResourcePatternTypeAny || pattern == acl.ResourcePatternType) &&
+		(principal == nil || *principal == acl.Principal) &&
+		(host == nil || *host == acl.Host) &&
+		(op == kmsg.ACLOperationAny || op == acl.Operation) &&
+		(perm == kmsg.ACLPermissionTypeAny || perm == acl.PermissionType)
+}
+
+func TestManagerACLs(t *testing.T) {
+	cluster, err := kfake.NewCluster()
+	require.NoError(t, err)
+	t.Cleanup(cluster.Close)
+	fake := newFakeACLs(t, cluster)
+	m, err := NewManager(ManagerConfig{CommonConfig: CommonConfig{
+		Brokers:   cluster.ListenAddrs(),
+		Logger:    zap.NewNop(),
+		Namespace: "name_space",
+	}})
+	require.NoError(t, err)
+	t.Cleanup(func() { m.Close() })
+	ctx := context.Background()
+
+	read := ACL{
+		Principal: "User:reader", ResourceType: ACLResourceTopic, ResourceName: "topic",
+		Operation: ACLOperationRead, Permission: ACLAllow,
+	}
+	write := ACL{
+		Principal: "User:writer", Host: "10.0.0.1", ResourceType: ACLResourceTopic,
+		ResourceName: "logs-", Prefixed: true, Operation: ACLOperationWrite, Permission: ACLAllow,
+	}
+	group := ACL{
+		Principal: "User:reader", ResourceType: ACLResourceGroup, ResourceName: "topic",
+		Operation: ACLOperationRead, Permission: ACLDeny,
+	}
+	cluster2 := ACL{
+		Principal: "User:admin", ResourceType: ACLResourceCluster,
+		Operation: ACLOperationAlter, Permission: ACLAllow,
+	}
+	require.NoError(t, m.CreateACLs(ctx, read, write, group, cluster2))
+	require.Equal(t, 4, fake.len())
+	// ACLs on topics outside the namespace aren't listed.
+	fake.acls = append(fake.acls, kmsg.CreateACLsRequestCreation{
+		ResourceType:        kmsg.ACLResourceTypeTopic,
+		ResourceName:        "other",
+		ResourcePatternType: kmsg.ACLResourcePatternTypeLiteral,
+		Principal:           "User:reader",
+		Host:                "*",
+		Operation:           kmsg.ACLOperationRead,
+		PermissionType:      kmsg.ACLPermissionTypeAllow,
+	})
+
+	withHost := func(acl ACL) ACL {
+		if acl.Host == "" {
+			acl.Host = "*"
+		}
+		return acl
+	}
+	acls, err := m.ListACLs(ctx, ACLFilter{})
+	require.NoError(t, err)
+	assert.Equal(t, []ACL{withHost(write), withHost(read), withHost(group), withHost(cluster2)}, acls)
+
+	acls, err = m.ListACLs(ctx, ACLFilter{ResourceType: ACLResourceTopic})
+	require.NoError(t, err)
+	assert.Equal(t, []ACL{withHost(write), withHost(read)}, acls)
+
+	// Filtering by name matches both namespaced topics and other resources.
+	acls, err = m.ListACLs(ctx, ACLFilter{ResourceName: "topic"})
+	require.NoError(t, err)
+	assert.Equal(t, []ACL{withHost(read), withHost(group)}, acls)
+
+	acls, err = m.ListACLs(ctx, ACLFilter{Principal: "User:reader", Permission: ACLDeny})
+	require.NoError(t, err)
+	assert.Equal(t, []ACL{withHost(group)}, acls)
+
+	require.NoError(t, m.DeleteACLs(ctx, read, cluster2))
+	acls, err = m.ListACLs(ctx, ACLFilter{})
+	require.NoError(t, err)
+	assert.Equal(t, []ACL{withHost(write), withHost(group)}, acls)
+
+	// Deleting ACLs which don't exist is a no-op.
+	require.NoError(t, m.DeleteACLs(ctx, read))
+	assert.Equal(t, 3, fake.len())
+}
+
+func TestManagerACLsInvalid(t *testing.T) {
+	cluster, err := kfake.NewCluster()
+	require.NoError(t, err)
+	t.Cleanup(cluster.Close)
+	m, err := NewManager(ManagerConfig{CommonConfig: CommonConfig{
+		Brokers: cluster.ListenAddrs(),
+		Logger:  zap.NewNop(),
+	}})
+	require.NoError(t, err)
+	t.Cleanup(func() { m.Close() })
+
+	err = m.CreateACLs(context.Background(),
+		ACL{ResourceType: ACLResourceTopic, ResourceName: "topic", Operation: ACLOperationRead, Permission: ACLAllow},
+		ACL{Principal: "User:a", ResourceType: ACLResourceTopic, Operation: ACLOperationRead, Permission: ACLAllow},
+		ACL{Principal: "User:a", ResourceType: ACLResourceTopic, ResourceName: "topic", Permission: ACLAllow},
+		ACL{Principal: "User:a", ResourceType: ACLResourceTopic, ResourceName: "topic", Operation: ACLOperationRead},
+		ACL{Principal: "User:a", ResourceName: "topic", Operation: ACLOperationRead, Permission: ACLAllow},
+	)
+	assert.ErrorContains(t, err, "kafka: ACL principal must be set")
+	assert.ErrorContains(t, err, "kafka: ACL resource name must be set")
+	assert.ErrorContains(t, err, "kafka: invalid ACL operation any")
+	assert.ErrorContains(t, err, "kafka: invalid ACL permission any")
+	assert.ErrorContains(t, err, "kafka: invalid ACL resource type any")
+
+	_, err = m.ListACLs(context.Background(), ACLFilter{Operation: 100})
+	assert.EqualError(t, err, "kafka: unknown ACL operation ACLOperation(100)")
+}
@@ -0,0 +1,265 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package kafka
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/twmb/franz-go/pkg/kadm"
+	"github.com/twmb/franz-go/pkg/kerr"
+	"github.com/twmb/franz-go/pkg/kgo"
+
+	apmqueue "github.com/elastic/apm-queue/v2"
+)
+
+// endBounds tracks the bounded partitions of a consumer with EndOffsets or
+// EndTimestamp set, until they've been consumed up to their end offsets.
+type endBounds struct {
+	mu sync.Mutex
+	// end holds the exclusive end offset of each bounded partition.
+	end map[topicPartition]int64
+	// remaining holds the bounded partitions which haven't been consumed
+	// up to their end offset yet.
+	remaining map[topicPartition]struct{}
+	// done is closed once every bounded partition has been consumed up to
+	// its end offset.
+	done chan struct{}
+}
+
+func newEndBounds() *endBounds {
+	return &endBounds{
+		end:       make(map[topicPartition]int64),
+		remaining: make(map[topicPartition]struct{}),
+		done:      make(chan struct{}),
+	}
+}
+
+// endOffset returns the end offset of the partition, and whether it's bounded.
+func (b *endBounds) endOffset(tp topicPartition) (int64, bool) {
+	if b == nil {
+		return 0, false
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	end, ok := b.end[tp]
+	return end, ok
+}
+
+// init sets the end offsets of the bounded partitions, given their start
+// offsets, so the partitions which start at or past their end offset are
+// done right away.
+func (b *endBounds) init(end, start map[topicPartition]int64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for tp, offset := range end {
+		b.end[tp] = offset
+		if start[tp] < offset {
+			b.remaining[tp] = struct{}{}
+		}
+	}
+	if len(b.remaining) == 0 {
+		close(b.done)
+	}
+}
+
+// reached marks the partition as consumed up to its end offset.
+func (b *endBounds) reached(tp topicPartition) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if _, ok := b.remaining[tp]; !ok {
+		return
+	}
+	delete(b.remaining, tp)
+	if len(b.remaining) == 0 {
+		close(b.done)
+	}
+}
+
+// doneC returns the channel which is closed once every bounded partition
+// has been consumed up to its end offset, or nil if there are none.
+func (b *endBounds) doneC() <-chan struct{} {
+	if b == nil {
+		return nil
+	}
+	return b.done
+}
+
+// isDone returns whether every bounded partition has been consumed up to
+// its end offset.
+func (b *endBounds) isDone() bool {
+	select {
+	case <-b.doneC():
+		return true
+	default:
+		return false
+	}
+}
+
+// boundRecords returns the data records of the partition before its end
+// offset, and whether the partition has been fetched up to its end offset.
+//
+// Bounded consumers keep the control records, e.g. transaction markers, so
+// the fetch position is known even when the offsets right before the end
+// offset hold no data records; they're dropped here, since they're never
+// processed. The partition has been fetched up to its end offset once a
+// record, data or control, at or past end-1 has been fetched.
+func (b *endBounds) boundRecords(tp topicPartition, records []*kgo.Record) ([]*kgo.Record, bool) {
+	end, ok := b.endOffset(tp)
+	if !ok {
+		return records, false
+	}
+	var reached bool
+	if n := len(records); n > 0 {
+		reached = records[n-1].Offset >= end-1
+	}
+	i := sort.Search(len(records), func(i int) bool { return records[i].Offset >= end })
+	records = records[:i]
+	if slices.ContainsFunc(records, isControl) {
+		records = slices.DeleteFunc(slices.Clone(records), isControl)
+	}
+	return records, reached
+}
+
+// isControl returns whether the record is a control record.
+func isControl(r *kgo.Record) bool {
+	return r.Attrs.IsControl()
+}
+
+// resolveEndOffsets resolves the end offsets of the bounded partitions, which
+// are the end of the partitions for snapshots, and their start offsets: the
+// committed offsets, or InitialOffset for the partitions without one.
+func (c *Consumer) resolveEndOffsets(ctx context.Context) error {
+	adminClient := kadm.NewClient(c.client)
+	prefix := c.consumer.topicPrefix
+	end := make(map[topicPartition]int64)
+	if c.cfg.EndTimestamp.IsZero() && !c.cfg.Snapshot {
+		for tp, offset := range c.cfg.EndOffsets {
+			end[topicPartition{topic: prefix + string(tp.Topic), partition: tp.Partition}] = offset
+		}
+	} else {
+		var topics []string
+		for _, topic := range c.cfg.Topics {
+			topics = append(topics, prefix+string(topic))
+		}
+		for topic := range c.cfg.Partitions {
+			topics = append(topics, prefix+topic)
+		}
+		var listed kadm.ListedOffsets
+		var err error
+		if c.cfg.Snapshot {
+			// Snapshots are read up to the end of the partitions.
+			listed, err = adminClient.ListEndOffsets(ctx, topics...)
+		} else {
+			listed, err = adminClient.ListOffsetsAfterMilli(ctx, c.cfg.EndTimestamp.UnixMilli(), topics...)
+		}
+		if err == nil {
+			err = listed.Error()
+		}
+		if err != nil {
+			return fmt.Errorf("failed to list end offsets: %w", classifyError(err))
+		}
+		listed.Each(func(o kadm.ListedOffset) {
+			if c.cfg.Partitions != nil && !slices.Contains(
+				c.cfg.Partitions[strings.TrimPrefix(o.Topic, prefix)], o.Partition,
+			) {
+				return
+			}
+			end[topicPartition{topic: o.Topic, partition: o.Partition}] = o.Offset
+		})
+	}
+	start, err := c.committedOffsets(ctx, adminClient, end)
+	if err != nil {
+		return err
+	}
+	var uncommitted []string
+	for tp := range end {
+		if _, ok := start[tp]; !ok && !slices.Contains(uncommitted, tp.topic) {
+			uncommitted = append(uncommitted, tp.topic)
+		}
+	}
+	if len(uncommitted) > 0 {
+		list := adminClient.ListStartOffsets
+		if c.cfg.InitialOffset == LatestOffset {
+			list = adminClient.ListEndOffsets
+		}
+		listed, err := list(ctx, uncommitted...)
+		if err == nil {
+			err = listed.Error()
+		}
+		if err != nil {
+			return fmt.Errorf("failed to list initial offsets: %w", classifyError(err))
+		}
+		for tp := range end {
+			if _, ok := start[tp]; ok {
+				continue
+			}
+			if o, ok := listed.Lookup(tp.topic, tp.partition); ok {
+				start[tp] = o.Offset
+			}
+		}
+	}
+	c.consumer.bounds.init(end, start)
+	return nil
+}
+
+// committedOffsets returns the committed offsets of the partitions, fetched
+// from the OffsetStore, if set, or the consumer group.
+func (c *Consumer) committedOffsets(ctx context.Context, adminClient *kadm.Client, partitions map[topicPartition]int64) (map[topicPartition]int64, error) {
+	prefix := c.consumer.topicPrefix
+	committed := make(map[topicPartition]int64)
+	switch {
+	case c.consumer.offsetStore != nil:
+		tps := make([]TopicPartition, 0, len(partitions))
+		for tp := range partitions {
+			tps = append(tps, TopicPartition{
+				Topic:     apmqueue.Topic(strings.TrimPrefix(tp.topic, prefix)),
+				Partition: tp.partition,
+			})
+		}
+		stored, err := c.consumer.loadOffsets(ctx, tps)
+		if err != nil {
+			return nil, err
+		}
+		for tp, offset := range stored {
+			committed[topicPartition{topic: prefix + string(tp.Topic), partition: tp.Partition}] = offset
+		}
+	case c.cfg.GroupID != "":
+		offsets, err := adminClient.FetchOffsets(ctx, c.cfg.GroupID)
+		if errors.Is(err, kerr.GroupIDNotFound) {
+			return committed, nil
+		}
+		if err == nil {
+			err = offsets.Error()
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to fetch committed offsets: %w", classifyError(err))
+		}
+		for tp := range partitions {
+			if o, ok := offsets.Lookup(tp.topic, tp.partition); ok && o.At >= 0 {
+				committed[tp] = o.At
+			}
+		}
+	}
+	return committed, nil
+}
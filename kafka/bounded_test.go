@@ -0,0 +1,294 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package kafka
+
+import (
+	"context"
+	"encoding/binary"
+	"hash/crc32"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/twmb/franz-go/pkg/kadm"
+	"github.com/twmb/franz-go/pkg/kfake"
+	"github.com/twmb/franz-go/pkg/kgo"
+	"github.com/twmb/franz-go/pkg/kmsg"
+	"go.uber.org/zap"
+
+	apmqueue "github.com/elastic/apm-queue/v2"
+)
+
+func TestConsumerEndOffsets(t *testing.T) {
+	topic := "topic"
+	addrs := newClusterAddrWithTopics(t, 3, topic)
+	client, err := kgo.NewClient(
+		kgo.SeedBrokers(addrs...),
+		kgo.RecordPartitioner(kgo.ManualPartitioner()),
+	)
+	require.NoError(t, err)
+	t.Cleanup(client.Close)
+	ctx := context.Background()
+	for partition := int32(0); partition < 3; partition++ {
+		for i := 0; i < 5; i++ {
+			produceRecord(ctx, t, client, &kgo.Record{
+				Topic: topic, Partition: partition, Value: []byte("x"),
+			})
+		}
+	}
+
+	var mu sync.Mutex
+	processed := make(map[int32][]int64)
+	consumer := newConsumer(t, ConsumerConfig{
+		CommonConfig: CommonConfig{
+			Brokers: addrs,
+			Logger:  zap.NewNop(),
+		},
+		Partitions: map[string][]int32{topic: {0, 1, 2}},
+		EndOffsets: map[TopicPartition]int64{
+			{Topic: apmqueue.Topic(topic), Partition: 0}: 3,
+			// Partitions which are empty up to their end offset are
+			// consumed right away.
+			{Topic: apmqueue.Topic(topic), Partition: 1}: 0,
+			// End offsets after the end of the partition are waited for.
+			{Topic: apmqueue.Topic(topic), Partition: 2}: 6,
+		},
+		Processor: apmqueue.ProcessorFunc(func(ctx context.Context, r apmqueue.Record) error {
+			mu.Lock()
+			defer mu.Unlock()
+			processed[r.Partition] = append(processed[r.Partition], int64(len(processed[r.Partition])))
+			return nil
+		}),
+	})
+	runCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	errc := make(chan error, 1)
+	go func() { errc <- consumer.Run(runCtx) }()
+
+	require.Eventually(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(processed[2]) == 5
+	}, 5*time.Second, 10*time.Millisecond)
+	select {
+	case err := <-errc:
+		t.Fatalf("expected Run to wait for partition 2, got %v", err)
+	default:
+	}
+	produceRecord(ctx, t, client, &kgo.Record{Topic: topic, Partition: 2, Value: []byte("x")})
+	produceRecord(ctx, t, client, &kgo.Record{Topic: topic, Partition: 2, Value: []byte("x")})
+	select {
+	case err := <-errc:
+		require.NoError(t, err)
+	case <-runCtx.Done():
+		t.Fatal("timed out waiting for Run to return")
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Equal(t, map[int32][]int64{
+		0: {0, 1, 2},
+		2: {0, 1, 2, 3, 4, 5},
+	}, processed)
+}
+
+func TestConsumerEndOffsetsControlRecord(t *testing.T) {
+	topic := "topic"
+	cluster, err := kfake.NewCluster(kfake.SeedTopics(1, topic))
+	require.NoError(t, err)
+	t.Cleanup(cluster.Close)
+	addrs := cluster.ListenAddrs()
+	client, err := kgo.NewClient(kgo.SeedBrokers(addrs...))
+	require.NoError(t, err)
+	t.Cleanup(client.Close)
+	ctx := context.Background()
+	for _, v := range []string{"a", "b"} {
+		produceRecord(ctx, t, client, &kgo.Record{Topic: topic, Value: []byte(v)})
+	}
+	// The record before the end offset is a transaction marker, which
+	// holds no data.
+	fakeControlRecord(t, cluster, 2)
+
+	var mu sync.Mutex
+	var processed []string
+	consumer := newConsumer(t, ConsumerConfig{
+		CommonConfig: CommonConfig{
+			Brokers: addrs,
+			Logger:  zap.NewNop(),
+		},
+		Partitions: map[string][]int32{topic: {0}},
+		EndOffsets: map[TopicPartition]int64{
+			{Topic: apmqueue.Topic(topic), Partition: 0}: 3,
+		},
+		Processor: apmqueue.ProcessorFunc(func(ctx context.Context, r apmqueue.Record) error {
+			mu.Lock()
+			defer mu.Unlock()
+			processed = append(processed, string(r.Value))
+			return nil
+		}),
+	})
+	runCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	require.NoError(t, consumer.Run(runCtx))
+	require.NoError(t, runCtx.Err(), "timed out waiting for Run to return")
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Equal(t, []string{"a", "b"}, processed)
+}
+
+// fakeControlRecord makes the fake cluster return a transaction commit
+// marker at the given offset of the topic's first partition, right after its
+// produced records, since kfake doesn't support transactions. The partition
+// ends after the marker.
+func fakeControlRecord(t testing.TB, cluster *kfake.Cluster, offset int64) {
+	t.Helper()
+	key := kmsg.NewControlRecordKey()
+	key.Type = kmsg.ControlRecordKeyTypeCommit
+	value := kmsg.NewEndTxnMarker()
+	record := kmsg.NewRecord()
+	record.Key = key.AppendTo(nil)
+	record.Value = value.AppendTo(nil)
+	// The record length is a varint, which is a single byte here.
+	record.Length = int32(len(record.AppendTo(nil)) - 1)
+	batch := kmsg.NewRecordBatch()
+	batch.FirstOffset = offset
+	batch.PartitionLeaderEpoch = -1
+	batch.Magic = 2
+	// Transactional control batch.
+	batch.Attributes = 0x10 | 0x20
+	batch.ProducerID = 1
+	batch.FirstSequence = -1
+	batch.NumRecords = 1
+	batch.Records = record.AppendTo(nil)
+	marker := batch.AppendTo(nil)
+	binary.BigEndian.PutUint32(marker[8:], uint32(len(marker)-12))
+	binary.BigEndian.PutUint32(marker[17:], crc32.Checksum(
+		marker[21:], crc32.MakeTable(crc32.Castagnoli),
+	))
+
+	cluster.ControlKey(kmsg.Fetch.Int16(), func(r kmsg.Request) (kmsg.Response, error, bool) {
+		cluster.KeepControl()
+		req := r.(*kmsg.FetchRequest)
+		if len(req.Topics) == 0 || len(req.Topics[0].Partitions) == 0 ||
+			req.Topics[0].Partitions[0].FetchOffset < offset {
+			return nil, nil, false
+		}
+		resp := req.ResponseKind().(*kmsg.FetchResponse)
+		respTopic := kmsg.NewFetchResponseTopic()
+		respTopic.Topic = req.Topics[0].Topic
+		respTopic.TopicID = req.Topics[0].TopicID
+		respPartition := kmsg.NewFetchResponseTopicPartition()
+		respPartition.HighWatermark = offset + 1
+		respPartition.LastStableOffset = offset + 1
+		if req.Topics[0].Partitions[0].FetchOffset == offset {
+			respPartition.RecordBatches = marker
+		}
+		respTopic.Partitions = append(respTopic.Partitions, respPartition)
+		resp.Topics = append(resp.Topics, respTopic)
+		return resp, nil, true
+	})
+	cluster.ControlKey(kmsg.ListOffsets.Int16(), func(r kmsg.Request) (kmsg.Response, error, bool) {
+		cluster.KeepControl()
+		req := r.(*kmsg.ListOffsetsRequest)
+		if len(req.Topics) == 0 || len(req.Topics[0].Partitions) == 0 ||
+			req.Topics[0].Partitions[0].Timestamp != -1 {
+			return nil, nil, false
+		}
+		resp := req.ResponseKind().(*kmsg.ListOffsetsResponse)
+		respTopic := kmsg.NewListOffsetsResponseTopic()
+		respTopic.Topic = req.Topics[0].Topic
+		respPartition := kmsg.NewListOffsetsResponseTopicPartition()
+		respPartition.Offset = offset + 1
+		respPartition.Timestamp = -1
+		respTopic.Partitions = append(respTopic.Partitions, respPartition)
+		resp.Topics = append(resp.Topics, respTopic)
+		return resp, nil, true
+	})
+}
+
+func TestConsumerEndTimestamp(t *testing.T) {
+	topic := "topic"
+	cluster, err := kfake.NewCluster(kfake.SeedTopics(1, topic))
+	require.NoError(t, err)
+	t.Cleanup(cluster.Close)
+	addrs := cluster.ListenAddrs()
+	client, err := kgo.NewClient(kgo.SeedBrokers(addrs...))
+	require.NoError(t, err)
+	t.Cleanup(client.Close)
+	ctx := context.Background()
+	end := time.Now().Add(-time.Hour)
+	// kfake doesn't look up offsets by timestamp correctly, respond with the
+	// offset of the first record at the end timestamp.
+	cluster.ControlKey(kmsg.ListOffsets.Int16(), func(r kmsg.Request) (kmsg.Response, error, bool) {
+		cluster.KeepControl()
+		req := r.(*kmsg.ListOffsetsRequest)
+		if len(req.Topics) == 0 || len(req.Topics[0].Partitions) == 0 ||
+			req.Topics[0].Partitions[0].Timestamp != end.UnixMilli() {
+			return nil, nil, false
+		}
+		resp := req.ResponseKind().(*kmsg.ListOffsetsResponse)
+		respTopic := kmsg.NewListOffsetsResponseTopic()
+		respTopic.Topic = req.Topics[0].Topic
+		respPartition := kmsg.NewListOffsetsResponseTopicPartition()
+		respPartition.Offset = 2
+		respPartition.Timestamp = end.UnixMilli()
+		respTopic.Partitions = append(respTopic.Partitions, respPartition)
+		resp.Topics = append(resp.Topics, respTopic)
+		return resp, nil, true
+	})
+	for i, ts := range []time.Time{
+		end.Add(-2 * time.Hour), end.Add(-time.Hour), end, end.Add(time.Minute),
+	} {
+		produceRecord(ctx, t, client, &kgo.Record{
+			Topic: topic, Value: []byte{byte('a' + i)}, Timestamp: ts,
+		})
+	}
+
+	var mu sync.Mutex
+	var processed []string
+	consumer := newConsumer(t, ConsumerConfig{
+		CommonConfig: CommonConfig{
+			Brokers: addrs,
+			Logger:  zap.NewNop(),
+		},
+		Topics:       []apmqueue.Topic{apmqueue.Topic(topic)},
+		GroupID:      "groupid",
+		Delivery:     apmqueue.AtLeastOnceDeliveryType,
+		EndTimestamp: end,
+		Processor: apmqueue.ProcessorFunc(func(ctx context.Context, r apmqueue.Record) error {
+			mu.Lock()
+			defer mu.Unlock()
+			processed = append(processed, string(r.Value))
+			return nil
+		}),
+	})
+	runCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	require.NoError(t, consumer.Run(runCtx))
+	mu.Lock()
+	assert.Equal(t, []string{"a", "b"}, processed)
+	mu.Unlock()
+
+	// The records after the end timestamp aren't committed.
+	offsets, err := kadm.NewClient(client).FetchOffsets(ctx, "groupid")
+	require.NoError(t, err)
+	o, ok := offsets.Lookup(topic, 0)
+	require.True(t, ok)
+	assert.Equal(t, int64(2), o.At)
+}
@@ -0,0 +1,61 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package kafka
+
+import "time"
+
+// clock abstracts the wall clock used by the time-dependent code paths, so
+// tests can control time instead of sleeping.
+type clock interface {
+	// Now returns the current time.
+	Now() time.Time
+	// NewTimer returns a timer which fires once after d.
+	NewTimer(d time.Duration) timer
+	// NewTicker returns a timer which fires every d.
+	NewTicker(d time.Duration) timer
+}
+
+// timer is a time.Timer or time.Ticker created by a clock.
+type timer interface {
+	// C returns the channel on which the times are delivered.
+	C() <-chan time.Time
+	// Stop stops the timer, without closing its channel.
+	Stop()
+}
+
+// realClock is the clock backed by the time package.
+type realClock struct{}
+
+func (realClock) Now() time.Time { return time.Now() }
+
+func (realClock) NewTimer(d time.Duration) timer {
+	return realTimer{Timer: time.NewTimer(d)}
+}
+
+func (realClock) NewTicker(d time.Duration) timer {
+	return realTicker{Ticker: time.NewTicker(d)}
+}
+
+type realTimer struct{ *time.Timer }
+
+func (t realTimer) C() <-chan time.Time { return t.Timer.C }
+func (t realTimer) Stop()               { t.Timer.Stop() }
+
+type realTicker struct{ *time.Ticker }
+
+func (t realTicker) C() <-chan time.Time { return t.Ticker.C }
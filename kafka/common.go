@@ -20,29 +20,113 @@ package kafka
 import (
 	"context"
 	"crypto/tls"
+	"crypto/x509"
 	"errors"
 	"fmt"
+	"math/rand/v2"
 	"net"
 	"os"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	awsconfig "github.com/aws/aws-sdk-go-v2/config"
 	"github.com/twmb/franz-go/pkg/kgo"
 	"github.com/twmb/franz-go/pkg/sasl"
 	"github.com/twmb/franz-go/pkg/sasl/aws"
+	"github.com/twmb/franz-go/pkg/sasl/oauth"
 	"github.com/twmb/franz-go/pkg/sasl/plain"
+	"github.com/twmb/franz-go/pkg/sasl/scram"
 	"github.com/twmb/franz-go/plugin/kzap"
 	"go.opentelemetry.io/otel"
 	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/propagation"
 	"go.opentelemetry.io/otel/trace"
 	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
+
+	apmqueue "github.com/elastic/apm-queue/v2"
 )
 
+// defaultMetadataMinAge is kgo's default minimum time between metadata
+// refreshes.
+const defaultMetadataMinAge = 5 * time.Second
+
 // SASLMechanism type alias to sasl.Mechanism
 type SASLMechanism = sasl.Mechanism
 
+// SCRAMMechanism identifies the hash function used for SASL/SCRAM.
+type SCRAMMechanism uint8
+
+const (
+	// SCRAMSHA256 configures SASL/SCRAM-SHA-256.
+	SCRAMSHA256 SCRAMMechanism = iota + 1
+	// SCRAMSHA512 configures SASL/SCRAM-SHA-512.
+	SCRAMSHA512
+)
+
+// SASLSCRAMConfig holds the configuration for SASL/SCRAM authentication.
+type SASLSCRAMConfig struct {
+	// Mechanism is the SCRAM mechanism to use, and must be set.
+	Mechanism SCRAMMechanism
+	// Username is the SCRAM username, and must be set.
+	Username string
+	// Password is the SCRAM password, and must be set.
+	Password string
+}
+
+// SASLAWSMSKIAMConfig holds the configuration for SASL/AWS_MSK_IAM
+// authentication.
+type SASLAWSMSKIAMConfig struct {
+	// Region is the AWS region used when resolving credentials.
+	//
+	// If Region is unspecified, but $AWS_REGION is specified, it will be
+	// used to populate Region.
+	Region string
+
+	// AccessKeyID and SecretAccessKey, if specified, are used as static
+	// credentials. Both must be specified together.
+	//
+	// If unspecified, credentials are resolved using the AWS SDK default
+	// credential chain (environment variables, shared credentials files,
+	// instance profiles, etc.) whenever a new connection is authenticated,
+	// ensuring temporary credentials are refreshed as they rotate.
+	AccessKeyID     string
+	SecretAccessKey string
+
+	// SessionToken is an optional session token to use with AccessKeyID
+	// and SecretAccessKey.
+	SessionToken string
+}
+
+// SASLOAuthBearerConfig holds the configuration for SASL/OAUTHBEARER
+// authentication.
+type SASLOAuthBearerConfig struct {
+	// TokenProvider returns an OAuth token and its expiry, and must be set.
+	//
+	// Tokens are cached and shared by all the connections of the client,
+	// and TokenProvider is called again once a token is within
+	// RefreshBefore of its expiry. If TokenProvider returns an error, it is
+	// logged and retried with backoff, up to 5 attempts or for as long as
+	// the connection attempt lasts, and the last error is returned. While
+	// the cached token hasn't expired yet, it keeps being used when
+	// TokenProvider fails.
+	TokenProvider func(ctx context.Context) (token string, expiry time.Time, err error)
+
+	// RefreshBefore is the time before a token's expiry at which it is
+	// refreshed. If zero, defaults to 1m.
+	RefreshBefore time.Duration
+}
+
+// TopicPartition identifies a partition of a topic.
+type TopicPartition struct {
+	// Topic is the topic name, without the namespace.
+	Topic apmqueue.Topic
+	// Partition is the partition number.
+	Partition int32
+}
+
 // TopicLogFieldFunc is a function that returns a zap.Field for a given topic.
 type TopicLogFieldFunc func(topic string) zap.Field
 
@@ -81,7 +165,15 @@ type CommonConfig struct {
 	// Namespace holds a namespace for Kafka topics.
 	//
 	// This is added as a prefix for topics names, and acts as a filter
-	// on topics monitored or described by the manager.
+	// on topics monitored or described by the manager. The prefix is
+	// "<Namespace>-", and is added to the topics passed to the Producer,
+	// Consumer, Manager and TopicCreator, including the DeadLetterTopic
+	// and the topics of ConsumerConfig.Partitions.
+	//
+	// Topics must always be given without the prefix. The prefix is added
+	// even when a topic already starts with it, so a topic "ns-logs" in the
+	// namespace "ns" refers to the Kafka topic "ns-ns-logs". This keeps the
+	// mapping between logical and Kafka topic names unambiguous.
 	//
 	// Namespace is always removed from topic names before they are
 	// returned to callers. The only way Namespace will surface is in
@@ -116,8 +208,27 @@ type CommonConfig struct {
 	//    SASL/AWS_MSK_IAM will be configured using the AWS SDK
 	SASL SASLMechanism
 
-	// TLS configures the kgo.Client to use TLS for authentication.
-	// This option conflicts with Dialer. Only one can be used.
+	// SASLSCRAM configures the kgo.Client to use SASL/SCRAM authorization
+	// with the given credentials. This option conflicts with SASL. Only one
+	// can be used.
+	//
+	// SASLSCRAM can be combined with TLS to authenticate over TLS.
+	SASLSCRAM *SASLSCRAMConfig
+
+	// SASLAWSMSKIAM configures the kgo.Client to use SASL/AWS_MSK_IAM
+	// authorization. This option conflicts with SASL and SASLSCRAM. Only
+	// one can be used.
+	SASLAWSMSKIAM *SASLAWSMSKIAMConfig
+
+	// SASLOAuthBearer configures the kgo.Client to use SASL/OAUTHBEARER
+	// authorization, with tokens returned by a token provider. This option
+	// conflicts with SASL, SASLSCRAM and SASLAWSMSKIAM. Only one can be
+	// used.
+	SASLOAuthBearer *SASLOAuthBearerConfig
+
+	// TLS configures the kgo.Client to use TLS for authentication. If
+	// Dialer is also specified, connections are dialed with Dialer and TLS
+	// is then negotiated over the dialed connections.
 	//
 	// If neither TLS nor Dialer are specified, then TLS will be configured
 	// by default unless the environment variable $KAFKA_PLAINTEXT is set to
@@ -125,6 +236,31 @@ type CommonConfig struct {
 	// set to "true" to disable server certificate and hostname verification.
 	TLS *tls.Config
 
+	// TLSCertPath and TLSKeyPath hold the paths to a PEM-encoded client
+	// certificate and private key, which are presented to the brokers for
+	// mutual TLS authentication. Both must be specified together.
+	//
+	// TLSCAPath holds the path to a PEM-encoded bundle of CA certificates
+	// used to verify the brokers' certificates. If unspecified, the host's
+	// root CA set is used.
+	//
+	// TLSServerName overrides the server name used to verify the brokers'
+	// certificates, and sent for SNI, regardless of the dialed address.
+	// This is useful when brokers are reached through a proxy or load
+	// balancer, and present certificates under a different hostname.
+	//
+	// TLSInsecureSkipVerify disables server certificate and hostname
+	// verification. It must only be used for development, and a warning
+	// is logged when it is enabled.
+	//
+	// If any of these are specified, they are added to a copy of TLS, or
+	// a new tls.Config if TLS is nil.
+	TLSCertPath           string
+	TLSKeyPath            string
+	TLSCAPath             string
+	TLSServerName         string
+	TLSInsecureSkipVerify bool
+
 	// Dialer uses fn to dial addresses, overriding the default dialer that uses a
 	// 10s dial timeout and no TLS (unless TLS option is set).
 	//
@@ -132,7 +268,12 @@ type CommonConfig struct {
 	// that caused the dial. If the request is a client-internal request, the
 	// context is the context on the client itself (which is canceled when the
 	// client is closed).
-	// This option conflicts with TLS. Only one can be used.
+	//
+	// If TLS is also specified, Dialer must return plaintext connections,
+	// e.g. dialed through a SOCKS5 proxy, which are then wrapped with TLS,
+	// using the broker's host as the server name unless TLS.ServerName is
+	// set; dialing fails if Dialer returns a *tls.Conn. Otherwise, TLS is
+	// not auto-configured when Dialer is specified.
 	Dialer func(ctx context.Context, network, address string) (net.Conn, error)
 
 	// Logger to use for any errors.
@@ -149,24 +290,130 @@ type CommonConfig struct {
 	// Defaults to the global one.
 	MeterProvider metric.MeterProvider
 
+	// TextMapPropagator allows specifying a custom otel propagator, used to
+	// inject and extract the trace context in record headers when trace
+	// context propagation is enabled. Defaults to the global one.
+	TextMapPropagator propagation.TextMapPropagator
+
 	// TopicAttributeFunc can be used to create custom dimensions from a Kafka
 	// topic for these metrics:
 	// - producer.messages.count
 	// - consumer.messages.fetched
 	TopicAttributeFunc TopicAttributeFunc
 
+	// MetricAttributeFilter, if set, returns the attributes identifying a
+	// topic, without the namespace, in all the metrics recorded by the
+	// Producer, Consumer and Manager, replacing the default topic name
+	// attributes. It can be used to collapse or rename topics to limit the
+	// metrics cardinality, e.g. by stripping a tenant-specific suffix.
+	//
+	// Observations of gauges, such as the consumer lag, for topics which
+	// are collapsed into the same attributes replace each other.
+	MetricAttributeFilter MetricAttributeFilter
+
 	// TopicAttributeFunc can be used to create custom dimensions from a Kafka
 	// topic for log messages
 	TopicLogFieldFunc TopicLogFieldFunc
 
 	// MetadataMaxAge is the maximum age of metadata before it is refreshed.
 	// The lower the value the more frequently new topics will be discovered.
-	// If zero, the default value of 5 minutes is used.
+	// If zero, the default value of 5 minutes is used. Values lower than 5s
+	// also lower the minimum time between metadata refreshes.
 	MetadataMaxAge time.Duration
 
+	// RequestTimeout is the time allowed for each request on top of the
+	// timeout carried by the request itself, such as the fetch max wait,
+	// after which the request is considered failed and is retried. When
+	// MaxRetries is also set, the total time spent retrying a request is
+	// bounded to RequestTimeout times MaxRetries+1.
+	//
+	// If RequestTimeout is unspecified, but $KAFKA_REQUEST_TIMEOUT is
+	// specified, it will be parsed as a duration and used. If neither is
+	// set, kgo's default of 10s is used. It must be between 1s and 15m.
+	RequestTimeout time.Duration
+
+	// MaxRetries is the maximum number of times a failed request is
+	// retried, for retriable errors.
+	//
+	// If MaxRetries is unspecified, but $KAFKA_MAX_RETRIES is specified, it
+	// will be parsed as an integer and used. If neither is set, kgo's
+	// default of 20 retries is used.
+	MaxRetries int
+
+	// ReconnectBackoff configures the backoff between retries of failed
+	// requests, including reconnections to the brokers, see
+	// ReconnectBackoffConfig.
+	ReconnectBackoff ReconnectBackoffConfig
+
+	// DisconnectedWarnThreshold, if set, logs a warning when connections
+	// to a broker have been failing for longer than the threshold, so
+	// prolonged broker outages can be alerted on. The warning is logged
+	// once per outage, and an info message is logged once reconnected.
+	DisconnectedWarnThreshold time.Duration
+
 	hooks []kgo.Hook
 }
 
+// ReconnectBackoffConfig configures the exponential backoff between retries
+// of failed requests and reconnections to the brokers. Jitter is applied, so
+// the clients of a fleet don't all reconnect simultaneously after an outage.
+type ReconnectBackoffConfig struct {
+	// Min is the backoff after the first failure, which is doubled after
+	// each consecutive failure. Defaults to 250ms.
+	Min time.Duration
+
+	// Max is the maximum backoff. Defaults to 10s.
+	Max time.Duration
+
+	// Jitter is the fraction of each backoff above Min which is randomized,
+	// in (0, 1]. Defaults to 1, full jitter, so each backoff is a random
+	// duration between Min and the exponential backoff.
+	Jitter float64
+}
+
+// withDefaults returns cfg with the defaults set for the unset fields.
+func (cfg ReconnectBackoffConfig) withDefaults() ReconnectBackoffConfig {
+	if cfg.Min == 0 {
+		cfg.Min = 250 * time.Millisecond
+	}
+	if cfg.Max == 0 {
+		cfg.Max = 10 * time.Second
+	}
+	if cfg.Jitter == 0 {
+		cfg.Jitter = 1
+	}
+	return cfg
+}
+
+// validate returns an error if cfg, with the defaults set, is invalid.
+func (cfg ReconnectBackoffConfig) validate() error {
+	cfg = cfg.withDefaults()
+	var errs []error
+	if cfg.Min < 0 {
+		errs = append(errs, fmt.Errorf("min cannot be negative: %s", cfg.Min))
+	}
+	if cfg.Max < cfg.Min {
+		errs = append(errs, fmt.Errorf("max %s cannot be less than min %s", cfg.Max, cfg.Min))
+	}
+	if cfg.Jitter < 0 || cfg.Jitter > 1 {
+		errs = append(errs, fmt.Errorf("jitter must be in (0, 1]: %v", cfg.Jitter))
+	}
+	return errors.Join(errs...)
+}
+
+// backoff returns the backoff after the given number of consecutive
+// failures.
+func (cfg ReconnectBackoffConfig) backoff(fails int) time.Duration {
+	backoff := cfg.Max
+	if fails <= 1 {
+		backoff = cfg.Min
+	} else if fails < 64 && cfg.Min <= cfg.Max>>(fails-1) {
+		backoff = cfg.Min << (fails - 1)
+	}
+	jitter := time.Duration(cfg.Jitter * rand.Float64() * float64(backoff-cfg.Min))
+	return backoff - jitter
+}
+
 // finalize ensures the configuration is valid, setting default values from
 // environment variables as described in doc comments, returning an error if
 // any configuration is invalid.
@@ -181,6 +428,35 @@ func (cfg *CommonConfig) finalize() error {
 	if cfg.Namespace != "" {
 		cfg.Logger = cfg.Logger.With(zap.String("namespace", cfg.Namespace))
 	}
+	switch {
+	case cfg.SASLSCRAM != nil && cfg.SASLAWSMSKIAM != nil:
+		errs = append(errs, errors.New("kafka: only one of SASLSCRAM or SASLAWSMSKIAM can be set"))
+	case cfg.SASLSCRAM != nil:
+		if cfg.SASL != nil {
+			errs = append(errs, errors.New("kafka: only one of SASL or SASLSCRAM can be set"))
+		} else if mechanism, err := cfg.SASLSCRAM.mechanism(); err != nil {
+			errs = append(errs, fmt.Errorf("kafka: error configuring SASL/SCRAM: %w", err))
+		} else {
+			cfg.SASL = mechanism
+		}
+	case cfg.SASLAWSMSKIAM != nil:
+		if cfg.SASL != nil {
+			errs = append(errs, errors.New("kafka: only one of SASL or SASLAWSMSKIAM can be set"))
+		} else if mechanism, err := newAWSMSKIAMSASL(*cfg.SASLAWSMSKIAM); err != nil {
+			errs = append(errs, fmt.Errorf("kafka: error configuring SASL/AWS_MSK_IAM: %w", err))
+		} else {
+			cfg.SASL = mechanism
+		}
+	}
+	if cfg.SASLOAuthBearer != nil {
+		if cfg.SASL != nil || cfg.SASLSCRAM != nil || cfg.SASLAWSMSKIAM != nil {
+			errs = append(errs, errors.New("kafka: only one of SASL, SASLSCRAM, SASLAWSMSKIAM or SASLOAuthBearer can be set"))
+		} else if mechanism, err := newOAuthBearerSASL(*cfg.SASLOAuthBearer, cfg.Logger); err != nil {
+			errs = append(errs, fmt.Errorf("kafka: error configuring SASL/OAUTHBEARER: %w", err))
+		} else {
+			cfg.SASL = mechanism
+		}
+	}
 	if cfg.ConfigFile == "" {
 		cfg.ConfigFile = os.Getenv("KAFKA_CONFIG_FILE")
 	}
@@ -205,16 +481,25 @@ func (cfg *CommonConfig) finalize() error {
 			errs = append(errs, errors.New("kafka: at least one broker must be set"))
 		}
 	}
-	switch {
-	case cfg.TLS != nil && cfg.Dialer != nil:
-		errs = append(errs, errors.New("kafka: only one of TLS or Dialer can be set"))
-	case cfg.TLS == nil && cfg.Dialer == nil && os.Getenv("KAFKA_PLAINTEXT") != "true":
+	if cfg.TLSCertPath != "" || cfg.TLSKeyPath != "" || cfg.TLSCAPath != "" ||
+		cfg.TLSServerName != "" || cfg.TLSInsecureSkipVerify {
+		if tlsConfig, err := cfg.loadTLSFiles(); err != nil {
+			errs = append(errs, fmt.Errorf("kafka: error configuring TLS: %w", err))
+		} else {
+			cfg.TLS = tlsConfig
+		}
+	}
+	if cfg.TLS == nil && cfg.Dialer == nil && os.Getenv("KAFKA_PLAINTEXT") != "true" {
 		// Auto-configure TLS from environment variables.
 		cfg.TLS = &tls.Config{}
 		if os.Getenv("KAFKA_TLS_INSECURE") == "true" {
 			cfg.TLS.InsecureSkipVerify = true
 		}
 	}
+	if cfg.TLS != nil && cfg.TLS.InsecureSkipVerify {
+		cfg.Logger.Warn("TLS server certificate verification is disabled; " +
+			"connections are vulnerable to interception and must only be used for development")
+	}
 	if cfg.SASL == nil {
 		saslConfig := saslConfigProperties{
 			Mechanism: os.Getenv("KAFKA_SASL_MECHANISM"),
@@ -235,13 +520,55 @@ func (cfg *CommonConfig) finalize() error {
 				}
 			case "AWS_MSK_IAM":
 				var err error
-				cfg.SASL, err = newAWSMSKIAMSASL()
+				cfg.SASL, err = newDefaultAWSMSKIAMSASL()
 				if err != nil {
 					errs = append(errs, fmt.Errorf("kafka: error configuring SASL/AWS_MSK_IAM: %w", err))
 				}
 			}
 		}
 	}
+	if cfg.RequestTimeout == 0 {
+		if v := os.Getenv("KAFKA_REQUEST_TIMEOUT"); v != "" {
+			if d, err := time.ParseDuration(v); err != nil {
+				errs = append(errs, fmt.Errorf("kafka: error parsing $KAFKA_REQUEST_TIMEOUT: %w", err))
+			} else {
+				cfg.RequestTimeout = d
+			}
+		}
+	}
+	switch {
+	case cfg.RequestTimeout < 0:
+		errs = append(errs, errors.New("kafka: request timeout cannot be negative"))
+	case cfg.RequestTimeout > 0 && cfg.RequestTimeout < time.Second:
+		// kgo rejects request timeouts outside of [1s, 15m].
+		errs = append(errs, errors.New("kafka: request timeout must be at least 1s"))
+	case cfg.RequestTimeout > 15*time.Minute:
+		errs = append(errs, errors.New("kafka: request timeout cannot exceed 15m"))
+	}
+	if cfg.MaxRetries == 0 {
+		if v := os.Getenv("KAFKA_MAX_RETRIES"); v != "" {
+			if n, err := strconv.Atoi(v); err != nil {
+				errs = append(errs, fmt.Errorf("kafka: error parsing $KAFKA_MAX_RETRIES: %w", err))
+			} else {
+				cfg.MaxRetries = n
+			}
+		}
+	}
+	if cfg.MaxRetries < 0 {
+		errs = append(errs, errors.New("kafka: max retries cannot be negative"))
+	}
+	if err := cfg.ReconnectBackoff.validate(); err != nil {
+		errs = append(errs, fmt.Errorf("kafka: invalid reconnect backoff: %w", err))
+	}
+	switch {
+	case cfg.DisconnectedWarnThreshold < 0:
+		errs = append(errs, errors.New("kafka: disconnected warn threshold cannot be negative"))
+	case cfg.DisconnectedWarnThreshold > 0:
+		cfg.hooks = append(cfg.hooks, &disconnectedHook{
+			logger:    cfg.Logger,
+			threshold: cfg.DisconnectedWarnThreshold,
+		})
+	}
 	// Wrap the cfg.TopicLogFieldFunc to ensure it never returns a field with
 	// an unknown type (like `zap.Field{}`).
 	if cfg.TopicLogFieldFunc != nil {
@@ -250,6 +577,43 @@ func (cfg *CommonConfig) finalize() error {
 	return errors.Join(errs...)
 }
 
+// loadTLSFiles returns a copy of cfg.TLS, or a new tls.Config if cfg.TLS is
+// nil, with the client certificate and CA certificates loaded from the files
+// specified in cfg, and the server name and verification overrides applied.
+func (cfg *CommonConfig) loadTLSFiles() (*tls.Config, error) {
+	tlsConfig := &tls.Config{}
+	if cfg.TLS != nil {
+		tlsConfig = cfg.TLS.Clone()
+	}
+	if (cfg.TLSCertPath == "") != (cfg.TLSKeyPath == "") {
+		return nil, errors.New("TLSCertPath and TLSKeyPath must be set together")
+	}
+	if cfg.TLSCertPath != "" {
+		cert, err := tls.LoadX509KeyPair(cfg.TLSCertPath, cfg.TLSKeyPath)
+		if err != nil {
+			return nil, fmt.Errorf("error loading client certificate: %w", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	if cfg.TLSCAPath != "" {
+		data, err := os.ReadFile(cfg.TLSCAPath)
+		if err != nil {
+			return nil, fmt.Errorf("error reading CA file: %w", err)
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("no valid CA certificates found in %q", cfg.TLSCAPath)
+		}
+	}
+	if cfg.TLSServerName != "" {
+		tlsConfig.ServerName = cfg.TLSServerName
+	}
+	if cfg.TLSInsecureSkipVerify {
+		tlsConfig.InsecureSkipVerify = true
+	}
+	return tlsConfig, nil
+}
+
 func (cfg *CommonConfig) namespacePrefix() string {
 	if cfg.Namespace == "" {
 		return ""
@@ -264,6 +628,13 @@ func (cfg *CommonConfig) tracerProvider() trace.TracerProvider {
 	return otel.GetTracerProvider()
 }
 
+func (cfg *CommonConfig) textMapPropagator() propagation.TextMapPropagator {
+	if cfg.TextMapPropagator != nil {
+		return cfg.TextMapPropagator
+	}
+	return otel.GetTextMapPropagator()
+}
+
 func (cfg *CommonConfig) meterProvider() metric.MeterProvider {
 	if cfg.MeterProvider != nil {
 		return cfg.MeterProvider
@@ -284,9 +655,12 @@ func (cfg *CommonConfig) newClient(topicAttributeFunc TopicAttributeFunc, additi
 			))
 		}
 	}
-	if cfg.Dialer != nil {
+	switch {
+	case cfg.Dialer != nil && cfg.TLS != nil:
+		opts = append(opts, kgo.Dialer(tlsDialer(cfg.Dialer, cfg.TLS.Clone())))
+	case cfg.Dialer != nil:
 		opts = append(opts, kgo.Dialer(cfg.Dialer))
-	} else if cfg.TLS != nil {
+	case cfg.TLS != nil:
 		opts = append(opts, kgo.DialTLSConfig(cfg.TLS.Clone()))
 	}
 	if cfg.SASL != nil {
@@ -295,7 +669,7 @@ func (cfg *CommonConfig) newClient(topicAttributeFunc TopicAttributeFunc, additi
 	opts = append(opts, additionalOpts...)
 	if !cfg.DisableTelemetry {
 		metricHooks, err := newKgoHooks(cfg.meterProvider(),
-			cfg.Namespace, cfg.namespacePrefix(), topicAttributeFunc,
+			cfg.Namespace, cfg.namespacePrefix(), topicAttributeFunc, cfg.MetricAttributeFilter,
 		)
 		if err != nil {
 			return nil, fmt.Errorf("kafka: failed creating kgo metrics hooks: %w", err)
@@ -306,6 +680,20 @@ func (cfg *CommonConfig) newClient(topicAttributeFunc TopicAttributeFunc, additi
 	}
 	if cfg.MetadataMaxAge > 0 {
 		opts = append(opts, kgo.MetadataMaxAge(cfg.MetadataMaxAge))
+		if cfg.MetadataMaxAge < defaultMetadataMinAge {
+			// kgo doesn't allow the max age to be lower than the min age.
+			opts = append(opts, kgo.MetadataMinAge(cfg.MetadataMaxAge))
+		}
+	}
+	if cfg.RequestTimeout > 0 {
+		opts = append(opts, kgo.RequestTimeoutOverhead(cfg.RequestTimeout))
+	}
+	opts = append(opts, kgo.RetryBackoffFn(cfg.ReconnectBackoff.withDefaults().backoff))
+	if cfg.MaxRetries > 0 {
+		opts = append(opts, kgo.RequestRetries(cfg.MaxRetries))
+	}
+	if cfg.RequestTimeout > 0 && cfg.MaxRetries > 0 {
+		opts = append(opts, kgo.RetryTimeout(cfg.RequestTimeout*time.Duration(cfg.MaxRetries+1)))
 	}
 	if len(cfg.hooks) != 0 {
 		opts = append(opts, kgo.WithHooks(cfg.hooks...))
@@ -319,7 +707,201 @@ func (cfg *CommonConfig) newClient(topicAttributeFunc TopicAttributeFunc, additi
 	return client, nil
 }
 
-func newAWSMSKIAMSASL() (sasl.Mechanism, error) {
+// mechanism validates cfg, returning the configured sasl.Mechanism.
+func (cfg *SASLSCRAMConfig) mechanism() (sasl.Mechanism, error) {
+	var errs []error
+	if cfg.Username == "" {
+		errs = append(errs, errors.New("username must be set"))
+	}
+	if cfg.Password == "" {
+		errs = append(errs, errors.New("password must be set"))
+	}
+	auth := scram.Auth{User: cfg.Username, Pass: cfg.Password}
+	var mechanism sasl.Mechanism
+	switch cfg.Mechanism {
+	case SCRAMSHA256:
+		mechanism = auth.AsSha256Mechanism()
+	case SCRAMSHA512:
+		mechanism = auth.AsSha512Mechanism()
+	default:
+		errs = append(errs, errors.New("mechanism must be one of SCRAMSHA256 or SCRAMSHA512"))
+	}
+	if err := errors.Join(errs...); err != nil {
+		return nil, err
+	}
+	return mechanism, nil
+}
+
+// tlsDialer returns a dial function that dials connections with dial, and
+// then performs a TLS handshake over them.
+func tlsDialer(
+	dial func(ctx context.Context, network, address string) (net.Conn, error),
+	tlsConfig *tls.Config,
+) func(ctx context.Context, network, address string) (net.Conn, error) {
+	return func(ctx context.Context, network, address string) (net.Conn, error) {
+		config := tlsConfig
+		if config.ServerName == "" {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return nil, fmt.Errorf("unable to split host:port for dialing: %w", err)
+			}
+			config = config.Clone()
+			config.ServerName = host
+		}
+		conn, err := dial(ctx, network, address)
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := conn.(*tls.Conn); ok {
+			// TLS would be negotiated twice.
+			conn.Close()
+			return nil, errors.New("kafka: Dialer must return plaintext connections when TLS is set")
+		}
+		tlsConn := tls.Client(conn, config)
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		return tlsConn, nil
+	}
+}
+
+func newOAuthBearerSASL(cfg SASLOAuthBearerConfig, logger *zap.Logger) (sasl.Mechanism, error) {
+	if cfg.TokenProvider == nil {
+		return nil, errors.New("token provider must be set")
+	}
+	if cfg.RefreshBefore < 0 {
+		return nil, errors.New("refresh before cannot be negative")
+	}
+	if cfg.RefreshBefore == 0 {
+		cfg.RefreshBefore = time.Minute
+	}
+	source := &oauthTokenSource{cfg: cfg, logger: logger}
+	return oauth.Oauth(func(ctx context.Context) (oauth.Auth, error) {
+		token, err := source.token(ctx)
+		if err != nil {
+			return oauth.Auth{}, err
+		}
+		return oauth.Auth{Token: token}, nil
+	}), nil
+}
+
+// oauthTokenSource caches the token returned by the token provider until it
+// needs to be refreshed.
+type oauthTokenSource struct {
+	cfg    SASLOAuthBearerConfig
+	logger *zap.Logger
+
+	mu     sync.Mutex
+	cached string
+	expiry time.Time
+}
+
+// oauthTokenAttempts is the number of times the token provider is called to
+// refresh a token before giving up.
+const oauthTokenAttempts = 5
+
+// token returns the cached token, refreshing it if it's within RefreshBefore
+// of its expiry. Token provider errors are retried with backoff, up to
+// oauthTokenAttempts times or until ctx is done, unless the cached token
+// hasn't expired yet, in which case it's returned right away. The mutex
+// isn't held while backing off, so the token can be refreshed concurrently.
+func (s *oauthTokenSource) token(ctx context.Context) (string, error) {
+	var err error
+	backoff := 100 * time.Millisecond
+	for attempt := 1; ; attempt++ {
+		s.mu.Lock()
+		if s.cached != "" && time.Until(s.expiry) > s.cfg.RefreshBefore {
+			token := s.cached
+			s.mu.Unlock()
+			return token, nil
+		}
+		var token string
+		var expiry time.Time
+		token, expiry, err = s.cfg.TokenProvider(ctx)
+		if err == nil && token == "" {
+			err = errors.New("token provider returned an empty token")
+		}
+		if err == nil {
+			s.cached, s.expiry = token, expiry
+			s.mu.Unlock()
+			return token, nil
+		}
+		if s.cached != "" && time.Now().Before(s.expiry) {
+			token := s.cached
+			s.mu.Unlock()
+			s.logger.Warn("failed to refresh SASL/OAUTHBEARER token, using the cached token",
+				zap.Error(err),
+			)
+			return token, nil
+		}
+		s.mu.Unlock()
+		if attempt == oauthTokenAttempts {
+			break
+		}
+		s.logger.Warn("failed to refresh SASL/OAUTHBEARER token",
+			zap.Error(err),
+			zap.Duration("backoff", backoff),
+		)
+		timer := time.NewTimer(backoff)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return "", fmt.Errorf("kafka: failed to get SASL/OAUTHBEARER token: %w", err)
+		case <-timer.C:
+		}
+		backoff = min(2*backoff, 5*time.Second)
+	}
+	return "", fmt.Errorf("kafka: failed to get SASL/OAUTHBEARER token: %w", err)
+}
+
+func newAWSMSKIAMSASL(cfg SASLAWSMSKIAMConfig) (sasl.Mechanism, error) {
+	if (cfg.AccessKeyID == "") != (cfg.SecretAccessKey == "") {
+		return nil, errors.New("access key ID and secret access key must be set together")
+	}
+	if cfg.AccessKeyID != "" {
+		auth := aws.Auth{
+			AccessKey:    cfg.AccessKeyID,
+			SecretKey:    cfg.SecretAccessKey,
+			SessionToken: cfg.SessionToken,
+		}
+		return auth.AsManagedStreamingIAMMechanism(), nil
+	}
+	if cfg.SessionToken != "" {
+		return nil, errors.New("session token requires access key ID and secret access key")
+	}
+	region := cfg.Region
+	if region == "" {
+		region = os.Getenv("AWS_REGION")
+	}
+	var loadOptions []func(*awsconfig.LoadOptions) error
+	if region != "" {
+		loadOptions = append(loadOptions, awsconfig.WithRegion(region))
+	}
+	// The config is loaded once, and its credentials provider caches the
+	// credentials until they expire.
+	awscfg, err := awsconfig.LoadDefaultConfig(context.Background(), loadOptions...)
+	if err != nil {
+		return nil, fmt.Errorf("error loading AWS config: %w", err)
+	}
+	return aws.ManagedStreamingIAM(func(ctx context.Context) (aws.Auth, error) {
+		creds, err := awscfg.Credentials.Retrieve(ctx)
+		if err != nil {
+			return aws.Auth{}, err
+		}
+		return aws.Auth{
+			AccessKey:    creds.AccessKeyID,
+			SecretKey:    creds.SecretAccessKey,
+			SessionToken: creds.SessionToken,
+		}, nil
+	}), nil
+}
+
+// newDefaultAWSMSKIAMSASL returns the SASL/AWS_MSK_IAM mechanism configured
+// with $KAFKA_SASL_MECHANISM or the config file, which loads the AWS config
+// for every authentication, so changes to the environment and the shared
+// credentials files are picked up.
+func newDefaultAWSMSKIAMSASL() (sasl.Mechanism, error) {
 	return aws.ManagedStreamingIAM(func(ctx context.Context) (aws.Auth, error) {
 		awscfg, err := awsconfig.LoadDefaultConfig(ctx)
 		if err != nil {
@@ -348,3 +930,38 @@ func topicFieldFunc(f TopicLogFieldFunc) TopicLogFieldFunc {
 		return zap.Skip()
 	}
 }
+
+// headerCarrier adapts record headers to a propagation.TextMapCarrier.
+type headerCarrier []kgo.RecordHeader
+
+var _ propagation.TextMapCarrier = (*headerCarrier)(nil)
+
+// Get returns the value of the first header with the given key.
+func (c *headerCarrier) Get(key string) string {
+	for _, h := range *c {
+		if h.Key == key {
+			return string(h.Value)
+		}
+	}
+	return ""
+}
+
+// Set sets the header with the given key, replacing any existing value.
+func (c *headerCarrier) Set(key, value string) {
+	for i, h := range *c {
+		if h.Key == key {
+			(*c)[i].Value = []byte(value)
+			return
+		}
+	}
+	*c = append(*c, kgo.RecordHeader{Key: key, Value: []byte(value)})
+}
+
+// Keys returns the keys of all the headers.
+func (c *headerCarrier) Keys() []string {
+	keys := make([]string, len(*c))
+	for i, h := range *c {
+		keys[i] = h.Key
+	}
+	return keys
+}
@@ -78,7 +78,7 @@ func newConfigFileHook(filepath string, logger *zap.Logger) (_ *configFileHook,
 			return plainAuth, nil
 		})
 	case "AWS_MSK_IAM":
-		saslMechanism, err = newAWSMSKIAMSASL()
+		saslMechanism, err = newDefaultAWSMSKIAMSASL()
 		if err != nil {
 			return nil, nil, nil, fmt.Errorf("kafka: error configuring SASL/AWS_MSK_IAM: %w", err)
 		}
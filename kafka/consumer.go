@@ -18,14 +18,29 @@
 package kafka
 
 import (
+	"cmp"
 	"context"
 	"errors"
 	"fmt"
+	"maps"
+	"math"
+	"os"
+	"regexp"
+	"slices"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/twmb/franz-go/pkg/kadm"
+	"github.com/twmb/franz-go/pkg/kerr"
 	"github.com/twmb/franz-go/pkg/kgo"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/propagation"
+	semconv "go.opentelemetry.io/otel/semconv/v1.17.0"
 	"go.opentelemetry.io/otel/trace"
 	"go.uber.org/zap"
 	"golang.org/x/sync/errgroup"
@@ -38,6 +53,29 @@ var (
 	// ErrCommitFailed may be returned by `consumer.Run` when DeliveryType is
 	// apmqueue.AtMostOnceDelivery.
 	ErrCommitFailed = errors.New("kafka: failed to commit offsets")
+
+	// ErrAutoCommitEnabled is returned by `consumer.Commit` when
+	// ConsumerConfig.DisableAutoCommit is not set.
+	ErrAutoCommitEnabled = errors.New("kafka: auto commit is enabled")
+
+	// ErrPartitionNotAssigned is returned by `consumer.Seek` when seeking a
+	// partition which isn't assigned to the consumer.
+	ErrPartitionNotAssigned = errors.New("kafka: partition not assigned to consumer")
+
+	// ErrDeadLetterFailed is returned by `consumer.Run` when a record which
+	// failed to be processed can't be produced to the dead letter topic.
+	ErrDeadLetterFailed = errors.New("kafka: failed to produce record to dead letter topic")
+
+	// ErrShutdownTimeout is returned by `consumer.Shutdown` when the fetched
+	// records aren't processed before the context is done, and by
+	// `consumer.Run` when they aren't processed within ShutdownGracePeriod
+	// after its context is canceled.
+	ErrShutdownTimeout = errors.New("kafka: timeout waiting for records to be processed")
+
+	// ErrConsumerUnhealthy is returned by `consumer.Healthy` when the
+	// consumer has lost its consumer group membership, or fetching records
+	// has failed repeatedly.
+	ErrConsumerUnhealthy = errors.New("kafka: consumer unhealthy")
 )
 
 // ConsumerConfig defines the configuration for the Kafka consumer.
@@ -48,8 +86,64 @@ type ConsumerConfig struct {
 	// ConsumeRegex sets the client to parse all topics passed to ConsumeTopics
 	// as regular expressions.
 	ConsumeRegex bool
+	// TopicRegex, if set instead of Topics, subscribes the consumer to all
+	// the topics matching the regular expression, including topics created
+	// after the consumer has started. When Namespace is set, only the topics
+	// of the namespace are matched, and the regular expression is matched
+	// against the topic names following the namespace prefix, so it must not
+	// be anchored with ^.
+	//
+	// New topics are discovered when the client refreshes its metadata,
+	// which happens every CommonConfig.MetadataMaxAge (5 minutes by default).
+	TopicRegex *regexp.Regexp
 	// GroupID to join as part of the consumer group.
 	GroupID string
+	// Partitions, if set, statically assigns the given partitions, keyed by
+	// topic, to the consumer instead of joining a consumer group, so neither
+	// Topics, GroupID nor ConsumeRegex can be set. OnAssigned is called with
+	// the partitions when the consumer is created, and OnRevoked is never
+	// called.
+	//
+	// Since there is no consumer group to commit the offsets to, offsets are
+	// committed to OffsetStore if set, and are otherwise not committed at
+	// all, in which case the partitions are consumed from InitialOffset.
+	Partitions map[string][]int32
+	// OffsetStore, if set, stores the offsets of the Partitions statically
+	// assigned to the consumer. The offsets to resume consuming from are
+	// loaded from the OffsetStore when the consumer is created, and offsets
+	// are stored in it as they would be committed to a consumer group, following
+	// Delivery, CommitInterval and DisableAutoCommit.
+	OffsetStore OffsetStore
+	// InitialOffset defines where to start consuming partitions which don't
+	// have a committed offset, e.g. for a new consumer group. Partitions
+	// with a committed offset resume from it regardless of InitialOffset.
+	// It also applies when a committed offset is out of range, e.g. when
+	// the records have been deleted by retention.
+	//
+	// Defaults to EarliestOffset.
+	InitialOffset InitialOffset
+	// OnOffsetOutOfRange defines how the consumer resets the offset of a
+	// partition which is out of range, e.g. when the records at the offset
+	// have been deleted by retention. With OffsetOutOfRangeEarliest or
+	// OffsetOutOfRangeLatest, the partition is sought to its earliest or
+	// latest offset, logging a warning with the previous and new offsets,
+	// and counting the reset in the consumer.offset.resets metric.
+	//
+	// Defaults to OffsetOutOfRangeNone, leaving the client to reset the
+	// partition as described in InitialOffset, without notice.
+	OnOffsetOutOfRange OffsetOutOfRangePolicy
+	// IsolationLevel defines whether the consumer reads the records of
+	// transactions which haven't been committed. With ReadCommitted, the
+	// partitions are only consumed up to the first offset of the open
+	// transactions, and the records of aborted transactions are skipped, so
+	// only the records of committed transactions, e.g. produced within
+	// Producer.BeginTransaction and Producer.CommitTransaction, and the
+	// records produced outside of transactions are processed. Combined with
+	// Producer.AddOffsetsToTransaction, this enables exactly-once
+	// consume-transform-produce pipelines.
+	//
+	// Defaults to ReadUncommitted, which processes every record.
+	IsolationLevel IsolationLevel
 	// MaxPollRecords defines an upper bound to the number of records that can
 	// be polled on a single fetch. If MaxPollRecords <= 0, defaults to 500.
 	// Note that this setting doesn't change how `franz-go` fetches and buffers
@@ -67,7 +161,7 @@ type ConsumerConfig struct {
 	MaxPollRecords int
 	// MaxPollWait defines the maximum amount of time a broker will wait for a
 	// fetch response to hit the minimum number of required bytes before
-	// returning
+	// returning. It must be between 10ms and 1m.
 	// Default: 5s
 	// Kafka consumer setting: fetch.max.wait.ms
 	// Docs: https://kafka.apache.org/28/documentation.html#consumerconfigs_fetch.max.wait.ms
@@ -80,6 +174,13 @@ type ConsumerConfig struct {
 	// Default: Unbounded, total number of brokers.
 	// Docs: https://pkg.go.dev/github.com/twmb/franz-go/pkg/kgo#MaxConcurrentFetches
 	MaxConcurrentFetches int
+	// MaxConcurrency bounds the number of records, or batches when using a
+	// BatchProcessor, which are processed simultaneously across all the
+	// assigned partitions. Records of the same partition are always
+	// processed sequentially, so offsets are only committed once all the
+	// preceding records of the partition have finished processing.
+	// Default: Unbounded, one record per assigned partition.
+	MaxConcurrency int
 	// MaxPollBytes sets the maximum amount of bytes a broker will try to send
 	// during a fetch
 	// Default: 52428800 bytes (~52MB, 50MiB)
@@ -100,6 +201,144 @@ type ConsumerConfig struct {
 	// AtMostOnceDeliveryType and AtLeastOnceDeliveryType are supported.
 	// If not set, it defaults to apmqueue.AtMostOnceDeliveryType.
 	Delivery apmqueue.DeliveryType
+	// DisableAutoCommit disables committing offsets automatically, as
+	// described by the Delivery type. Instead, the offsets of the records
+	// delivered to the Processor are committed when Consumer.Commit is
+	// called. With AtLeastOnceDeliveryType, only the offsets of records
+	// which were processed without error are committed.
+	//
+	// Offsets which have not been committed when a partition is revoked
+	// are discarded, and the records are re-delivered to the new owner of
+	// the partition.
+	DisableAutoCommit bool
+	// CommitInterval, if set, commits the offsets of the processed records
+	// of each partition every CommitInterval with AtLeastOnceDeliveryType,
+	// instead of after each fetch's records are processed. Offsets never
+	// advance past a record which is still being processed, so at most
+	// CommitInterval worth of processed records are re-delivered after a
+	// crash. The processed offsets are also committed when partitions are
+	// revoked and when the consumer is closed.
+	//
+	// Unlike kgo's auto commit, which commits the fetch position, only the
+	// offsets of processed records are committed. It can't be set with
+	// DisableAutoCommit.
+	CommitInterval time.Duration
+
+	// OnAssigned, if set, is called with the partitions which are assigned
+	// to the consumer, keyed by topic, after each rebalance. No records of
+	// the assigned partitions are processed until OnAssigned returns.
+	//
+	// The context is canceled when the consumer is closed.
+	OnAssigned func(ctx context.Context, assigned map[string][]int32)
+
+	// OnRevoked, if set, is called with the partitions which are revoked
+	// from or lost by the consumer, keyed by topic. OnRevoked is called once
+	// all the fetched records of the partitions have been processed (and
+	// committed, when using AtLeastOnceDeliveryType), but before the
+	// partitions are given up, so no records of the partitions are processed
+	// concurrently with OnRevoked. Offsets can't be committed for lost
+	// partitions.
+	//
+	// The context is canceled when the consumer is closed.
+	OnRevoked func(ctx context.Context, revoked map[string][]int32)
+
+	// OnFetchError, if set, is called with a *FetchError for each error
+	// returned by the brokers when fetching records, as opposed to errors
+	// returned by the Processor, e.g. to alert on, or to reset the offsets
+	// of a partition with Consumer.Seek on kerr.OffsetOutOfRange. The
+	// consumer keeps fetching records after OnFetchError returns, since
+	// fetch errors are retried by the client.
+	//
+	// OnFetchError is called from the fetch loop, which is blocked until it
+	// returns. The context is canceled when the consumer is closed.
+	OnFetchError func(ctx context.Context, err error)
+
+	// EndOffsets, if set, bounds the consumption of the given partitions to
+	// the records before their end offset, so the consumer can replay a
+	// finite range of records. Records at or after the end offset of a
+	// partition aren't processed, and the partition is no longer fetched
+	// once its records before the end offset have been processed. Run
+	// returns nil once every partition in EndOffsets has been consumed up
+	// to its end offset. The partitions which aren't in EndOffsets are
+	// consumed without bounds until then.
+	//
+	// The partitions must belong to Topics or Partitions, and all of them
+	// must be consumed by the consumer, so bounded consumers should set
+	// Partitions, or be the only member of their consumer group. With
+	// AtMostOnceDeliveryType, the fetched records are committed before
+	// they're processed, so the records fetched after the end offsets may
+	// be committed without being processed.
+	EndOffsets map[TopicPartition]int64
+	// EndTimestamp, if set, bounds the consumption of every partition of
+	// Topics or Partitions to the records before the first record whose
+	// timestamp is at or after EndTimestamp, as for EndOffsets. The end
+	// offsets are resolved when Run is called, so partitions without a
+	// record after EndTimestamp are consumed up to their end at that time.
+	//
+	// Only one of EndOffsets or EndTimestamp can be set.
+	EndTimestamp time.Time
+	// Snapshot, if set, reads a snapshot of the compacted Partitions, e.g.
+	// to warm a cache: every partition is consumed from its earliest offset
+	// up to its end offset at the time Run is called, keeping only the
+	// latest record of each key. Records with a nil value, i.e. tombstones,
+	// remove their key from the snapshot. Once every partition has been
+	// read, the snapshot is delivered, sorted by topic, partition and
+	// offset, and Run returns nil, or the processing error.
+	//
+	// The snapshot is delivered to Processor one record at a time, or to
+	// BatchProcessor in batches of the records of each partition, of up to
+	// BatchMaxSize records. Records without a key are delivered as they
+	// are. Offsets are never committed, so Snapshot can only be set with
+	// Partitions, without an OffsetStore, EndOffsets or EndTimestamp.
+	Snapshot bool
+
+	// RetryConfig configures how processing a record is retried when the
+	// Processor returns an error. By default, records are not retried.
+	RetryConfig RetryConfig
+
+	// DeadLetterTopic, if set, is the topic that records which fail to be
+	// processed, after any retries, are produced to, using the
+	// consumer's connection. Once produced to DeadLetterTopic, the record
+	// is considered processed and its offset may be committed.
+	//
+	// Dead letter records keep the original record's key, value and
+	// headers, with the following headers added describing the failure:
+	//
+	//   - dlq-original-topic
+	//   - dlq-original-partition
+	//   - dlq-original-offset
+	//   - dlq-attempts
+	//   - dlq-error
+	//
+	// If a record can't be produced to DeadLetterTopic, it is not committed
+	// and no further records of its partition are processed, and Run returns
+	// ErrDeadLetterFailed.
+	DeadLetterTopic apmqueue.Topic
+	// PropagateTraceContext extracts the trace context from the headers of
+	// the consumed records, using the configured TextMapPropagator, and
+	// starts a `Process` span for each record as its child. The span's
+	// context is passed to the Processor. When the record has no valid trace
+	// context, the span is started as a new root span. The spans record the
+	// messaging system, the `receive` operation, and the topic and partition
+	// the record was consumed from.
+	PropagateTraceContext bool
+	// LagRefreshInterval defines how often the consumer refreshes the
+	// `consumer.group.lag` gauge for its assigned partitions, by comparing
+	// each partition's fetch position with its high watermark.
+	// Default: 30s
+	LagRefreshInterval time.Duration
+	// StuckPartitionThreshold, if set, detects the assigned partitions whose
+	// processing hasn't progressed for longer than the threshold while they
+	// have fetched records to process, e.g. because of a slow key or a slow
+	// downstream service, which the other partitions keeping up would hide
+	// until the lag grows. A warning is logged once a partition is stuck,
+	// and Healthy returns an error wrapping ErrConsumerUnhealthy while any
+	// partition is stuck.
+	//
+	// The progress of each partition is reported regardless by the
+	// `consumer.partition.processed` and `consumer.partition.last_progress`
+	// metrics.
+	StuckPartitionThreshold time.Duration
 	// Processor that will be used to process each event individually.
 	// It is recommended to keep the synchronous processing fast and below the
 	// rebalance.timeout.ms setting in Kafka.
@@ -107,8 +346,69 @@ type ConsumerConfig struct {
 	// The processing time of each processing cycle can be calculated as:
 	// record.process.time * MaxPollRecords.
 	Processor apmqueue.Processor
+	// TopicProcessors, if set, holds the Processor used to process the records
+	// of each topic, with Processor used as the default for the topics which
+	// have no Processor of their own. When Processor isn't set, every topic in
+	// Topics must have a Processor, and ConsumeRegex can't be used.
+	TopicProcessors map[apmqueue.Topic]apmqueue.Processor
+	// ProcessorMiddleware wraps Processor and each of the TopicProcessors,
+	// with the first middleware being the outermost, so records flow through
+	// the middleware in order before reaching the Processor. Middleware can't
+	// be used with a BatchProcessor.
+	//
+	// See RecoverMiddleware and NewProcessDurationMiddleware.
+	ProcessorMiddleware []ProcessorMiddleware
+	// Transform, if set, is called with the processing context of each
+	// consumed record before it's passed to the Processor or BatchProcessor,
+	// and may modify the record, e.g. to decrypt record values which were
+	// encrypted by ProducerConfig.Transform.
+	//
+	// If Transform returns an error, the record isn't processed or retried,
+	// and is handled as a record which failed to be processed, so it's
+	// produced to the DeadLetterTopic, if set, as it was consumed.
+	Transform func(context.Context, *apmqueue.Record) error
+	// BatchProcessor, if set instead of Processor, is used to process the
+	// fetched records of each partition in batches of up to BatchMaxSize
+	// records. Batches are never held back waiting for more records, so the
+	// maximum time to wait for a batch is bounded by MaxPollWait.
+	//
+	// Failed records are retried as described by RetryConfig, passing only
+	// the failed records to ProcessBatch, and are then handled as individual
+	// failed records, see DeadLetterTopic. With AtLeastOnceDeliveryType, the
+	// offsets of the fetched records are only committed once all of their
+	// batches have been processed.
+	BatchProcessor apmqueue.BatchProcessor
+	// GroupProcessor, if set instead of Processor, is used to process the
+	// fetched records of each partition like BatchProcessor, passing each
+	// run of consecutive records with the same OrderingKey to ProcessGroup.
+	// Only adjacent records are grouped, so when keys are interleaved in a
+	// partition, a key's records are passed in multiple groups, ordered by
+	// offset. Groups don't span batches, see BatchMaxSize.
+	//
+	// Failed records are retried and committed as with BatchProcessor, so
+	// the offsets of a group are only committed once it's fully processed.
+	GroupProcessor GroupProcessor
+	// ValueProcessor, if set instead of Processor, is used to process each
+	// record along with its value deserialized by Deserializer, which must be
+	// set. Records which fail to be deserialized are handled as records which
+	// failed to be processed, so they're retried as described by RetryConfig
+	// and produced to the DeadLetterTopic, if set. ProcessorMiddleware wraps
+	// the deserialization and the ValueProcessor.
+	ValueProcessor ValueProcessor
+	// Deserializer deserializes the values of the records passed to
+	// ValueProcessor, e.g. with a schema registry client.
+	Deserializer Deserializer
+	// BatchMaxSize is the maximum number of records passed to
+	// BatchProcessor.ProcessBatch. If BatchMaxSize <= 0, each partition's
+	// fetched records are processed in a single batch, up to MaxPollRecords.
+	BatchMaxSize int
 	// FetchMinBytes sets the minimum amount of bytes a broker will try to send
-	// during a fetch, overriding the default 1 byte.
+	// during a fetch, overriding the default 1 byte. The broker holds the
+	// fetch until FetchMinBytes have accumulated, or until MaxPollWait has
+	// elapsed, so raising it batches the records of sparse topics into fewer
+	// and larger fetches, reducing the broker load and network round trips,
+	// at the cost of delaying records by up to MaxPollWait when the
+	// partitions are idle.
 	// Default: 1
 	// Kafka consumer setting: fetch.min.bytes
 	// Docs: https://kafka.apache.org/28/documentation.html#consumerconfigs_fetch.min.bytes
@@ -118,10 +418,54 @@ type ConsumerConfig struct {
 	// Kafka, overriding the default 100MiB.
 	BrokerMaxReadBytes int32
 
+	// Rack sets the rack the consumer runs in, such as its availability
+	// zone, so records are fetched from the closest replica in the same
+	// rack, rather than from the partition leader, reducing cross-zone
+	// traffic. Closest replica fetching requires the brokers to have
+	// `broker.rack` and `replica.selector.class` set, e.g. to
+	// `org.apache.kafka.common.replica.RackAwareReplicaSelector`. Brokers
+	// which don't support it keep serving fetches from the leader.
+	//
+	// If Rack is unspecified, but $KAFKA_RACK is specified, it is used.
+	// Kafka consumer setting: client.rack
+	Rack string
+
+	// MaxDecompressedRecordBytes, if set, rejects the consumed records whose
+	// decompressed key, value and headers exceed it, before they reach the
+	// Processor or BatchProcessor. Rejected records are logged and produced
+	// to DeadLetterTopic, if set, and counted by the
+	// `consumer.messages.oversized` metric. The record batches are still
+	// decompressed by the client, so use MaxPollBytes, MaxPollPartitionBytes
+	// and BrokerMaxReadBytes to bound the size of the fetched batches.
+	MaxDecompressedRecordBytes int
+
+	// HeaderAllowList, if set, holds the keys of the record headers which
+	// are copied to the records passed to the Processor or BatchProcessor,
+	// and to the metadata of their context. Other headers are dropped
+	// before they're copied, to save allocations when the records have
+	// headers which aren't needed. Records produced to DeadLetterTopic keep
+	// all their headers. If empty, all the headers are copied.
+	HeaderAllowList []string
+
+	// MaxRecordAge, if set, skips the consumed records whose timestamp is
+	// older than MaxRecordAge, without passing them to the Processor or
+	// BatchProcessor, e.g. to catch up with the latest records after an
+	// incident. Skipped records are considered processed, so their offsets
+	// are committed, and are counted by the `consumer.messages.skipped`
+	// metric.
+	//
+	// The record timestamp is the create time set by the producer, or the
+	// log append time if the topic's `message.timestamp.type` is
+	// `LogAppendTime`, as described by apmqueue.Record.Timestamp.
+	MaxRecordAge time.Duration
+
 	// ConsumePreferringLagFn alters the order in which partitions are consumed.
 	// Use with caution, as this can lead to uneven consumption of partitions,
 	// and in the worst case scenario, in partitions starved out from being consumed.
 	PreferLagFn kgo.PreferLagFn
+
+	// clock, if set, replaces the real clock, so tests can control time.
+	clock clock
 }
 
 // finalize ensures the configuration is valid, setting default values from
@@ -132,15 +476,82 @@ func (cfg *ConsumerConfig) finalize() error {
 	if err := cfg.CommonConfig.finalize(); err != nil {
 		errs = append(errs, err)
 	}
-	if len(cfg.Topics) == 0 {
-		errs = append(errs, errors.New("kafka: at least one topic must be set"))
+	if cfg.clock == nil {
+		cfg.clock = realClock{}
 	}
-	if cfg.GroupID == "" {
-		errs = append(errs, errors.New("kafka: consumer GroupID must be set"))
+	if len(cfg.Partitions) > 0 {
+		if len(cfg.Topics) > 0 {
+			errs = append(errs, errors.New("kafka: only one of topics or partitions can be set"))
+		}
+		if cfg.GroupID != "" {
+			errs = append(errs, errors.New("kafka: only one of consumer GroupID or partitions can be set"))
+		}
+		if cfg.ConsumeRegex || cfg.TopicRegex != nil {
+			errs = append(errs, errors.New("kafka: partitions cannot be consumed by regex"))
+		}
+	} else {
+		if cfg.TopicRegex != nil {
+			if len(cfg.Topics) > 0 {
+				errs = append(errs, errors.New("kafka: only one of topics or topic regex can be set"))
+			}
+			if cfg.ConsumeRegex {
+				errs = append(errs, errors.New("kafka: only one of consume regex or topic regex can be set"))
+			}
+		} else if len(cfg.Topics) == 0 {
+			errs = append(errs, errors.New("kafka: at least one topic must be set"))
+		}
+		if cfg.GroupID == "" {
+			errs = append(errs, errors.New("kafka: consumer GroupID must be set"))
+		}
+		if cfg.OffsetStore != nil {
+			errs = append(errs, errors.New("kafka: offset store can only be set with partitions"))
+		}
 	}
-	if cfg.Processor == nil {
+	if cfg.Processor == nil && cfg.BatchProcessor == nil && len(cfg.TopicProcessors) == 0 &&
+		cfg.ValueProcessor == nil && cfg.GroupProcessor == nil {
 		errs = append(errs, errors.New("kafka: processor must be set"))
 	}
+	if cfg.GroupProcessor != nil {
+		if cfg.Processor != nil || len(cfg.TopicProcessors) > 0 || cfg.BatchProcessor != nil ||
+			cfg.ValueProcessor != nil {
+			errs = append(errs, errors.New("kafka: group processor cannot be set with another processor"))
+		}
+		if len(cfg.ProcessorMiddleware) > 0 {
+			errs = append(errs, errors.New("kafka: processor middleware cannot be used with a group processor"))
+		}
+	}
+	if cfg.ValueProcessor != nil {
+		if cfg.Processor != nil || len(cfg.TopicProcessors) > 0 || cfg.BatchProcessor != nil {
+			errs = append(errs, errors.New("kafka: value processor cannot be set with a processor or batch processor"))
+		}
+		if cfg.Deserializer == nil {
+			errs = append(errs, errors.New("kafka: deserializer must be set with a value processor"))
+		}
+	} else if cfg.Deserializer != nil {
+		errs = append(errs, errors.New("kafka: deserializer can only be set with a value processor"))
+	}
+	if (cfg.Processor != nil || len(cfg.TopicProcessors) > 0) && cfg.BatchProcessor != nil {
+		errs = append(errs, errors.New("kafka: only one of processor or batch processor can be set"))
+	}
+	if len(cfg.ProcessorMiddleware) > 0 && cfg.BatchProcessor != nil {
+		errs = append(errs, errors.New("kafka: processor middleware cannot be used with a batch processor"))
+	}
+	if cfg.Processor == nil && len(cfg.TopicProcessors) > 0 {
+		if cfg.ConsumeRegex || cfg.TopicRegex != nil {
+			errs = append(errs, errors.New("kafka: processor must be set when consuming topics by regex"))
+		} else {
+			for _, topic := range cfg.Topics {
+				if cfg.TopicProcessors[topic] == nil {
+					errs = append(errs, fmt.Errorf("kafka: no processor set for topic %q", topic))
+				}
+			}
+			for topic := range cfg.Partitions {
+				if cfg.TopicProcessors[apmqueue.Topic(topic)] == nil {
+					errs = append(errs, fmt.Errorf("kafka: no processor set for topic %q", topic))
+				}
+			}
+		}
+	}
 	if cfg.MaxPollBytes < 0 {
 		errs = append(errs, errors.New("kafka: max poll bytes cannot be negative"))
 	}
@@ -150,13 +561,287 @@ func (cfg *ConsumerConfig) finalize() error {
 	if cfg.FetchMinBytes < 0 {
 		errs = append(errs, errors.New("kafka: fetch min bytes cannot be negative"))
 	}
+	if cfg.MaxPollWait != 0 && (cfg.MaxPollWait < minPollWait || cfg.MaxPollWait > maxPollWait) {
+		errs = append(errs, fmt.Errorf("kafka: max poll wait must be between %s and %s: %s",
+			minPollWait, maxPollWait, cfg.MaxPollWait,
+		))
+	}
+	if cfg.MaxDecompressedRecordBytes < 0 {
+		errs = append(errs, errors.New("kafka: max decompressed record bytes cannot be negative"))
+	}
+	if cfg.MaxRecordAge < 0 {
+		errs = append(errs, errors.New("kafka: max record age cannot be negative"))
+	}
+	if cfg.Rack == "" {
+		cfg.Rack = os.Getenv("KAFKA_RACK")
+	}
+	if len(cfg.EndOffsets) > 0 || !cfg.EndTimestamp.IsZero() {
+		switch {
+		case len(cfg.EndOffsets) > 0 && !cfg.EndTimestamp.IsZero():
+			errs = append(errs, errors.New("kafka: only one of end offsets or end timestamp can be set"))
+		case cfg.ConsumeRegex || cfg.TopicRegex != nil:
+			errs = append(errs, errors.New("kafka: end offsets and end timestamp cannot be used with topic regexes"))
+		}
+		for tp, offset := range cfg.EndOffsets {
+			if offset < 0 {
+				errs = append(errs, fmt.Errorf("kafka: end offset of topic %q partition %d cannot be negative: %d",
+					tp.Topic, tp.Partition, offset,
+				))
+			}
+			if !slices.Contains(cfg.Topics, tp.Topic) &&
+				!slices.Contains(cfg.Partitions[string(tp.Topic)], tp.Partition) {
+				errs = append(errs, fmt.Errorf("kafka: end offset of topic %q partition %d is not consumed",
+					tp.Topic, tp.Partition,
+				))
+			}
+		}
+	}
+	if cfg.Snapshot {
+		if len(cfg.Partitions) == 0 {
+			errs = append(errs, errors.New("kafka: snapshot can only be used with partitions"))
+		}
+		if cfg.OffsetStore != nil {
+			errs = append(errs, errors.New("kafka: snapshot cannot be used with an offset store"))
+		}
+		if len(cfg.EndOffsets) > 0 || !cfg.EndTimestamp.IsZero() {
+			errs = append(errs, errors.New("kafka: snapshot cannot be used with end offsets or end timestamp"))
+		}
+		if cfg.InitialOffset == LatestOffset {
+			errs = append(errs, errors.New("kafka: snapshot cannot be used with the latest initial offset"))
+		}
+		if cfg.ValueProcessor != nil || cfg.GroupProcessor != nil || len(cfg.TopicProcessors) > 0 {
+			errs = append(errs, errors.New("kafka: snapshot can only be used with a processor or batch processor"))
+		}
+	}
+	if err := cfg.RetryConfig.finalize(); err != nil {
+		errs = append(errs, err)
+	}
+	if cfg.LagRefreshInterval < 0 {
+		errs = append(errs, errors.New("kafka: lag refresh interval cannot be negative"))
+	}
+	if cfg.StuckPartitionThreshold < 0 {
+		errs = append(errs, fmt.Errorf("kafka: stuck partition threshold cannot be negative: %s", cfg.StuckPartitionThreshold))
+	}
+	if cfg.CommitInterval < 0 {
+		errs = append(errs, errors.New("kafka: commit interval cannot be negative"))
+	}
+	if cfg.CommitInterval > 0 {
+		if cfg.Delivery != apmqueue.AtLeastOnceDeliveryType {
+			errs = append(errs, errors.New("kafka: commit interval requires at least once delivery"))
+		}
+		if cfg.DisableAutoCommit {
+			errs = append(errs, errors.New("kafka: commit interval cannot be set with auto commit disabled"))
+		}
+	}
+	if cfg.MaxConcurrency < 0 {
+		errs = append(errs, errors.New("kafka: max concurrency cannot be negative"))
+	}
+	if cfg.InitialOffset > LatestOffset {
+		errs = append(errs, fmt.Errorf("kafka: unknown initial offset %s", cfg.InitialOffset))
+	}
+	if cfg.OnOffsetOutOfRange > OffsetOutOfRangeLatest {
+		errs = append(errs, fmt.Errorf("kafka: unknown offset out of range policy %s", cfg.OnOffsetOutOfRange))
+	}
+	if cfg.IsolationLevel > ReadCommitted {
+		errs = append(errs, fmt.Errorf("kafka: unknown isolation level %s", cfg.IsolationLevel))
+	}
+	return errors.Join(errs...)
+}
+
+// minPollWait and maxPollWait bound ConsumerConfig.MaxPollWait. The client
+// rejects waits shorter than 10ms, and fetches which wait longer than a
+// minute delay the records of idle partitions for too long.
+const (
+	minPollWait = 10 * time.Millisecond
+	maxPollWait = time.Minute
+)
+
+// InitialOffset defines where a consumer starts consuming partitions which
+// don't have a committed offset.
+type InitialOffset uint8
+
+const (
+	// EarliestOffset starts consuming from the earliest available offset.
+	EarliestOffset InitialOffset = iota
+	// LatestOffset starts consuming from the end of the partition, so only
+	// records produced after the consumer started are consumed.
+	LatestOffset
+)
+
+func (o InitialOffset) kgoOffset() kgo.Offset {
+	if o == LatestOffset {
+		return kgo.NewOffset().AtEnd()
+	}
+	return kgo.NewOffset().AtStart()
+}
+
+func (o InitialOffset) String() string {
+	switch o {
+	case EarliestOffset:
+		return "EarliestOffset"
+	case LatestOffset:
+		return "LatestOffset"
+	default:
+		return fmt.Sprintf("InitialOffset(%d)", o)
+	}
+}
+
+// OffsetOutOfRangePolicy defines how a consumer resets the offsets of
+// partitions which are out of range.
+type OffsetOutOfRangePolicy uint8
+
+const (
+	// OffsetOutOfRangeNone doesn't reset the offsets, leaving the client
+	// to recover from the nearest available offset.
+	OffsetOutOfRangeNone OffsetOutOfRangePolicy = iota
+	// OffsetOutOfRangeEarliest resets the offsets to the earliest available
+	// offset.
+	OffsetOutOfRangeEarliest
+	// OffsetOutOfRangeLatest resets the offsets to the end of the partition,
+	// skipping the remaining records.
+	OffsetOutOfRangeLatest
+)
+
+func (p OffsetOutOfRangePolicy) String() string {
+	switch p {
+	case OffsetOutOfRangeNone:
+		return "OffsetOutOfRangeNone"
+	case OffsetOutOfRangeEarliest:
+		return "OffsetOutOfRangeEarliest"
+	case OffsetOutOfRangeLatest:
+		return "OffsetOutOfRangeLatest"
+	default:
+		return fmt.Sprintf("OffsetOutOfRangePolicy(%d)", p)
+	}
+}
+
+// IsolationLevel defines which transactional records a consumer reads.
+type IsolationLevel uint8
+
+const (
+	// ReadUncommitted reads every record, including the records of open
+	// and aborted transactions.
+	ReadUncommitted IsolationLevel = iota
+	// ReadCommitted only reads the records of committed transactions, and
+	// the records produced outside of transactions.
+	ReadCommitted
+)
+
+func (l IsolationLevel) kgoIsolationLevel() kgo.IsolationLevel {
+	if l == ReadCommitted {
+		return kgo.ReadCommitted()
+	}
+	return kgo.ReadUncommitted()
+}
+
+func (l IsolationLevel) String() string {
+	switch l {
+	case ReadUncommitted:
+		return "ReadUncommitted"
+	case ReadCommitted:
+		return "ReadCommitted"
+	default:
+		return fmt.Sprintf("IsolationLevel(%d)", l)
+	}
+}
+
+// RetryConfig defines how processing a record is retried when the Processor
+// returns an error. While a record is being retried, fetching the record's
+// partition is paused.
+type RetryConfig struct {
+	// MaxAttempts is the maximum number of times processing a record is
+	// attempted, including the first attempt. If MaxAttempts <= 1, records
+	// are not retried. Records whose processing returns apmqueue.ErrRetry
+	// are retried regardless of MaxAttempts.
+	MaxAttempts int
+	// InitialBackoff is the time to wait before the first retry. If zero,
+	// defaults to 100ms.
+	InitialBackoff time.Duration
+	// MaxBackoff is the maximum time to wait between retries. If zero,
+	// defaults to 10s.
+	MaxBackoff time.Duration
+	// Multiplier is the factor the backoff is multiplied by after each
+	// retry. If zero, defaults to 2.
+	Multiplier float64
+	// ShouldRetry, if set, is called with the error returned by the
+	// Processor and returns whether the record should be retried. When it
+	// returns false, the error is considered fatal and the record isn't
+	// retried. For a *apmqueue.BatchError returned by the BatchProcessor,
+	// it's called with the error of each failed record, and only the
+	// records which should be retried are retried. If nil, all errors are
+	// retried. ShouldRetry isn't called for apmqueue.ErrRetry, which is
+	// always retried, nor for apmqueue.ErrSkip, which skips the record
+	// without retrying it.
+	ShouldRetry func(error) bool
+}
+
+func (cfg *RetryConfig) finalize() error {
+	var errs []error
+	if cfg.MaxAttempts <= 0 {
+		cfg.MaxAttempts = 1
+	}
+	if cfg.InitialBackoff < 0 {
+		errs = append(errs, errors.New("kafka: retry initial backoff cannot be negative"))
+	} else if cfg.InitialBackoff == 0 {
+		cfg.InitialBackoff = 100 * time.Millisecond
+	}
+	if cfg.MaxBackoff < 0 {
+		errs = append(errs, errors.New("kafka: retry max backoff cannot be negative"))
+	} else if cfg.MaxBackoff == 0 {
+		cfg.MaxBackoff = 10 * time.Second
+	}
+	if cfg.Multiplier == 0 {
+		cfg.Multiplier = 2
+	} else if cfg.Multiplier < 1 {
+		errs = append(errs, errors.New("kafka: retry multiplier cannot be less than 1"))
+	}
 	return errors.Join(errs...)
 }
 
+// backoff returns the time to wait before the given retry, starting at 1.
+func (cfg RetryConfig) backoff(retry int) time.Duration {
+	d := float64(cfg.InitialBackoff) * math.Pow(cfg.Multiplier, float64(retry-1))
+	if d > float64(cfg.MaxBackoff) {
+		return cfg.MaxBackoff
+	}
+	return time.Duration(d)
+}
+
+// retryable returns whether processing can be retried after the given
+// number of attempts failed with err.
+func (cfg RetryConfig) retryable(err error, attempts int) bool {
+	switch {
+	case errors.Is(err, apmqueue.ErrRetry):
+		return true
+	case errors.Is(err, apmqueue.ErrSkip):
+		return false
+	}
+	return attempts < cfg.MaxAttempts && (cfg.ShouldRetry == nil || cfg.ShouldRetry(err))
+}
+
+// OffsetStore stores the offsets of the partitions statically assigned to a
+// consumer with ConsumerConfig.Partitions, which are otherwise not committed
+// since there is no consumer group. Offsets are the offsets of the next
+// records to consume.
+type OffsetStore interface {
+	// Load returns the stored offset of the partition, or a negative
+	// offset if it has none, in which case the partition is consumed from
+	// InitialOffset.
+	Load(ctx context.Context, partition TopicPartition) (int64, error)
+	// Store stores the offset of the partition.
+	Store(ctx context.Context, partition TopicPartition, offset int64) error
+}
+
 var _ apmqueue.Consumer = &Consumer{}
 
 // Consumer wraps a Kafka consumer and the consumption implementation details.
 // Consumes each partition in a dedicated goroutine.
+//
+// The records of each assigned partition are processed sequentially, in
+// offset order, while different partitions are processed concurrently, up to
+// MaxConcurrency. The offsets of each partition are committed independently,
+// as its records are processed, and when a partition is revoked, its records
+// which are being processed finish before the partition is released.
 type Consumer struct {
 	mu       sync.RWMutex
 	client   *kgo.Client
@@ -168,7 +853,8 @@ type Consumer struct {
 	forceClose context.CancelCauseFunc
 	stopPoll   context.CancelFunc
 
-	tracer trace.Tracer
+	tracer          trace.Tracer
+	lagRegistration metric.Registration
 }
 
 // NewConsumer creates a new instance of a Consumer. The consumer will read from
@@ -181,39 +867,129 @@ func NewConsumer(cfg ConsumerConfig) (*Consumer, error) {
 	// `cfg.ShutdownGracePeriod` is exceeded.
 	processingCtx, forceClose := context.WithCancelCause(context.Background())
 	namespacePrefix := cfg.namespacePrefix()
+	processor := cfg.Processor
+	if cfg.ValueProcessor != nil {
+		processor = deserializingProcessor{
+			deserializer: cfg.Deserializer,
+			processor:    cfg.ValueProcessor,
+		}
+	}
+	batch := cfg.BatchProcessor
+	if cfg.GroupProcessor != nil {
+		batch = groupingProcessor{processor: cfg.GroupProcessor}
+	}
 	consumer := &consumer{
-		topicPrefix: namespacePrefix,
-		logFieldFn:  cfg.TopicLogFieldFunc,
-		assignments: make(map[topicPartition]*pc),
-		processor:   cfg.Processor,
-		logger:      cfg.Logger.Named("partition"),
-		delivery:    cfg.Delivery,
-		ctx:         processingCtx,
-	}
-	topics := make([]string, len(cfg.Topics))
-	for i, topic := range cfg.Topics {
-		topics[i] = fmt.Sprintf("%s%s", consumer.topicPrefix, topic)
+		topicPrefix:           namespacePrefix,
+		logFieldFn:            cfg.TopicLogFieldFunc,
+		assignments:           make(map[topicPartition]*pc),
+		committed:             make(map[TopicPartition]int64),
+		commitTimes:           make(map[TopicPartition]time.Time),
+		pauses:                make(map[topicPartition]int),
+		userPaused:            make(map[topicPartition]struct{}),
+		processor:             wrapProcessor(processor, cfg.ProcessorMiddleware),
+		topicProcessors:       wrapTopicProcessors(cfg.TopicProcessors, cfg.ProcessorMiddleware),
+		batch:                 batch,
+		transform:             cfg.Transform,
+		batchMaxSize:          cfg.BatchMaxSize,
+		logger:                cfg.Logger.Named("partition"),
+		groupLogger:           cfg.Logger.With(zap.String("group", cfg.GroupID)),
+		delivery:              cfg.Delivery,
+		manualCommit:          cfg.DisableAutoCommit || cfg.CommitInterval > 0,
+		commitOnRevoke:        cfg.CommitInterval > 0,
+		onAssigned:            cfg.OnAssigned,
+		onRevoked:             cfg.OnRevoked,
+		groupID:               cfg.GroupID,
+		ctx:                   processingCtx,
+		retry:                 cfg.RetryConfig,
+		errc:                  make(chan error, 1),
+		tracer:                cfg.tracerProvider().Tracer("kafka"),
+		offsetStore:           cfg.OffsetStore,
+		initialOffset:         cfg.InitialOffset,
+		maxRecordBytes:        cfg.MaxDecompressedRecordBytes,
+		maxRecordAge:          cfg.MaxRecordAge,
+		metricAttributeFilter: cfg.MetricAttributeFilter,
+		clock:                 cfg.clock,
+		stuckThreshold:        cfg.StuckPartitionThreshold,
+	}
+	if len(cfg.HeaderAllowList) > 0 {
+		consumer.headerAllowList = make(map[string]struct{}, len(cfg.HeaderAllowList))
+		for _, key := range cfg.HeaderAllowList {
+			consumer.headerAllowList[key] = struct{}{}
+		}
+	}
+	if cfg.PropagateTraceContext {
+		consumer.propagator = cfg.textMapPropagator()
+	}
+	if len(cfg.EndOffsets) > 0 || !cfg.EndTimestamp.IsZero() || cfg.Snapshot {
+		consumer.bounds = newEndBounds()
+	}
+	if cfg.Snapshot {
+		consumer.snapshot = newSnapshot()
+	}
+	if cfg.MaxConcurrency > 0 {
+		consumer.limiter = make(chan struct{}, cfg.MaxConcurrency)
+	}
+	if cfg.DeadLetterTopic != "" {
+		consumer.deadLetterTopic = fmt.Sprintf("%s%s", namespacePrefix, cfg.DeadLetterTopic)
+	}
+	resetOffset := cfg.InitialOffset.kgoOffset()
+	if cfg.OnOffsetOutOfRange != OffsetOutOfRangeNone {
+		// Return kerr.OffsetOutOfRange from the fetches instead of resetting
+		// the offsets in the client, so they're reset by the consumer.
+		resetOffset = kgo.NoResetOffset().AtStart()
+		if cfg.InitialOffset == LatestOffset {
+			resetOffset = resetOffset.AtEnd()
+		}
 	}
 	opts := []kgo.Opt{
 		// Injects the kgo.Client context as the record.Context.
 		kgo.WithHooks(consumer),
-		kgo.ConsumerGroup(cfg.GroupID),
-		kgo.ConsumeTopics(topics...),
-		// If a rebalance happens while the client is polling, the consumed
-		// records may belong to a partition which has been reassigned to a
-		// different consumer int he group. To avoid this scenario, Polls will
-		// block rebalances of partitions which would be lost, and the consumer
-		// MUST manually call `AllowRebalance`.
-		kgo.BlockRebalanceOnPoll(),
-		kgo.DisableAutoCommit(),
-		// Assign concurrent consumer callbacks to ensure consuming starts
-		// for newly assigned partitions, and consuming ceases from lost or
-		// revoked partitions.
-		kgo.OnPartitionsAssigned(consumer.assigned),
-		kgo.OnPartitionsLost(consumer.lost),
-		kgo.OnPartitionsRevoked(consumer.lost),
-	}
-	if cfg.ConsumeRegex {
+		kgo.ConsumeResetOffset(resetOffset),
+	}
+	// partitions holds the namespaced statically assigned partitions.
+	var partitions map[string][]int32
+	if len(cfg.Partitions) > 0 {
+		partitions = make(map[string][]int32, len(cfg.Partitions))
+		for topic, p := range cfg.Partitions {
+			partitions[namespacePrefix+topic] = p
+		}
+		offsets, err := consumer.startOffsets(processingCtx, partitions)
+		if err != nil {
+			forceClose(err)
+			return nil, fmt.Errorf("kafka: failed to load stored offsets: %w", err)
+		}
+		opts = append(opts, kgo.ConsumePartitions(offsets))
+	} else {
+		topics := make([]string, len(cfg.Topics))
+		for i, topic := range cfg.Topics {
+			topics[i] = fmt.Sprintf("%s%s", consumer.topicPrefix, topic)
+		}
+		if cfg.TopicRegex != nil {
+			expr := cfg.TopicRegex.String()
+			if consumer.topicPrefix != "" {
+				expr = fmt.Sprintf("^%s(?:%s)", regexp.QuoteMeta(consumer.topicPrefix), expr)
+			}
+			topics = []string{expr}
+		}
+		opts = append(opts,
+			kgo.ConsumerGroup(cfg.GroupID),
+			kgo.ConsumeTopics(topics...),
+			// If a rebalance happens while the client is polling, the consumed
+			// records may belong to a partition which has been reassigned to a
+			// different consumer int he group. To avoid this scenario, Polls will
+			// block rebalances of partitions which would be lost, and the consumer
+			// MUST manually call `AllowRebalance`.
+			kgo.BlockRebalanceOnPoll(),
+			kgo.DisableAutoCommit(),
+			// Assign concurrent consumer callbacks to ensure consuming starts
+			// for newly assigned partitions, and consuming ceases from lost or
+			// revoked partitions.
+			kgo.OnPartitionsAssigned(consumer.assigned),
+			kgo.OnPartitionsLost(consumer.lost),
+			kgo.OnPartitionsRevoked(consumer.revoked),
+		)
+	}
+	if cfg.ConsumeRegex || cfg.TopicRegex != nil {
 		opts = append(opts, kgo.ConsumeRegex())
 	}
 	if cfg.MaxPollWait > 0 {
@@ -237,72 +1013,227 @@ func NewConsumer(cfg ConsumerConfig) (*Consumer, error) {
 	if cfg.FetchMinBytes > 0 {
 		opts = append(opts, kgo.FetchMinBytes(cfg.FetchMinBytes))
 	}
+	if cfg.IsolationLevel != ReadUncommitted {
+		opts = append(opts, kgo.FetchIsolationLevel(cfg.IsolationLevel.kgoIsolationLevel()))
+	}
+	if consumer.bounds != nil {
+		// The control records tell bounded consumers how far they've been
+		// fetched when the last offsets before the end are markers.
+		opts = append(opts, kgo.KeepControlRecords())
+	}
 	if cfg.BrokerMaxReadBytes > 0 {
 		opts = append(opts, kgo.BrokerMaxReadBytes(cfg.BrokerMaxReadBytes))
 	}
+	if cfg.Rack != "" {
+		opts = append(opts, kgo.Rack(cfg.Rack))
+	}
 
 	client, err := cfg.newClient(cfg.TopicAttributeFunc, opts...)
 	if err != nil {
+		forceClose(err)
 		return nil, fmt.Errorf("kafka: failed creating kafka consumer: %w", err)
 	}
+	if partitions != nil {
+		// Without a consumer group, the partitions are assigned right away.
+		consumer.assigned(processingCtx, client, partitions)
+	}
 	if cfg.MaxPollRecords <= 0 {
 		cfg.MaxPollRecords = 500
 	}
+	if cfg.LagRefreshInterval == 0 {
+		cfg.LagRefreshInterval = 30 * time.Second
+	}
+	meter := cfg.meterProvider().Meter(instrumentName)
+	lagMetric, err := meter.Int64ObservableGauge("consumer.group.lag",
+		metric.WithUnit(unitCount),
+		metric.WithDescription("Number of records between the fetch position and the high watermark, by topic and partition"),
+	)
+	if err != nil {
+		client.Close()
+		forceClose(err)
+		return nil, fmt.Errorf("kafka: failed to create consumer.group.lag metric: %w", err)
+	}
+	consumer.oversized, err = meter.Int64Counter("consumer.messages.oversized",
+		metric.WithUnit(unitCount),
+		metric.WithDescription("Number of records rejected for exceeding MaxDecompressedRecordBytes"),
+	)
+	if err != nil {
+		client.Close()
+		forceClose(err)
+		return nil, fmt.Errorf("kafka: failed to create consumer.messages.oversized metric: %w", err)
+	}
+	consumer.skipped, err = meter.Int64Counter("consumer.messages.skipped",
+		metric.WithUnit(unitCount),
+		metric.WithDescription("Number of records skipped for exceeding MaxRecordAge"),
+	)
+	if err != nil {
+		client.Close()
+		forceClose(err)
+		return nil, fmt.Errorf("kafka: failed to create consumer.messages.skipped metric: %w", err)
+	}
+	consumer.offsetResets, err = meter.Int64Counter("consumer.offset.resets",
+		metric.WithUnit(unitCount),
+		metric.WithDescription("Number of out of range partition offsets reset by OnOffsetOutOfRange"),
+	)
+	if err != nil {
+		client.Close()
+		forceClose(err)
+		return nil, fmt.Errorf("kafka: failed to create consumer.offset.resets metric: %w", err)
+	}
+	consumer.e2eLatency, err = meter.Float64Histogram("consumer.record.e2e_latency",
+		metric.WithUnit("s"),
+		metric.WithDescription("Time between the record timestamp and the processor finishing the record"),
+	)
+	if err != nil {
+		client.Close()
+		forceClose(err)
+		return nil, fmt.Errorf("kafka: failed to create consumer.record.e2e_latency metric: %w", err)
+	}
+	consumer.clockSkews, err = meter.Int64Counter("consumer.record.clock_skew",
+		metric.WithUnit(unitCount),
+		metric.WithDescription("Number of processed records timestamped in the future, whose end-to-end latency is recorded as zero"),
+	)
+	if err != nil {
+		client.Close()
+		forceClose(err)
+		return nil, fmt.Errorf("kafka: failed to create consumer.record.clock_skew metric: %w", err)
+	}
+	commitTimeMetric, err := meter.Float64ObservableGauge("consumer.commit.last_success",
+		metric.WithUnit("s"),
+		metric.WithDescription("Unix time of the last successful offset commit, by topic and partition"),
+	)
+	if err != nil {
+		client.Close()
+		forceClose(err)
+		return nil, fmt.Errorf("kafka: failed to create consumer.commit.last_success metric: %w", err)
+	}
+	processedMetric, err := meter.Int64ObservableCounter("consumer.partition.processed",
+		metric.WithUnit(unitCount),
+		metric.WithDescription("Number of records which finished processing, by topic and partition"),
+	)
+	if err != nil {
+		client.Close()
+		forceClose(err)
+		return nil, fmt.Errorf("kafka: failed to create consumer.partition.processed metric: %w", err)
+	}
+	progressMetric, err := meter.Float64ObservableGauge("consumer.partition.last_progress",
+		metric.WithUnit("s"),
+		metric.WithDescription("Unix time the processing of the partition last progressed, by topic and partition"),
+	)
+	if err != nil {
+		client.Close()
+		forceClose(err)
+		return nil, fmt.Errorf("kafka: failed to create consumer.partition.last_progress metric: %w", err)
+	}
+	lagRegistration, err := meter.RegisterCallback(func(_ context.Context, o metric.Observer) error {
+		consumer.observeLag(o, lagMetric)
+		consumer.observeCommitTimes(o, commitTimeMetric)
+		consumer.observeProgress(o, processedMetric, progressMetric)
+		return nil
+	}, lagMetric, commitTimeMetric, processedMetric, progressMetric)
+	if err != nil {
+		client.Close()
+		forceClose(err)
+		return nil, fmt.Errorf("kafka: failed to register consumer metrics callback: %w", err)
+	}
 	return &Consumer{
-		cfg:        cfg,
-		client:     client,
-		consumer:   consumer,
-		closed:     make(chan struct{}),
-		running:    make(chan struct{}),
-		forceClose: forceClose,
-		stopPoll:   func() {},
-		tracer:     cfg.tracerProvider().Tracer("kafka"),
+		cfg:             cfg,
+		client:          client,
+		consumer:        consumer,
+		closed:          make(chan struct{}),
+		running:         make(chan struct{}),
+		forceClose:      forceClose,
+		stopPoll:        func() {},
+		tracer:          cfg.tracerProvider().Tracer("kafka"),
+		lagRegistration: lagRegistration,
 	}, nil
 }
 
 // Close the consumer, blocking until all partition consumers are stopped.
 func (c *Consumer) Close() error {
+	ctx, cancel := context.WithTimeout(context.Background(), c.cfg.ShutdownGracePeriod)
+	defer cancel()
+	c.shutdown(ctx, func() error {
+		return fmt.Errorf(
+			"consumer: close: timeout waiting for consumers to stop (%s)",
+			c.cfg.ShutdownGracePeriod.String(),
+		)
+	})
+	return nil
+}
+
+// Shutdown gracefully closes the consumer: it stops fetching records, waits
+// for the records which have already been fetched to be processed and their
+// offsets committed, and then closes the client. Unlike Close, Shutdown is
+// bounded by the context instead of ShutdownGracePeriod.
+//
+// If the context is done before all the fetched records have been
+// processed, the processing context is canceled and an error wrapping
+// ErrShutdownTimeout is returned, with the number of abandoned records.
+func (c *Consumer) Shutdown(ctx context.Context) error {
+	return c.shutdown(ctx, func() error {
+		return fmt.Errorf("%w: %d records abandoned: %w",
+			ErrShutdownTimeout, c.consumer.pending.Load(), context.Cause(ctx),
+		)
+	})
+}
+
+// shutdown closes the consumer, canceling the processing context with the
+// error returned by timeoutErr if the partition consumers haven't stopped
+// by the time ctx is done.
+func (c *Consumer) shutdown(ctx context.Context, timeoutErr func() error) error {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 	select {
 	case <-c.closed:
+		return nil
 	default:
-		close(c.closed)
-		defer c.client.CloseAllowingRebalance() // Last, close the `kgo.Client`
-		// Cancel the context used in client.PollRecords, triggering graceful
-		// cancellation.
-		c.stopPoll()
-		stopped := make(chan struct{})
-		go func() {
-			defer close(stopped)
-			// Close all partition consumers first to ensure there aren't any
-			// records being processed while the kgo.Client is being closed.
-			// Also ensures that commits can be issued after the records are
-			// processed when AtLeastOnceDelivery is configured.
-			c.consumer.close()
-		}()
-		// Wait for the consumers to process any in-flight records, or cancel
-		// the underlying processing context if they aren't stopped in time.
-		select {
-		case <-time.After(c.cfg.ShutdownGracePeriod): // Timeout
-			c.forceClose(fmt.Errorf(
-				"consumer: close: timeout waiting for consumers to stop (%s)",
-				c.cfg.ShutdownGracePeriod.String(),
-			))
-		case <-stopped: // Stopped within c.cfg.ShutdownGracePeriod.
-		}
+	}
+	close(c.closed)
+	defer c.client.CloseAllowingRebalance() // Last, close the `kgo.Client`
+	if err := c.lagRegistration.Unregister(); err != nil {
+		c.cfg.Logger.Warn("failed to unregister consumer lag metric", zap.Error(err))
+	}
+	// Cancel the context used in client.PollRecords, triggering graceful
+	// cancellation.
+	c.stopPoll()
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		// Close all partition consumers first to ensure there aren't any
+		// records being processed while the kgo.Client is being closed.
+		// Also ensures that commits can be issued after the records are
+		// processed when AtLeastOnceDelivery is configured.
+		c.consumer.close(c.client)
+	}()
+	// Wait for the consumers to process any in-flight records, or cancel
+	// the underlying processing context if they aren't stopped in time.
+	select {
+	case <-ctx.Done():
+		err := timeoutErr()
+		c.forceClose(err)
+		return err
+	case <-stopped: // Stopped in time.
 	}
 	return nil
 }
 
-// Run the consumer until a non recoverable error is found:
+// Run the consumer, blocking while records are fetched and processed, until
+// the context is canceled, the consumer is closed, or a non recoverable error
+// is found:
 //   - ErrCommitFailed.
+//   - ErrDeadLetterFailed.
+//
+// When the context is canceled, Run stops fetching records and waits up to
+// ShutdownGracePeriod for the fetched records to be processed, returning nil
+// once they are, or ErrShutdownTimeout otherwise. Run also returns nil when
+// the consumer is closed, which waits for the records instead.
 //
 // To shut down the consumer, call consumer.Close() or cancel the context.
 // Calling `consumer.Close` is advisable to ensure graceful shutdown and
 // avoid any records from being lost (AMOD), or processed twice (ALOD).
-// To ensure that all polled records are processed. Close() must be called,
-// even when the context is canceled.
+// Close() must be called to release the consumer's resources, even when the
+// context is canceled.
 //
 // If called more than once, returns `apmqueue.ErrConsumerAlreadyRunning`.
 func (c *Consumer) Run(ctx context.Context) error {
@@ -319,10 +1250,50 @@ func (c *Consumer) Run(ctx context.Context) error {
 	// cancel this context as part of the graceful shutdown sequence.
 	var clientCtx context.Context
 	clientCtx, c.stopPoll = context.WithCancel(ctx)
+	stopPoll := c.stopPoll
 	c.mu.Unlock()
+	if c.consumer.bounds != nil {
+		if err := c.resolveEndOffsets(clientCtx); err != nil {
+			stopPoll()
+			return fmt.Errorf("cannot resolve end offsets: %w", err)
+		}
+	}
+	// Stop polling when a partition consumer reports a fatal error, which
+	// is then returned instead of the context cancellation, or once the
+	// bounded partitions have been consumed up to their end offsets.
+	fatal := make(chan error, 1)
+	go func() {
+		select {
+		case err := <-c.consumer.errc:
+			fatal <- err
+			stopPoll()
+		case <-c.consumer.bounds.doneC():
+			stopPoll()
+		case <-clientCtx.Done():
+		}
+	}()
+	go c.refreshLag(clientCtx)
+	if c.cfg.CommitInterval > 0 {
+		go c.commitPeriodically(clientCtx)
+	}
+	if c.cfg.StuckPartitionThreshold > 0 {
+		go c.detectStuckPartitions(clientCtx)
+	}
 	for {
 		if err := c.fetch(clientCtx); err != nil {
 			if errors.Is(err, context.Canceled) {
+				select {
+				case err := <-fatal:
+					return err
+				default:
+				}
+				if ctx.Err() != nil || c.consumer.bounds.isDone() {
+					err := c.drain()
+					if err != nil || ctx.Err() != nil || c.consumer.snapshot == nil {
+						return err
+					}
+					return c.consumer.deliverSnapshot(ctx)
+				}
 				return nil // Return no error if err == context.Canceled.
 			}
 			return fmt.Errorf("cannot fetch records: %w", err)
@@ -330,6 +1301,86 @@ func (c *Consumer) Run(ctx context.Context) error {
 	}
 }
 
+// drain waits up to ShutdownGracePeriod for the partition consumers to process
+// the fetched records, once Run has stopped fetching.
+func (c *Consumer) drain() error {
+	c.consumer.mu.RLock()
+	pcs := make([]*pc, 0, len(c.consumer.assignments))
+	for _, pc := range c.consumer.assignments {
+		pcs = append(pcs, pc)
+	}
+	c.consumer.mu.RUnlock()
+	drained := make(chan struct{})
+	go func() {
+		defer close(drained)
+		for _, pc := range pcs {
+			pc.g.Wait()
+		}
+	}()
+	timer := c.cfg.clock.NewTimer(c.cfg.ShutdownGracePeriod)
+	defer timer.Stop()
+	select {
+	case <-drained:
+		return nil
+	case <-timer.C():
+		return fmt.Errorf("%w: %d records still being processed after %s",
+			ErrShutdownTimeout, c.consumer.pending.Load(), c.cfg.ShutdownGracePeriod,
+		)
+	}
+}
+
+// refreshLag periodically updates the lag of the assigned partitions, until
+// the context is canceled.
+func (c *Consumer) refreshLag(ctx context.Context) {
+	adminClient := kadm.NewClient(c.client)
+	ticker := c.cfg.clock.NewTicker(c.cfg.LagRefreshInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C():
+		}
+		if err := c.consumer.refreshLag(ctx, adminClient); err != nil &&
+			!errors.Is(err, context.Canceled) {
+			c.cfg.Logger.Warn("failed to refresh consumer lag", zap.Error(err))
+		}
+	}
+}
+
+// commitPeriodically commits the offsets of the processed records every
+// CommitInterval, until the context is canceled.
+func (c *Consumer) commitPeriodically(ctx context.Context) {
+	ticker := c.cfg.clock.NewTicker(c.cfg.CommitInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C():
+		}
+		if err := c.consumer.commit(ctx, c.client); err != nil &&
+			!errors.Is(err, context.Canceled) {
+			c.cfg.Logger.Error("failed to commit processed offsets", zap.Error(err))
+		}
+	}
+}
+
+// detectStuckPartitions periodically logs a warning for the partitions which
+// became stuck, until the context is canceled.
+func (c *Consumer) detectStuckPartitions(ctx context.Context) {
+	ticker := c.cfg.clock.NewTicker(c.cfg.StuckPartitionThreshold / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C():
+		}
+		c.consumer.warnStuck()
+	}
+}
+
 // fetch polls the Kafka broker for new records up to cfg.MaxPollRecords.
 // Any errors returned by fetch should be considered fatal.
 func (c *Consumer) fetch(ctx context.Context) error {
@@ -343,22 +1394,25 @@ func (c *Consumer) fetch(ctx context.Context) error {
 	}
 	c.mu.RLock()
 	defer c.mu.RUnlock()
-	switch c.cfg.Delivery {
-	case apmqueue.AtLeastOnceDeliveryType:
+	switch {
+	case c.cfg.DisableAutoCommit:
+		// Offsets are committed by Consumer.Commit.
+	case c.cfg.Delivery == apmqueue.AtLeastOnceDeliveryType:
 		// Committing the processed records happens on each partition consumer.
-	case apmqueue.AtMostOnceDeliveryType:
+	case c.cfg.Delivery == apmqueue.AtMostOnceDeliveryType:
 		// Commit the fetched record offsets as soon as we've polled them.
-		if err := c.client.CommitUncommittedOffsets(ctx); err != nil {
+		if err := c.commitFetched(ctx, fetches); err != nil {
 			// NOTE(marclop): If the commit fails with an unrecoverable error,
 			// return it and terminate the consumer. This will avoid potentially
 			// processing records twice, and it's up to the consumer to re-start
 			// the consumer.
-			return ErrCommitFailed
+			return fmt.Errorf("%w: %w", ErrCommitFailed, classifyError(err))
 		}
 		// Allow re-balancing now that we have committed offsets, preventing
 		// another consumer from reprocessing the records.
 		c.client.AllowRebalance()
 	}
+	c.consumer.fetched(fetches.Err())
 	fetches.EachError(func(t string, p int32, err error) {
 		topicName := strings.TrimPrefix(t, c.consumer.topicPrefix)
 		logger := c.cfg.Logger
@@ -372,33 +1426,483 @@ func (c *Consumer) fetch(ctx context.Context) error {
 			zap.String("topic", topicName),
 			zap.Int32("partition", p),
 		)
+		if c.cfg.OnFetchError != nil {
+			c.cfg.OnFetchError(ctx, &FetchError{
+				Topic:     apmqueue.Topic(topicName),
+				Partition: p,
+				Err:       classifyError(err),
+			})
+		}
+		if errors.Is(err, kerr.OffsetOutOfRange) && c.cfg.OnOffsetOutOfRange != OffsetOutOfRangeNone {
+			c.resetOffset(ctx, t, p, logger)
+		}
 	})
 	c.consumer.processFetch(fetches)
 	return nil
 }
 
-// Healthy returns an error if the Kafka client fails to reach a discovered
-// broker.
-func (c *Consumer) Healthy(ctx context.Context) error {
-	if err := c.client.Ping(ctx); err != nil {
-		return fmt.Errorf("health probe: %w", err)
+// commitFetched commits the offsets of the fetched records.
+func (c *Consumer) commitFetched(ctx context.Context, fetches kgo.Fetches) error {
+	if c.consumer.offsetStore == nil && c.consumer.groupID == "" {
+		// Offsets are not committed without a consumer group or store.
+		return nil
 	}
-	return nil
-}
-
-// consumer wraps partitionConsumers and exposes the necessary callbacks
-// to use when partitions are reassigned.
-type consumer struct {
-	mu          sync.RWMutex
-	topicPrefix string
-	assignments map[topicPartition]*pc
+	if c.consumer.offsetStore == nil {
+		uncommitted := c.client.UncommittedOffsets()
+		if err := c.client.CommitUncommittedOffsets(ctx); err != nil {
+			return err
+		}
+		offsets := make(map[TopicPartition]int64)
+		for topic, partitions := range uncommitted {
+			for partition, offset := range partitions {
+				offsets[TopicPartition{
+					Topic:     apmqueue.Topic(strings.TrimPrefix(topic, c.consumer.topicPrefix)),
+					Partition: partition,
+				}] = offset.Offset
+			}
+		}
+		c.consumer.setCommitted(offsets)
+		return nil
+	}
+	var records []*kgo.Record
+	fetches.EachPartition(func(ftp kgo.FetchTopicPartition) {
+		if len(ftp.Records) > 0 {
+			records = append(records, ftp.Records[len(ftp.Records)-1])
+		}
+	})
+	return c.consumer.commitRecords(ctx, c.client, records...)
+}
+
+// Commit commits the offsets of the records that have been delivered to the
+// Processor, for the partitions currently assigned to the consumer.
+//
+// Returns ErrAutoCommitEnabled unless ConsumerConfig.DisableAutoCommit is set.
+func (c *Consumer) Commit(ctx context.Context) error {
+	if !c.cfg.DisableAutoCommit {
+		return ErrAutoCommitEnabled
+	}
+	return c.consumer.commit(ctx, c.client)
+}
+
+// CommittedOffsets returns the offsets last committed by the consumer for
+// the partitions currently assigned to it, i.e. the offsets of the next
+// records to consume. Partitions which haven't been committed since they
+// were assigned are omitted, so an empty map is returned before the first
+// commit.
+//
+// CommittedOffsets is safe to call concurrently with Run.
+func (c *Consumer) CommittedOffsets() map[TopicPartition]int64 {
+	c.consumer.committedMu.Lock()
+	defer c.consumer.committedMu.Unlock()
+	return maps.Clone(c.consumer.committed)
+}
+
+// Seek sets the offsets of the next records to fetch for the given
+// partitions, which must be assigned to the consumer. Records which have
+// already been fetched continue to be processed.
+//
+// Seek is safe to call while the consumer is running. If any partition is
+// not assigned to the consumer, ErrPartitionNotAssigned is returned and no
+// offsets are set.
+func (c *Consumer) Seek(ctx context.Context, offsets map[TopicPartition]int64) error {
+	c.consumer.mu.RLock()
+	defer c.consumer.mu.RUnlock()
+	var errs []error
+	setOffsets := make(map[string]map[int32]kgo.EpochOffset)
+	for tp, offset := range offsets {
+		topic := c.consumer.topicPrefix + string(tp.Topic)
+		if _, ok := c.consumer.assignments[topicPartition{topic: topic, partition: tp.Partition}]; !ok {
+			errs = append(errs, fmt.Errorf(
+				"cannot seek topic %q partition %d: %w",
+				tp.Topic, tp.Partition, ErrPartitionNotAssigned,
+			))
+			continue
+		}
+		if offset < 0 {
+			errs = append(errs, fmt.Errorf(
+				"cannot seek topic %q partition %d: kafka: invalid offset %d",
+				tp.Topic, tp.Partition, offset,
+			))
+			continue
+		}
+		if setOffsets[topic] == nil {
+			setOffsets[topic] = make(map[int32]kgo.EpochOffset)
+		}
+		setOffsets[topic][tp.Partition] = kgo.EpochOffset{Epoch: -1, Offset: offset}
+	}
+	if err := errors.Join(errs...); err != nil {
+		return err
+	}
+	c.client.SetOffsets(setOffsets)
+	return nil
+}
+
+// SeekToTimestamp sets the offsets of the next records to fetch for all the
+// partitions assigned to the consumer to the offsets of the first records
+// with a timestamp at or after ts. Partitions without any such records are
+// set to their end offsets.
+//
+// SeekToTimestamp is safe to call while the consumer is running. Partitions
+// which are revoked while the offsets are being resolved are not sought.
+func (c *Consumer) SeekToTimestamp(ctx context.Context, ts time.Time) error {
+	c.consumer.mu.RLock()
+	topicSet := make(map[string]struct{})
+	for tp := range c.consumer.assignments {
+		topicSet[tp.topic] = struct{}{}
+	}
+	c.consumer.mu.RUnlock()
+	if len(topicSet) == 0 {
+		return nil
+	}
+	topics := make([]string, 0, len(topicSet))
+	for topic := range topicSet {
+		topics = append(topics, topic)
+	}
+
+	listed, err := kadm.NewClient(c.client).ListOffsetsAfterMilli(ctx, ts.UnixMilli(), topics...)
+	if err == nil {
+		err = listed.Error()
+	}
+	if err != nil {
+		return fmt.Errorf("failed to list offsets after %s: %w", ts, classifyError(err))
+	}
+	c.consumer.mu.RLock()
+	offsets := make(map[TopicPartition]int64)
+	listed.Each(func(o kadm.ListedOffset) {
+		// Only seek partitions which are still assigned.
+		if _, ok := c.consumer.assignments[topicPartition{topic: o.Topic, partition: o.Partition}]; ok {
+			offsets[TopicPartition{
+				Topic:     apmqueue.Topic(strings.TrimPrefix(o.Topic, c.consumer.topicPrefix)),
+				Partition: o.Partition,
+			}] = o.Offset
+		}
+	})
+	c.consumer.mu.RUnlock()
+	return c.Seek(ctx, offsets)
+}
+
+// resetOffset seeks the out of range partition to the offset defined by
+// OnOffsetOutOfRange.
+func (c *Consumer) resetOffset(ctx context.Context, topic string, partition int32, logger *zap.Logger) {
+	topicName := strings.TrimPrefix(topic, c.consumer.topicPrefix)
+	logger = logger.With(
+		zap.String("topic", topicName),
+		zap.Int32("partition", partition),
+	)
+	adminClient := kadm.NewClient(c.client)
+	var listed kadm.ListedOffsets
+	var err error
+	if c.cfg.OnOffsetOutOfRange == OffsetOutOfRangeLatest {
+		listed, err = adminClient.ListEndOffsets(ctx, topic)
+	} else {
+		listed, err = adminClient.ListStartOffsets(ctx, topic)
+	}
+	if err == nil {
+		err = listed.Error()
+	}
+	if err != nil {
+		logger.Error("failed to list offsets to reset out of range offset",
+			zap.Error(classifyError(err)),
+		)
+		return
+	}
+	offset, ok := listed.Lookup(topic, partition)
+	if !ok {
+		logger.Error("failed to list offsets to reset out of range offset")
+		return
+	}
+	previous := c.fetchOffset(topic, partition)
+	tp := TopicPartition{Topic: apmqueue.Topic(topicName), Partition: partition}
+	if err := c.Seek(ctx, map[TopicPartition]int64{tp: offset.Offset}); err != nil {
+		logger.Error("failed to reset out of range offset", zap.Error(err))
+		return
+	}
+	logger.Warn("reset out of range offset",
+		zap.Int64("previous_offset", previous),
+		zap.Int64("offset", offset.Offset),
+		zap.Stringer("policy", c.cfg.OnOffsetOutOfRange),
+	)
+	attrs := c.consumer.metricAttributes(topicName)
+	c.consumer.offsetResets.Add(ctx, 1, metric.WithAttributes(attrs...))
+}
+
+// fetchOffset returns the offset the partition was fetched from: the offset
+// following the last fetched record, or the committed offset if no records
+// have been fetched yet. -1 is returned if the offset is unknown.
+func (c *Consumer) fetchOffset(topic string, partition int32) int64 {
+	c.consumer.mu.RLock()
+	pc, ok := c.consumer.assignments[topicPartition{topic: topic, partition: partition}]
+	c.consumer.mu.RUnlock()
+	if ok {
+		if position := pc.position.Load(); position > 0 {
+			return position
+		}
+	}
+	if offset, ok := c.client.CommittedOffsets()[topic][partition]; ok {
+		return offset.Offset
+	}
+	return -1
+}
+
+// PausePartitions stops fetching records from the given partitions, until
+// they are resumed with ResumePartitions. Records which have already been
+// fetched continue to be processed. Paused partitions are not fetched, and
+// don't count towards the fetch limits.
+//
+// Partitions are resumed automatically when they are revoked or lost.
+func (c *Consumer) PausePartitions(topicPartitions ...TopicPartition) {
+	c.consumer.pauseUser(c.client, c.consumer.kgoPartitions(topicPartitions))
+}
+
+// ResumePartitions resumes fetching records from the given partitions,
+// which were paused with PausePartitions.
+func (c *Consumer) ResumePartitions(topicPartitions ...TopicPartition) {
+	c.consumer.resumeUser(c.client, c.consumer.kgoPartitions(topicPartitions))
+}
+
+// Healthy returns an error if the Kafka client fails to reach a discovered
+// broker, or ErrConsumerUnhealthy if the consumer has lost its consumer
+// group membership and not rejoined yet, the last fetches have failed, or a
+// partition is stuck, see ConsumerConfig.StuckPartitionThreshold.
+func (c *Consumer) Healthy(ctx context.Context) error {
+	if err := c.client.Ping(ctx); err != nil {
+		return fmt.Errorf("health probe: %w", classifyError(err))
+	}
+	if err := c.consumer.healthy(); err != nil {
+		return fmt.Errorf("health probe: %w", err)
+	}
+	return nil
+}
+
+// KafkaClient returns the underlying kgo.Client, for features which the
+// Consumer doesn't expose. It must only be used for read-only operations:
+// closing the client, polling records, committing offsets or changing the
+// consumed topics or partitions with it is unsupported and may break the
+// Consumer's delivery guarantees.
+func (c *Consumer) KafkaClient() *kgo.Client {
+	return c.client
+}
+
+// consumer wraps partitionConsumers and exposes the necessary callbacks
+// to use when partitions are reassigned.
+type consumer struct {
+	mu          sync.RWMutex
+	topicPrefix string
+	assignments map[topicPartition]*pc
 	processor   apmqueue.Processor
-	logger      *zap.Logger
-	delivery    apmqueue.DeliveryType
-	logFieldFn  TopicLogFieldFunc
+	// topicProcessors overrides processor for the records of each topic.
+	topicProcessors map[apmqueue.Topic]apmqueue.Processor
+	// batch is set instead of processor to process records in batches.
+	batch        apmqueue.BatchProcessor
+	batchMaxSize int
+	logger       *zap.Logger
+	// groupLogger logs the consumer group rebalances.
+	groupLogger *zap.Logger
+	// revokedAt holds the time, in Unix nanoseconds, at which partitions were
+	// last revoked or lost, until partitions are assigned again.
+	revokedAt  atomic.Int64
+	delivery   apmqueue.DeliveryType
+	logFieldFn TopicLogFieldFunc
+	// manualCommit disables committing offsets in the partition consumers.
+	manualCommit bool
+	// commitOnRevoke commits the records delivered to the partition
+	// consumers when their partitions are revoked or the consumer is closed.
+	commitOnRevoke bool
+	onAssigned     func(context.Context, map[string][]int32)
+	onRevoked      func(context.Context, map[string][]int32)
+	retry          RetryConfig
+	groupID        string
+	// deadLetterTopic holds the namespaced dead letter topic, if any.
+	deadLetterTopic string
+	// errc receives fatal errors from the partition consumers.
+	errc chan error
+	// limiter bounds the number of concurrent Process or ProcessBatch
+	// calls, when MaxConcurrency is set.
+	limiter chan struct{}
+	// pending holds the number of records which have been fetched, but not
+	// yet processed.
+	pending atomic.Int64
+	// metricAttributeFilter replaces the topic attributes of the metrics.
+	metricAttributeFilter MetricAttributeFilter
+	// clock is the clock of the time-dependent code paths.
+	clock clock
+	// stuckThreshold, if positive, is the time after which a partition
+	// which has records to process but doesn't progress is stuck.
+	stuckThreshold time.Duration
+	// offsetStore, if set, is committed to instead of the consumer group.
+	offsetStore OffsetStore
+	// initialOffset is where partitions without a stored offset are
+	// consumed from.
+	initialOffset InitialOffset
+	// maxRecordBytes, if positive, is the maximum decompressed size of the
+	// records passed to the processor.
+	maxRecordBytes int
+	// oversized counts the records rejected for exceeding maxRecordBytes.
+	oversized metric.Int64Counter
+	// maxRecordAge, if positive, is the maximum age of the records passed
+	// to the processor.
+	maxRecordAge time.Duration
+	// headerAllowList, if set, holds the keys of the headers which are
+	// copied to the processed records.
+	headerAllowList map[string]struct{}
+	// transform, if set, is applied to the records before they're processed.
+	transform func(context.Context, *apmqueue.Record) error
+	// bounds, if set, holds the end offsets of the bounded partitions.
+	bounds *endBounds
+	// snapshot, if set, collects the records delivered once the bounded
+	// partitions have been consumed, instead of processing them.
+	snapshot *snapshot
+	// skipped counts the records skipped for exceeding maxRecordAge.
+	skipped metric.Int64Counter
+	// offsetResets counts the out of range offsets reset by the consumer.
+	offsetResets metric.Int64Counter
+	// e2eLatency records the time between producing the records and the
+	// processor finishing them, and clockSkews counts the records whose
+	// timestamp is after they were processed, which are recorded as zero.
+	e2eLatency metric.Float64Histogram
+	clockSkews metric.Int64Counter
+	// committedMu guards committed.
+	committedMu sync.Mutex
+	// committed holds the offsets last committed for each assigned
+	// partition.
+	committed map[TopicPartition]int64
+	// commitTimes holds the time of the last successful commit of each
+	// assigned partition, guarded by committedMu.
+	commitTimes map[TopicPartition]time.Time
+	// pauseMu guards pauses and userPaused.
+	pauseMu sync.Mutex
+	// pauses holds the number of pauses of each partition held by the
+	// partition consumers, e.g. while waiting to retry records.
+	pauses map[topicPartition]int
+	// userPaused holds the partitions paused with Consumer.PausePartitions,
+	// which aren't resumed when the partition consumers release their
+	// pauses.
+	userPaused map[topicPartition]struct{}
+	// propagator is only set when trace context propagation is enabled.
+	propagator propagation.TextMapPropagator
+	tracer     trace.Tracer
 	// ctx contains the graceful cancellation context that is passed to the
 	// partition consumers.
 	ctx context.Context
+
+	// healthMu guards the fields used to report the consumer health.
+	healthMu sync.Mutex
+	// groupErr holds the error which caused the consumer group membership
+	// to be lost, until partitions are assigned again.
+	groupErr error
+	// fetchErr holds the error of the last failed fetch, and fetchErrors
+	// the number of consecutive failed fetches.
+	fetchErr    error
+	fetchErrors int
+	// lastFetch holds the time of the last successful fetch.
+	lastFetch time.Time
+}
+
+// maxFetchErrors is the number of consecutive failed fetches after which the
+// consumer is reported as unhealthy.
+const maxFetchErrors = 3
+
+// OnGroupManageError implements the kgo.HookGroupManageError interface,
+// recording the error which caused the consumer group membership to be lost.
+func (c *consumer) OnGroupManageError(err error) {
+	c.healthMu.Lock()
+	defer c.healthMu.Unlock()
+	c.groupErr = err
+}
+
+// fetched records the outcome of polling records, err being the first fetch
+// error, if any.
+func (c *consumer) fetched(err error) {
+	c.healthMu.Lock()
+	defer c.healthMu.Unlock()
+	if err != nil {
+		c.fetchErr = err
+		c.fetchErrors++
+		return
+	}
+	c.fetchErr = nil
+	c.fetchErrors = 0
+	c.lastFetch = c.clock.Now()
+}
+
+// healthy returns an error wrapping ErrConsumerUnhealthy if the consumer
+// group membership has been lost, the last maxFetchErrors fetches failed, or
+// a partition is stuck.
+func (c *consumer) healthy() error {
+	if err := c.fetchHealthy(); err != nil {
+		return err
+	}
+	if stuck := c.stuckPartitions(); len(stuck) > 0 {
+		// Report the longest stalled partition.
+		p := slices.MaxFunc(stuck, func(a, b stuckPartition) int {
+			return cmp.Compare(a.stalled, b.stalled)
+		})
+		return fmt.Errorf("%w: %d partitions stuck, topic %q partition %d hasn't progressed for %s",
+			ErrConsumerUnhealthy, len(stuck),
+			strings.TrimPrefix(p.tp.topic, c.topicPrefix), p.tp.partition, p.stalled,
+		)
+	}
+	return nil
+}
+
+// stuckPartition is a partition whose processing has stalled.
+type stuckPartition struct {
+	tp      topicPartition
+	pc      *pc
+	stalled time.Duration
+}
+
+// stuckPartitions returns the assigned partitions which have records to
+// process and haven't progressed for longer than stuckThreshold.
+func (c *consumer) stuckPartitions() []stuckPartition {
+	if c.stuckThreshold <= 0 {
+		return nil
+	}
+	now := c.clock.Now()
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	var stuck []stuckPartition
+	for tp, pc := range c.assignments {
+		if stalled, ok := pc.stalled(now); ok && stalled > c.stuckThreshold {
+			stuck = append(stuck, stuckPartition{tp: tp, pc: pc, stalled: stalled})
+		}
+	}
+	return stuck
+}
+
+// warnStuck logs a warning for the partitions which became stuck since they
+// last progressed.
+func (c *consumer) warnStuck() {
+	for _, p := range c.stuckPartitions() {
+		if p.pc.stuck.CompareAndSwap(false, true) {
+			p.pc.logger.Warn("partition processing stuck",
+				zap.Duration("stalled", p.stalled),
+				zap.Duration("threshold", c.stuckThreshold),
+			)
+		}
+	}
+}
+
+// fetchHealthy returns an error wrapping ErrConsumerUnhealthy if the consumer
+// group membership has been lost, or the last maxFetchErrors fetches failed.
+func (c *consumer) fetchHealthy() error {
+	c.healthMu.Lock()
+	defer c.healthMu.Unlock()
+	if c.groupErr != nil {
+		return fmt.Errorf("%w: consumer group membership lost: %w",
+			ErrConsumerUnhealthy, c.groupErr,
+		)
+	}
+	if c.fetchErrors >= maxFetchErrors {
+		var since string
+		if !c.lastFetch.IsZero() {
+			since = fmt.Sprintf(" since %s", c.lastFetch.Format(time.RFC3339))
+		}
+		return fmt.Errorf("%w: %d consecutive fetches failed%s: %w",
+			ErrConsumerUnhealthy, c.fetchErrors, since, c.fetchErr,
+		)
+	}
+	return nil
 }
 
 type topicPartition struct {
@@ -406,11 +1910,38 @@ type topicPartition struct {
 	partition int32
 }
 
+// kgoPartitions returns the namespaced topic partitions as expected by the
+// kgo.Client.
+func (c *consumer) kgoPartitions(topicPartitions []TopicPartition) map[string][]int32 {
+	m := make(map[string][]int32)
+	for _, tp := range topicPartitions {
+		topic := c.topicPrefix + string(tp.Topic)
+		m[topic] = append(m[topic], tp.Partition)
+	}
+	return m
+}
+
 // assigned must be set as a kgo.OnPartitionsAssigned callback. Ensuring all
 // assigned partitions to this consumer process received records.
-func (c *consumer) assigned(_ context.Context, client *kgo.Client, assigned map[string][]int32) {
+func (c *consumer) assigned(ctx context.Context, client *kgo.Client, assigned map[string][]int32) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
+	if c.groupID != "" {
+		fields := c.rebalanceFields(client, assigned)
+		if revokedAt := c.revokedAt.Swap(0); revokedAt > 0 {
+			fields = append(fields, zap.Duration("rebalance_duration",
+				time.Since(time.Unix(0, revokedAt)),
+			))
+		}
+		c.groupLogger.Info("consumer group partitions assigned", fields...)
+	}
+	// Partitions are assigned after (re)joining the consumer group.
+	c.healthMu.Lock()
+	c.groupErr = nil
+	c.healthMu.Unlock()
+	if c.onAssigned != nil {
+		c.onAssigned(ctx, c.trimTopicPrefix(assigned))
+	}
 	for topic, partitions := range assigned {
 		for _, partition := range partitions {
 			t := strings.TrimPrefix(topic, c.topicPrefix)
@@ -422,27 +1953,62 @@ func (c *consumer) assigned(_ context.Context, client *kgo.Client, assigned map[
 				logger = logger.With(c.logFieldFn(t))
 			}
 
-			pc := newPartitionConsumer(c.ctx, client, c.processor,
-				c.delivery, t, logger,
-			)
+			pc := newPartitionConsumer(c, client, t, logger)
 			c.assignments[topicPartition{topic: topic, partition: partition}] = pc
 		}
 	}
 }
 
-// lost must be set as a kgo.OnPartitionsLost and kgo.OnPartitionsReassigned
-// callbacks. Ensures that partitions that are lost (see kgo.OnPartitionsLost
-// for more details) or reassigned (see kgo.OnPartitionsReassigned for more
-// details) have their partition consumer stopped.
+// lost must be set as a kgo.OnPartitionsLost callback. Ensures that
+// partitions that are lost (see kgo.OnPartitionsLost for more details) have
+// their partition consumer stopped.
 // This callback must finish within the re-balance timeout.
-func (c *consumer) lost(_ context.Context, _ *kgo.Client, lost map[string][]int32) {
+func (c *consumer) lost(ctx context.Context, client *kgo.Client, lost map[string][]int32) {
+	start := time.Now()
+	c.revokedAt.CompareAndSwap(0, start.UnixNano())
+	c.stop(ctx, client, lost, false)
+	c.groupLogger.Info("consumer group partitions lost", append(
+		c.rebalanceFields(client, lost), zap.Duration("duration", time.Since(start)),
+	)...)
+}
+
+// revoked must be set as a kgo.OnPartitionsRevoked callback. Ensures that
+// partitions that are revoked (see kgo.OnPartitionsRevoked for more details)
+// have their partition consumer stopped, committing the offsets of their
+// processed records if commitOnRevoke is set.
+// This callback must finish within the re-balance timeout.
+func (c *consumer) revoked(ctx context.Context, client *kgo.Client, revoked map[string][]int32) {
+	start := time.Now()
+	c.revokedAt.CompareAndSwap(0, start.UnixNano())
+	c.stop(ctx, client, revoked, c.commitOnRevoke)
+	c.groupLogger.Info("consumer group partitions revoked", append(
+		c.rebalanceFields(client, revoked), zap.Duration("duration", time.Since(start)),
+	)...)
+}
+
+// rebalanceFields returns the log fields describing the consumer group
+// membership and the rebalanced partitions.
+func (c *consumer) rebalanceFields(client *kgo.Client, partitions map[string][]int32) []zap.Field {
+	memberID, generation := client.GroupMetadata()
+	return []zap.Field{
+		zap.String("member_id", memberID),
+		zap.Int32("generation", generation),
+		zap.Any("partitions", c.trimTopicPrefix(partitions)),
+	}
+}
+
+// stop stops the partition consumers of the partitions, committing the
+// records delivered to them first if commit is true.
+func (c *consumer) stop(ctx context.Context, client *kgo.Client, partitions map[string][]int32, commit bool) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 	var wg sync.WaitGroup
-	for topic, partitions := range lost {
-		for _, partition := range partitions {
+	var stopped []*pc
+	for topic, p := range partitions {
+		for _, partition := range p {
 			tp := topicPartition{topic: topic, partition: partition}
 			if consumer, ok := c.assignments[tp]; ok {
+				stopped = append(stopped, consumer)
 				wg.Add(1)
 				go func() {
 					defer wg.Done()
@@ -453,19 +2019,240 @@ func (c *consumer) lost(_ context.Context, _ *kgo.Client, lost map[string][]int3
 		}
 	}
 	wg.Wait()
+	// Clear the pause state of the partitions once their partition
+	// consumers have stopped, so they are fetched if they are assigned to
+	// this consumer again.
+	c.clearPauses(client, partitions)
+	if commit {
+		if err := c.commitDelivered(ctx, client, stopped); err != nil {
+			c.logger.Error("failed to commit offsets of revoked partitions", zap.Error(err))
+		}
+	}
+	c.committedMu.Lock()
+	for topic, p := range partitions {
+		for _, partition := range p {
+			tp := TopicPartition{
+				Topic:     apmqueue.Topic(strings.TrimPrefix(topic, c.topicPrefix)),
+				Partition: partition,
+			}
+			delete(c.committed, tp)
+			delete(c.commitTimes, tp)
+		}
+	}
+	c.committedMu.Unlock()
+	if c.onRevoked != nil {
+		c.onRevoked(ctx, c.trimTopicPrefix(partitions))
+	}
+}
+
+// pausePartitions pauses fetching the partitions until the returned function
+// is called. Pauses are counted, so the partitions are resumed once every
+// pause has been released, unless they're paused with PausePartitions.
+func (c *consumer) pausePartitions(client *kgo.Client, partitions map[string][]int32) (resume func()) {
+	c.pauseMu.Lock()
+	defer c.pauseMu.Unlock()
+	pause := make(map[string][]int32)
+	for topic, p := range partitions {
+		for _, partition := range p {
+			tp := topicPartition{topic: topic, partition: partition}
+			c.pauses[tp]++
+			if _, ok := c.userPaused[tp]; !ok && c.pauses[tp] == 1 {
+				pause[topic] = append(pause[topic], partition)
+			}
+		}
+	}
+	client.PauseFetchPartitions(pause)
+	return sync.OnceFunc(func() {
+		c.pauseMu.Lock()
+		defer c.pauseMu.Unlock()
+		resume := make(map[string][]int32)
+		for topic, p := range partitions {
+			for _, partition := range p {
+				tp := topicPartition{topic: topic, partition: partition}
+				n, ok := c.pauses[tp]
+				if !ok {
+					// Cleared when the partition was revoked.
+					continue
+				}
+				if n > 1 {
+					c.pauses[tp]--
+					continue
+				}
+				delete(c.pauses, tp)
+				if _, ok := c.userPaused[tp]; !ok {
+					resume[topic] = append(resume[topic], partition)
+				}
+			}
+		}
+		client.ResumeFetchPartitions(resume)
+	})
+}
+
+// pauseUser pauses fetching the partitions until they're resumed with
+// resumeUser.
+func (c *consumer) pauseUser(client *kgo.Client, partitions map[string][]int32) {
+	c.pauseMu.Lock()
+	defer c.pauseMu.Unlock()
+	for topic, p := range partitions {
+		for _, partition := range p {
+			c.userPaused[topicPartition{topic: topic, partition: partition}] = struct{}{}
+		}
+	}
+	client.PauseFetchPartitions(partitions)
+}
+
+// resumeUser resumes fetching the partitions paused with pauseUser, unless
+// the partition consumers still hold pauses of them.
+func (c *consumer) resumeUser(client *kgo.Client, partitions map[string][]int32) {
+	c.pauseMu.Lock()
+	defer c.pauseMu.Unlock()
+	resume := make(map[string][]int32)
+	for topic, p := range partitions {
+		for _, partition := range p {
+			tp := topicPartition{topic: topic, partition: partition}
+			delete(c.userPaused, tp)
+			if c.pauses[tp] == 0 {
+				resume[topic] = append(resume[topic], partition)
+			}
+		}
+	}
+	client.ResumeFetchPartitions(resume)
+}
+
+// clearPauses clears the pauses of the partitions, resuming them.
+func (c *consumer) clearPauses(client *kgo.Client, partitions map[string][]int32) {
+	c.pauseMu.Lock()
+	defer c.pauseMu.Unlock()
+	for topic, p := range partitions {
+		for _, partition := range p {
+			tp := topicPartition{topic: topic, partition: partition}
+			delete(c.pauses, tp)
+			delete(c.userPaused, tp)
+		}
+	}
+	client.ResumeFetchPartitions(partitions)
+}
+
+// refreshLag updates the lag of the assigned partitions with the difference
+// between their high watermark and fetch position.
+func (c *consumer) refreshLag(ctx context.Context, adminClient *kadm.Client) error {
+	c.mu.RLock()
+	topicSet := make(map[string]struct{})
+	for tp := range c.assignments {
+		topicSet[tp.topic] = struct{}{}
+	}
+	c.mu.RUnlock()
+	if len(topicSet) == 0 {
+		return nil
+	}
+	topics := make([]string, 0, len(topicSet))
+	for topic := range topicSet {
+		topics = append(topics, topic)
+	}
+	endOffsets, err := adminClient.ListEndOffsets(ctx, topics...)
+	if err != nil {
+		return fmt.Errorf("failed to list end offsets: %w", classifyError(err))
+	}
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	for tp, pc := range c.assignments {
+		end, ok := endOffsets.Lookup(tp.topic, tp.partition)
+		if !ok || end.Err != nil {
+			continue
+		}
+		position := pc.position.Load()
+		if position <= 0 {
+			// Nothing has been fetched yet.
+			continue
+		}
+		pc.lag.Store(max(end.Offset-position, 0))
+	}
+	return nil
+}
+
+// observeLag observes the last refreshed lag of the assigned partitions.
+// Revoked partitions are no longer observed.
+func (c *consumer) observeLag(o metric.Observer, gauge metric.Int64Observable) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	for tp, pc := range c.assignments {
+		lag := pc.lag.Load()
+		if lag < 0 {
+			continue
+		}
+		topic := strings.TrimPrefix(tp.topic, c.topicPrefix)
+		attrs := c.metricAttributes(topic, attribute.Int("partition", int(tp.partition)))
+		o.ObserveInt64(gauge, lag, metric.WithAttributeSet(attribute.NewSet(attrs...)))
+	}
+}
+
+// observeCommitTimes observes the time of the last successful commit of the
+// assigned partitions. Revoked partitions are no longer observed.
+func (c *consumer) observeCommitTimes(o metric.Observer, gauge metric.Float64Observable) {
+	c.committedMu.Lock()
+	defer c.committedMu.Unlock()
+	for tp, t := range c.commitTimes {
+		topic := string(tp.Topic)
+		attrs := c.metricAttributes(topic, attribute.Int("partition", int(tp.Partition)))
+		o.ObserveFloat64(gauge, float64(t.UnixNano())/1e9,
+			metric.WithAttributeSet(attribute.NewSet(attrs...)),
+		)
+	}
+}
+
+// observeProgress observes the number of processed records and the time of
+// the last progress of the assigned partitions.
+func (c *consumer) observeProgress(o metric.Observer,
+	processed metric.Int64Observable, progress metric.Float64Observable,
+) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	for tp, pc := range c.assignments {
+		topic := strings.TrimPrefix(tp.topic, c.topicPrefix)
+		attrs := c.metricAttributes(topic, attribute.Int("partition", int(tp.partition)))
+		opt := metric.WithAttributeSet(attribute.NewSet(attrs...))
+		o.ObserveInt64(processed, pc.processed.Load(), opt)
+		if t := pc.lastProgress.Load(); t > 0 {
+			o.ObserveFloat64(progress, float64(t)/1e9, opt)
+		}
+	}
+}
+
+// metricAttributes returns the attributes of the consumer metrics of the
+// topic, without the namespace: the group, the topic attributes filtered by
+// MetricAttributeFilter, and the extra attributes.
+func (c *consumer) metricAttributes(topic string, extra ...attribute.KeyValue) []attribute.KeyValue {
+	attrs := []attribute.KeyValue{attribute.String("group", c.groupID)}
+	attrs = append(attrs, c.metricAttributeFilter.topicAttributes(topic,
+		attribute.String("topic", topic),
+	)...)
+	return append(attrs, extra...)
+}
+
+// trimTopicPrefix returns a copy of partitions with the namespace removed
+// from the topic names.
+func (c *consumer) trimTopicPrefix(partitions map[string][]int32) map[string][]int32 {
+	m := make(map[string][]int32, len(partitions))
+	for topic, p := range partitions {
+		m[strings.TrimPrefix(topic, c.topicPrefix)] = p
+	}
+	return m
 }
 
 // close is used on initiate clean shutdown. This call blocks until all the
-// partition consumers have processed their records and stopped.
+// partition consumers have processed their records and stopped, and their
+// offsets have been committed if commitOnRevoke is set.
 //
 // It holds the write lock, which cannot be acquired until the last fetch of
 // records has been sent to all the partition consumers.
-func (c *consumer) close() {
+func (c *consumer) close(client *kgo.Client) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 	var wg sync.WaitGroup
+	stopped := make([]*pc, 0, len(c.assignments))
 	for tp, consumer := range c.assignments {
 		delete(c.assignments, tp)
+		stopped = append(stopped, consumer)
 		wg.Add(1)
 		go func(c *pc) {
 			defer wg.Done()
@@ -473,6 +2260,165 @@ func (c *consumer) close() {
 		}(consumer)
 	}
 	wg.Wait()
+	if c.commitOnRevoke {
+		if err := c.commitDelivered(c.ctx, client, stopped); err != nil {
+			c.logger.Error("failed to commit offsets on close", zap.Error(err))
+		}
+	}
+}
+
+// commit commits the offsets of the last records delivered to each assigned
+// partition consumer, which haven't been committed yet.
+//
+// It holds the consumer read lock, so partitions cannot be revoked while the
+// offsets are being committed.
+func (c *consumer) commit(ctx context.Context, client *kgo.Client) error {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	pcs := make([]*pc, 0, len(c.assignments))
+	for _, pc := range c.assignments {
+		pcs = append(pcs, pc)
+	}
+	return c.commitDelivered(ctx, client, pcs)
+}
+
+// commitDelivered commits the offsets of the last records delivered to the
+// partition consumers, which haven't been committed yet.
+func (c *consumer) commitDelivered(ctx context.Context, client *kgo.Client, pcs []*pc) error {
+	type pending struct {
+		pc     *pc
+		record *kgo.Record
+	}
+	var pendings []pending
+	var records []*kgo.Record
+	for _, pc := range pcs {
+		if record := pc.delivered.Swap(nil); record != nil {
+			pendings = append(pendings, pending{pc: pc, record: record})
+			records = append(records, record)
+		}
+	}
+	if len(records) == 0 {
+		return nil
+	}
+	if err := c.commitRecords(ctx, client, records...); err != nil {
+		// Restore the uncommitted records, unless newer records have
+		// been delivered since.
+		for _, p := range pendings {
+			p.pc.delivered.CompareAndSwap(nil, p.record)
+		}
+		return fmt.Errorf("%w: %w", ErrCommitFailed, classifyError(err))
+	}
+	return nil
+}
+
+// commitRecords commits the offsets of the records to the offset store, if
+// set, or the consumer group otherwise.
+func (c *consumer) commitRecords(ctx context.Context, client *kgo.Client, records ...*kgo.Record) error {
+	if len(records) == 0 {
+		return nil
+	}
+	offsets := make(map[TopicPartition]int64, len(records))
+	for _, r := range records {
+		tp := TopicPartition{
+			Topic:     apmqueue.Topic(strings.TrimPrefix(r.Topic, c.topicPrefix)),
+			Partition: r.Partition,
+		}
+		if offset, ok := offsets[tp]; !ok || r.Offset+1 > offset {
+			offsets[tp] = r.Offset + 1
+		}
+	}
+	switch {
+	case c.offsetStore != nil:
+		var errs []error
+		for tp, offset := range offsets {
+			if err := c.offsetStore.Store(ctx, tp, offset); err != nil {
+				errs = append(errs, fmt.Errorf(
+					"failed to store offset of topic %q partition %d: %w",
+					tp.Topic, tp.Partition, err,
+				))
+				delete(offsets, tp)
+			}
+		}
+		if len(errs) > 0 {
+			c.setCommitted(offsets)
+			return errors.Join(errs...)
+		}
+	case c.groupID != "":
+		if err := client.CommitRecords(ctx, records...); err != nil {
+			return err
+		}
+	default:
+		// Offsets are not committed without a consumer group or store.
+		return nil
+	}
+	c.setCommitted(offsets)
+	return nil
+}
+
+// setCommitted records the offsets which have been committed successfully.
+func (c *consumer) setCommitted(offsets map[TopicPartition]int64) {
+	c.committedMu.Lock()
+	defer c.committedMu.Unlock()
+	now := c.clock.Now()
+	for tp, offset := range offsets {
+		c.committed[tp] = offset
+		c.commitTimes[tp] = now
+	}
+}
+
+// loadOffsets loads the stored offsets of the partitions from the offset
+// store, omitting the partitions without a stored offset.
+func (c *consumer) loadOffsets(ctx context.Context, partitions []TopicPartition) (map[TopicPartition]int64, error) {
+	offsets := make(map[TopicPartition]int64, len(partitions))
+	for _, tp := range partitions {
+		offset, err := c.offsetStore.Load(ctx, tp)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load offset of topic %q partition %d: %w",
+				tp.Topic, tp.Partition, err,
+			)
+		}
+		if offset >= 0 {
+			offsets[tp] = offset
+		}
+	}
+	return offsets, nil
+}
+
+// startOffsets returns the offsets to start consuming the statically
+// assigned partitions from, fetched from the offset store, if set.
+func (c *consumer) startOffsets(ctx context.Context, partitions map[string][]int32) (map[string]map[int32]kgo.Offset, error) {
+	var stored map[TopicPartition]int64
+	if c.offsetStore != nil {
+		var tps []TopicPartition
+		for topic, p := range partitions {
+			for _, partition := range p {
+				tps = append(tps, TopicPartition{
+					Topic:     apmqueue.Topic(strings.TrimPrefix(topic, c.topicPrefix)),
+					Partition: partition,
+				})
+			}
+		}
+		var err error
+		if stored, err = c.loadOffsets(ctx, tps); err != nil {
+			return nil, err
+		}
+	}
+	offsets := make(map[string]map[int32]kgo.Offset, len(partitions))
+	for topic, p := range partitions {
+		offsets[topic] = make(map[int32]kgo.Offset, len(p))
+		for _, partition := range p {
+			offset := c.initialOffset.kgoOffset()
+			tp := TopicPartition{
+				Topic:     apmqueue.Topic(strings.TrimPrefix(topic, c.topicPrefix)),
+				Partition: partition,
+			}
+			if o, ok := stored[tp]; ok {
+				offset = kgo.NewOffset().At(o)
+			}
+			offsets[topic][partition] = offset
+		}
+	}
+	return offsets, nil
 }
 
 // processFetch sends the received records for a partition to the corresponding
@@ -493,6 +2439,8 @@ func (c *consumer) processFetch(fetches kgo.Fetches) {
 		}
 		consumer, ok := c.assignments[topicPartition{topic: ftp.Topic, partition: ftp.Partition}]
 		if ok {
+			consumer.position.Store(ftp.Records[len(ftp.Records)-1].Offset + 1)
+			c.pending.Add(int64(len(ftp.Records)))
 			consumer.consumeRecords(ftp)
 			return
 		}
@@ -527,88 +2475,933 @@ func (c *consumer) OnFetchRecordBuffered(r *kgo.Record) {
 }
 
 type pc struct {
-	topic     apmqueue.Topic
-	g         errgroup.Group
-	logger    *zap.Logger
-	delivery  apmqueue.DeliveryType
+	topic apmqueue.Topic
+	// g holds the goroutine processing the queued records, if running.
+	g      errgroup.Group
+	logger *zap.Logger
+	client *kgo.Client
+	// consumer holds the configuration shared by all partition consumers.
+	consumer *consumer
+	// processor processes the records of the topic, unless a BatchProcessor
+	// is used.
 	processor apmqueue.Processor
-	client    *kgo.Client
-	ctx       context.Context
+
+	// delivered holds the last record delivered to the processor which
+	// hasn't been committed yet, when manualCommit is true.
+	delivered atomic.Pointer[kgo.Record]
+	// failed is set when a record couldn't be produced to the dead letter
+	// topic, stopping any further processing.
+	failed atomic.Bool
+	// stopping is closed when the partition consumer is stopped, to
+	// interrupt any pending retries.
+	stopping chan struct{}
+	stopOnce sync.Once
+
+	// queueMu guards queue, running and resumeQueued.
+	queueMu sync.Mutex
+	// queue holds the fetched records waiting to be processed, in order.
+	queue []kgo.FetchTopicPartition
+	// running is set while the goroutine processing the queue is running.
+	running bool
+	// resumeQueued, if set, resumes fetching the partition, which is paused
+	// while records are queued.
+	resumeQueued func()
+
+	// settled holds the number of records of the fetch being processed
+	// which are no longer pending. Only accessed by the processing goroutine.
+	settled int
+
+	// position holds the offset of the next record to be fetched, or 0 if
+	// no records have been fetched yet.
+	position atomic.Int64
+	// lag holds the last refreshed lag, or -1 if it hasn't been refreshed.
+	lag atomic.Int64
+	// processed holds the number of records which finished processing.
+	processed atomic.Int64
+	// lastProgress holds the time, in Unix nanoseconds, the partition
+	// consumer last settled records or started processing queued records
+	// while idle, or 0 if it hasn't yet.
+	lastProgress atomic.Int64
+	// stuck is set once the partition has been reported as stuck, until it
+	// progresses again.
+	stuck atomic.Bool
 }
 
-func newPartitionConsumer(ctx context.Context,
+func newPartitionConsumer(consumer *consumer,
 	client *kgo.Client,
-	processor apmqueue.Processor,
-	delivery apmqueue.DeliveryType,
 	topic string,
 	logger *zap.Logger,
 ) *pc {
 	c := pc{
 		topic:     apmqueue.Topic(topic),
-		ctx:       ctx,
+		consumer:  consumer,
+		processor: consumer.processor,
 		client:    client,
-		processor: processor,
-		delivery:  delivery,
 		logger:    logger,
+		stopping:  make(chan struct{}),
+	}
+	if p, ok := consumer.topicProcessors[c.topic]; ok && p != nil {
+		c.processor = p
 	}
-	// Only allow calls to processor.Process to happen serially.
-	c.g.SetLimit(1)
+	c.lag.Store(-1)
 	return &c
 }
 
-// consumeTopicPartition processes the records for a topic and partition. The
-// records will be processed asynchronously.
+// consumeRecords queues the fetched records of the partition to be processed
+// asynchronously, in order, by the partition consumer's goroutine. Fetching
+// the partition is paused while its records are queued behind the records
+// being processed, so that a partition which is slow to process its records
+// doesn't block the processing of the other partitions.
 func (c *pc) consumeRecords(ftp kgo.FetchTopicPartition) {
-	c.g.Go(func() error {
-		// Stores the last processed record. Default to -1 for cases where
-		// only the first record is received.
-		last := -1
-		for i, msg := range ftp.Records {
-			meta := make(map[string]string, len(msg.Headers))
-			for _, h := range msg.Headers {
-				meta[h.Key] = string(h.Value)
-			}
-
-			processCtx := queuecontext.WithMetadata(msg.Context, meta)
-			record := apmqueue.Record{
-				Topic:       c.topic,
-				Partition:   msg.Partition,
-				OrderingKey: msg.Key,
-				Value:       msg.Value,
-			}
-			// If a record can't be processed, no retries are attempted and it
-			// may be lost. https://github.com/elastic/apm-queue/issues/118.
-			if err := c.processor.Process(processCtx, record); err != nil {
-				c.logger.Error("data loss: unable to process event",
-					zap.Error(err),
-					zap.Int64("offset", msg.Offset),
-					zap.Any("headers", meta),
-				)
-				switch c.delivery {
-				case apmqueue.AtLeastOnceDeliveryType:
+	c.queueMu.Lock()
+	defer c.queueMu.Unlock()
+	c.queue = append(c.queue, ftp)
+	if !c.running {
+		c.running = true
+		// Time spent idle doesn't count towards being stuck.
+		c.lastProgress.Store(c.consumer.clock.Now().UnixNano())
+		c.g.Go(c.run)
+		return
+	}
+	if c.resumeQueued == nil {
+		c.resumeQueued = c.consumer.pausePartitions(c.client, map[string][]int32{
+			ftp.Topic: {ftp.Partition},
+		})
+	}
+}
+
+// run processes the queued records until the queue is empty, including once
+// the partition consumer is stopping, so that the records which have already
+// been fetched are processed. The remaining queued records are only discarded
+// without being processed when the processing context is canceled, or when
+// processing the previous records stopped early, since committing the
+// following records would then skip the records which weren't processed.
+func (c *pc) run() error {
+	var discard bool
+	for {
+		c.queueMu.Lock()
+		if c.consumer.ctx.Err() != nil {
+			discard = true
+		}
+		if discard {
+			for _, ftp := range c.queue {
+				c.consumer.pending.Add(-int64(len(ftp.Records)))
+			}
+			c.queue = nil
+		}
+		if len(c.queue) == 0 {
+			c.running = false
+			if c.resumeQueued != nil {
+				c.resumeQueued()
+				c.resumeQueued = nil
+			}
+			c.queueMu.Unlock()
+			return nil
+		}
+		ftp := c.queue[0]
+		c.queue = c.queue[1:]
+		if len(c.queue) == 0 && c.resumeQueued != nil {
+			// Fetch the partition while the last queued records are processed.
+			c.resumeQueued()
+			c.resumeQueued = nil
+		}
+		c.queueMu.Unlock()
+		discard = !c.consumeFetch(ftp)
+	}
+}
+
+// consumeFetch processes the fetched records of the partition, committing
+// them when the delivery guarantee is AtLeastOnceDeliveryType. It returns
+// false if processing stopped before all the records were processed, e.g.
+// because a retry was interrupted, in which case the following records of
+// the partition mustn't be processed.
+func (c *pc) consumeFetch(ftp kgo.FetchTopicPartition) bool {
+	// Records which aren't processed, e.g. because the partition
+	// consumer is stopping, are no longer pending either.
+	defer func() {
+		c.consumer.pending.Add(-int64(len(ftp.Records) - c.settled))
+		c.settled = 0
+	}()
+	records := ftp.Records
+	tp := topicPartition{topic: ftp.Topic, partition: ftp.Partition}
+	// reachedEnd is set when the partition has been fetched up to its
+	// end offset, if bounded.
+	records, reachedEnd := c.consumer.bounds.boundRecords(tp, records)
+	// skipped and rejected hold the last stale and oversized records
+	// which are considered processed, if any.
+	var skipped, rejected *kgo.Record
+	if c.consumer.maxRecordAge > 0 {
+		records, skipped = c.skipStale(records)
+	}
+	if c.consumer.maxRecordBytes > 0 {
+		records, rejected = c.rejectOversized(records)
+	}
+	var lastRecord *kgo.Record
+	// unreached holds the offset of the first record which wasn't
+	// processed, if processing stopped early. The skipped and rejected
+	// records after it mustn't be committed.
+	unreached := int64(math.MaxInt64)
+	last := c.processRecordsOrBatches(records)
+	if last >= 0 {
+		lastRecord = records[last]
+	}
+	if last+1 < len(records) {
+		unreached = records[last+1].Offset
+	}
+	complete := unreached == math.MaxInt64 && !c.failed.Load()
+	if reachedEnd && complete {
+		// Once committed, stop fetching the partition.
+		defer c.reachedEnd(tp)
+	}
+	var settled bool
+	for _, r := range []*kgo.Record{skipped, rejected} {
+		if r != nil && r.Offset < unreached &&
+			(lastRecord == nil || r.Offset > lastRecord.Offset) {
+			lastRecord = r
+			settled = true
+		}
+	}
+	if c.consumer.manualCommit {
+		if settled {
+			c.delivered.Store(lastRecord)
+		}
+		return complete
+	}
+	// Commit the last record offset when one or more records are processed
+	// and the delivery guarantee is set to AtLeastOnceDeliveryType.
+	if c.consumer.delivery == apmqueue.AtLeastOnceDeliveryType && lastRecord != nil {
+		if err := c.consumer.commitRecords(c.consumer.ctx, c.client, lastRecord); err != nil {
+			c.logger.Error("unable to commit records",
+				zap.Error(err),
+				zap.Int64("offset", lastRecord.Offset),
+			)
+		} else if len(ftp.Records) > 0 {
+			c.logger.Info("committed",
+				zap.Int64("offset", lastRecord.Offset),
+			)
+		}
+	}
+	return complete
+}
+
+// processRecordsOrBatches processes the records with the BatchProcessor, if
+// set, or one at a time otherwise, returning the index of the last processed
+// record, or -1 if none were processed.
+func (c *pc) processRecordsOrBatches(msgs []*kgo.Record) int {
+	if len(msgs) == 0 {
+		return -1
+	}
+	if c.consumer.snapshot != nil {
+		c.addSnapshot(msgs)
+		return len(msgs) - 1
+	}
+	if c.consumer.batch != nil {
+		return c.processBatches(msgs)
+	}
+	return c.processRecords(msgs)
+}
+
+// processRecords processes the records one at a time, returning the index
+// of the last processed record, or -1 if none were processed.
+func (c *pc) processRecords(msgs []*kgo.Record) int {
+	// Stores the last processed record. Default to -1 for cases where
+	// only the first record is received.
+	last := -1
+	for i, msg := range msgs {
+		if c.failed.Load() {
+			break
+		}
+		processCtx, record := c.newRecord(msg)
+		var span trace.Span
+		if c.consumer.propagator != nil {
+			processCtx, span = c.startProcessSpan(processCtx, msg)
+		}
+		var attempts int
+		err := c.transformRecord(processCtx, &record)
+		if err == nil {
+			attempts, err = c.process(processCtx, msg, record)
+		}
+		if errors.Is(err, apmqueue.ErrSkip) {
+			// The record is considered processed.
+			c.logger.Debug("skipped record",
+				zap.Int64("offset", msg.Offset),
+				zap.Int("attempts", attempts),
+			)
+			err = nil
+		}
+		c.settle(1)
+		if span != nil {
+			if err != nil {
+				span.RecordError(err)
+				span.SetStatus(codes.Error, "failed to process record")
+			}
+			span.End()
+		}
+		if errors.Is(err, errRetryStopped) {
+			// The partition consumer is stopping, leave the record and
+			// any following records uncommitted.
+			c.logger.Info("stopped retrying record",
+				zap.Int64("offset", msg.Offset),
+				zap.Int("attempts", attempts),
+			)
+			break
+		}
+		c.recordLatency(msg)
+		if err != nil {
+			processed, ok := c.handleFailed(msg, attempts, err)
+			if !ok {
+				break
+			}
+			if !processed {
+				continue
+			}
+		}
+		last = i
+		if c.consumer.manualCommit {
+			c.delivered.Store(msg)
+		}
+	}
+	return last
+}
+
+// processBatches processes the records in batches of up to batchMaxSize,
+// returning the index of the last processed record, or -1 if none were
+// processed.
+func (c *pc) processBatches(msgs []*kgo.Record) int {
+	size := c.consumer.batchMaxSize
+	if size <= 0 {
+		size = len(msgs)
+	}
+	last := -1
+	for start := 0; start < len(msgs); start += size {
+		if c.failed.Load() {
+			break
+		}
+		end := min(start+size, len(msgs))
+		processed, ok := c.processBatch(msgs[start:end])
+		if processed >= 0 {
+			last = start + processed
+		}
+		if !ok {
+			break
+		}
+	}
+	return last
+}
+
+// processBatch processes a batch of records, retrying the failed records as
+// configured by RetryConfig. It returns the index of the last processed
+// record, or -1 if none were processed, and false if no further records
+// should be processed.
+func (c *pc) processBatch(msgs []*kgo.Record) (int, bool) {
+	ctx := msgs[0].Context
+	records := make([]apmqueue.Record, len(msgs))
+	// transformErrs holds the errors of the records which failed to be
+	// transformed, keyed by index, which aren't passed to ProcessBatch.
+	var transformErrs map[int]error
+	for i, msg := range msgs {
+		var processCtx context.Context
+		processCtx, records[i] = c.newRecord(msg)
+		if err := c.transformRecord(processCtx, &records[i]); err != nil {
+			if transformErrs == nil {
+				transformErrs = make(map[int]error)
+			}
+			transformErrs[i] = err
+		}
+	}
+	var span trace.Span
+	if c.consumer.propagator != nil {
+		ctx, span = c.startProcessBatchSpan(ctx, msgs)
+	}
+	attempts, failures, err := c.processTransformedBatch(ctx, msgs, records, transformErrs)
+	c.settle(len(msgs))
+	if span != nil {
+		if err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, "failed to process batch")
+		}
+		span.End()
+	}
+	if errors.Is(err, errRetryStopped) {
+		// The partition consumer is stopping, leave the batch and any
+		// following records uncommitted.
+		c.logger.Info("stopped retrying batch",
+			zap.Int64("offset", msgs[0].Offset),
+			zap.Int("attempts", attempts),
+		)
+		return -1, false
+	}
+	c.recordLatency(msgs...)
+	last := -1
+	for i, msg := range msgs {
+		if f, failed := failures[i]; failed {
+			processed, ok := c.handleFailed(msg, f.attempts, f.err)
+			if !ok {
+				return last, false
+			}
+			if !processed {
+				continue
+			}
+		}
+		last = i
+		if c.consumer.manualCommit {
+			c.delivered.Store(msg)
+		}
+	}
+	return last, true
+}
+
+// recordFailure is the error of a record of a batch which failed to be
+// processed, and the number of processing attempts made for the record.
+type recordFailure struct {
+	err      error
+	attempts int
+}
+
+// processTransformedBatch calls processBatchRetry with the records which
+// were transformed, returning the failures of the records which failed to be
+// transformed or processed, keyed by index.
+func (c *pc) processTransformedBatch(ctx context.Context, msgs []*kgo.Record, records []apmqueue.Record, transformErrs map[int]error) (int, map[int]recordFailure, error) {
+	if len(transformErrs) == 0 {
+		return c.processBatchRetry(ctx, msgs, records)
+	}
+	// indices holds the indices of the transformed records.
+	indices := make([]int, 0, len(records)-len(transformErrs))
+	for i := range records {
+		if _, failed := transformErrs[i]; !failed {
+			indices = append(indices, i)
+		}
+	}
+	failures := make(map[int]recordFailure, len(transformErrs))
+	for i, err := range transformErrs {
+		failures[i] = recordFailure{err: err}
+	}
+	if len(indices) == 0 {
+		return 0, failures, nil
+	}
+	batchMsgs := make([]*kgo.Record, len(indices))
+	batch := make([]apmqueue.Record, len(indices))
+	for i, idx := range indices {
+		batchMsgs[i] = msgs[idx]
+		batch[i] = records[idx]
+	}
+	attempts, batchFailures, err := c.processBatchRetry(ctx, batchMsgs, batch)
+	if errors.Is(err, errRetryStopped) {
+		return attempts, nil, err
+	}
+	for i, f := range batchFailures {
+		failures[indices[i]] = f
+	}
+	return attempts, failures, err
+}
+
+// processBatchRetry calls ProcessBatch with the records, retrying the failed
+// records as configured by RetryConfig. The retry policy is evaluated for
+// each failed record with its own error, so only the records which qualify
+// are retried, and the others fail without being passed to ProcessBatch
+// again. It returns the number of attempts made and the failures of the
+// records which weren't processed, keyed by index.
+func (c *pc) processBatchRetry(ctx context.Context, msgs []*kgo.Record, records []apmqueue.Record) (int, map[int]recordFailure, error) {
+	cfg := c.consumer.retry
+	// pending holds the indices of the records passed to ProcessBatch.
+	pending := make([]int, len(records))
+	for i := range pending {
+		pending[i] = i
+	}
+	batch := records
+	// failures holds the records which failed and aren't retried.
+	var failures map[int]recordFailure
+	var resume func()
+	defer func() {
+		if resume != nil {
+			resume()
+		}
+	}()
+	for attempts := 1; ; attempts++ {
+		err := c.processBatchOnce(ctx, batch)
+		if errors.Is(err, errRetryStopped) {
+			return attempts, nil, err
+		}
+		if err == nil {
+			return attempts, failures, failuresError(failures)
+		}
+		errs := make(map[int]error, len(pending))
+		var batchErr *apmqueue.BatchError
+		switch {
+		case errors.As(err, &batchErr):
+			// Skipped records are considered processed.
+			for i, recordErr := range batchErr.Errors {
+				if errors.Is(recordErr, apmqueue.ErrSkip) {
 					continue
 				}
+				if i >= 0 && i < len(pending) {
+					errs[pending[i]] = recordErr
+				}
+			}
+		case errors.Is(err, apmqueue.ErrSkip):
+			c.logger.Debug("skipped batch",
+				zap.Int64("offset", msgs[0].Offset),
+				zap.Int("attempts", attempts),
+			)
+			return attempts, failures, failuresError(failures)
+		default:
+			for _, i := range pending {
+				errs[i] = err
 			}
-			last = i
 		}
-		// Commit the last record offset when one or more records are processed
-		// and the delivery guarantee is set to AtLeastOnceDeliveryType.
-		if c.delivery == apmqueue.AtLeastOnceDeliveryType && last >= 0 {
-			lastRecord := ftp.Records[last]
-			if err := c.client.CommitRecords(c.ctx, lastRecord); err != nil {
-				c.logger.Error("unable to commit records",
-					zap.Error(err),
-					zap.Int64("offset", lastRecord.Offset),
-				)
-			} else if len(ftp.Records) > 0 {
-				c.logger.Info("committed",
-					zap.Int64("offset", lastRecord.Offset),
-				)
+		pending = pending[:0]
+		for i := range records {
+			recordErr, failed := errs[i]
+			if !failed {
+				continue
 			}
+			if cfg.retryable(recordErr, attempts) {
+				pending = append(pending, i)
+				continue
+			}
+			if failures == nil {
+				failures = make(map[int]recordFailure, len(errs))
+			}
+			failures[i] = recordFailure{err: recordErr, attempts: attempts}
+		}
+		if len(pending) == 0 {
+			return attempts, failures, failuresError(failures)
+		}
+		if resume == nil {
+			resume = c.pause(msgs...)
 		}
+		backoff := cfg.backoff(attempts)
+		c.logger.Debug("retrying batch",
+			zap.Error(err),
+			zap.Int64("offset", msgs[0].Offset),
+			zap.Int("attempts", attempts),
+			zap.Int("records", len(pending)),
+			zap.Duration("backoff", backoff),
+		)
+		if !c.backoff(backoff) {
+			return attempts, nil, errRetryStopped
+		}
+		batch = make([]apmqueue.Record, len(pending))
+		for i, idx := range pending {
+			batch[i] = records[idx]
+		}
+	}
+}
+
+// failuresError returns a *apmqueue.BatchError holding the errors of the
+// failed records, or nil if there are none.
+func failuresError(failures map[int]recordFailure) error {
+	if len(failures) == 0 {
 		return nil
-	})
+	}
+	errs := make(map[int]error, len(failures))
+	for i, f := range failures {
+		errs[i] = f.err
+	}
+	return &apmqueue.BatchError{Errors: errs}
+}
+
+// newRecord returns the record passed to the processor for msg, and its
+// processing context, which holds the record headers as metadata. Only the
+// headers in the header allow list are copied, if set.
+func (c *pc) newRecord(msg *kgo.Record) (context.Context, apmqueue.Record) {
+	var n int
+	for _, h := range msg.Headers {
+		if c.consumer.headerAllowed(h.Key) {
+			n++
+		}
+	}
+	meta := make(map[string]string, n)
+	var headers []apmqueue.Header
+	if n > 0 {
+		headers = make([]apmqueue.Header, 0, n)
+	}
+	for _, h := range msg.Headers {
+		if !c.consumer.headerAllowed(h.Key) {
+			continue
+		}
+		meta[h.Key] = string(h.Value)
+		headers = append(headers, apmqueue.Header{Key: h.Key, Value: h.Value})
+	}
+	return queuecontext.WithMetadata(msg.Context, meta), apmqueue.Record{
+		Topic:       c.topic,
+		Partition:   msg.Partition,
+		OrderingKey: msg.Key,
+		Key:         msg.Key,
+		Value:       msg.Value,
+		Headers:     headers,
+		Timestamp:   msg.Timestamp,
+	}
+}
+
+// headerAllowed returns whether the header with key is copied to the
+// processed records.
+func (c *consumer) headerAllowed(key string) bool {
+	if c.headerAllowList == nil {
+		return true
+	}
+	_, ok := c.headerAllowList[key]
+	return ok
+}
+
+// transformRecord applies the configured Transform to record, if any.
+func (c *pc) transformRecord(ctx context.Context, record *apmqueue.Record) error {
+	if c.consumer.transform == nil {
+		return nil
+	}
+	if err := c.consumer.transform(ctx, record); err != nil {
+		return fmt.Errorf("failed to transform record: %w", err)
+	}
+	return nil
+}
+
+// handleFailed handles a record which failed to be processed, producing it
+// to the dead letter topic if configured. It returns whether the record is
+// considered processed, and false if no further records should be processed.
+func (c *pc) handleFailed(msg *kgo.Record, attempts int, err error) (bool, bool) {
+	meta := make(map[string]string, len(msg.Headers))
+	for _, h := range msg.Headers {
+		meta[h.Key] = string(h.Value)
+	}
+	if c.consumer.deadLetterTopic != "" {
+		if dlqErr := c.produceDeadLetter(msg, attempts, err); dlqErr != nil {
+			c.logger.Error("unable to produce record to dead letter topic",
+				zap.Error(dlqErr),
+				zap.Int64("offset", msg.Offset),
+				zap.Any("headers", meta),
+			)
+			c.failed.Store(true)
+			select {
+			case c.consumer.errc <- fmt.Errorf("%w: %w", ErrDeadLetterFailed, dlqErr):
+			default:
+			}
+			return false, false
+		}
+		c.logger.Warn("produced unprocessable record to dead letter topic",
+			zap.Error(err),
+			zap.Int64("offset", msg.Offset),
+			zap.Int("attempts", attempts),
+		)
+		return true, true
+	}
+	// If a record can't be processed, it may be lost.
+	// https://github.com/elastic/apm-queue/issues/118.
+	c.logger.Error("data loss: unable to process event",
+		zap.Error(err),
+		zap.Int64("offset", msg.Offset),
+		zap.Any("headers", meta),
+	)
+	return c.consumer.delivery != apmqueue.AtLeastOnceDeliveryType, true
+}
+
+// checkSize returns an error wrapping ErrRecordTooLarge if the decompressed
+// size of msg exceeds MaxDecompressedRecordBytes, recording the rejection.
+func (c *pc) checkSize(msg *kgo.Record) error {
+	if c.consumer.maxRecordBytes <= 0 {
+		return nil
+	}
+	size := recordSize(msg)
+	if size <= c.consumer.maxRecordBytes {
+		return nil
+	}
+	topic := string(c.topic)
+	attrs := c.consumer.metricAttributes(topic)
+	c.consumer.oversized.Add(context.Background(), 1, metric.WithAttributes(attrs...))
+	return fmt.Errorf("%w: decompressed record of %d bytes exceeds the maximum of %d bytes",
+		ErrRecordTooLarge, size, c.consumer.maxRecordBytes,
+	)
+}
+
+// rejectOversized handles the records which exceed MaxDecompressedRecordBytes
+// as failed records, returning the remaining records, and the last rejected
+// record which is considered processed, if any.
+func (c *pc) rejectOversized(msgs []*kgo.Record) ([]*kgo.Record, *kgo.Record) {
+	var accepted []*kgo.Record
+	var last *kgo.Record
+	for i, msg := range msgs {
+		err := c.checkSize(msg)
+		if err == nil {
+			if accepted != nil {
+				accepted = append(accepted, msg)
+			}
+			continue
+		}
+		if accepted == nil {
+			accepted = append(make([]*kgo.Record, 0, len(msgs)-1), msgs[:i]...)
+		}
+		c.settle(1)
+		processed, ok := c.handleFailed(msg, 0, err)
+		if !ok {
+			break
+		}
+		if processed {
+			last = msg
+		}
+	}
+	if accepted == nil {
+		return msgs, last
+	}
+	return accepted, last
 }
 
-// wait blocks until all the records have been processed.
-func (c *pc) wait() error { return c.g.Wait() }
+// skipStale skips the records which are older than maxRecordAge, returning
+// the remaining records, and the last skipped record, if any.
+func (c *pc) skipStale(msgs []*kgo.Record) ([]*kgo.Record, *kgo.Record) {
+	cutoff := c.consumer.clock.Now().Add(-c.consumer.maxRecordAge)
+	var accepted []*kgo.Record
+	var last *kgo.Record
+	for i, msg := range msgs {
+		if !msg.Timestamp.Before(cutoff) {
+			if accepted != nil {
+				accepted = append(accepted, msg)
+			}
+			continue
+		}
+		if accepted == nil {
+			accepted = append(make([]*kgo.Record, 0, len(msgs)-1), msgs[:i]...)
+		}
+		c.settle(1)
+		last = msg
+	}
+	if last == nil {
+		return msgs, nil
+	}
+	topic := string(c.topic)
+	attrs := c.consumer.metricAttributes(topic)
+	skipped := int64(len(msgs) - len(accepted))
+	c.consumer.skipped.Add(context.Background(), skipped, metric.WithAttributes(attrs...))
+	c.logger.Debug("skipped stale records",
+		zap.Int64("count", skipped),
+		zap.Int64("offset", last.Offset),
+	)
+	return accepted, last
+}
+
+// reachedEnd marks the bounded partition as consumed up to its end offset,
+// and stops fetching it.
+func (c *pc) reachedEnd(tp topicPartition) {
+	// The pause is held until the partition is revoked.
+	c.consumer.pausePartitions(c.client, map[string][]int32{tp.topic: {tp.partition}})
+	c.consumer.bounds.reached(tp)
+	c.logger.Info("consumed partition up to its end offset")
+}
+
+// recordLatency records the end-to-end latency of the records which the
+// processor finished, from their timestamp. The latency of records
+// timestamped in the future, e.g. due to clock skew between the producer and
+// the consumer, is clamped to zero and counted separately.
+func (c *pc) recordLatency(msgs ...*kgo.Record) {
+	now := c.consumer.clock.Now()
+	topic := string(c.topic)
+	attrs := c.consumer.metricAttributes(topic)
+	opt := metric.WithAttributeSet(attribute.NewSet(attrs...))
+	var skewed int64
+	for _, msg := range msgs {
+		latency := now.Sub(msg.Timestamp)
+		if latency < 0 {
+			latency = 0
+			skewed++
+		}
+		c.consumer.e2eLatency.Record(context.Background(), latency.Seconds(), opt)
+	}
+	if skewed > 0 {
+		c.consumer.clockSkews.Add(context.Background(), skewed, opt)
+	}
+}
+
+// settle marks n records of the fetch being processed as no longer pending.
+func (c *pc) settle(n int) {
+	c.settled += n
+	c.consumer.pending.Add(-int64(n))
+	c.processed.Add(int64(n))
+	c.lastProgress.Store(c.consumer.clock.Now().UnixNano())
+	c.stuck.Store(false)
+}
+
+// stalled returns how long the partition consumer hasn't progressed for,
+// and whether it has records to process.
+func (c *pc) stalled(now time.Time) (time.Duration, bool) {
+	c.queueMu.Lock()
+	running := c.running
+	c.queueMu.Unlock()
+	if !running {
+		return 0, false
+	}
+	return now.Sub(time.Unix(0, c.lastProgress.Load())), true
+}
+
+// startProcessSpan starts the span for processing msg, as a child of the
+// trace context propagated in the record headers, if any.
+func (c *pc) startProcessSpan(ctx context.Context, msg *kgo.Record) (context.Context, trace.Span) {
+	ctx = c.consumer.propagator.Extract(ctx, (*headerCarrier)(&msg.Headers))
+	opts := []trace.SpanStartOption{
+		trace.WithSpanKind(trace.SpanKindConsumer),
+		trace.WithAttributes(
+			semconv.MessagingSystemKey.String("kafka"),
+			semconv.MessagingOperationReceive,
+			semconv.MessagingSourceName(string(c.topic)),
+			semconv.MessagingKafkaSourcePartition(int(msg.Partition)),
+		),
+	}
+	if !trace.SpanContextFromContext(ctx).IsRemote() {
+		// The record has no valid trace context. Don't use any span which
+		// may be in the record's context as the parent.
+		opts = append(opts, trace.WithNewRoot())
+	}
+	return c.consumer.tracer.Start(ctx, "Process", opts...)
+}
+
+// startProcessBatchSpan starts the span for processing a batch of records, as
+// a new root span linked to the trace context propagated in the headers of
+// each record, if any.
+func (c *pc) startProcessBatchSpan(ctx context.Context, msgs []*kgo.Record) (context.Context, trace.Span) {
+	var links []trace.Link
+	for _, msg := range msgs {
+		sc := trace.SpanContextFromContext(c.consumer.propagator.Extract(
+			context.Background(), (*headerCarrier)(&msg.Headers),
+		))
+		if sc.IsValid() {
+			links = append(links, trace.Link{SpanContext: sc})
+		}
+	}
+	return c.consumer.tracer.Start(ctx, "ProcessBatch",
+		trace.WithNewRoot(),
+		trace.WithSpanKind(trace.SpanKindConsumer),
+		trace.WithLinks(links...),
+		trace.WithAttributes(
+			semconv.MessagingSystemKey.String("kafka"),
+			semconv.MessagingOperationReceive,
+			semconv.MessagingSourceName(string(c.topic)),
+			semconv.MessagingKafkaSourcePartition(int(msgs[0].Partition)),
+			semconv.MessagingBatchMessageCount(len(msgs)),
+		),
+	)
+}
+
+// errRetryStopped is returned by process when the partition consumer is
+// stopped while waiting to retry a record, or to start processing it.
+var errRetryStopped = errors.New("kafka: record retry stopped")
+
+// process processes the record, retrying as configured by RetryConfig,
+// and returns the number of attempts made and the last processing error.
+// The partition is paused while waiting to retry the record.
+func (c *pc) process(ctx context.Context, msg *kgo.Record, record apmqueue.Record) (int, error) {
+	cfg := c.consumer.retry
+	err := c.processOnce(ctx, record)
+	if err == nil || errors.Is(err, errRetryStopped) || !cfg.retryable(err, 1) {
+		return 1, err
+	}
+	defer c.consumer.pausePartitions(c.client, map[string][]int32{
+		msg.Topic: {msg.Partition},
+	})()
+	attempts := 1
+	for ; err != nil && cfg.retryable(err, attempts); attempts++ {
+		backoff := cfg.backoff(attempts)
+		c.logger.Debug("retrying record",
+			zap.Error(err),
+			zap.Int64("offset", msg.Offset),
+			zap.Int("attempts", attempts),
+			zap.Duration("backoff", backoff),
+		)
+		if !c.backoff(backoff) {
+			return attempts, errRetryStopped
+		}
+		if err = c.processOnce(ctx, record); errors.Is(err, errRetryStopped) {
+			return attempts, err
+		}
+	}
+	return attempts, err
+}
+
+// processOnce calls Process with the record once a processing slot is
+// acquired.
+func (c *pc) processOnce(ctx context.Context, record apmqueue.Record) error {
+	release, ok := c.acquire()
+	if !ok {
+		return errRetryStopped
+	}
+	defer release()
+	return c.processor.Process(ctx, record)
+}
+
+// processBatchOnce calls ProcessBatch with the records once a processing
+// slot is acquired.
+func (c *pc) processBatchOnce(ctx context.Context, records []apmqueue.Record) error {
+	release, ok := c.acquire()
+	if !ok {
+		return errRetryStopped
+	}
+	defer release()
+	return c.consumer.batch.ProcessBatch(ctx, records)
+}
+
+// acquire waits for a processing slot when MaxConcurrency is set, returning
+// the function to release it, or false if the partition consumer is stopped
+// in the meantime.
+func (c *pc) acquire() (release func(), ok bool) {
+	if c.consumer.limiter == nil {
+		return func() {}, true
+	}
+	select {
+	case c.consumer.limiter <- struct{}{}:
+		return func() { <-c.consumer.limiter }, true
+	case <-c.stopping:
+	case <-c.consumer.ctx.Done():
+	}
+	return nil, false
+}
+
+// pause pauses fetching the partitions the records belong to, returning the
+// function to release the pause, see consumer.pausePartitions.
+func (c *pc) pause(msgs ...*kgo.Record) (resume func()) {
+	partitions := make(map[string][]int32)
+	for _, msg := range msgs {
+		if !slices.Contains(partitions[msg.Topic], msg.Partition) {
+			partitions[msg.Topic] = append(partitions[msg.Topic], msg.Partition)
+		}
+	}
+	return c.consumer.pausePartitions(c.client, partitions)
+}
+
+// backoff waits for the duration, returning false if the partition consumer
+// is stopped in the meantime.
+func (c *pc) backoff(d time.Duration) bool {
+	timer := c.consumer.clock.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C():
+		return true
+	case <-c.stopping:
+	case <-c.consumer.ctx.Done():
+	}
+	return false
+}
+
+// produceDeadLetter synchronously produces msg to the dead letter topic,
+// adding headers describing why it failed to be processed.
+func (c *pc) produceDeadLetter(msg *kgo.Record, attempts int, processErr error) error {
+	headers := make([]kgo.RecordHeader, len(msg.Headers), len(msg.Headers)+5)
+	copy(headers, msg.Headers)
+	headers = append(headers,
+		kgo.RecordHeader{Key: "dlq-original-topic", Value: []byte(c.topic)},
+		kgo.RecordHeader{Key: "dlq-original-partition", Value: []byte(strconv.Itoa(int(msg.Partition)))},
+		kgo.RecordHeader{Key: "dlq-original-offset", Value: []byte(strconv.FormatInt(msg.Offset, 10))},
+		kgo.RecordHeader{Key: "dlq-attempts", Value: []byte(strconv.Itoa(attempts))},
+		kgo.RecordHeader{Key: "dlq-error", Value: []byte(processErr.Error())},
+	)
+	return c.client.ProduceSync(c.consumer.ctx, &kgo.Record{
+		Topic:   c.consumer.deadLetterTopic,
+		Key:     msg.Key,
+		Value:   msg.Value,
+		Headers: headers,
+	}).FirstErr()
+}
+
+// wait blocks until all the records have been processed, including the
+// queued records, or discarded once the processing context is canceled.
+//
+// Any pending record retries are interrupted, leaving the records uncommitted.
+func (c *pc) wait() error {
+	c.stopOnce.Do(func() { close(c.stopping) })
+	return c.g.Wait()
+}
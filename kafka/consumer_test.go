@@ -18,24 +18,41 @@
 package kafka
 
 import (
+	"bytes"
 	"context"
 	"crypto/tls"
 	"errors"
+	"fmt"
+	"maps"
 	"math"
+	"regexp"
+	"slices"
+	"sort"
 	"strconv"
+	"sync"
 	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"github.com/twmb/franz-go/pkg/kadm"
+	"github.com/twmb/franz-go/pkg/kerr"
 	"github.com/twmb/franz-go/pkg/kfake"
 	"github.com/twmb/franz-go/pkg/kgo"
+	"github.com/twmb/franz-go/pkg/kmsg"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
 	sdktrace "go.opentelemetry.io/otel/sdk/trace"
 	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	semconv "go.opentelemetry.io/otel/semconv/v1.17.0"
+	"go.opentelemetry.io/otel/trace"
 	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
 	"go.uber.org/zap/zaptest"
+	"go.uber.org/zap/zaptest/observer"
 
 	apmqueue "github.com/elastic/apm-queue/v2"
 	"github.com/elastic/apm-queue/v2/queuecontext"
@@ -61,6 +78,301 @@ func TestNewConsumer(t *testing.T) {
 			},
 			expectErr: true,
 		},
+		"group processor with processor": {
+			cfg: ConsumerConfig{
+				CommonConfig: CommonConfig{
+					Brokers: []string{"localhost:9092"},
+					Logger:  zapTest(t),
+				},
+				Topics:    []apmqueue.Topic{"topic"},
+				GroupID:   "groupid",
+				Processor: apmqueue.ProcessorFunc(func(context.Context, apmqueue.Record) error { return nil }),
+				GroupProcessor: GroupProcessorFunc(func(context.Context, []byte, []apmqueue.Record) error {
+					return nil
+				}),
+			},
+			expectErr: true,
+		},
+		"snapshot without partitions": {
+			cfg: ConsumerConfig{
+				CommonConfig: CommonConfig{
+					Brokers: []string{"localhost:9092"},
+					Logger:  zapTest(t),
+				},
+				Topics:    []apmqueue.Topic{"topic"},
+				GroupID:   "groupid",
+				Processor: apmqueue.ProcessorFunc(func(context.Context, apmqueue.Record) error { return nil }),
+				Snapshot:  true,
+			},
+			expectErr: true,
+		},
+		"max poll wait too short": {
+			cfg: ConsumerConfig{
+				CommonConfig: CommonConfig{
+					Brokers: []string{"localhost:9092"},
+					Logger:  zapTest(t),
+				},
+				Topics:      []apmqueue.Topic{"topic"},
+				GroupID:     "groupid",
+				Processor:   apmqueue.ProcessorFunc(func(context.Context, apmqueue.Record) error { return nil }),
+				MaxPollWait: time.Millisecond,
+			},
+			expectErr: true,
+		},
+		"max poll wait too long": {
+			cfg: ConsumerConfig{
+				CommonConfig: CommonConfig{
+					Brokers: []string{"localhost:9092"},
+					Logger:  zapTest(t),
+				},
+				Topics:      []apmqueue.Topic{"topic"},
+				GroupID:     "groupid",
+				Processor:   apmqueue.ProcessorFunc(func(context.Context, apmqueue.Record) error { return nil }),
+				MaxPollWait: time.Hour,
+			},
+			expectErr: true,
+		},
+		"unknown isolation level": {
+			cfg: ConsumerConfig{
+				CommonConfig: CommonConfig{
+					Brokers: []string{"localhost:9092"},
+					Logger:  zapTest(t),
+				},
+				Topics:         []apmqueue.Topic{"topic"},
+				GroupID:        "groupid",
+				Processor:      apmqueue.ProcessorFunc(func(context.Context, apmqueue.Record) error { return nil }),
+				IsolationLevel: 10,
+			},
+			expectErr: true,
+		},
+		"invalid retry config": {
+			cfg: ConsumerConfig{
+				CommonConfig: CommonConfig{
+					Brokers: []string{"localhost:9092"},
+					Logger:  zapTest(t),
+				},
+				Topics:      []apmqueue.Topic{"topic"},
+				GroupID:     "groupid",
+				Processor:   apmqueue.ProcessorFunc(func(context.Context, apmqueue.Record) error { return nil }),
+				RetryConfig: RetryConfig{MaxAttempts: 3, Multiplier: 0.5},
+			},
+			expectErr: true,
+		},
+		"negative max concurrency": {
+			cfg: ConsumerConfig{
+				CommonConfig: CommonConfig{
+					Brokers: []string{"localhost:9092"},
+					Logger:  zapTest(t),
+				},
+				Topics:         []apmqueue.Topic{"topic"},
+				GroupID:        "groupid",
+				Processor:      apmqueue.ProcessorFunc(func(context.Context, apmqueue.Record) error { return nil }),
+				MaxConcurrency: -1,
+			},
+			expectErr: true,
+		},
+		"negative max decompressed record bytes": {
+			cfg: ConsumerConfig{
+				CommonConfig: CommonConfig{
+					Brokers: []string{"localhost:9092"},
+					Logger:  zapTest(t),
+				},
+				Topics:                     []apmqueue.Topic{"topic"},
+				GroupID:                    "groupid",
+				Processor:                  apmqueue.ProcessorFunc(func(context.Context, apmqueue.Record) error { return nil }),
+				MaxDecompressedRecordBytes: -1,
+			},
+			expectErr: true,
+		},
+		"end offsets and end timestamp": {
+			cfg: ConsumerConfig{
+				CommonConfig: CommonConfig{
+					Brokers: []string{"localhost:9092"},
+					Logger:  zapTest(t),
+				},
+				Topics:       []apmqueue.Topic{"topic"},
+				GroupID:      "groupid",
+				Processor:    apmqueue.ProcessorFunc(func(context.Context, apmqueue.Record) error { return nil }),
+				EndOffsets:   map[TopicPartition]int64{{Topic: "topic"}: 1},
+				EndTimestamp: time.Now(),
+			},
+			expectErr: true,
+		},
+		"end offset of a topic not consumed": {
+			cfg: ConsumerConfig{
+				CommonConfig: CommonConfig{
+					Brokers: []string{"localhost:9092"},
+					Logger:  zapTest(t),
+				},
+				Topics:     []apmqueue.Topic{"topic"},
+				GroupID:    "groupid",
+				Processor:  apmqueue.ProcessorFunc(func(context.Context, apmqueue.Record) error { return nil }),
+				EndOffsets: map[TopicPartition]int64{{Topic: "other"}: 1},
+			},
+			expectErr: true,
+		},
+		"negative max record age": {
+			cfg: ConsumerConfig{
+				CommonConfig: CommonConfig{
+					Brokers: []string{"localhost:9092"},
+					Logger:  zapTest(t),
+				},
+				Topics:       []apmqueue.Topic{"topic"},
+				GroupID:      "groupid",
+				Processor:    apmqueue.ProcessorFunc(func(context.Context, apmqueue.Record) error { return nil }),
+				MaxRecordAge: -time.Second,
+			},
+			expectErr: true,
+		},
+		"negative stuck partition threshold": {
+			cfg: ConsumerConfig{
+				CommonConfig: CommonConfig{
+					Brokers: []string{"localhost:9092"},
+					Logger:  zapTest(t),
+				},
+				Topics:                  []apmqueue.Topic{"topic"},
+				GroupID:                 "groupid",
+				Processor:               apmqueue.ProcessorFunc(func(context.Context, apmqueue.Record) error { return nil }),
+				StuckPartitionThreshold: -time.Second,
+			},
+			expectErr: true,
+		},
+		"commit interval with at most once delivery": {
+			cfg: ConsumerConfig{
+				CommonConfig: CommonConfig{
+					Brokers: []string{"localhost:9092"},
+					Logger:  zapTest(t),
+				},
+				Topics:         []apmqueue.Topic{"topic"},
+				GroupID:        "groupid",
+				Processor:      apmqueue.ProcessorFunc(func(context.Context, apmqueue.Record) error { return nil }),
+				CommitInterval: time.Second,
+			},
+			expectErr: true,
+		},
+		"topics and topic regex": {
+			cfg: ConsumerConfig{
+				CommonConfig: CommonConfig{
+					Brokers: []string{"localhost:9092"},
+					Logger:  zapTest(t),
+				},
+				Topics:     []apmqueue.Topic{"topic"},
+				TopicRegex: regexp.MustCompile("topic.*"),
+				GroupID:    "groupid",
+				Processor:  apmqueue.ProcessorFunc(func(context.Context, apmqueue.Record) error { return nil }),
+			},
+			expectErr: true,
+		},
+		"processor middleware with batch processor": {
+			cfg: ConsumerConfig{
+				CommonConfig: CommonConfig{
+					Brokers: []string{"localhost:9092"},
+					Logger:  zapTest(t),
+				},
+				Topics:  []apmqueue.Topic{"topic"},
+				GroupID: "groupid",
+				BatchProcessor: apmqueue.BatchProcessorFunc(func(context.Context, []apmqueue.Record) error {
+					return nil
+				}),
+				ProcessorMiddleware: []ProcessorMiddleware{RecoverMiddleware},
+			},
+			expectErr: true,
+		},
+		"unknown initial offset": {
+			cfg: ConsumerConfig{
+				CommonConfig: CommonConfig{
+					Brokers: []string{"localhost:9092"},
+					Logger:  zapTest(t),
+				},
+				Topics:        []apmqueue.Topic{"topic"},
+				GroupID:       "groupid",
+				Processor:     apmqueue.ProcessorFunc(func(context.Context, apmqueue.Record) error { return nil }),
+				InitialOffset: LatestOffset + 1,
+			},
+			expectErr: true,
+		},
+		"value processor without deserializer": {
+			cfg: ConsumerConfig{
+				CommonConfig: CommonConfig{
+					Brokers: []string{"localhost:9092"},
+					Logger:  zapTest(t),
+				},
+				Topics:  []apmqueue.Topic{"topic"},
+				GroupID: "groupid",
+				ValueProcessor: ValueProcessorFunc(func(context.Context, apmqueue.Record, any) error {
+					return nil
+				}),
+			},
+			expectErr: true,
+		},
+		"value processor and processor": {
+			cfg: ConsumerConfig{
+				CommonConfig: CommonConfig{
+					Brokers: []string{"localhost:9092"},
+					Logger:  zapTest(t),
+				},
+				Topics:       []apmqueue.Topic{"topic"},
+				GroupID:      "groupid",
+				Processor:    apmqueue.ProcessorFunc(func(context.Context, apmqueue.Record) error { return nil }),
+				Deserializer: &framingSerializer{},
+				ValueProcessor: ValueProcessorFunc(func(context.Context, apmqueue.Record, any) error {
+					return nil
+				}),
+			},
+			expectErr: true,
+		},
+		"deserializer without value processor": {
+			cfg: ConsumerConfig{
+				CommonConfig: CommonConfig{
+					Brokers: []string{"localhost:9092"},
+					Logger:  zapTest(t),
+				},
+				Topics:       []apmqueue.Topic{"topic"},
+				GroupID:      "groupid",
+				Processor:    apmqueue.ProcessorFunc(func(context.Context, apmqueue.Record) error { return nil }),
+				Deserializer: &framingSerializer{},
+			},
+			expectErr: true,
+		},
+		"unknown offset out of range policy": {
+			cfg: ConsumerConfig{
+				CommonConfig: CommonConfig{
+					Brokers: []string{"localhost:9092"},
+					Logger:  zapTest(t),
+				},
+				Topics:             []apmqueue.Topic{"topic"},
+				GroupID:            "groupid",
+				Processor:          apmqueue.ProcessorFunc(func(context.Context, apmqueue.Record) error { return nil }),
+				OnOffsetOutOfRange: OffsetOutOfRangeLatest + 1,
+			},
+			expectErr: true,
+		},
+		"missing topic processor": {
+			cfg: ConsumerConfig{
+				CommonConfig: CommonConfig{
+					Brokers: []string{"localhost:9092"},
+					Logger:  zapTest(t),
+				},
+				Topics:  []apmqueue.Topic{"topic", "other"},
+				GroupID: "groupid",
+				TopicProcessors: map[apmqueue.Topic]apmqueue.Processor{
+					"topic": apmqueue.ProcessorFunc(func(context.Context, apmqueue.Record) error { return nil }),
+				},
+			},
+			expectErr: true,
+		},
+		"group and partitions": {
+			cfg: ConsumerConfig{
+				CommonConfig: CommonConfig{
+					Brokers: []string{"localhost:9092"},
+					Logger:  zapTest(t),
+				},
+				GroupID:    "groupid",
+				Partitions: map[string][]int32{"topic": {0}},
+				Processor:  apmqueue.ProcessorFunc(func(context.Context, apmqueue.Record) error { return nil }),
+			},
+			expectErr: true,
+		},
 		"valid": {
 			cfg: ConsumerConfig{
 				CommonConfig: CommonConfig{
@@ -139,6 +451,50 @@ func TestConsumerHealth(t *testing.T) {
 	}
 }
 
+func TestConsumerHealthState(t *testing.T) {
+	newHealthyConsumer := func(t *testing.T) *Consumer {
+		_, addrs := newClusterWithTopics(t, 1, "topic")
+		consumer := newConsumer(t, ConsumerConfig{
+			CommonConfig: CommonConfig{
+				Brokers: addrs,
+				Logger:  zapTest(t),
+			},
+			Topics:    []apmqueue.Topic{"topic"},
+			GroupID:   "groupid",
+			Processor: apmqueue.ProcessorFunc(func(context.Context, apmqueue.Record) error { return nil }),
+		})
+		require.NoError(t, consumer.Healthy(context.Background()))
+		return consumer
+	}
+	t.Run("group membership lost", func(t *testing.T) {
+		consumer := newHealthyConsumer(t)
+		groupErr := errors.New("heartbeat failed")
+		consumer.consumer.OnGroupManageError(groupErr)
+		err := consumer.Healthy(context.Background())
+		assert.ErrorIs(t, err, ErrConsumerUnhealthy)
+		assert.ErrorIs(t, err, groupErr)
+
+		// Rejoining the group assigns partitions again.
+		consumer.consumer.assigned(context.Background(), consumer.client, nil)
+		assert.NoError(t, consumer.Healthy(context.Background()))
+	})
+	t.Run("fetch errors", func(t *testing.T) {
+		consumer := newHealthyConsumer(t)
+		fetchErr := errors.New("fetch failed")
+		for i := 0; i < maxFetchErrors-1; i++ {
+			consumer.consumer.fetched(fetchErr)
+			assert.NoError(t, consumer.Healthy(context.Background()))
+		}
+		consumer.consumer.fetched(fetchErr)
+		err := consumer.Healthy(context.Background())
+		assert.ErrorIs(t, err, ErrConsumerUnhealthy)
+		assert.ErrorIs(t, err, fetchErr)
+
+		consumer.consumer.fetched(nil)
+		assert.NoError(t, consumer.Healthy(context.Background()))
+	})
+}
+
 func TestConsumerInstrumentation(t *testing.T) {
 	const partitions = 4
 	exp := tracetest.NewInMemoryExporter()
@@ -711,6 +1067,69 @@ func TestConsumerRunError(t *testing.T) {
 	})
 }
 
+func TestConsumerRunCanceled(t *testing.T) {
+	t.Run("drained", func(t *testing.T) {
+		client, addrs := newClusterWithTopics(t, 1, "topic")
+		started := make(chan struct{})
+		release := make(chan struct{})
+		var processed atomic.Bool
+		consumer := newConsumer(t, ConsumerConfig{
+			CommonConfig: CommonConfig{
+				Brokers: addrs,
+				Logger:  zapTest(t),
+			},
+			Topics:  []apmqueue.Topic{"topic"},
+			GroupID: "groupid",
+			Processor: apmqueue.ProcessorFunc(func(context.Context, apmqueue.Record) error {
+				close(started)
+				<-release
+				processed.Store(true)
+				return nil
+			}),
+		})
+		produceRecord(context.Background(), t, client, &kgo.Record{Topic: "topic", Value: []byte("{}")})
+		ctx, cancel := context.WithCancel(context.Background())
+		errc := make(chan error, 1)
+		go func() { errc <- consumer.Run(ctx) }()
+		<-started
+		cancel()
+		select {
+		case err := <-errc:
+			t.Fatalf("Run returned before the records were processed: %v", err)
+		case <-time.After(50 * time.Millisecond):
+		}
+		close(release)
+		require.NoError(t, <-errc)
+		assert.True(t, processed.Load())
+	})
+	t.Run("timeout", func(t *testing.T) {
+		client, addrs := newClusterWithTopics(t, 1, "topic")
+		started := make(chan struct{})
+		consumer := newConsumer(t, ConsumerConfig{
+			CommonConfig: CommonConfig{
+				Brokers: addrs,
+				Logger:  zapTest(t),
+			},
+			Topics:              []apmqueue.Topic{"topic"},
+			GroupID:             "groupid",
+			MaxPollWait:         50 * time.Millisecond,
+			ShutdownGracePeriod: 50 * time.Millisecond,
+			Processor: apmqueue.ProcessorFunc(func(context.Context, apmqueue.Record) error {
+				close(started)
+				time.Sleep(500 * time.Millisecond)
+				return nil
+			}),
+		})
+		produceRecord(context.Background(), t, client, &kgo.Record{Topic: "topic", Value: []byte("{}")})
+		ctx, cancel := context.WithCancel(context.Background())
+		errc := make(chan error, 1)
+		go func() { errc <- consumer.Run(ctx) }()
+		<-started
+		cancel()
+		assert.ErrorIs(t, <-errc, ErrShutdownTimeout)
+	})
+}
+
 func TestConsumerTopicLogFieldFunc(t *testing.T) {
 	t.Run("empty field", func(t *testing.T) {
 		const partitions = 2
@@ -763,18 +1182,2756 @@ func TestConsumerTopicLogFieldFunc(t *testing.T) {
 	})
 }
 
-func newConsumer(t testing.TB, cfg ConsumerConfig) *Consumer {
-	if cfg.MaxPollWait <= 0 {
-		// Lower MaxPollWait, ShutdownGracePeriod to speed up execution.
-		cfg.MaxPollWait = 50 * time.Millisecond
-		cfg.ShutdownGracePeriod = time.Second
+func TestConsumerManualCommit(t *testing.T) {
+	test := func(t *testing.T, dt apmqueue.DeliveryType) {
+		topic := "topic"
+		client, addrs := newClusterWithTopics(t, 1, topic)
+		var processed atomic.Int64
+		consumer := newConsumer(t, ConsumerConfig{
+			CommonConfig: CommonConfig{
+				Brokers: addrs,
+				Logger:  zap.NewNop(),
+			},
+			Topics:            []apmqueue.Topic{apmqueue.Topic(topic)},
+			GroupID:           "groupid",
+			Delivery:          dt,
+			DisableAutoCommit: true,
+			Processor: apmqueue.ProcessorFunc(func(_ context.Context, r apmqueue.Record) error {
+				processed.Add(1)
+				return nil
+			}),
+		})
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		for i := 0; i < 3; i++ {
+			produceRecord(ctx, t, client, &kgo.Record{Topic: topic, Value: []byte("x")})
+		}
+		go consumer.Run(ctx)
+		require.Eventually(t, func() bool {
+			return processed.Load() == 3
+		}, 5*time.Second, 10*time.Millisecond)
+
+		adminClient := kadm.NewClient(client)
+		committedOffset := func() int64 {
+			offsets, err := adminClient.FetchOffsets(ctx, "groupid")
+			require.NoError(t, err)
+			o, ok := offsets.Lookup(topic, 0)
+			if !ok {
+				return -1
+			}
+			return o.At
+		}
+		assert.Equal(t, int64(-1), committedOffset())
+
+		require.NoError(t, consumer.Commit(ctx))
+		assert.Equal(t, int64(3), committedOffset())
+		// Committing again without new records is a no-op.
+		require.NoError(t, consumer.Commit(ctx))
+		assert.Equal(t, int64(3), committedOffset())
 	}
-	consumer, err := NewConsumer(cfg)
-	require.NoError(t, err)
-	t.Cleanup(func() {
-		assert.NoError(t, consumer.Close())
+	t.Run("AMOD", func(t *testing.T) { test(t, apmqueue.AtMostOnceDeliveryType) })
+	t.Run("ALOD", func(t *testing.T) { test(t, apmqueue.AtLeastOnceDeliveryType) })
+	t.Run("auto_commit", func(t *testing.T) {
+		_, addrs := newClusterWithTopics(t, 1, "topic")
+		consumer := newConsumer(t, ConsumerConfig{
+			CommonConfig: CommonConfig{
+				Brokers: addrs,
+				Logger:  zap.NewNop(),
+			},
+			Topics:    []apmqueue.Topic{"topic"},
+			GroupID:   "groupid",
+			Processor: apmqueue.ProcessorFunc(func(context.Context, apmqueue.Record) error { return nil }),
+		})
+		assert.ErrorIs(t, consumer.Commit(context.Background()), ErrAutoCommitEnabled)
 	})
-	return consumer
+}
+
+func TestConsumerCommittedOffsets(t *testing.T) {
+	test := func(t *testing.T, dt apmqueue.DeliveryType) {
+		topic := "topic"
+		client, addrs := newClusterWithTopics(t, 1, topic)
+		var processed atomic.Int64
+		consumer := newConsumer(t, ConsumerConfig{
+			CommonConfig: CommonConfig{
+				Brokers: addrs,
+				Logger:  zap.NewNop(),
+			},
+			Topics:   []apmqueue.Topic{apmqueue.Topic(topic)},
+			GroupID:  "groupid",
+			Delivery: dt,
+			Processor: apmqueue.ProcessorFunc(func(_ context.Context, r apmqueue.Record) error {
+				processed.Add(1)
+				return nil
+			}),
+		})
+		committed := consumer.CommittedOffsets()
+		require.NotNil(t, committed)
+		assert.Empty(t, committed)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		for i := 0; i < 3; i++ {
+			produceRecord(ctx, t, client, &kgo.Record{Topic: topic, Value: []byte("x")})
+		}
+		go consumer.Run(ctx)
+		require.Eventually(t, func() bool {
+			return processed.Load() == 3
+		}, 5*time.Second, 10*time.Millisecond)
+		assert.Eventually(t, func() bool {
+			return maps.Equal(map[TopicPartition]int64{
+				{Topic: apmqueue.Topic(topic), Partition: 0}: 3,
+			}, consumer.CommittedOffsets())
+		}, 5*time.Second, 10*time.Millisecond)
+	}
+	t.Run("AMOD", func(t *testing.T) { test(t, apmqueue.AtMostOnceDeliveryType) })
+	t.Run("ALOD", func(t *testing.T) { test(t, apmqueue.AtLeastOnceDeliveryType) })
+}
+
+func TestConsumerCommitInterval(t *testing.T) {
+	topic := "topic"
+	tp := TopicPartition{Topic: apmqueue.Topic(topic), Partition: 0}
+	newCommitConsumer := func(t *testing.T, addrs []string, interval time.Duration,
+		rdr sdkmetric.Reader, p apmqueue.Processor,
+	) *Consumer {
+		return newConsumer(t, ConsumerConfig{
+			CommonConfig: CommonConfig{
+				Brokers:       addrs,
+				Logger:        zap.NewNop(),
+				MeterProvider: sdkmetric.NewMeterProvider(sdkmetric.WithReader(rdr)),
+			},
+			Topics:         []apmqueue.Topic{apmqueue.Topic(topic)},
+			GroupID:        "groupid",
+			Delivery:       apmqueue.AtLeastOnceDeliveryType,
+			CommitInterval: interval,
+			Processor:      p,
+		})
+	}
+	t.Run("periodic", func(t *testing.T) {
+		client, addrs := newClusterWithTopics(t, 1, topic)
+		rdr := sdkmetric.NewManualReader()
+		release := make(chan struct{})
+		var processed atomic.Int64
+		consumer := newCommitConsumer(t, addrs, 10*time.Millisecond, rdr,
+			apmqueue.ProcessorFunc(func(_ context.Context, r apmqueue.Record) error {
+				if string(r.Value) == "block" {
+					<-release
+				}
+				processed.Add(1)
+				return nil
+			}),
+		)
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		for _, v := range []string{"x", "block", "x"} {
+			produceRecord(ctx, t, client, &kgo.Record{Topic: topic, Value: []byte(v)})
+		}
+		go consumer.Run(ctx)
+
+		// The offset never advances past the record being processed.
+		require.Eventually(t, func() bool {
+			return consumer.CommittedOffsets()[tp] == 1
+		}, 5*time.Second, 10*time.Millisecond)
+		time.Sleep(50 * time.Millisecond)
+		assert.Equal(t, int64(1), consumer.CommittedOffsets()[tp])
+
+		close(release)
+		require.Eventually(t, func() bool {
+			return consumer.CommittedOffsets()[tp] == 3
+		}, 5*time.Second, 10*time.Millisecond)
+
+		var rm metricdata.ResourceMetrics
+		require.NoError(t, rdr.Collect(ctx, &rm))
+		var found bool
+		for _, sm := range rm.ScopeMetrics {
+			for _, m := range sm.Metrics {
+				if m.Name != "consumer.commit.last_success" {
+					continue
+				}
+				found = true
+				dps := m.Data.(metricdata.Gauge[float64]).DataPoints
+				require.Len(t, dps, 1)
+				assert.Equal(t, attribute.NewSet(
+					attribute.String("group", "groupid"),
+					attribute.String("topic", topic),
+					attribute.Int("partition", 0),
+				), dps[0].Attributes)
+				assert.InDelta(t, float64(time.Now().Unix()), dps[0].Value, 5)
+			}
+		}
+		assert.True(t, found, "consumer.commit.last_success metric not found")
+	})
+	t.Run("close", func(t *testing.T) {
+		client, addrs := newClusterWithTopics(t, 1, topic)
+		var processed atomic.Int64
+		consumer := newCommitConsumer(t, addrs, time.Hour, sdkmetric.NewManualReader(),
+			apmqueue.ProcessorFunc(func(context.Context, apmqueue.Record) error {
+				processed.Add(1)
+				return nil
+			}),
+		)
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		for i := 0; i < 3; i++ {
+			produceRecord(ctx, t, client, &kgo.Record{Topic: topic, Value: []byte("x")})
+		}
+		go consumer.Run(ctx)
+		require.Eventually(t, func() bool {
+			return processed.Load() == 3
+		}, 5*time.Second, 10*time.Millisecond)
+		assert.Empty(t, consumer.CommittedOffsets())
+
+		// The final commit happens when the consumer is closed.
+		require.NoError(t, consumer.Close())
+		offsets, err := kadm.NewClient(client).FetchOffsets(ctx, "groupid")
+		require.NoError(t, err)
+		offset, ok := offsets.Lookup(topic, 0)
+		require.True(t, ok)
+		assert.Equal(t, int64(3), offset.At)
+	})
+}
+
+func TestConsumerInitialOffset(t *testing.T) {
+	test := func(t *testing.T, commit bool) {
+		topic := "topic"
+		client, addrs := newClusterWithTopics(t, 1, topic)
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		for i := 0; i < 3; i++ {
+			produceRecord(ctx, t, client, &kgo.Record{Topic: topic, Value: []byte("old")})
+		}
+		cfg := ConsumerConfig{
+			CommonConfig: CommonConfig{
+				Brokers: addrs,
+				Logger:  zap.NewNop(),
+			},
+			Topics:  []apmqueue.Topic{apmqueue.Topic(topic)},
+			GroupID: "groupid",
+		}
+		if commit {
+			// Commit the existing records, and produce records which
+			// haven't been committed yet.
+			committingCfg := cfg
+			committingCfg.Processor = apmqueue.ProcessorFunc(func(context.Context, apmqueue.Record) error {
+				return nil
+			})
+			consumer := newConsumer(t, committingCfg)
+			go consumer.Run(ctx)
+			require.Eventually(t, func() bool {
+				return consumer.CommittedOffsets()[TopicPartition{Topic: apmqueue.Topic(topic)}] == 3
+			}, 5*time.Second, 10*time.Millisecond)
+			require.NoError(t, consumer.Close())
+			for i := 0; i < 2; i++ {
+				produceRecord(ctx, t, client, &kgo.Record{Topic: topic, Value: []byte("uncommitted")})
+			}
+		}
+
+		var mu sync.Mutex
+		var processed []string
+		cfg.InitialOffset = LatestOffset
+		cfg.Processor = apmqueue.ProcessorFunc(func(_ context.Context, r apmqueue.Record) error {
+			mu.Lock()
+			defer mu.Unlock()
+			processed = append(processed, string(r.Value))
+			return nil
+		})
+		consumer := newConsumer(t, cfg)
+		go consumer.Run(ctx)
+		// Keep producing until records are consumed, since the end offset
+		// may be resolved after the first records are produced.
+		require.Eventually(t, func() bool {
+			produceRecord(ctx, t, client, &kgo.Record{Topic: topic, Value: []byte("new")})
+			mu.Lock()
+			defer mu.Unlock()
+			return len(processed) > 0 && processed[len(processed)-1] == "new"
+		}, 5*time.Second, 50*time.Millisecond)
+
+		mu.Lock()
+		defer mu.Unlock()
+		if commit {
+			// Partitions with a committed offset resume from it.
+			require.GreaterOrEqual(t, len(processed), 2)
+			assert.Equal(t, []string{"uncommitted", "uncommitted"}, processed[:2])
+			processed = processed[2:]
+		}
+		assert.NotContains(t, processed, "old")
+		assert.NotContains(t, processed, "uncommitted")
+	}
+	t.Run("latest", func(t *testing.T) { test(t, false) })
+	t.Run("committed", func(t *testing.T) { test(t, true) })
+}
+
+func TestConsumerMaxDecompressedRecordBytes(t *testing.T) {
+	topic, dlt := "topic", "topic-dlq"
+	test := func(t *testing.T, batch bool) {
+		client, addrs := newClusterWithTopics(t, 1, topic, dlt)
+		rdr := sdkmetric.NewManualReader()
+		var mu sync.Mutex
+		var processed []string
+		cfg := ConsumerConfig{
+			CommonConfig: CommonConfig{
+				Brokers:       addrs,
+				Logger:        zap.NewNop(),
+				MeterProvider: sdkmetric.NewMeterProvider(sdkmetric.WithReader(rdr)),
+			},
+			Topics:                     []apmqueue.Topic{apmqueue.Topic(topic)},
+			GroupID:                    "groupid",
+			Delivery:                   apmqueue.AtLeastOnceDeliveryType,
+			DeadLetterTopic:            apmqueue.Topic(dlt),
+			MaxDecompressedRecordBytes: 6,
+		}
+		if batch {
+			cfg.BatchProcessor = apmqueue.BatchProcessorFunc(func(_ context.Context, rs []apmqueue.Record) error {
+				mu.Lock()
+				defer mu.Unlock()
+				for _, r := range rs {
+					processed = append(processed, string(r.Value))
+				}
+				return nil
+			})
+		} else {
+			cfg.Processor = apmqueue.ProcessorFunc(func(_ context.Context, r apmqueue.Record) error {
+				mu.Lock()
+				defer mu.Unlock()
+				processed = append(processed, string(r.Value))
+				return nil
+			})
+		}
+		consumer := newConsumer(t, cfg)
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		require.NoError(t, client.ProduceSync(ctx,
+			&kgo.Record{Topic: topic, Value: []byte("small")},
+			&kgo.Record{Topic: topic, Value: []byte("oversized")},
+			// The key counts towards the record size.
+			&kgo.Record{Topic: topic, Key: []byte("key"), Value: []byte("value")},
+		).FirstErr())
+		go consumer.Run(ctx)
+
+		// Rejected records which are produced to the dead letter topic
+		// are committed, even when they're the last fetched record.
+		require.Eventually(t, func() bool {
+			offsets, err := kadm.NewClient(client).FetchOffsets(ctx, "groupid")
+			require.NoError(t, err)
+			o, ok := offsets.Lookup(topic, 0)
+			return ok && o.At == 3
+		}, 5*time.Second, 10*time.Millisecond)
+		mu.Lock()
+		assert.Equal(t, []string{"small"}, processed)
+		mu.Unlock()
+
+		dltClient, err := kgo.NewClient(
+			kgo.SeedBrokers(addrs...),
+			kgo.ConsumeTopics(dlt),
+			kgo.ConsumeResetOffset(kgo.NewOffset().AtStart()),
+		)
+		require.NoError(t, err)
+		t.Cleanup(dltClient.Close)
+		fetchCtx, fetchCancel := context.WithTimeout(ctx, 5*time.Second)
+		defer fetchCancel()
+		var rejected []string
+		for len(rejected) < 2 {
+			fetches := dltClient.PollRecords(fetchCtx, 2)
+			require.NoError(t, fetches.Err())
+			for _, r := range fetches.Records() {
+				rejected = append(rejected, string(r.Value))
+			}
+		}
+		assert.ElementsMatch(t, []string{"oversized", "value"}, rejected)
+
+		var rm metricdata.ResourceMetrics
+		require.NoError(t, rdr.Collect(ctx, &rm))
+		var oversized int64
+		for _, sm := range rm.ScopeMetrics {
+			for _, m := range sm.Metrics {
+				if m.Name != "consumer.messages.oversized" {
+					continue
+				}
+				for _, dp := range m.Data.(metricdata.Sum[int64]).DataPoints {
+					oversized += dp.Value
+				}
+			}
+		}
+		assert.Equal(t, int64(2), oversized)
+	}
+	t.Run("processor", func(t *testing.T) { test(t, false) })
+	t.Run("batch_processor", func(t *testing.T) { test(t, true) })
+}
+
+func TestConsumerTransform(t *testing.T) {
+	topic, dlt := "topic", "topic-dlq"
+	errInvalid := errors.New("invalid record")
+	test := func(t *testing.T, batch bool) {
+		client, addrs := newClusterWithTopics(t, 1, topic, dlt)
+		var mu sync.Mutex
+		var processed []string
+		cfg := ConsumerConfig{
+			CommonConfig: CommonConfig{
+				Brokers: addrs,
+				Logger:  zap.NewNop(),
+			},
+			Topics:          []apmqueue.Topic{apmqueue.Topic(topic)},
+			GroupID:         "groupid",
+			Delivery:        apmqueue.AtLeastOnceDeliveryType,
+			DeadLetterTopic: apmqueue.Topic(dlt),
+			Transform: func(_ context.Context, r *apmqueue.Record) error {
+				if string(r.Value) == "invalid" {
+					return errInvalid
+				}
+				r.Value = bytes.ToUpper(r.Value)
+				return nil
+			},
+		}
+		if batch {
+			cfg.BatchProcessor = apmqueue.BatchProcessorFunc(func(_ context.Context, rs []apmqueue.Record) error {
+				mu.Lock()
+				defer mu.Unlock()
+				for _, r := range rs {
+					processed = append(processed, string(r.Value))
+				}
+				return nil
+			})
+		} else {
+			cfg.Processor = apmqueue.ProcessorFunc(func(_ context.Context, r apmqueue.Record) error {
+				mu.Lock()
+				defer mu.Unlock()
+				processed = append(processed, string(r.Value))
+				return nil
+			})
+		}
+		consumer := newConsumer(t, cfg)
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		require.NoError(t, client.ProduceSync(ctx,
+			&kgo.Record{Topic: topic, Value: []byte("a")},
+			&kgo.Record{Topic: topic, Value: []byte("invalid")},
+			&kgo.Record{Topic: topic, Value: []byte("b")},
+		).FirstErr())
+		go consumer.Run(ctx)
+
+		require.Eventually(t, func() bool {
+			offsets, err := kadm.NewClient(client).FetchOffsets(ctx, "groupid")
+			require.NoError(t, err)
+			o, ok := offsets.Lookup(topic, 0)
+			return ok && o.At == 3
+		}, 5*time.Second, 10*time.Millisecond)
+		mu.Lock()
+		assert.Equal(t, []string{"A", "B"}, processed)
+		mu.Unlock()
+
+		// Records which fail to be transformed are produced to the dead
+		// letter topic as they were consumed.
+		dltClient, err := kgo.NewClient(
+			kgo.SeedBrokers(addrs...),
+			kgo.ConsumeTopics(dlt),
+			kgo.ConsumeResetOffset(kgo.NewOffset().AtStart()),
+		)
+		require.NoError(t, err)
+		t.Cleanup(dltClient.Close)
+		fetchCtx, fetchCancel := context.WithTimeout(ctx, 5*time.Second)
+		defer fetchCancel()
+		fetches := dltClient.PollRecords(fetchCtx, 1)
+		require.NoError(t, fetches.Err())
+		records := fetches.Records()
+		require.Len(t, records, 1)
+		assert.Equal(t, "invalid", string(records[0].Value))
+	}
+	t.Run("processor", func(t *testing.T) { test(t, false) })
+	t.Run("batch_processor", func(t *testing.T) { test(t, true) })
+}
+
+func TestConsumerMaxRecordAge(t *testing.T) {
+	topic := "topic"
+	client, addrs := newClusterWithTopics(t, 1, topic)
+	rdr := sdkmetric.NewManualReader()
+	var mu sync.Mutex
+	var processed []string
+	consumer := newConsumer(t, ConsumerConfig{
+		CommonConfig: CommonConfig{
+			Brokers:       addrs,
+			Logger:        zap.NewNop(),
+			MeterProvider: sdkmetric.NewMeterProvider(sdkmetric.WithReader(rdr)),
+		},
+		Topics:       []apmqueue.Topic{apmqueue.Topic(topic)},
+		GroupID:      "groupid",
+		Delivery:     apmqueue.AtLeastOnceDeliveryType,
+		MaxRecordAge: time.Hour,
+		Processor: apmqueue.ProcessorFunc(func(_ context.Context, r apmqueue.Record) error {
+			mu.Lock()
+			defer mu.Unlock()
+			processed = append(processed, string(r.Value))
+			return nil
+		}),
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	now := time.Now()
+	require.NoError(t, client.ProduceSync(ctx,
+		&kgo.Record{Topic: topic, Value: []byte("stale"), Timestamp: now.Add(-2 * time.Hour)},
+		&kgo.Record{Topic: topic, Value: []byte("fresh"), Timestamp: now},
+		&kgo.Record{Topic: topic, Value: []byte("last_stale"), Timestamp: now.Add(-90 * time.Minute)},
+	).FirstErr())
+	go consumer.Run(ctx)
+
+	// Skipped records are committed, even when they're the last fetched
+	// record.
+	require.Eventually(t, func() bool {
+		offsets, err := kadm.NewClient(client).FetchOffsets(ctx, "groupid")
+		require.NoError(t, err)
+		o, ok := offsets.Lookup(topic, 0)
+		return ok && o.At == 3
+	}, 5*time.Second, 10*time.Millisecond)
+	mu.Lock()
+	assert.Equal(t, []string{"fresh"}, processed)
+	mu.Unlock()
+
+	var rm metricdata.ResourceMetrics
+	require.NoError(t, rdr.Collect(ctx, &rm))
+	var skipped int64
+	for _, sm := range rm.ScopeMetrics {
+		for _, m := range sm.Metrics {
+			if m.Name != "consumer.messages.skipped" {
+				continue
+			}
+			for _, dp := range m.Data.(metricdata.Sum[int64]).DataPoints {
+				skipped += dp.Value
+			}
+		}
+	}
+	assert.Equal(t, int64(2), skipped)
+}
+
+func TestConsumerE2ELatencyMetric(t *testing.T) {
+	topic := "topic"
+	client, addrs := newClusterWithTopics(t, 1, topic)
+	rdr := sdkmetric.NewManualReader()
+	consumer := newConsumer(t, ConsumerConfig{
+		CommonConfig: CommonConfig{
+			Brokers:       addrs,
+			Logger:        zap.NewNop(),
+			MeterProvider: sdkmetric.NewMeterProvider(sdkmetric.WithReader(rdr)),
+		},
+		Topics:    []apmqueue.Topic{apmqueue.Topic(topic)},
+		GroupID:   "groupid",
+		Delivery:  apmqueue.AtLeastOnceDeliveryType,
+		Processor: apmqueue.ProcessorFunc(func(context.Context, apmqueue.Record) error { return nil }),
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	now := time.Now()
+	require.NoError(t, client.ProduceSync(ctx,
+		&kgo.Record{Topic: topic, Value: []byte("old"), Timestamp: now.Add(-time.Hour)},
+		&kgo.Record{Topic: topic, Value: []byte("skewed"), Timestamp: now.Add(time.Hour)},
+	).FirstErr())
+	go consumer.Run(ctx)
+	require.Eventually(t, func() bool {
+		offsets, err := kadm.NewClient(client).FetchOffsets(ctx, "groupid")
+		require.NoError(t, err)
+		o, ok := offsets.Lookup(topic, 0)
+		return ok && o.At == 2
+	}, 5*time.Second, 10*time.Millisecond)
+
+	var rm metricdata.ResourceMetrics
+	require.NoError(t, rdr.Collect(ctx, &rm))
+	attrs := attribute.NewSet(
+		attribute.String("group", "groupid"),
+		attribute.String("topic", topic),
+	)
+	var latency *metricdata.HistogramDataPoint[float64]
+	var skewed int64
+	for _, sm := range rm.ScopeMetrics {
+		for _, m := range sm.Metrics {
+			switch m.Name {
+			case "consumer.record.e2e_latency":
+				dps := m.Data.(metricdata.Histogram[float64]).DataPoints
+				require.Len(t, dps, 1)
+				latency = &dps[0]
+			case "consumer.record.clock_skew":
+				for _, dp := range m.Data.(metricdata.Sum[int64]).DataPoints {
+					assert.Equal(t, attrs, dp.Attributes)
+					skewed += dp.Value
+				}
+			}
+		}
+	}
+	require.NotNil(t, latency)
+	assert.Equal(t, attrs, latency.Attributes)
+	assert.Equal(t, uint64(2), latency.Count)
+	// The latency of the skewed record is clamped to zero.
+	minLatency, _ := latency.Min.Value()
+	assert.Zero(t, minLatency)
+	assert.GreaterOrEqual(t, latency.Sum, time.Hour.Seconds())
+	assert.Less(t, latency.Sum, (time.Hour + time.Minute).Seconds())
+	assert.Equal(t, int64(1), skewed)
+}
+
+func TestConsumerStuckPartition(t *testing.T) {
+	topic := "topic"
+	client, addrs := newClusterWithTopics(t, 1, topic)
+	rdr := sdkmetric.NewManualReader()
+	core, logs := observer.New(zapcore.WarnLevel)
+	clock := newFakeClock(time.Now())
+	processing := make(chan struct{})
+	release := make(chan struct{})
+	consumer := newConsumer(t, ConsumerConfig{
+		CommonConfig: CommonConfig{
+			Brokers:       addrs,
+			Logger:        zap.New(core),
+			MeterProvider: sdkmetric.NewMeterProvider(sdkmetric.WithReader(rdr)),
+		},
+		Topics:                  []apmqueue.Topic{apmqueue.Topic(topic)},
+		GroupID:                 "groupid",
+		StuckPartitionThreshold: time.Minute,
+		Processor: apmqueue.ProcessorFunc(func(context.Context, apmqueue.Record) error {
+			processing <- struct{}{}
+			<-release
+			return nil
+		}),
+		clock: clock,
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	produceRecord(ctx, t, client, &kgo.Record{Topic: topic, Value: []byte("x")})
+	go consumer.Run(ctx)
+	select {
+	case <-processing:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the record to be processed")
+	}
+	assert.NoError(t, consumer.Healthy(ctx))
+
+	// The partition is stuck once it hasn't progressed for longer than the
+	// threshold while processing the record.
+	clock.Advance(time.Minute + time.Second)
+	err := consumer.Healthy(ctx)
+	assert.ErrorIs(t, err, ErrConsumerUnhealthy)
+	assert.EqualError(t, err, `health probe: kafka: consumer unhealthy: 1 partitions stuck, `+
+		`topic "topic" partition 0 hasn't progressed for 1m1s`)
+	require.Eventually(t, func() bool {
+		return logs.FilterMessage("partition processing stuck").Len() == 1
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// Once the record is processed, the partition is no longer stuck.
+	close(release)
+	require.Eventually(t, func() bool {
+		return consumer.Healthy(ctx) == nil
+	}, 5*time.Second, 10*time.Millisecond)
+
+	var rm metricdata.ResourceMetrics
+	require.NoError(t, rdr.Collect(ctx, &rm))
+	attrs := attribute.NewSet(
+		attribute.String("group", "groupid"),
+		attribute.String("topic", topic),
+		attribute.Int("partition", 0),
+	)
+	var processed, lastProgress []any
+	for _, sm := range rm.ScopeMetrics {
+		for _, m := range sm.Metrics {
+			switch m.Name {
+			case "consumer.partition.processed":
+				for _, dp := range m.Data.(metricdata.Sum[int64]).DataPoints {
+					assert.Equal(t, attrs, dp.Attributes)
+					processed = append(processed, dp.Value)
+				}
+			case "consumer.partition.last_progress":
+				for _, dp := range m.Data.(metricdata.Gauge[float64]).DataPoints {
+					assert.Equal(t, attrs, dp.Attributes)
+					lastProgress = append(lastProgress, dp.Value)
+				}
+			}
+		}
+	}
+	assert.Equal(t, []any{int64(1)}, processed)
+	assert.Equal(t, []any{float64(clock.Now().UnixNano()) / 1e9}, lastProgress)
+}
+
+func TestConsumerOnFetchError(t *testing.T) {
+	topic := "topic"
+	cluster, err := kfake.NewCluster(kfake.SeedTopics(1, topic))
+	require.NoError(t, err)
+	t.Cleanup(cluster.Close)
+	addrs := cluster.ListenAddrs()
+	client, err := kgo.NewClient(kgo.SeedBrokers(addrs...))
+	require.NoError(t, err)
+	t.Cleanup(client.Close)
+
+	// Fail the first fetch of the partition with a non-retriable error.
+	var injected atomic.Bool
+	cluster.ControlKey(kmsg.Fetch.Int16(), func(r kmsg.Request) (kmsg.Response, error, bool) {
+		cluster.KeepControl()
+		req := r.(*kmsg.FetchRequest)
+		if len(req.Topics) == 0 || injected.Swap(true) {
+			return nil, nil, false
+		}
+		resp := req.ResponseKind().(*kmsg.FetchResponse)
+		for _, t := range req.Topics {
+			respTopic := kmsg.NewFetchResponseTopic()
+			respTopic.Topic = t.Topic
+			respTopic.TopicID = t.TopicID
+			for _, p := range t.Partitions {
+				respPartition := kmsg.NewFetchResponseTopicPartition()
+				respPartition.Partition = p.Partition
+				respPartition.ErrorCode = kerr.TopicAuthorizationFailed.Code
+				respTopic.Partitions = append(respTopic.Partitions, respPartition)
+			}
+			resp.Topics = append(resp.Topics, respTopic)
+		}
+		return resp, nil, true
+	})
+
+	var mu sync.Mutex
+	var fetchErrs []error
+	var processed []string
+	consumer := newConsumer(t, ConsumerConfig{
+		CommonConfig: CommonConfig{
+			Brokers: addrs,
+			Logger:  zap.NewNop(),
+		},
+		Topics:  []apmqueue.Topic{apmqueue.Topic(topic)},
+		GroupID: "groupid",
+		OnFetchError: func(_ context.Context, err error) {
+			mu.Lock()
+			defer mu.Unlock()
+			fetchErrs = append(fetchErrs, err)
+		},
+		Processor: apmqueue.ProcessorFunc(func(_ context.Context, r apmqueue.Record) error {
+			mu.Lock()
+			defer mu.Unlock()
+			processed = append(processed, string(r.Value))
+			return nil
+		}),
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	require.NoError(t, client.ProduceSync(ctx,
+		&kgo.Record{Topic: topic, Value: []byte("a")},
+	).FirstErr())
+	go consumer.Run(ctx)
+
+	// The consumer keeps fetching records after the fetch error.
+	require.Eventually(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(processed) == 1
+	}, 5*time.Second, 10*time.Millisecond)
+	mu.Lock()
+	defer mu.Unlock()
+	require.Len(t, fetchErrs, 1)
+	var fetchErr *FetchError
+	require.ErrorAs(t, fetchErrs[0], &fetchErr)
+	assert.Equal(t, apmqueue.Topic(topic), fetchErr.Topic)
+	assert.Equal(t, int32(0), fetchErr.Partition)
+	assert.ErrorIs(t, fetchErr, ErrUnauthorized)
+	assert.ErrorIs(t, fetchErr, kerr.TopicAuthorizationFailed)
+	assert.EqualError(t, fetchErr, fmt.Sprintf(
+		"kafka: failed to fetch records of topic %q partition 0: %v", topic, classifyError(kerr.TopicAuthorizationFailed),
+	))
+}
+
+func TestConsumerOnOffsetOutOfRange(t *testing.T) {
+	for policy, expected := range map[OffsetOutOfRangePolicy][]string{
+		OffsetOutOfRangeEarliest: {"a", "b", "c", "d"},
+		OffsetOutOfRangeLatest:   {"d"},
+	} {
+		t.Run(policy.String(), func(t *testing.T) {
+			topic := "topic"
+			client, addrs := newClusterWithTopics(t, 1, topic)
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			require.NoError(t, client.ProduceSync(ctx,
+				&kgo.Record{Topic: topic, Value: []byte("a")},
+				&kgo.Record{Topic: topic, Value: []byte("b")},
+				&kgo.Record{Topic: topic, Value: []byte("c")},
+			).FirstErr())
+			// Join the group and commit an offset past the end of the
+			// partition.
+			member, err := kgo.NewClient(
+				kgo.SeedBrokers(addrs...),
+				kgo.ConsumerGroup("groupid"),
+				kgo.ConsumeTopics(topic),
+				kgo.DisableAutoCommit(),
+			)
+			require.NoError(t, err)
+			require.NoError(t, member.PollFetches(ctx).Err())
+			var commitErr error
+			member.CommitOffsetsSync(ctx, map[string]map[int32]kgo.EpochOffset{
+				topic: {0: {Epoch: -1, Offset: 10}},
+			}, func(_ *kgo.Client, _ *kmsg.OffsetCommitRequest, _ *kmsg.OffsetCommitResponse, err error) {
+				commitErr = err
+			})
+			require.NoError(t, commitErr)
+			member.Close()
+
+			core, logs := observer.New(zapcore.WarnLevel)
+			rdr := sdkmetric.NewManualReader()
+			var mu sync.Mutex
+			var processed []string
+			consumer := newConsumer(t, ConsumerConfig{
+				CommonConfig: CommonConfig{
+					Brokers:       addrs,
+					Logger:        zap.New(core),
+					MeterProvider: sdkmetric.NewMeterProvider(sdkmetric.WithReader(rdr)),
+				},
+				Topics:             []apmqueue.Topic{apmqueue.Topic(topic)},
+				GroupID:            "groupid",
+				OnOffsetOutOfRange: policy,
+				Processor: apmqueue.ProcessorFunc(func(_ context.Context, r apmqueue.Record) error {
+					mu.Lock()
+					defer mu.Unlock()
+					processed = append(processed, string(r.Value))
+					return nil
+				}),
+			})
+			go consumer.Run(ctx)
+
+			var reset []observer.LoggedEntry
+			require.Eventually(t, func() bool {
+				reset = logs.FilterMessage("reset out of range offset").AllUntimed()
+				return len(reset) > 0
+			}, 5*time.Second, 10*time.Millisecond)
+			require.NoError(t, client.ProduceSync(ctx,
+				&kgo.Record{Topic: topic, Value: []byte("d")},
+			).FirstErr())
+			require.Eventually(t, func() bool {
+				mu.Lock()
+				defer mu.Unlock()
+				return len(processed) == len(expected)
+			}, 5*time.Second, 10*time.Millisecond)
+			mu.Lock()
+			assert.Equal(t, expected, processed)
+			mu.Unlock()
+
+			require.Len(t, reset, 1)
+			fields := reset[0].ContextMap()
+			assert.Equal(t, topic, fields["topic"])
+			assert.Equal(t, int32(0), fields["partition"])
+			assert.Equal(t, int64(10), fields["previous_offset"])
+			if policy == OffsetOutOfRangeEarliest {
+				assert.Equal(t, int64(0), fields["offset"])
+			} else {
+				assert.Equal(t, int64(3), fields["offset"])
+			}
+
+			var rm metricdata.ResourceMetrics
+			require.NoError(t, rdr.Collect(ctx, &rm))
+			var resets int64
+			for _, sm := range rm.ScopeMetrics {
+				for _, m := range sm.Metrics {
+					if m.Name != "consumer.offset.resets" {
+						continue
+					}
+					for _, dp := range m.Data.(metricdata.Sum[int64]).DataPoints {
+						resets += dp.Value
+					}
+				}
+			}
+			assert.Equal(t, int64(1), resets)
+		})
+	}
+}
+
+func TestConsumerRack(t *testing.T) {
+	addrs := newClusterAddrWithTopics(t, 1, "topic")
+	newRackConsumer := func(t *testing.T, rack string) *Consumer {
+		return newConsumer(t, ConsumerConfig{
+			CommonConfig: CommonConfig{
+				Brokers: addrs,
+				Logger:  zap.NewNop(),
+			},
+			Topics:    []apmqueue.Topic{"topic"},
+			GroupID:   "groupid",
+			Rack:      rack,
+			Processor: apmqueue.ProcessorFunc(func(context.Context, apmqueue.Record) error { return nil }),
+		})
+	}
+	t.Run("env", func(t *testing.T) {
+		t.Setenv("KAFKA_RACK", "zone-a")
+		consumer := newRackConsumer(t, "")
+		assert.Equal(t, "zone-a", consumer.KafkaClient().OptValue(kgo.Rack))
+	})
+	t.Run("override_env", func(t *testing.T) {
+		t.Setenv("KAFKA_RACK", "zone-a")
+		consumer := newRackConsumer(t, "zone-b")
+		assert.Equal(t, "zone-b", consumer.KafkaClient().OptValue(kgo.Rack))
+	})
+}
+
+func TestConsumerSeek(t *testing.T) {
+	topic := "topic"
+	cluster, err := kfake.NewCluster(kfake.SeedTopics(1, topic))
+	require.NoError(t, err)
+	t.Cleanup(cluster.Close)
+	addrs := cluster.ListenAddrs()
+	client, err := kgo.NewClient(kgo.SeedBrokers(addrs...))
+	require.NoError(t, err)
+	t.Cleanup(client.Close)
+
+	var mu sync.Mutex
+	var values []string
+	consumer := newConsumer(t, ConsumerConfig{
+		CommonConfig: CommonConfig{
+			Brokers: addrs,
+			Logger:  zap.NewNop(),
+		},
+		Topics:  []apmqueue.Topic{apmqueue.Topic(topic)},
+		GroupID: "groupid",
+		Processor: apmqueue.ProcessorFunc(func(_ context.Context, r apmqueue.Record) error {
+			mu.Lock()
+			defer mu.Unlock()
+			values = append(values, string(r.Value))
+			return nil
+		}),
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	start := time.Now().Add(-time.Hour)
+	for i := 0; i < 4; i++ {
+		produceRecord(ctx, t, client, &kgo.Record{
+			Topic:     topic,
+			Value:     []byte(strconv.Itoa(i)),
+			Timestamp: start.Add(time.Duration(i) * time.Minute),
+		})
+	}
+	go consumer.Run(ctx)
+	waitValues := func(expected ...string) {
+		t.Helper()
+		assert.Eventually(t, func() bool {
+			mu.Lock()
+			defer mu.Unlock()
+			return len(values) == len(expected)
+		}, 5*time.Second, 10*time.Millisecond)
+		mu.Lock()
+		defer mu.Unlock()
+		assert.Equal(t, expected, values)
+		values = nil
+	}
+	waitValues("0", "1", "2", "3")
+
+	require.NoError(t, consumer.Seek(ctx, map[TopicPartition]int64{
+		{Topic: "topic", Partition: 0}: 2,
+	}))
+	waitValues("2", "3")
+
+	// kfake does not resolve timestamps to offsets correctly, so fake the
+	// ListOffsets response for timestamp lookups.
+	var listedTimestamp atomic.Int64
+	cluster.ControlKey(kmsg.ListOffsets.Int16(), func(req kmsg.Request) (kmsg.Response, error, bool) {
+		cluster.KeepControl()
+		r := req.(*kmsg.ListOffsetsRequest)
+		if len(r.Topics) != 1 || len(r.Topics[0].Partitions) != 1 || r.Topics[0].Partitions[0].Timestamp < 0 {
+			return nil, nil, false
+		}
+		listedTimestamp.Store(r.Topics[0].Partitions[0].Timestamp)
+		resp := r.ResponseKind().(*kmsg.ListOffsetsResponse)
+		respTopic := kmsg.NewListOffsetsResponseTopic()
+		respTopic.Topic = topic
+		respPartition := kmsg.NewListOffsetsResponseTopicPartition()
+		respPartition.Offset = 2
+		respTopic.Partitions = append(respTopic.Partitions, respPartition)
+		resp.Topics = append(resp.Topics, respTopic)
+		return resp, nil, true
+	})
+	ts := start.Add(90 * time.Second)
+	require.NoError(t, consumer.SeekToTimestamp(ctx, ts))
+	assert.Equal(t, ts.UnixMilli(), listedTimestamp.Load())
+	waitValues("2", "3")
+
+	err = consumer.Seek(ctx, map[TopicPartition]int64{
+		{Topic: "topic", Partition: 1}: 0,
+	})
+	assert.ErrorIs(t, err, ErrPartitionNotAssigned)
+	err = consumer.Seek(ctx, map[TopicPartition]int64{
+		{Topic: "topic", Partition: 0}: -1,
+	})
+	assert.EqualError(t, err, `cannot seek topic "topic" partition 0: kafka: invalid offset -1`)
+}
+
+func TestConsumerPausePartitions(t *testing.T) {
+	topic := "topic"
+	client, addrs := newClusterWithTopics(t, 1, topic)
+	var processed atomic.Int64
+	consumer := newConsumer(t, ConsumerConfig{
+		CommonConfig: CommonConfig{
+			Brokers: addrs,
+			Logger:  zap.NewNop(),
+		},
+		Topics:  []apmqueue.Topic{apmqueue.Topic(topic)},
+		GroupID: "groupid",
+		Processor: apmqueue.ProcessorFunc(func(_ context.Context, r apmqueue.Record) error {
+			processed.Add(1)
+			return nil
+		}),
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go consumer.Run(ctx)
+	produceRecord(ctx, t, client, &kgo.Record{Topic: topic, Value: []byte("1")})
+	require.Eventually(t, func() bool {
+		return processed.Load() == 1
+	}, 5*time.Second, 10*time.Millisecond)
+
+	tp := TopicPartition{Topic: apmqueue.Topic(topic), Partition: 0}
+	consumer.PausePartitions(tp)
+	assert.Equal(t, map[string][]int32{topic: {0}}, consumer.client.PauseFetchPartitions(nil))
+	produceRecord(ctx, t, client, &kgo.Record{Topic: topic, Value: []byte("2")})
+	assert.Never(t, func() bool {
+		return processed.Load() != 1
+	}, 300*time.Millisecond, 10*time.Millisecond)
+
+	consumer.ResumePartitions(tp)
+	assert.Eventually(t, func() bool {
+		return processed.Load() == 2
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// Losing a partition clears its pause state.
+	consumer.PausePartitions(tp)
+	consumer.consumer.lost(ctx, consumer.client, map[string][]int32{topic: {0}})
+	assert.Empty(t, consumer.client.PauseFetchPartitions(nil))
+}
+
+func TestConsumerPausePartitionsDuringRetry(t *testing.T) {
+	topic := "topic"
+	client, addrs := newClusterWithTopics(t, 1, topic)
+	failed := make(chan struct{})
+	var failedOnce atomic.Bool
+	var processed atomic.Int64
+	consumer := newConsumer(t, ConsumerConfig{
+		CommonConfig: CommonConfig{
+			Brokers: addrs,
+			Logger:  zap.NewNop(),
+		},
+		Topics:  []apmqueue.Topic{apmqueue.Topic(topic)},
+		GroupID: "groupid",
+		RetryConfig: RetryConfig{
+			MaxAttempts:    2,
+			InitialBackoff: 200 * time.Millisecond,
+		},
+		Processor: apmqueue.ProcessorFunc(func(_ context.Context, r apmqueue.Record) error {
+			if !failedOnce.Swap(true) {
+				close(failed)
+				return errors.New("boom")
+			}
+			processed.Add(1)
+			return nil
+		}),
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go consumer.Run(ctx)
+	produceRecord(ctx, t, client, &kgo.Record{Topic: topic, Value: []byte("1")})
+	select {
+	case <-failed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the record to fail")
+	}
+
+	// Pausing the partition while the record is retried keeps it paused
+	// once the retry succeeds.
+	tp := TopicPartition{Topic: apmqueue.Topic(topic), Partition: 0}
+	consumer.PausePartitions(tp)
+	require.Eventually(t, func() bool {
+		return processed.Load() == 1
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, map[string][]int32{topic: {0}}, consumer.client.PauseFetchPartitions(nil))
+	produceRecord(ctx, t, client, &kgo.Record{Topic: topic, Value: []byte("2")})
+	assert.Never(t, func() bool {
+		return processed.Load() != 1
+	}, 300*time.Millisecond, 10*time.Millisecond)
+
+	consumer.ResumePartitions(tp)
+	assert.Eventually(t, func() bool {
+		return processed.Load() == 2
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestConsumerPausePartitionsDuringBatchRetry(t *testing.T) {
+	topic := "topic"
+	client, addrs := newClusterWithTopics(t, 1, topic)
+	failed := make(chan struct{})
+	var failedOnce atomic.Bool
+	var processed atomic.Int64
+	consumer := newConsumer(t, ConsumerConfig{
+		CommonConfig: CommonConfig{
+			Brokers: addrs,
+			Logger:  zap.NewNop(),
+		},
+		Topics:  []apmqueue.Topic{apmqueue.Topic(topic)},
+		GroupID: "groupid",
+		RetryConfig: RetryConfig{
+			MaxAttempts:    2,
+			InitialBackoff: 200 * time.Millisecond,
+		},
+		BatchProcessor: apmqueue.BatchProcessorFunc(func(_ context.Context, rs []apmqueue.Record) error {
+			if !failedOnce.Swap(true) {
+				close(failed)
+				return errors.New("boom")
+			}
+			processed.Add(int64(len(rs)))
+			return nil
+		}),
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go consumer.Run(ctx)
+	produceRecord(ctx, t, client, &kgo.Record{Topic: topic, Value: []byte("1")})
+	select {
+	case <-failed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the batch to fail")
+	}
+
+	// Pausing the partition while the batch is retried keeps it paused
+	// once the retry succeeds.
+	tp := TopicPartition{Topic: apmqueue.Topic(topic), Partition: 0}
+	consumer.PausePartitions(tp)
+	require.Eventually(t, func() bool {
+		return processed.Load() == 1
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, map[string][]int32{topic: {0}}, consumer.client.PauseFetchPartitions(nil))
+	produceRecord(ctx, t, client, &kgo.Record{Topic: topic, Value: []byte("2")})
+	assert.Never(t, func() bool {
+		return processed.Load() != 1
+	}, 300*time.Millisecond, 10*time.Millisecond)
+
+	consumer.ResumePartitions(tp)
+	assert.Eventually(t, func() bool {
+		return processed.Load() == 2
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestConsumerPausePartitionsWhileQueued(t *testing.T) {
+	topic := "topic"
+	client, addrs := newClusterWithTopics(t, 1, topic)
+	started := make(chan struct{})
+	release := make(chan struct{})
+	var processed atomic.Int64
+	consumer := newConsumer(t, ConsumerConfig{
+		CommonConfig: CommonConfig{
+			Brokers: addrs,
+			Logger:  zap.NewNop(),
+		},
+		Topics:  []apmqueue.Topic{apmqueue.Topic(topic)},
+		GroupID: "groupid",
+		Processor: apmqueue.ProcessorFunc(func(_ context.Context, r apmqueue.Record) error {
+			if string(r.Value) == "1" {
+				close(started)
+				<-release
+			}
+			processed.Add(1)
+			return nil
+		}),
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go consumer.Run(ctx)
+	produceRecord(ctx, t, client, &kgo.Record{Topic: topic, Value: []byte("1")})
+	select {
+	case <-started:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the record to be processed")
+	}
+	// The partition is paused while its records are queued.
+	produceRecord(ctx, t, client, &kgo.Record{Topic: topic, Value: []byte("2")})
+	require.Eventually(t, func() bool {
+		return len(consumer.client.PauseFetchPartitions(nil)) > 0
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// Pausing the partition while records are queued keeps it paused once
+	// the queued records are processed.
+	tp := TopicPartition{Topic: apmqueue.Topic(topic), Partition: 0}
+	consumer.PausePartitions(tp)
+	close(release)
+	require.Eventually(t, func() bool {
+		return processed.Load() == 2
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, map[string][]int32{topic: {0}}, consumer.client.PauseFetchPartitions(nil))
+	produceRecord(ctx, t, client, &kgo.Record{Topic: topic, Value: []byte("3")})
+	assert.Never(t, func() bool {
+		return processed.Load() != 2
+	}, 300*time.Millisecond, 10*time.Millisecond)
+
+	consumer.ResumePartitions(tp)
+	assert.Eventually(t, func() bool {
+		return processed.Load() == 3
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestConsumerRebalanceCallbacks(t *testing.T) {
+	topic := "name_space-topic"
+	client, addrs := newClusterWithTopics(t, 2, topic)
+	assigned := make(chan map[string][]int32, 1)
+	revoked := make(chan map[string][]int32, 1)
+	var processed atomic.Int64
+	consumer, err := NewConsumer(ConsumerConfig{
+		CommonConfig: CommonConfig{
+			Brokers:   addrs,
+			Logger:    zap.NewNop(),
+			Namespace: "name_space",
+		},
+		Topics:              []apmqueue.Topic{"topic"},
+		GroupID:             "groupid",
+		MaxPollWait:         50 * time.Millisecond,
+		ShutdownGracePeriod: time.Second,
+		Processor: apmqueue.ProcessorFunc(func(_ context.Context, r apmqueue.Record) error {
+			processed.Add(1)
+			return nil
+		}),
+		OnAssigned: func(_ context.Context, m map[string][]int32) {
+			sort.Slice(m["topic"], func(i, j int) bool { return m["topic"][i] < m["topic"][j] })
+			assigned <- m
+		},
+		OnRevoked: func(ctx context.Context, m map[string][]int32) {
+			// All the fetched records have been processed.
+			assert.Equal(t, int64(1), processed.Load())
+			sort.Slice(m["topic"], func(i, j int) bool { return m["topic"][i] < m["topic"][j] })
+			revoked <- m
+		},
+	})
+	require.NoError(t, err)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go consumer.Run(ctx)
+
+	select {
+	case m := <-assigned:
+		assert.Equal(t, map[string][]int32{"topic": {0, 1}}, m)
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for partitions to be assigned")
+	}
+	produceRecord(ctx, t, client, &kgo.Record{Topic: topic, Value: []byte("1")})
+	require.Eventually(t, func() bool {
+		return processed.Load() == 1
+	}, 5*time.Second, 10*time.Millisecond)
+
+	require.NoError(t, consumer.Close())
+	select {
+	case m := <-revoked:
+		assert.Equal(t, map[string][]int32{"topic": {0, 1}}, m)
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for partitions to be revoked")
+	}
+}
+
+func TestConsumerRebalanceLogging(t *testing.T) {
+	topic := "name_space-topic"
+	_, addrs := newClusterWithTopics(t, 2, topic)
+	core, logs := observer.New(zapcore.InfoLevel)
+	consumer, err := NewConsumer(ConsumerConfig{
+		CommonConfig: CommonConfig{
+			Brokers:   addrs,
+			Logger:    zap.New(core),
+			Namespace: "name_space",
+		},
+		Topics:      []apmqueue.Topic{"topic"},
+		GroupID:     "groupid",
+		MaxPollWait: 50 * time.Millisecond,
+		Processor: apmqueue.ProcessorFunc(func(context.Context, apmqueue.Record) error {
+			return nil
+		}),
+	})
+	require.NoError(t, err)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go consumer.Run(ctx)
+
+	require.Eventually(t, func() bool {
+		return logs.FilterMessage("consumer group partitions assigned").Len() == 1
+	}, 5*time.Second, 10*time.Millisecond)
+	require.NoError(t, consumer.Close())
+
+	assertRebalanceLog := func(t *testing.T, msg string) map[string]any {
+		entries := logs.FilterMessage(msg).AllUntimed()
+		require.Len(t, entries, 1)
+		fields := entries[0].ContextMap()
+		assert.Equal(t, zapcore.InfoLevel, entries[0].Level)
+		assert.Equal(t, "groupid", fields["group"])
+		assert.NotEmpty(t, fields["member_id"])
+		assert.Equal(t, int32(1), fields["generation"])
+		partitions := fields["partitions"].(map[string][]int32)
+		sort.Slice(partitions["topic"], func(i, j int) bool {
+			return partitions["topic"][i] < partitions["topic"][j]
+		})
+		assert.Equal(t, map[string][]int32{"topic": {0, 1}}, partitions)
+		return fields
+	}
+	assigned := assertRebalanceLog(t, "consumer group partitions assigned")
+	assert.NotContains(t, assigned, "rebalance_duration")
+	revoked := assertRebalanceLog(t, "consumer group partitions revoked")
+	assert.Contains(t, revoked, "duration")
+}
+
+func TestConsumerDeadLetterTopic(t *testing.T) {
+	topic, dlt := "topic", "topic-dlq"
+	t.Run("produced", func(t *testing.T) {
+		client, addrs := newClusterWithTopics(t, 1, topic, dlt)
+		var attempts atomic.Int64
+		var processed atomic.Int64
+		consumer := newConsumer(t, ConsumerConfig{
+			CommonConfig: CommonConfig{
+				Brokers: addrs,
+				Logger:  zap.NewNop(),
+			},
+			Topics:          []apmqueue.Topic{apmqueue.Topic(topic)},
+			GroupID:         "groupid",
+			Delivery:        apmqueue.AtLeastOnceDeliveryType,
+			DeadLetterTopic: apmqueue.Topic(dlt),
+			RetryConfig: RetryConfig{
+				MaxAttempts:    3,
+				InitialBackoff: time.Millisecond,
+			},
+			Processor: apmqueue.ProcessorFunc(func(_ context.Context, r apmqueue.Record) error {
+				if string(r.Value) == "bad" {
+					attempts.Add(1)
+					return errors.New("boom")
+				}
+				processed.Add(1)
+				return nil
+			}),
+		})
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		produceRecord(ctx, t, client, &kgo.Record{Topic: topic, Value: []byte("bad"),
+			Headers: []kgo.RecordHeader{{Key: "a", Value: []byte("b")}},
+		})
+		produceRecord(ctx, t, client, &kgo.Record{Topic: topic, Value: []byte("good")})
+		go consumer.Run(ctx)
+		require.Eventually(t, func() bool {
+			return processed.Load() == 1
+		}, 5*time.Second, 10*time.Millisecond)
+		assert.Equal(t, int64(3), attempts.Load())
+
+		dltClient, err := kgo.NewClient(
+			kgo.SeedBrokers(addrs...),
+			kgo.ConsumeTopics(dlt),
+			kgo.ConsumeResetOffset(kgo.NewOffset().AtStart()),
+		)
+		require.NoError(t, err)
+		t.Cleanup(dltClient.Close)
+		fetchCtx, fetchCancel := context.WithTimeout(ctx, 5*time.Second)
+		defer fetchCancel()
+		fetches := dltClient.PollRecords(fetchCtx, 1)
+		require.NoError(t, fetches.Err())
+		records := fetches.Records()
+		require.Len(t, records, 1)
+		assert.Equal(t, []byte("bad"), records[0].Value)
+		assert.Equal(t, []kgo.RecordHeader{
+			{Key: "a", Value: []byte("b")},
+			{Key: "dlq-original-topic", Value: []byte(topic)},
+			{Key: "dlq-original-partition", Value: []byte("0")},
+			{Key: "dlq-original-offset", Value: []byte("0")},
+			{Key: "dlq-attempts", Value: []byte("3")},
+			{Key: "dlq-error", Value: []byte("boom")},
+		}, records[0].Headers)
+
+		require.Eventually(t, func() bool {
+			offsets, err := kadm.NewClient(client).FetchOffsets(ctx, "groupid")
+			require.NoError(t, err)
+			o, ok := offsets.Lookup(topic, 0)
+			return ok && o.At == 2
+		}, 5*time.Second, 10*time.Millisecond)
+	})
+	t.Run("failed", func(t *testing.T) {
+		cluster, err := kfake.NewCluster(kfake.SeedTopics(1, topic, dlt))
+		require.NoError(t, err)
+		t.Cleanup(cluster.Close)
+		addrs := cluster.ListenAddrs()
+		client, err := kgo.NewClient(kgo.SeedBrokers(addrs...))
+		require.NoError(t, err)
+		t.Cleanup(client.Close)
+		cluster.ControlKey(int16(kmsg.Produce), func(req kmsg.Request) (kmsg.Response, error, bool) {
+			cluster.KeepControl()
+			produceReq := req.(*kmsg.ProduceRequest)
+			if len(produceReq.Topics) == 0 || produceReq.Topics[0].Topic != dlt {
+				return nil, nil, false
+			}
+			resp := produceReq.ResponseKind().(*kmsg.ProduceResponse)
+			for _, rt := range produceReq.Topics {
+				st := kmsg.NewProduceResponseTopic()
+				st.Topic = rt.Topic
+				for _, rp := range rt.Partitions {
+					sp := kmsg.NewProduceResponseTopicPartition()
+					sp.Partition = rp.Partition
+					sp.ErrorCode = kerr.InvalidTopicException.Code
+					st.Partitions = append(st.Partitions, sp)
+				}
+				resp.Topics = append(resp.Topics, st)
+			}
+			return resp, nil, true
+		})
+
+		consumer := newConsumer(t, ConsumerConfig{
+			CommonConfig: CommonConfig{
+				Brokers: addrs,
+				Logger:  zap.NewNop(),
+			},
+			Topics:          []apmqueue.Topic{apmqueue.Topic(topic)},
+			GroupID:         "groupid",
+			Delivery:        apmqueue.AtLeastOnceDeliveryType,
+			DeadLetterTopic: apmqueue.Topic(dlt),
+			Processor: apmqueue.ProcessorFunc(func(context.Context, apmqueue.Record) error {
+				return errors.New("boom")
+			}),
+		})
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		produceRecord(ctx, t, client, &kgo.Record{Topic: topic, Value: []byte("bad")})
+		errc := make(chan error, 1)
+		go func() { errc <- consumer.Run(ctx) }()
+		select {
+		case err := <-errc:
+			assert.ErrorIs(t, err, ErrDeadLetterFailed)
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for consumer.Run to return")
+		}
+		offsets, err := kadm.NewClient(client).FetchOffsets(ctx, "groupid")
+		require.NoError(t, err)
+		_, ok := offsets.Lookup(topic, 0)
+		assert.False(t, ok)
+	})
+}
+
+func TestConsumerRetry(t *testing.T) {
+	errTransient := errors.New("transient")
+	errFatal := errors.New("fatal")
+	test := func(t *testing.T, failures []error, expectedAttempts int) {
+		topic := "topic"
+		client, addrs := newClusterWithTopics(t, 1, topic)
+		var attempts atomic.Int64
+		consumer := newConsumer(t, ConsumerConfig{
+			CommonConfig: CommonConfig{
+				Brokers: addrs,
+				Logger:  zap.NewNop(),
+			},
+			Topics:   []apmqueue.Topic{apmqueue.Topic(topic)},
+			GroupID:  "groupid",
+			Delivery: apmqueue.AtLeastOnceDeliveryType,
+			RetryConfig: RetryConfig{
+				MaxAttempts:    3,
+				InitialBackoff: time.Millisecond,
+				ShouldRetry: func(err error) bool {
+					return !errors.Is(err, errFatal)
+				},
+			},
+			Processor: apmqueue.ProcessorFunc(func(_ context.Context, r apmqueue.Record) error {
+				if string(r.Value) == "ok" {
+					return nil
+				}
+				n := attempts.Add(1)
+				if int(n) <= len(failures) {
+					return failures[n-1]
+				}
+				return nil
+			}),
+		})
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		produceRecord(ctx, t, client, &kgo.Record{Topic: topic, Value: []byte("x")})
+		produceRecord(ctx, t, client, &kgo.Record{Topic: topic, Value: []byte("ok")})
+		go consumer.Run(ctx)
+		// The second record is always processed, committing both.
+		require.Eventually(t, func() bool {
+			offsets, err := kadm.NewClient(client).FetchOffsets(ctx, "groupid")
+			require.NoError(t, err)
+			o, ok := offsets.Lookup(topic, 0)
+			return ok && o.At == 2
+		}, 5*time.Second, 10*time.Millisecond)
+		assert.Equal(t, int64(expectedAttempts), attempts.Load())
+	}
+	t.Run("succeeds", func(t *testing.T) {
+		test(t, []error{errTransient, errTransient}, 3)
+	})
+	t.Run("exhausted", func(t *testing.T) {
+		test(t, []error{errTransient, errTransient, errTransient}, 3)
+	})
+	t.Run("fatal", func(t *testing.T) {
+		test(t, []error{errTransient, errFatal}, 2)
+	})
+	t.Run("skip", func(t *testing.T) {
+		test(t, []error{fmt.Errorf("%w: %w", errTransient, apmqueue.ErrSkip)}, 1)
+	})
+	t.Run("retry_ignores_policy", func(t *testing.T) {
+		retry := fmt.Errorf("%w: %w", errFatal, apmqueue.ErrRetry)
+		test(t, []error{retry, retry, retry, retry}, 5)
+	})
+	t.Run("backoff_clock", func(t *testing.T) {
+		topic := "topic"
+		client, addrs := newClusterWithTopics(t, 1, topic)
+		clock := newFakeClock(time.Now())
+		var attempts atomic.Int64
+		consumer := newConsumer(t, ConsumerConfig{
+			CommonConfig: CommonConfig{
+				Brokers: addrs,
+				Logger:  zap.NewNop(),
+			},
+			Topics:   []apmqueue.Topic{apmqueue.Topic(topic)},
+			GroupID:  "groupid",
+			Delivery: apmqueue.AtLeastOnceDeliveryType,
+			RetryConfig: RetryConfig{
+				MaxAttempts:    2,
+				InitialBackoff: time.Hour,
+				MaxBackoff:     time.Hour,
+			},
+			Processor: apmqueue.ProcessorFunc(func(context.Context, apmqueue.Record) error {
+				if attempts.Add(1) == 1 {
+					return errTransient
+				}
+				return nil
+			}),
+			clock: clock,
+		})
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		produceRecord(ctx, t, client, &kgo.Record{Topic: topic, Value: []byte("x")})
+		go consumer.Run(ctx)
+		// The record is retried once the backoff elapses on the clock.
+		require.Eventually(t, func() bool {
+			return attempts.Load() == 1 && clock.Timers() == 1
+		}, 5*time.Second, time.Millisecond)
+		clock.Advance(time.Hour - time.Nanosecond)
+		assert.Equal(t, int64(1), attempts.Load())
+		clock.Advance(time.Nanosecond)
+		require.Eventually(t, func() bool {
+			offsets, err := kadm.NewClient(client).FetchOffsets(ctx, "groupid")
+			require.NoError(t, err)
+			o, ok := offsets.Lookup(topic, 0)
+			return ok && o.At == 1
+		}, 5*time.Second, 10*time.Millisecond)
+		assert.Equal(t, int64(2), attempts.Load())
+	})
+	t.Run("close_interrupts_backoff", func(t *testing.T) {
+		topic := "topic"
+		client, addrs := newClusterWithTopics(t, 1, topic)
+		var attempts atomic.Int64
+		consumer, err := NewConsumer(ConsumerConfig{
+			CommonConfig: CommonConfig{
+				Brokers: addrs,
+				Logger:  zap.NewNop(),
+			},
+			Topics:              []apmqueue.Topic{apmqueue.Topic(topic)},
+			GroupID:             "groupid",
+			Delivery:            apmqueue.AtLeastOnceDeliveryType,
+			MaxPollWait:         50 * time.Millisecond,
+			ShutdownGracePeriod: time.Minute,
+			RetryConfig: RetryConfig{
+				MaxAttempts:    3,
+				InitialBackoff: time.Hour,
+			},
+			Processor: apmqueue.ProcessorFunc(func(context.Context, apmqueue.Record) error {
+				attempts.Add(1)
+				return errTransient
+			}),
+		})
+		require.NoError(t, err)
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		produceRecord(ctx, t, client, &kgo.Record{Topic: topic, Value: []byte("x")})
+		go consumer.Run(ctx)
+		require.Eventually(t, func() bool {
+			return attempts.Load() == 1
+		}, 5*time.Second, 10*time.Millisecond)
+
+		closed := make(chan struct{})
+		go func() {
+			defer close(closed)
+			assert.NoError(t, consumer.Close())
+		}()
+		select {
+		case <-closed:
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for consumer.Close to return")
+		}
+		assert.Equal(t, int64(1), attempts.Load())
+		offsets, err := kadm.NewClient(client).FetchOffsets(ctx, "groupid")
+		require.NoError(t, err)
+		_, ok := offsets.Lookup(topic, 0)
+		assert.False(t, ok)
+	})
+}
+
+func TestConsumerLagMetric(t *testing.T) {
+	topic := "topic"
+	client, addrs := newClusterWithTopics(t, 1, topic)
+	rdr := sdkmetric.NewManualReader()
+	release := make(chan struct{})
+	var processed atomic.Int64
+	consumer, err := NewConsumer(ConsumerConfig{
+		CommonConfig: CommonConfig{
+			Brokers:       addrs,
+			Logger:        zap.NewNop(),
+			MeterProvider: sdkmetric.NewMeterProvider(sdkmetric.WithReader(rdr)),
+		},
+		Topics:              []apmqueue.Topic{apmqueue.Topic(topic)},
+		GroupID:             "groupid",
+		MaxPollRecords:      1,
+		MaxPollWait:         50 * time.Millisecond,
+		ShutdownGracePeriod: time.Second,
+		LagRefreshInterval:  10 * time.Millisecond,
+		Processor: apmqueue.ProcessorFunc(func(context.Context, apmqueue.Record) error {
+			<-release
+			processed.Add(1)
+			return nil
+		}),
+	})
+	require.NoError(t, err)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	for i := 0; i < 3; i++ {
+		produceRecord(ctx, t, client, &kgo.Record{Topic: topic, Value: []byte("x")})
+	}
+	go consumer.Run(ctx)
+
+	lag := func() (int64, bool) {
+		var rm metricdata.ResourceMetrics
+		require.NoError(t, rdr.Collect(ctx, &rm))
+		for _, sm := range rm.ScopeMetrics {
+			for _, m := range sm.Metrics {
+				if m.Name != "consumer.group.lag" {
+					continue
+				}
+				dps := m.Data.(metricdata.Gauge[int64]).DataPoints
+				if len(dps) == 0 {
+					return 0, false
+				}
+				require.Len(t, dps, 1)
+				assert.Equal(t, attribute.NewSet(
+					attribute.String("group", "groupid"),
+					attribute.String("topic", topic),
+					attribute.Int("partition", 0),
+				), dps[0].Attributes)
+				return dps[0].Value, true
+			}
+		}
+		return 0, false
+	}
+	// The first record is being processed and the second one is waiting to
+	// be processed, so the last record hasn't been fetched.
+	require.Eventually(t, func() bool {
+		v, ok := lag()
+		return ok && v == 1
+	}, 5*time.Second, 10*time.Millisecond)
+
+	close(release)
+	require.Eventually(t, func() bool {
+		v, ok := lag()
+		return ok && v == 0 && processed.Load() == 3
+	}, 5*time.Second, 10*time.Millisecond)
+
+	require.NoError(t, consumer.Close())
+	_, ok := lag()
+	assert.False(t, ok)
+}
+
+func TestConsumerRecordHeaders(t *testing.T) {
+	topic := "topic"
+	client, addrs := newClusterWithTopics(t, 1, topic)
+	records := make(chan apmqueue.Record, 1)
+	consumer := newConsumer(t, ConsumerConfig{
+		CommonConfig: CommonConfig{
+			Brokers: addrs,
+			Logger:  zap.NewNop(),
+		},
+		Topics:  []apmqueue.Topic{apmqueue.Topic(topic)},
+		GroupID: "groupid",
+		Processor: apmqueue.ProcessorFunc(func(_ context.Context, r apmqueue.Record) error {
+			records <- r
+			return nil
+		}),
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	produceRecord(ctx, t, client, &kgo.Record{Topic: topic, Value: []byte("x"),
+		Headers: []kgo.RecordHeader{{Key: "tenant", Value: []byte("a")}},
+	})
+	go consumer.Run(ctx)
+	select {
+	case r := <-records:
+		assert.Equal(t, []apmqueue.Header{{Key: "tenant", Value: []byte("a")}}, r.Headers)
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for record to be processed")
+	}
+}
+
+func TestConsumerHeaderAllowList(t *testing.T) {
+	topic := "topic"
+	client, addrs := newClusterWithTopics(t, 1, topic)
+	type processed struct {
+		record apmqueue.Record
+		meta   map[string]string
+	}
+	records := make(chan processed, 1)
+	consumer := newConsumer(t, ConsumerConfig{
+		CommonConfig: CommonConfig{
+			Brokers: addrs,
+			Logger:  zap.NewNop(),
+		},
+		Topics:          []apmqueue.Topic{apmqueue.Topic(topic)},
+		GroupID:         "groupid",
+		HeaderAllowList: []string{"tenant", "missing"},
+		Processor: apmqueue.ProcessorFunc(func(ctx context.Context, r apmqueue.Record) error {
+			meta, _ := queuecontext.MetadataFromContext(ctx)
+			records <- processed{record: r, meta: meta}
+			return nil
+		}),
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	produceRecord(ctx, t, client, &kgo.Record{Topic: topic, Value: []byte("x"),
+		Headers: []kgo.RecordHeader{
+			{Key: "large", Value: bytes.Repeat([]byte("x"), 1024)},
+			{Key: "tenant", Value: []byte("a")},
+		},
+	})
+	go consumer.Run(ctx)
+	select {
+	case p := <-records:
+		assert.Equal(t, []apmqueue.Header{{Key: "tenant", Value: []byte("a")}}, p.record.Headers)
+		assert.Equal(t, map[string]string{"tenant": "a"}, p.meta)
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for record to be processed")
+	}
+}
+
+func TestConsumerTopicRegex(t *testing.T) {
+	client, addrs := newClusterWithTopics(t, 1, "ns-logs-a", "ns-metrics", "logs-b")
+	var mu sync.Mutex
+	processed := make(map[apmqueue.Topic]int)
+	consumer := newConsumer(t, ConsumerConfig{
+		CommonConfig: CommonConfig{
+			Brokers:        addrs,
+			Logger:         zap.NewNop(),
+			Namespace:      "ns",
+			MetadataMaxAge: 100 * time.Millisecond,
+		},
+		TopicRegex: regexp.MustCompile("logs-.*"),
+		GroupID:    "groupid",
+		Processor: apmqueue.ProcessorFunc(func(_ context.Context, r apmqueue.Record) error {
+			mu.Lock()
+			defer mu.Unlock()
+			processed[r.Topic]++
+			return nil
+		}),
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	for _, topic := range []string{"ns-logs-a", "ns-metrics", "logs-b"} {
+		produceRecord(ctx, t, client, &kgo.Record{Topic: topic, Value: []byte("x")})
+	}
+	go consumer.Run(ctx)
+	require.Eventually(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return processed["logs-a"] == 1
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// Topics created after the consumer has started are consumed once
+	// they're discovered.
+	_, err := kadm.NewClient(client).CreateTopic(ctx, 1, 1, nil, "ns-logs-new")
+	require.NoError(t, err)
+	produceRecord(ctx, t, client, &kgo.Record{Topic: "ns-logs-new", Value: []byte("x")})
+	require.Eventually(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return processed["logs-new"] == 1
+	}, 10*time.Second, 10*time.Millisecond)
+
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Equal(t, map[apmqueue.Topic]int{"logs-a": 1, "logs-new": 1}, processed)
+}
+
+func TestConsumerKafkaClient(t *testing.T) {
+	_, addrs := newClusterWithTopics(t, 1, "topic")
+	consumer := newConsumer(t, ConsumerConfig{
+		CommonConfig: CommonConfig{Brokers: addrs, Logger: zap.NewNop()},
+		Topics:       []apmqueue.Topic{"topic"},
+		GroupID:      "groupid",
+		Processor: apmqueue.ProcessorFunc(func(context.Context, apmqueue.Record) error {
+			return nil
+		}),
+	})
+	require.NotNil(t, consumer.KafkaClient())
+	assert.NoError(t, consumer.KafkaClient().Ping(context.Background()))
+}
+
+func TestConsumerRecordTimestamp(t *testing.T) {
+	topic := "topic"
+	client, addrs := newClusterWithTopics(t, 1, topic)
+	records := make(chan apmqueue.Record, 1)
+	consumer := newConsumer(t, ConsumerConfig{
+		CommonConfig: CommonConfig{
+			Brokers: addrs,
+			Logger:  zap.NewNop(),
+		},
+		Topics:  []apmqueue.Topic{apmqueue.Topic(topic)},
+		GroupID: "groupid",
+		Processor: apmqueue.ProcessorFunc(func(_ context.Context, r apmqueue.Record) error {
+			records <- r
+			return nil
+		}),
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ts := time.Now().Add(-time.Hour).Truncate(time.Millisecond)
+	produceRecord(ctx, t, client, &kgo.Record{Topic: topic, Value: []byte("x"), Timestamp: ts})
+	go consumer.Run(ctx)
+	select {
+	case r := <-records:
+		assert.True(t, ts.Equal(r.Timestamp), "expected %s, got %s", ts, r.Timestamp)
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for record to be processed")
+	}
+}
+
+func TestConsumerPropagateTraceContext(t *testing.T) {
+	exp := tracetest.NewInMemoryExporter()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exp))
+	defer tp.Shutdown(context.Background())
+
+	topic := "topic"
+	client, addrs := newClusterWithTopics(t, 1, topic)
+	common := CommonConfig{
+		Brokers:           addrs,
+		Logger:            zap.NewNop(),
+		TracerProvider:    tp,
+		TextMapPropagator: propagation.TraceContext{},
+	}
+	producer := newProducer(t, ProducerConfig{
+		CommonConfig:          common,
+		Sync:                  true,
+		PropagateTraceContext: true,
+	})
+	processed := make(chan trace.SpanContext, 2)
+	consumer := newConsumer(t, ConsumerConfig{
+		CommonConfig:          common,
+		Topics:                []apmqueue.Topic{apmqueue.Topic(topic)},
+		GroupID:               "groupid",
+		PropagateTraceContext: true,
+		Processor: apmqueue.ProcessorFunc(func(ctx context.Context, r apmqueue.Record) error {
+			processed <- trace.SpanContextFromContext(ctx)
+			return nil
+		}),
+	})
+
+	ctx, span := tp.Tracer("test").Start(context.Background(), "parent")
+	require.NoError(t, producer.Produce(ctx, apmqueue.Record{Topic: apmqueue.Topic(topic), Value: []byte("1")}))
+	span.End()
+	// A malformed traceparent header results in a new root span.
+	produceRecord(context.Background(), t, client, &kgo.Record{Topic: topic, Value: []byte("2"),
+		Headers: []kgo.RecordHeader{{Key: "traceparent", Value: []byte("invalid")}},
+	})
+	go consumer.Run(context.Background())
+
+	var contexts []trace.SpanContext
+	for i := 0; i < 2; i++ {
+		select {
+		case sc := <-processed:
+			contexts = append(contexts, sc)
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for records to be processed")
+		}
+	}
+	assert.Equal(t, span.SpanContext().TraceID(), contexts[0].TraceID())
+	assert.True(t, contexts[1].IsValid())
+	assert.NotEqual(t, span.SpanContext().TraceID(), contexts[1].TraceID())
+
+	var processSpans []tracetest.SpanStub
+	for _, s := range exp.GetSpans() {
+		if s.Name == "Process" {
+			processSpans = append(processSpans, s)
+		}
+	}
+	require.Len(t, processSpans, 2)
+	assert.Equal(t, span.SpanContext().SpanID(), processSpans[0].Parent.SpanID())
+	assert.Equal(t, trace.SpanKindConsumer, processSpans[0].SpanKind)
+	assert.ElementsMatch(t, []attribute.KeyValue{
+		semconv.MessagingSystemKey.String("kafka"),
+		semconv.MessagingOperationReceive,
+		semconv.MessagingSourceName(topic),
+		semconv.MessagingKafkaSourcePartition(0),
+	}, processSpans[0].Attributes)
+	assert.False(t, processSpans[1].Parent.IsValid())
+}
+
+func TestConsumerIsolationLevel(t *testing.T) {
+	for level, expected := range map[IsolationLevel]int8{
+		ReadUncommitted: 0,
+		ReadCommitted:   1,
+	} {
+		t.Run(level.String(), func(t *testing.T) {
+			topic := "topic"
+			cluster, err := kfake.NewCluster(kfake.SeedTopics(1, topic))
+			require.NoError(t, err)
+			t.Cleanup(cluster.Close)
+			fetched := make(chan int8, 1)
+			cluster.ControlKey(kmsg.Fetch.Int16(), func(r kmsg.Request) (kmsg.Response, error, bool) {
+				cluster.KeepControl()
+				select {
+				case fetched <- r.(*kmsg.FetchRequest).IsolationLevel:
+				default:
+				}
+				return nil, nil, false
+			})
+			consumer := newConsumer(t, ConsumerConfig{
+				CommonConfig: CommonConfig{
+					Brokers: cluster.ListenAddrs(),
+					Logger:  zap.NewNop(),
+				},
+				Partitions:     map[string][]int32{topic: {0}},
+				IsolationLevel: level,
+				MaxPollWait:    50 * time.Millisecond,
+				Processor: apmqueue.ProcessorFunc(func(context.Context, apmqueue.Record) error {
+					return nil
+				}),
+			})
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			go consumer.Run(ctx)
+			select {
+			case isolation := <-fetched:
+				assert.Equal(t, expected, isolation)
+			case <-time.After(5 * time.Second):
+				t.Fatal("timed out waiting for a fetch request")
+			}
+		})
+	}
+}
+
+func TestConsumerGroupProcessor(t *testing.T) {
+	topic := "topic"
+	client, addrs := newClusterWithTopics(t, 1, topic)
+	var mu sync.Mutex
+	var groups []string
+	consumer := newConsumer(t, ConsumerConfig{
+		CommonConfig: CommonConfig{
+			Brokers: addrs,
+			Logger:  zap.NewNop(),
+		},
+		Topics:   []apmqueue.Topic{apmqueue.Topic(topic)},
+		GroupID:  "groupid",
+		Delivery: apmqueue.AtLeastOnceDeliveryType,
+		RetryConfig: RetryConfig{
+			MaxAttempts:    2,
+			InitialBackoff: time.Millisecond,
+		},
+		GroupProcessor: GroupProcessorFunc(func(_ context.Context, key []byte, rs []apmqueue.Record) error {
+			mu.Lock()
+			defer mu.Unlock()
+			group := string(key) + ":"
+			for _, r := range rs {
+				assert.Equal(t, key, r.OrderingKey)
+				group += string(r.Value)
+			}
+			groups = append(groups, group)
+			if len(groups) == 2 {
+				return &apmqueue.BatchError{Errors: map[int]error{1: errors.New("boom")}}
+			}
+			return nil
+		}),
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	// Produce the records in a single batch, so they're fetched together.
+	var records []*kgo.Record
+	for i, key := range []string{"a", "a", "b", "b", "b", "a"} {
+		records = append(records, &kgo.Record{
+			Topic: topic, Key: []byte(key), Value: []byte(strconv.Itoa(i)),
+		})
+	}
+	require.NoError(t, client.ProduceSync(ctx, records...).FirstErr())
+	go consumer.Run(ctx)
+	require.Eventually(t, func() bool {
+		offsets, err := kadm.NewClient(client).FetchOffsets(ctx, "groupid")
+		require.NoError(t, err)
+		o, _ := offsets.Lookup(topic, 0)
+		return o.At == 6
+	}, 5*time.Second, 10*time.Millisecond)
+
+	mu.Lock()
+	defer mu.Unlock()
+	// Only adjacent records are grouped, and only the failed records of a
+	// group are retried.
+	assert.Equal(t, []string{"a:01", "b:234", "a:5", "b:3"}, groups)
+}
+
+func TestConsumerBatchProcessor(t *testing.T) {
+	topic := "topic"
+	committedOffset := func(t *testing.T, client *kgo.Client) int64 {
+		offsets, err := kadm.NewClient(client).FetchOffsets(context.Background(), "groupid")
+		require.NoError(t, err)
+		o, ok := offsets.Lookup(topic, 0)
+		if !ok {
+			return -1
+		}
+		return o.At
+	}
+	t.Run("batches", func(t *testing.T) {
+		client, addrs := newClusterWithTopics(t, 1, topic)
+		var mu sync.Mutex
+		var batches [][]string
+		consumer := newConsumer(t, ConsumerConfig{
+			CommonConfig: CommonConfig{
+				Brokers: addrs,
+				Logger:  zap.NewNop(),
+			},
+			Topics:       []apmqueue.Topic{apmqueue.Topic(topic)},
+			GroupID:      "groupid",
+			Delivery:     apmqueue.AtLeastOnceDeliveryType,
+			BatchMaxSize: 2,
+			BatchProcessor: apmqueue.BatchProcessorFunc(func(_ context.Context, rs []apmqueue.Record) error {
+				mu.Lock()
+				defer mu.Unlock()
+				var values []string
+				for _, r := range rs {
+					values = append(values, string(r.Value))
+				}
+				batches = append(batches, values)
+				return nil
+			}),
+		})
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		for i := 0; i < 5; i++ {
+			produceRecord(ctx, t, client, &kgo.Record{Topic: topic, Value: []byte(strconv.Itoa(i))})
+		}
+		go consumer.Run(ctx)
+		require.Eventually(t, func() bool {
+			return committedOffset(t, client) == 5
+		}, 5*time.Second, 10*time.Millisecond)
+
+		mu.Lock()
+		defer mu.Unlock()
+		var values []string
+		for _, b := range batches {
+			assert.LessOrEqual(t, len(b), 2)
+			values = append(values, b...)
+		}
+		assert.Equal(t, []string{"0", "1", "2", "3", "4"}, values)
+	})
+	t.Run("partial_failure", func(t *testing.T) {
+		client, addrs := newClusterWithTopics(t, 1, topic)
+		var mu sync.Mutex
+		var batches [][]string
+		consumer := newConsumer(t, ConsumerConfig{
+			CommonConfig: CommonConfig{
+				Brokers: addrs,
+				Logger:  zap.NewNop(),
+			},
+			Topics:         []apmqueue.Topic{apmqueue.Topic(topic)},
+			GroupID:        "groupid",
+			Delivery:       apmqueue.AtLeastOnceDeliveryType,
+			MaxPollRecords: 3,
+			RetryConfig: RetryConfig{
+				MaxAttempts:    2,
+				InitialBackoff: time.Millisecond,
+			},
+			BatchProcessor: apmqueue.BatchProcessorFunc(func(_ context.Context, rs []apmqueue.Record) error {
+				mu.Lock()
+				defer mu.Unlock()
+				var values []string
+				for _, r := range rs {
+					values = append(values, string(r.Value))
+				}
+				batches = append(batches, values)
+				if len(batches) == 1 {
+					return &apmqueue.BatchError{Errors: map[int]error{1: errors.New("boom")}}
+				}
+				return nil
+			}),
+		})
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		for i := 0; i < 3; i++ {
+			produceRecord(ctx, t, client, &kgo.Record{Topic: topic, Value: []byte(strconv.Itoa(i))})
+		}
+		go consumer.Run(ctx)
+		require.Eventually(t, func() bool {
+			return committedOffset(t, client) == 3
+		}, 5*time.Second, 10*time.Millisecond)
+
+		mu.Lock()
+		defer mu.Unlock()
+		assert.Equal(t, [][]string{{"0", "1", "2"}, {"1"}}, batches)
+	})
+	t.Run("partial_skip", func(t *testing.T) {
+		client, addrs := newClusterWithTopics(t, 1, topic)
+		var mu sync.Mutex
+		var batches [][]string
+		consumer := newConsumer(t, ConsumerConfig{
+			CommonConfig: CommonConfig{
+				Brokers: addrs,
+				Logger:  zap.NewNop(),
+			},
+			Topics:         []apmqueue.Topic{apmqueue.Topic(topic)},
+			GroupID:        "groupid",
+			Delivery:       apmqueue.AtLeastOnceDeliveryType,
+			MaxPollRecords: 3,
+			RetryConfig: RetryConfig{
+				MaxAttempts:    2,
+				InitialBackoff: time.Millisecond,
+			},
+			BatchProcessor: apmqueue.BatchProcessorFunc(func(_ context.Context, rs []apmqueue.Record) error {
+				mu.Lock()
+				defer mu.Unlock()
+				var values []string
+				for _, r := range rs {
+					values = append(values, string(r.Value))
+				}
+				batches = append(batches, values)
+				if len(batches) == 1 {
+					return &apmqueue.BatchError{Errors: map[int]error{
+						0: apmqueue.ErrSkip,
+						2: errors.New("boom"),
+					}}
+				}
+				return nil
+			}),
+		})
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		for i := 0; i < 3; i++ {
+			produceRecord(ctx, t, client, &kgo.Record{Topic: topic, Value: []byte(strconv.Itoa(i))})
+		}
+		go consumer.Run(ctx)
+		require.Eventually(t, func() bool {
+			return committedOffset(t, client) == 3
+		}, 5*time.Second, 10*time.Millisecond)
+
+		mu.Lock()
+		defer mu.Unlock()
+		// The skipped record isn't retried.
+		assert.Equal(t, [][]string{{"0", "1", "2"}, {"2"}}, batches)
+	})
+	t.Run("per_record_retry", func(t *testing.T) {
+		client, addrs := newClusterWithTopics(t, 1, topic)
+		var mu sync.Mutex
+		var batches [][]string
+		consumer := newConsumer(t, ConsumerConfig{
+			CommonConfig: CommonConfig{
+				Brokers: addrs,
+				Logger:  zap.NewNop(),
+			},
+			Topics:         []apmqueue.Topic{apmqueue.Topic(topic)},
+			GroupID:        "groupid",
+			Delivery:       apmqueue.AtLeastOnceDeliveryType,
+			MaxPollRecords: 3,
+			RetryConfig: RetryConfig{
+				MaxAttempts:    3,
+				InitialBackoff: time.Millisecond,
+				ShouldRetry: func(err error) bool {
+					return err.Error() != "fatal"
+				},
+			},
+			BatchProcessor: apmqueue.BatchProcessorFunc(func(_ context.Context, rs []apmqueue.Record) error {
+				mu.Lock()
+				defer mu.Unlock()
+				var values []string
+				for _, r := range rs {
+					values = append(values, string(r.Value))
+				}
+				batches = append(batches, values)
+				if len(batches) == 1 {
+					return &apmqueue.BatchError{Errors: map[int]error{
+						0: errors.New("fatal"),
+						1: apmqueue.ErrRetry,
+					}}
+				}
+				return nil
+			}),
+		})
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		for i := 0; i < 3; i++ {
+			produceRecord(ctx, t, client, &kgo.Record{Topic: topic, Value: []byte(strconv.Itoa(i))})
+		}
+		go consumer.Run(ctx)
+		require.Eventually(t, func() bool {
+			return committedOffset(t, client) == 3
+		}, 5*time.Second, 10*time.Millisecond)
+
+		mu.Lock()
+		defer mu.Unlock()
+		// Only the record which returned ErrRetry is retried, the record
+		// which failed with a fatal error isn't.
+		assert.Equal(t, [][]string{{"0", "1", "2"}, {"1"}}, batches)
+	})
+	t.Run("failure_dead_letter", func(t *testing.T) {
+		dlt := "topic-dlq"
+		client, addrs := newClusterWithTopics(t, 1, topic, dlt)
+		consumer := newConsumer(t, ConsumerConfig{
+			CommonConfig: CommonConfig{
+				Brokers: addrs,
+				Logger:  zap.NewNop(),
+			},
+			Topics:          []apmqueue.Topic{apmqueue.Topic(topic)},
+			GroupID:         "groupid",
+			Delivery:        apmqueue.AtLeastOnceDeliveryType,
+			DeadLetterTopic: apmqueue.Topic(dlt),
+			BatchProcessor: apmqueue.BatchProcessorFunc(func(context.Context, []apmqueue.Record) error {
+				return errors.New("boom")
+			}),
+		})
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		for i := 0; i < 2; i++ {
+			produceRecord(ctx, t, client, &kgo.Record{Topic: topic, Value: []byte(strconv.Itoa(i))})
+		}
+		go consumer.Run(ctx)
+		require.Eventually(t, func() bool {
+			return committedOffset(t, client) == 2
+		}, 5*time.Second, 10*time.Millisecond)
+
+		offsets, err := kadm.NewClient(client).ListEndOffsets(ctx, dlt)
+		require.NoError(t, err)
+		o, ok := offsets.Lookup(dlt, 0)
+		require.True(t, ok)
+		assert.Equal(t, int64(2), o.Offset)
+	})
+	t.Run("both_processors", func(t *testing.T) {
+		_, err := NewConsumer(ConsumerConfig{
+			CommonConfig: CommonConfig{
+				Brokers: []string{"localhost:9092"},
+				Logger:  zap.NewNop(),
+			},
+			Topics:         []apmqueue.Topic{apmqueue.Topic(topic)},
+			GroupID:        "groupid",
+			Processor:      apmqueue.ProcessorFunc(func(context.Context, apmqueue.Record) error { return nil }),
+			BatchProcessor: apmqueue.BatchProcessorFunc(func(context.Context, []apmqueue.Record) error { return nil }),
+		})
+		assert.ErrorContains(t, err, "only one of processor or batch processor can be set")
+	})
+}
+
+func TestConsumerShutdown(t *testing.T) {
+	topic := "topic"
+	newShutdownConsumer := func(t *testing.T, addrs []string, processor apmqueue.Processor) *Consumer {
+		consumer, err := NewConsumer(ConsumerConfig{
+			CommonConfig: CommonConfig{
+				Brokers: addrs,
+				Logger:  zap.NewNop(),
+			},
+			Topics:      []apmqueue.Topic{apmqueue.Topic(topic)},
+			GroupID:     "groupid",
+			Delivery:    apmqueue.AtLeastOnceDeliveryType,
+			MaxPollWait: 50 * time.Millisecond,
+			Processor:   processor,
+		})
+		require.NoError(t, err)
+		return consumer
+	}
+	t.Run("drained", func(t *testing.T) {
+		client, addrs := newClusterWithTopics(t, 1, topic)
+		started := make(chan struct{})
+		var processed atomic.Int64
+		consumer := newShutdownConsumer(t, addrs, apmqueue.ProcessorFunc(func(context.Context, apmqueue.Record) error {
+			if processed.Add(1) == 1 {
+				close(started)
+			}
+			time.Sleep(10 * time.Millisecond)
+			return nil
+		}))
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		for i := 0; i < 3; i++ {
+			produceRecord(ctx, t, client, &kgo.Record{Topic: topic, Value: []byte("x")})
+		}
+		go consumer.Run(ctx)
+		<-started
+
+		shutdownCtx, shutdownCancel := context.WithTimeout(ctx, 5*time.Second)
+		defer shutdownCancel()
+		require.NoError(t, consumer.Shutdown(shutdownCtx))
+		assert.Equal(t, int64(3), processed.Load())
+		offsets, err := kadm.NewClient(client).FetchOffsets(ctx, "groupid")
+		require.NoError(t, err)
+		o, ok := offsets.Lookup(topic, 0)
+		require.True(t, ok)
+		assert.Equal(t, int64(3), o.At)
+		// Closing after shutting down is a no-op.
+		assert.NoError(t, consumer.Close())
+	})
+	t.Run("timeout", func(t *testing.T) {
+		client, addrs := newClusterWithTopics(t, 1, topic)
+		started := make(chan struct{})
+		var once sync.Once
+		consumer := newShutdownConsumer(t, addrs, apmqueue.ProcessorFunc(func(context.Context, apmqueue.Record) error {
+			once.Do(func() { close(started) })
+			time.Sleep(500 * time.Millisecond)
+			return nil
+		}))
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		for i := 0; i < 3; i++ {
+			produceRecord(ctx, t, client, &kgo.Record{Topic: topic, Value: []byte("x")})
+		}
+		go consumer.Run(ctx)
+		<-started
+
+		shutdownCtx, shutdownCancel := context.WithTimeout(ctx, 100*time.Millisecond)
+		defer shutdownCancel()
+		err := consumer.Shutdown(shutdownCtx)
+		assert.ErrorIs(t, err, ErrShutdownTimeout)
+		assert.ErrorIs(t, err, context.DeadlineExceeded)
+		assert.ErrorContains(t, err, "3 records abandoned")
+	})
+}
+
+func TestConsumerShutdownQueuedRecords(t *testing.T) {
+	topic := "topic"
+	// newQueuedConsumer returns a consumer processing a record, blocked
+	// until release is closed or the processing context is canceled, with
+	// several fetches of the partition queued behind it.
+	newQueuedConsumer := func(t *testing.T, release chan struct{}) (*Consumer, *pc, func() []string) {
+		client, addrs := newClusterWithTopics(t, 1, topic)
+		started := make(chan struct{})
+		var mu sync.Mutex
+		var processed []string
+		consumer := newConsumer(t, ConsumerConfig{
+			CommonConfig: CommonConfig{
+				Brokers: addrs,
+				Logger:  zap.NewNop(),
+			},
+			Topics:   []apmqueue.Topic{apmqueue.Topic(topic)},
+			GroupID:  "groupid",
+			Delivery: apmqueue.AtMostOnceDeliveryType,
+			Processor: apmqueue.ProcessorFunc(func(ctx context.Context, r apmqueue.Record) error {
+				if string(r.Value) == "0" {
+					close(started)
+					select {
+					case <-release:
+					case <-ctx.Done():
+					}
+				}
+				if ctx.Err() != nil {
+					return ctx.Err()
+				}
+				mu.Lock()
+				defer mu.Unlock()
+				processed = append(processed, string(r.Value))
+				return nil
+			}),
+		})
+		ctx, cancel := context.WithCancel(context.Background())
+		t.Cleanup(cancel)
+		go consumer.Run(ctx)
+		produceRecord(ctx, t, client, &kgo.Record{Topic: topic, Value: []byte("0")})
+		select {
+		case <-started:
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for the record to be processed")
+		}
+		consumer.consumer.mu.RLock()
+		pc := consumer.consumer.assignments[topicPartition{topic: topic, partition: 0}]
+		consumer.consumer.mu.RUnlock()
+		require.NotNil(t, pc)
+		// Queue several fetches behind the record being processed, as if
+		// they had been fetched, and committed, before the partition was
+		// paused.
+		for i := 1; i <= 3; i++ {
+			consumer.consumer.processFetch(kgo.Fetches{{Topics: []kgo.FetchTopic{{
+				Topic: topic,
+				Partitions: []kgo.FetchPartition{{Records: []*kgo.Record{{
+					Topic:   topic,
+					Offset:  int64(i),
+					Value:   []byte(strconv.Itoa(i)),
+					Context: consumer.consumer.ctx,
+				}}}},
+			}}}})
+		}
+		pc.queueMu.Lock()
+		assert.Len(t, pc.queue, 3)
+		pc.queueMu.Unlock()
+		return consumer, pc, func() []string {
+			mu.Lock()
+			defer mu.Unlock()
+			return slices.Clone(processed)
+		}
+	}
+	for name, stop := range map[string]func(*Consumer) error{
+		"close": func(c *Consumer) error { return c.Close() },
+		"shutdown": func(c *Consumer) error {
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			return c.Shutdown(ctx)
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			release := make(chan struct{})
+			var releaseOnce sync.Once
+			// Release the processor if the test fails early, so that the
+			// consumer can be closed.
+			t.Cleanup(func() { releaseOnce.Do(func() { close(release) }) })
+			consumer, pc, processed := newQueuedConsumer(t, release)
+
+			stopped := make(chan error, 1)
+			go func() { stopped <- stop(consumer) }()
+			select {
+			case <-pc.stopping:
+			case <-time.After(5 * time.Second):
+				t.Fatal("timed out waiting for the partition consumer to stop")
+			}
+			releaseOnce.Do(func() { close(release) })
+			select {
+			case err := <-stopped:
+				require.NoError(t, err)
+			case <-time.After(5 * time.Second):
+				t.Fatal("timed out waiting for the consumer to stop")
+			}
+			// The queued records are processed, they would otherwise be
+			// lost since they have already been committed.
+			assert.Equal(t, []string{"0", "1", "2", "3"}, processed())
+		})
+	}
+	t.Run("timeout", func(t *testing.T) {
+		consumer, _, processed := newQueuedConsumer(t, make(chan struct{}))
+
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		defer cancel()
+		err := consumer.Shutdown(ctx)
+		assert.ErrorIs(t, err, ErrShutdownTimeout)
+		// The queued records are abandoned too.
+		assert.ErrorContains(t, err, "4 records abandoned")
+		// Once the processing context is canceled, the queued records are
+		// discarded without being processed.
+		assert.Eventually(t, func() bool {
+			return consumer.consumer.pending.Load() == 0
+		}, 5*time.Second, 10*time.Millisecond)
+		assert.Empty(t, processed())
+	})
+}
+
+func newConsumer(t testing.TB, cfg ConsumerConfig) *Consumer {
+	if cfg.MaxPollWait <= 0 {
+		// Lower MaxPollWait, ShutdownGracePeriod to speed up execution.
+		cfg.MaxPollWait = 50 * time.Millisecond
+		cfg.ShutdownGracePeriod = time.Second
+	}
+	consumer, err := NewConsumer(cfg)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		assert.NoError(t, consumer.Close())
+	})
+	return consumer
+}
+
+func TestConsumerMaxConcurrency(t *testing.T) {
+	topic := "topic"
+	const records = 40
+	client, addrs := newClusterWithTopics(t, 4, topic)
+	var active, maxActive, processed atomic.Int64
+	done := make(chan struct{})
+	consumer, err := NewConsumer(ConsumerConfig{
+		CommonConfig: CommonConfig{
+			Brokers: addrs,
+			Logger:  zapTest(t),
+		},
+		Topics:         []apmqueue.Topic{apmqueue.Topic(topic)},
+		GroupID:        "groupid",
+		Delivery:       apmqueue.AtLeastOnceDeliveryType,
+		MaxPollWait:    50 * time.Millisecond,
+		MaxConcurrency: 2,
+		Processor: apmqueue.ProcessorFunc(func(context.Context, apmqueue.Record) error {
+			n := active.Add(1)
+			defer active.Add(-1)
+			for m := maxActive.Load(); n > m && !maxActive.CompareAndSwap(m, n); m = maxActive.Load() {
+			}
+			time.Sleep(5 * time.Millisecond)
+			if processed.Add(1) == records {
+				close(done)
+			}
+			return nil
+		}),
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() { assert.NoError(t, consumer.Close()) })
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	for i := 0; i < records; i++ {
+		produceRecord(ctx, t, client, &kgo.Record{
+			Topic: topic,
+			Key:   []byte(strconv.Itoa(i)),
+			Value: []byte("x"),
+		})
+	}
+	go consumer.Run(ctx)
+	select {
+	case <-done:
+	case <-ctx.Done():
+		t.Fatal("timed out waiting for records to be processed")
+	}
+	assert.LessOrEqual(t, maxActive.Load(), int64(2))
+	assert.Positive(t, maxActive.Load())
+}
+
+func TestConsumerPartitionOrdering(t *testing.T) {
+	topic := "topic"
+	addrs := newClusterAddrWithTopics(t, 2, topic)
+	client, err := kgo.NewClient(
+		kgo.SeedBrokers(addrs...),
+		kgo.RecordPartitioner(kgo.ManualPartitioner()),
+	)
+	require.NoError(t, err)
+	t.Cleanup(client.Close)
+	// The first record of partition 0 is only processed once all the
+	// records of partition 1 are processed, which requires the partitions to
+	// be processed concurrently.
+	partition1Done := make(chan struct{})
+	var mu sync.Mutex
+	processed := make(map[int32][]string)
+	consumer := newConsumer(t, ConsumerConfig{
+		CommonConfig: CommonConfig{
+			Brokers: addrs,
+			Logger:  zapTest(t),
+		},
+		Topics:      []apmqueue.Topic{apmqueue.Topic(topic)},
+		GroupID:     "groupid",
+		MaxPollWait: 50 * time.Millisecond,
+		Processor: apmqueue.ProcessorFunc(func(ctx context.Context, r apmqueue.Record) error {
+			if r.Partition == 0 && string(r.Value) == "0" {
+				select {
+				case <-partition1Done:
+				case <-ctx.Done():
+					return ctx.Err()
+				}
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			processed[r.Partition] = append(processed[r.Partition], string(r.Value))
+			if r.Partition == 1 && len(processed[1]) == 3 {
+				close(partition1Done)
+			}
+			return nil
+		}),
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	for i := 0; i < 3; i++ {
+		for partition := int32(0); partition < 2; partition++ {
+			produceRecord(ctx, t, client, &kgo.Record{
+				Topic:     topic,
+				Partition: partition,
+				Value:     []byte(strconv.Itoa(i)),
+			})
+		}
+	}
+	go consumer.Run(ctx)
+
+	require.Eventually(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(processed[0]) == 3
+	}, 5*time.Second, 10*time.Millisecond)
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Equal(t, map[int32][]string{
+		0: {"0", "1", "2"},
+		1: {"0", "1", "2"},
+	}, processed)
+}
+
+func TestConsumerTopicProcessors(t *testing.T) {
+	topics := []string{"a", "b", "c"}
+	client, addrs := newClusterWithTopics(t, 1, topics...)
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	processed := make(map[string][]string)
+	newProcessor := func(name string) apmqueue.Processor {
+		return apmqueue.ProcessorFunc(func(_ context.Context, r apmqueue.Record) error {
+			defer wg.Done()
+			mu.Lock()
+			defer mu.Unlock()
+			processed[name] = append(processed[name], string(r.Topic))
+			return nil
+		})
+	}
+	consumer, err := NewConsumer(ConsumerConfig{
+		CommonConfig: CommonConfig{
+			Brokers: addrs,
+			Logger:  zapTest(t),
+		},
+		Topics:      []apmqueue.Topic{"a", "b", "c"},
+		GroupID:     "groupid",
+		MaxPollWait: 50 * time.Millisecond,
+		Processor:   newProcessor("default"),
+		TopicProcessors: map[apmqueue.Topic]apmqueue.Processor{
+			"a": newProcessor("a"),
+			"b": newProcessor("b"),
+		},
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() { assert.NoError(t, consumer.Close()) })
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	for _, topic := range topics {
+		wg.Add(1)
+		produceRecord(ctx, t, client, &kgo.Record{Topic: topic, Value: []byte("x")})
+	}
+	go consumer.Run(ctx)
+	wg.Wait()
+
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Equal(t, map[string][]string{
+		"a":       {"a"},
+		"b":       {"b"},
+		"default": {"c"},
+	}, processed)
+}
+
+type memoryOffsetStore struct {
+	mu      sync.Mutex
+	offsets map[TopicPartition]int64
+}
+
+func (s *memoryOffsetStore) Load(_ context.Context, tp TopicPartition) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if o, ok := s.offsets[tp]; ok {
+		return o, nil
+	}
+	return -1, nil
+}
+
+func (s *memoryOffsetStore) Store(_ context.Context, tp TopicPartition, offset int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.offsets[tp] = offset
+	return nil
+}
+
+func (s *memoryOffsetStore) load() map[TopicPartition]int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return maps.Clone(s.offsets)
+}
+
+func TestConsumerPartitions(t *testing.T) {
+	topic := "topic"
+	addrs := newClusterAddrWithTopics(t, 2, topic)
+	producer, err := kgo.NewClient(
+		kgo.SeedBrokers(addrs...),
+		kgo.RecordPartitioner(kgo.ManualPartitioner()),
+	)
+	require.NoError(t, err)
+	t.Cleanup(producer.Close)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	for partition := int32(0); partition < 2; partition++ {
+		for i := 0; i < 3; i++ {
+			produceRecord(ctx, t, producer, &kgo.Record{
+				Topic:     topic,
+				Partition: partition,
+				Value:     []byte(fmt.Sprintf("%d-%d", partition, i)),
+			})
+		}
+	}
+	newConsumer := func(t *testing.T, store OffsetStore, processed chan<- string) *Consumer {
+		consumer, err := NewConsumer(ConsumerConfig{
+			CommonConfig: CommonConfig{
+				Brokers: addrs,
+				Logger:  zapTest(t),
+			},
+			Partitions:  map[string][]int32{topic: {1}},
+			OffsetStore: store,
+			Delivery:    apmqueue.AtLeastOnceDeliveryType,
+			MaxPollWait: 50 * time.Millisecond,
+			Processor: apmqueue.ProcessorFunc(func(_ context.Context, r apmqueue.Record) error {
+				processed <- string(r.Value)
+				return nil
+			}),
+		})
+		require.NoError(t, err)
+		t.Cleanup(func() { assert.NoError(t, consumer.Close()) })
+		return consumer
+	}
+	receive := func(t *testing.T, processed <-chan string, n int) []string {
+		var values []string
+		for len(values) < n {
+			select {
+			case v := <-processed:
+				values = append(values, v)
+			case <-ctx.Done():
+				t.Fatal("timed out waiting for records to be processed")
+			}
+		}
+		return values
+	}
+	t.Run("offset store", func(t *testing.T) {
+		tp := TopicPartition{Topic: apmqueue.Topic(topic), Partition: 1}
+		store := &memoryOffsetStore{offsets: map[TopicPartition]int64{tp: 1}}
+		processed := make(chan string, 3)
+		consumer := newConsumer(t, store, processed)
+		go consumer.Run(ctx)
+
+		assert.Equal(t, []string{"1-1", "1-2"}, receive(t, processed, 2))
+		assert.Eventually(t, func() bool {
+			return store.load()[tp] == 3
+		}, 5*time.Second, 10*time.Millisecond)
+	})
+	t.Run("no offset store", func(t *testing.T) {
+		processed := make(chan string, 3)
+		consumer := newConsumer(t, nil, processed)
+		go consumer.Run(ctx)
+
+		assert.Equal(t, []string{"1-0", "1-1", "1-2"}, receive(t, processed, 3))
+	})
+	t.Run("offset store manual commit", func(t *testing.T) {
+		tp := TopicPartition{Topic: apmqueue.Topic(topic), Partition: 1}
+		store := &memoryOffsetStore{offsets: map[TopicPartition]int64{}}
+		processed := make(chan string, 3)
+		consumer, err := NewConsumer(ConsumerConfig{
+			CommonConfig: CommonConfig{
+				Brokers: addrs,
+				Logger:  zapTest(t),
+			},
+			Partitions:        map[string][]int32{topic: {1}},
+			OffsetStore:       store,
+			DisableAutoCommit: true,
+			MaxPollWait:       50 * time.Millisecond,
+			Processor: apmqueue.ProcessorFunc(func(_ context.Context, r apmqueue.Record) error {
+				processed <- string(r.Value)
+				return nil
+			}),
+		})
+		require.NoError(t, err)
+		t.Cleanup(func() { assert.NoError(t, consumer.Close()) })
+		go consumer.Run(ctx)
+
+		assert.Equal(t, []string{"1-0", "1-1", "1-2"}, receive(t, processed, 3))
+		assert.Empty(t, store.load())
+		assert.Eventually(t, func() bool {
+			return consumer.Commit(ctx) == nil && store.load()[tp] == 3
+		}, 5*time.Second, 10*time.Millisecond)
+		assert.Equal(t, map[TopicPartition]int64{tp: 3}, consumer.CommittedOffsets())
+	})
+	t.Run("offset store load error", func(t *testing.T) {
+		_, err := NewConsumer(ConsumerConfig{
+			CommonConfig: CommonConfig{
+				Brokers: addrs,
+				Logger:  zapTest(t),
+			},
+			Partitions:  map[string][]int32{topic: {1}},
+			OffsetStore: failingOffsetStore{err: assert.AnError},
+			Processor: apmqueue.ProcessorFunc(func(context.Context, apmqueue.Record) error {
+				return nil
+			}),
+		})
+		assert.ErrorIs(t, err, assert.AnError)
+		assert.ErrorContains(t, err, `kafka: failed to load stored offsets: failed to load offset of topic "topic" partition 1`)
+	})
+}
+
+type failingOffsetStore struct {
+	err error
+}
+
+func (s failingOffsetStore) Load(context.Context, TopicPartition) (int64, error) {
+	return 0, s.err
+}
+
+func (s failingOffsetStore) Store(context.Context, TopicPartition, int64) error {
+	return s.err
 }
 
 func produceRecord(ctx context.Context, t testing.TB, c *kgo.Client, r *kgo.Record) {
@@ -0,0 +1,130 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package kafka
+
+import (
+	"errors"
+	"fmt"
+	"net"
+
+	"github.com/twmb/franz-go/pkg/kerr"
+	"github.com/twmb/franz-go/pkg/kgo"
+
+	apmqueue "github.com/elastic/apm-queue/v2"
+)
+
+var (
+	// ErrTopicNotFound is returned by the Manager, Producer and Consumer
+	// when the topic does not exist.
+	ErrTopicNotFound = errors.New("kafka: topic not found")
+
+	// ErrUnauthorized is returned by the Manager, Producer and Consumer when
+	// the broker rejects the client's credentials or the client is not
+	// authorized to perform the operation.
+	ErrUnauthorized = errors.New("kafka: unauthorized")
+
+	// ErrBrokerUnavailable is returned by the Manager, Producer and Consumer
+	// when a broker, or the leader or coordinator required by the operation,
+	// can't be reached.
+	ErrBrokerUnavailable = errors.New("kafka: broker unavailable")
+
+	// ErrRecordTooLarge is returned by the Producer for records which exceed
+	// the maximum batch size of the producer or the broker, or
+	// ProducerConfig.MaxRecordBytes, and is the error of consumed records
+	// which exceed MaxDecompressedRecordBytes.
+	ErrRecordTooLarge = errors.New("kafka: record too large")
+
+	// ErrRecordTimeout is returned by the Producer for records which
+	// couldn't be produced within ProducerConfig.RecordTimeout.
+	ErrRecordTimeout = errors.New("kafka: record timed out")
+)
+
+// FetchError is the error passed to ConsumerConfig.OnFetchError when the
+// brokers return an error fetching records, such as kerr.OffsetOutOfRange.
+type FetchError struct {
+	// Topic is the topic which failed to be fetched, without the namespace,
+	// or empty if the error isn't specific to a topic.
+	Topic apmqueue.Topic
+	// Partition is the partition which failed to be fetched, or -1 if the
+	// error isn't specific to a partition.
+	Partition int32
+	// Err is the fetch error, wrapped with the exported error categorizing
+	// it, if any.
+	Err error
+}
+
+func (e *FetchError) Error() string {
+	if e.Topic == "" {
+		return fmt.Sprintf("kafka: failed to fetch records: %v", e.Err)
+	}
+	return fmt.Sprintf("kafka: failed to fetch records of topic %q partition %d: %v",
+		e.Topic, e.Partition, e.Err,
+	)
+}
+
+func (e *FetchError) Unwrap() error { return e.Err }
+
+// kerrCategories maps the Kafka error codes to the exported error which
+// categorizes them.
+var kerrCategories = map[*kerr.Error]error{
+	kerr.UnknownTopicOrPartition: ErrTopicNotFound,
+	kerr.UnknownTopicID:          ErrTopicNotFound,
+
+	kerr.TopicAuthorizationFailed:           ErrUnauthorized,
+	kerr.GroupAuthorizationFailed:           ErrUnauthorized,
+	kerr.ClusterAuthorizationFailed:         ErrUnauthorized,
+	kerr.TransactionalIDAuthorizationFailed: ErrUnauthorized,
+	kerr.DelegationTokenAuthorizationFailed: ErrUnauthorized,
+	kerr.SaslAuthenticationFailed:           ErrUnauthorized,
+
+	kerr.BrokerNotAvailable:      ErrBrokerUnavailable,
+	kerr.LeaderNotAvailable:      ErrBrokerUnavailable,
+	kerr.NotLeaderForPartition:   ErrBrokerUnavailable,
+	kerr.CoordinatorNotAvailable: ErrBrokerUnavailable,
+	kerr.NotCoordinator:          ErrBrokerUnavailable,
+	kerr.NetworkException:        ErrBrokerUnavailable,
+	kerr.RequestTimedOut:         ErrBrokerUnavailable,
+
+	kerr.MessageTooLarge:    ErrRecordTooLarge,
+	kerr.RecordListTooLarge: ErrRecordTooLarge,
+}
+
+// classifyError wraps err with the exported error categorizing it, so that
+// errors.Is can be used to tell broker failures apart. Errors which don't
+// belong to any category, or which are already categorized, are returned
+// unchanged.
+func classifyError(err error) error {
+	if err == nil {
+		return nil
+	}
+	var category error
+	var kerrErr *kerr.Error
+	var netErr net.Error
+	switch {
+	case errors.Is(err, kgo.ErrRecordTimeout):
+		category = ErrRecordTimeout
+	case errors.As(err, &kerrErr):
+		category = kerrCategories[kerrErr]
+	case errors.As(err, &netErr):
+		category = ErrBrokerUnavailable
+	}
+	if category == nil || errors.Is(err, category) {
+		return err
+	}
+	return fmt.Errorf("%w: %w", category, err)
+}
@@ -0,0 +1,125 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package kafka
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/twmb/franz-go/pkg/kerr"
+	"github.com/twmb/franz-go/pkg/kfake"
+	"github.com/twmb/franz-go/pkg/kgo"
+	"github.com/twmb/franz-go/pkg/kmsg"
+	"go.uber.org/zap"
+
+	apmqueue "github.com/elastic/apm-queue/v2"
+)
+
+func TestClassifyError(t *testing.T) {
+	netErr := &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}
+	for name, tc := range map[string]struct {
+		err      error
+		expected error
+	}{
+		"topic not found":     {err: kerr.UnknownTopicOrPartition, expected: ErrTopicNotFound},
+		"topic unauthorized":  {err: kerr.TopicAuthorizationFailed, expected: ErrUnauthorized},
+		"sasl failed":         {err: kerr.SaslAuthenticationFailed, expected: ErrUnauthorized},
+		"leader not in place": {err: kerr.LeaderNotAvailable, expected: ErrBrokerUnavailable},
+		"wrapped kerr":        {err: fmt.Errorf("failed: %w", kerr.GroupAuthorizationFailed), expected: ErrUnauthorized},
+		"record too large":    {err: kerr.MessageTooLarge, expected: ErrRecordTooLarge},
+		"net error":           {err: fmt.Errorf("unable to dial: %w", netErr), expected: ErrBrokerUnavailable},
+		"record timeout":      {err: fmt.Errorf("failed: %w", kgo.ErrRecordTimeout), expected: ErrRecordTimeout},
+	} {
+		t.Run(name, func(t *testing.T) {
+			err := classifyError(tc.err)
+			assert.ErrorIs(t, err, tc.expected)
+			assert.ErrorIs(t, err, tc.err)
+		})
+	}
+	t.Run("uncategorized", func(t *testing.T) {
+		assert.NoError(t, classifyError(nil))
+		err := errors.New("boom")
+		assert.Equal(t, err, classifyError(err))
+		assert.Equal(t, kerr.InvalidTopicException, classifyError(kerr.InvalidTopicException))
+	})
+	t.Run("already categorized", func(t *testing.T) {
+		err := fmt.Errorf("%w: %w", ErrTopicNotFound, kerr.UnknownTopicOrPartition)
+		assert.Equal(t, err, classifyError(err))
+	})
+}
+
+func TestErrorCategories(t *testing.T) {
+	t.Run("manager", func(t *testing.T) {
+		cluster, cfg := newFakeCluster(t)
+		m, err := NewManager(ManagerConfig{CommonConfig: cfg})
+		require.NoError(t, err)
+		t.Cleanup(func() { m.Close() })
+
+		cluster.ControlKey(kmsg.DeleteTopics.Int16(), func(req kmsg.Request) (kmsg.Response, error, bool) {
+			return &kmsg.DeleteTopicsResponse{
+				Version: req.GetVersion(),
+				Topics: []kmsg.DeleteTopicsResponseTopic{{
+					Topic:     kmsg.StringPtr("name_space-topic"),
+					ErrorCode: kerr.TopicAuthorizationFailed.Code,
+				}},
+			}, nil, true
+		})
+		err = m.DeleteTopics(context.Background(), "topic")
+		assert.ErrorIs(t, err, ErrUnauthorized)
+		assert.ErrorIs(t, err, kerr.TopicAuthorizationFailed)
+	})
+	t.Run("producer", func(t *testing.T) {
+		cluster, err := kfake.NewCluster(
+			kfake.NumBrokers(1),
+			kfake.SeedTopics(1, "name_space-topic"),
+		)
+		require.NoError(t, err)
+		t.Cleanup(cluster.Close)
+		cluster.ControlKey(kmsg.Produce.Int16(), func(req kmsg.Request) (kmsg.Response, error, bool) {
+			cluster.KeepControl()
+			produceReq := req.(*kmsg.ProduceRequest)
+			resp := produceReq.ResponseKind().(*kmsg.ProduceResponse)
+			for _, topic := range produceReq.Topics {
+				respTopic := kmsg.NewProduceResponseTopic()
+				respTopic.Topic = topic.Topic
+				for _, partition := range topic.Partitions {
+					respPartition := kmsg.NewProduceResponseTopicPartition()
+					respPartition.Partition = partition.Partition
+					respPartition.ErrorCode = kerr.TopicAuthorizationFailed.Code
+					respTopic.Partitions = append(respTopic.Partitions, respPartition)
+				}
+				resp.Topics = append(resp.Topics, respTopic)
+			}
+			return resp, nil, true
+		})
+		producer := newProducer(t, ProducerConfig{CommonConfig: CommonConfig{
+			Brokers:   cluster.ListenAddrs(),
+			Logger:    zap.NewNop(),
+			Namespace: "name_space",
+		}})
+		_, err = producer.ProduceSync(context.Background(),
+			apmqueue.Record{Topic: "topic", Value: []byte("value")},
+		)
+		assert.ErrorIs(t, err, ErrUnauthorized)
+	})
+}
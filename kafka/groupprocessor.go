@@ -0,0 +1,85 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package kafka
+
+import (
+	"bytes"
+	"context"
+	"errors"
+
+	apmqueue "github.com/elastic/apm-queue/v2"
+)
+
+// GroupProcessor processes runs of consecutive records which have the same
+// ordering key, e.g. so that a sink can collapse them.
+type GroupProcessor interface {
+	// ProcessGroup processes the records, which belong to the same topic
+	// and partition, are ordered by offset, and all have key as their
+	// OrderingKey.
+	//
+	// If only some of the records fail to be processed, ProcessGroup should
+	// return a *apmqueue.BatchError identifying them by their index in
+	// records, the rest of the records are then considered processed. Any
+	// other error fails all the records.
+	ProcessGroup(ctx context.Context, key []byte, records []apmqueue.Record) error
+}
+
+// GroupProcessorFunc is a function type that implements GroupProcessor.
+type GroupProcessorFunc func(ctx context.Context, key []byte, records []apmqueue.Record) error
+
+// ProcessGroup calls f(ctx, key, records).
+func (f GroupProcessorFunc) ProcessGroup(ctx context.Context, key []byte, records []apmqueue.Record) error {
+	return f(ctx, key, records)
+}
+
+// groupingProcessor adapts a GroupProcessor to an apmqueue.BatchProcessor,
+// splitting each batch into runs of consecutive records with the same key.
+type groupingProcessor struct {
+	processor GroupProcessor
+}
+
+func (p groupingProcessor) ProcessBatch(ctx context.Context, rs []apmqueue.Record) error {
+	var errs map[int]error
+	for start := 0; start < len(rs); {
+		key := rs[start].OrderingKey
+		end := start + 1
+		for end < len(rs) && bytes.Equal(rs[end].OrderingKey, key) {
+			end++
+		}
+		if err := p.processor.ProcessGroup(ctx, key, rs[start:end]); err != nil {
+			if errs == nil {
+				errs = make(map[int]error)
+			}
+			var batchErr *apmqueue.BatchError
+			if errors.As(err, &batchErr) {
+				for i, err := range batchErr.Errors {
+					errs[start+i] = err
+				}
+			} else {
+				for i := start; i < end; i++ {
+					errs[i] = err
+				}
+			}
+		}
+		start = end
+	}
+	if len(errs) > 0 {
+		return &apmqueue.BatchError{Errors: errs}
+	}
+	return nil
+}
@@ -19,6 +19,7 @@ package kafka
 
 import (
 	"net"
+	"sync"
 	"time"
 
 	"github.com/twmb/franz-go/pkg/kgo"
@@ -26,7 +27,10 @@ import (
 )
 
 // Compile-time check that loggerHook implements the HookBrokerConnect interface.
-var _ kgo.HookBrokerConnect = new(loggerHook)
+var (
+	_ kgo.HookBrokerConnect = new(loggerHook)
+	_ kgo.HookBrokerConnect = new(disconnectedHook)
+)
 
 type loggerHook struct {
 	logger *zap.Logger
@@ -44,3 +48,55 @@ func (l *loggerHook) OnBrokerConnect(meta kgo.BrokerMetadata, dialDur time.Durat
 		)
 	}
 }
+
+// disconnectedHook logs a warning when connections to a broker have been
+// failing for longer than the threshold.
+type disconnectedHook struct {
+	logger    *zap.Logger
+	threshold time.Duration
+
+	mu sync.Mutex
+	// outages holds the outage of each broker which connections are
+	// failing to, keyed by node ID.
+	outages map[int32]*brokerOutage
+}
+
+type brokerOutage struct {
+	since  time.Time
+	warned bool
+}
+
+// OnBrokerConnect implements the kgo.HookBrokerConnect interface.
+func (h *disconnectedHook) OnBrokerConnect(meta kgo.BrokerMetadata, _ time.Duration, _ net.Conn, err error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	outage, ok := h.outages[meta.NodeID]
+	if err == nil {
+		if ok && outage.warned {
+			h.logger.Info("reconnected to broker",
+				zap.String("host", meta.Host),
+				zap.Int32("port", meta.Port),
+				zap.Duration("disconnected", time.Since(outage.since)),
+			)
+		}
+		delete(h.outages, meta.NodeID)
+		return
+	}
+	if !ok {
+		if h.outages == nil {
+			h.outages = make(map[int32]*brokerOutage)
+		}
+		outage = &brokerOutage{since: time.Now()}
+		h.outages[meta.NodeID] = outage
+	}
+	if d := time.Since(outage.since); !outage.warned && d >= h.threshold {
+		outage.warned = true
+		h.logger.Warn("disconnected from broker for longer than threshold",
+			zap.Error(err),
+			zap.String("host", meta.Host),
+			zap.Int32("port", meta.Port),
+			zap.Duration("disconnected", d),
+			zap.Duration("threshold", h.threshold),
+		)
+	}
+}
@@ -21,7 +21,9 @@ import (
 	"context"
 	"errors"
 	"net"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -57,3 +59,41 @@ func TestHookLogsFailedDial(t *testing.T) {
 	assert.EqualValues(t, observedLogs[0].ContextMap()["error"], errorMsg)
 	assert.Contains(t, observedLogs[0].ContextMap(), "duration")
 }
+
+func TestHookLogsDisconnected(t *testing.T) {
+	cluster, cfg := newFakeCluster(t)
+	t.Cleanup(cluster.Close)
+
+	core, logs := observer.New(zap.InfoLevel)
+	cfg.Logger = zap.New(core)
+	cfg.DisconnectedWarnThreshold = 50 * time.Millisecond
+	cfg.ReconnectBackoff = ReconnectBackoffConfig{Min: time.Millisecond, Max: 10 * time.Millisecond}
+	// Fail to dial the broker until the threshold is exceeded.
+	var failing atomic.Bool
+	failing.Store(true)
+	var dialer net.Dialer
+	cfg.Dialer = func(ctx context.Context, network, address string) (net.Conn, error) {
+		if failing.Load() {
+			return nil, errors.New("busted")
+		}
+		return dialer.DialContext(ctx, network, address)
+	}
+	require.NoError(t, cfg.finalize())
+
+	c, err := cfg.newClient(func(string) attribute.KeyValue { return attribute.String("k", "v") })
+	require.NoError(t, err)
+	t.Cleanup(c.Close)
+	require.Eventually(t, func() bool {
+		c.Ping(context.Background())
+		return logs.FilterMessage("disconnected from broker for longer than threshold").Len() > 0
+	}, 5*time.Second, 10*time.Millisecond)
+	// The warning is logged once per outage.
+	c.Ping(context.Background())
+	assert.Equal(t, 1, logs.FilterMessage("disconnected from broker for longer than threshold").Len())
+
+	failing.Store(false)
+	require.NoError(t, c.Ping(context.Background()))
+	reconnected := logs.FilterMessage("reconnected to broker").TakeAll()
+	require.Len(t, reconnected, 1)
+	assert.GreaterOrEqual(t, reconnected[0].ContextMap()["disconnected"], 50*time.Millisecond)
+}
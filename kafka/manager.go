@@ -22,11 +22,16 @@ import (
 	"errors"
 	"fmt"
 	"regexp"
+	"slices"
+	"sort"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/twmb/franz-go/pkg/kadm"
 	"github.com/twmb/franz-go/pkg/kerr"
 	"github.com/twmb/franz-go/pkg/kgo"
+	"github.com/twmb/franz-go/pkg/kmsg"
 	"go.opentelemetry.io/otel"
 	"go.opentelemetry.io/otel/attribute"
 	"go.opentelemetry.io/otel/codes"
@@ -38,6 +43,26 @@ import (
 	apmqueue "github.com/elastic/apm-queue/v2"
 )
 
+var (
+	// ErrGroupNotFound is returned by Manager methods when the consumer
+	// group does not exist.
+	ErrGroupNotFound = errors.New("kafka: consumer group not found")
+
+	// ErrGroupNotEmpty is returned by Manager methods when the consumer
+	// group cannot be modified because it has active members.
+	ErrGroupNotEmpty = errors.New("kafka: consumer group has active members")
+
+	// ErrBrokersUnreachable is returned by Manager.DescribeCluster when the
+	// cluster metadata can't be fetched from any broker.
+	ErrBrokersUnreachable = errors.New("kafka: no brokers reachable")
+
+	// ErrIncompleteMetadata is returned by Manager.DescribeCluster, along
+	// with the cluster information which is known, when the brokers return
+	// metadata without a controller or brokers, e.g. while the cluster is
+	// electing a new controller.
+	ErrIncompleteMetadata = errors.New("kafka: incomplete cluster metadata")
+)
+
 // ManagerConfig holds configuration for managing Kafka topics.
 type ManagerConfig struct {
 	CommonConfig
@@ -98,6 +123,538 @@ func (m *Manager) Close() error {
 	return nil
 }
 
+// AdminClient returns the underlying kadm.Client, for admin requests which
+// the Manager doesn't expose. Topic names aren't prefixed with the Namespace
+// by the admin client. Closing the client is unsupported, use Close instead.
+func (m *Manager) AdminClient() *kadm.Client {
+	return m.adminClient
+}
+
+// CreateTopics creates one or more topics, using the partition count,
+// replication factor and topic-level configs of each topic config.
+//
+// No error is returned for topics that already exist.
+func (m *Manager) CreateTopics(ctx context.Context, topics ...apmqueue.TopicConfig) error {
+	ctx, span := m.tracer.Start(ctx, "CreateTopics", trace.WithAttributes(
+		semconv.MessagingSystemKey.String("kafka"),
+	))
+	defer span.End()
+
+	_, err := m.createTopics(ctx, span, topics)
+	return err
+}
+
+// TopicSpec specifies a topic created by Manager.CreateTopicsWithDefaults.
+type TopicSpec struct {
+	// Topic is the name of the topic to create.
+	Topic apmqueue.Topic
+	// PartitionCount, if positive, overrides the partition count of the
+	// default topic config.
+	PartitionCount int
+}
+
+// CreateTopicsResult holds the topics processed by
+// Manager.CreateTopicsWithDefaults, in the order they were specified.
+type CreateTopicsResult struct {
+	// Created holds the topics which were created.
+	Created []apmqueue.Topic
+	// Existing holds the topics which already existed, and were left
+	// unchanged.
+	Existing []apmqueue.Topic
+}
+
+// CreateTopicsWithDefaults creates the topics with the partition count,
+// replication factor and topic-level configs of defaults, whose Topic is
+// ignored, overriding the partition count of the topics which specify one.
+//
+// Topics which already exist are skipped, and returned in the Existing
+// topics of the result. Topics which fail to be created are returned as a
+// joined error, along with the topics which were processed.
+func (m *Manager) CreateTopicsWithDefaults(ctx context.Context, defaults apmqueue.TopicConfig, topics ...TopicSpec) (CreateTopicsResult, error) {
+	ctx, span := m.tracer.Start(ctx, "CreateTopicsWithDefaults", trace.WithAttributes(
+		semconv.MessagingSystemKey.String("kafka"),
+	))
+	defer span.End()
+
+	configs := make([]apmqueue.TopicConfig, len(topics))
+	for i, topic := range topics {
+		configs[i] = defaults
+		configs[i].Topic = topic.Topic
+		if topic.PartitionCount > 0 {
+			configs[i].PartitionCount = topic.PartitionCount
+		}
+	}
+	return m.createTopics(ctx, span, configs)
+}
+
+// createTopics creates the topics, returning the topics which were created
+// and the ones which already existed.
+func (m *Manager) createTopics(ctx context.Context, span trace.Span, topics []apmqueue.TopicConfig) (CreateTopicsResult, error) {
+	namespacePrefix := m.cfg.namespacePrefix()
+	var result CreateTopicsResult
+	var createErrors []error
+	for _, topic := range topics {
+		partitions := int32(topic.PartitionCount)
+		if partitions == 0 {
+			partitions = -1 // default.num.partitions
+		}
+		replicationFactor := int16(topic.ReplicationFactor)
+		if replicationFactor == 0 {
+			replicationFactor = -1 // default.replication.factor
+		}
+		topicName := fmt.Sprintf("%s%s", namespacePrefix, topic.Topic)
+		responses, err := m.adminClient.CreateTopics(ctx,
+			partitions, replicationFactor, topic.Configs, topicName,
+		)
+		if err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, "CreateTopics returned an error")
+			return result, fmt.Errorf("failed to create kafka topics: %w", classifyError(err))
+		}
+		for _, response := range responses.Sorted() {
+			topic := strings.TrimPrefix(response.Topic, namespacePrefix)
+			logger := m.cfg.Logger.With(
+				zap.String("topic", topic),
+				zap.Int32("partition_count", partitions),
+				zap.Int16("replication_factor", replicationFactor),
+			)
+			if m.cfg.TopicLogFieldFunc != nil {
+				logger = logger.With(m.cfg.TopicLogFieldFunc(topic))
+			}
+			if err := response.Err; err != nil {
+				if errors.Is(err, kerr.TopicAlreadyExists) {
+					logger.Debug("kafka topic already exists")
+					result.Existing = append(result.Existing, apmqueue.Topic(topic))
+				} else {
+					span.RecordError(err)
+					span.SetStatus(codes.Error, "failed to create one or more topic")
+					createErrors = append(createErrors,
+						fmt.Errorf("failed to create topic %q: %w", topic, classifyError(err)),
+					)
+				}
+				continue
+			}
+			logger.Info("created kafka topic")
+			result.Created = append(result.Created, apmqueue.Topic(topic))
+		}
+	}
+	return result, errors.Join(createErrors...)
+}
+
+// AlterTopicConfigs alters the configuration of an existing topic. Configs
+// with a nil value are removed from the topic, reverting to the default.
+//
+// Each config is altered independently, so the configs that are accepted by
+// the broker are applied even if others are rejected. Any rejected configs
+// are returned as a joined error.
+func (m *Manager) AlterTopicConfigs(ctx context.Context, topic apmqueue.Topic, configs map[string]*string) error {
+	ctx, span := m.tracer.Start(ctx, "AlterTopicConfigs", trace.WithAttributes(
+		semconv.MessagingSystemKey.String("kafka"),
+		semconv.MessagingDestinationKey.String(string(topic)),
+	))
+	defer span.End()
+
+	logger := m.cfg.Logger.With(zap.String("topic", string(topic)))
+	if m.cfg.TopicLogFieldFunc != nil {
+		logger = logger.With(m.cfg.TopicLogFieldFunc(string(topic)))
+	}
+	keys := make([]string, 0, len(configs))
+	for k := range configs {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	topicName := fmt.Sprintf("%s%s", m.cfg.namespacePrefix(), topic)
+	var alterErrors []error
+	for _, k := range keys {
+		alterCfg := kadm.AlterConfig{Name: k, Value: configs[k]}
+		if alterCfg.Value == nil {
+			alterCfg.Op = kadm.DeleteConfig
+		}
+		responses, err := m.adminClient.AlterTopicConfigs(ctx,
+			[]kadm.AlterConfig{alterCfg}, topicName,
+		)
+		if err == nil {
+			_, err = responses.On(topicName, func(r *kadm.AlterConfigsResponse) error {
+				return r.Err
+			})
+		}
+		if err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, "failed to alter one or more topic configs")
+			alterErrors = append(alterErrors, fmt.Errorf(
+				"failed to alter config %q for topic %q: %w", k, topic, classifyError(err),
+			))
+			continue
+		}
+		logger.Info("altered configuration for kafka topic", zap.String("config", k))
+	}
+	return errors.Join(alterErrors...)
+}
+
+// CreatePartitions increases the number of partitions of an existing topic
+// to count. Partition counts can never be decreased, so an error is returned
+// if count is lower than the topic's current partition count. No error is
+// returned if the topic already has count partitions.
+func (m *Manager) CreatePartitions(ctx context.Context, topic apmqueue.Topic, count int) error {
+	ctx, span := m.tracer.Start(ctx, "CreatePartitions", trace.WithAttributes(
+		semconv.MessagingSystemKey.String("kafka"),
+		semconv.MessagingDestinationKey.String(string(topic)),
+	))
+	defer span.End()
+
+	topicName := fmt.Sprintf("%s%s", m.cfg.namespacePrefix(), topic)
+	details, err := m.adminClient.ListTopics(ctx, topicName)
+	if err == nil {
+		err = details[topicName].Err
+	}
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return fmt.Errorf("failed to describe topic %q: %w", topic, classifyError(err))
+	}
+	current := len(details[topicName].Partitions)
+	switch {
+	case count < current:
+		err := fmt.Errorf(
+			"kafka: cannot decrease partitions of topic %q from %d to %d",
+			topic, current, count,
+		)
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return err
+	case count == current:
+		return nil
+	}
+
+	logger := m.cfg.Logger.With(
+		zap.String("topic", string(topic)),
+		zap.Int("partition_count", count),
+	)
+	if m.cfg.TopicLogFieldFunc != nil {
+		logger = logger.With(m.cfg.TopicLogFieldFunc(string(topic)))
+	}
+	// Set the partition count, rather than adding partitions, so a
+	// concurrent increase isn't added to.
+	responses, err := m.adminClient.UpdatePartitions(ctx, count, topicName)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "UpdatePartitions returned an error")
+		return fmt.Errorf("failed to create partitions for topic %q: %w", topic, classifyError(err))
+	}
+	var createErrors []error
+	for _, response := range responses.Sorted() {
+		if err := response.Err; err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, "failed to create partitions")
+			createErrors = append(createErrors, fmt.Errorf(
+				"failed to create partitions for topic %q: %w", topic, classifyError(err),
+			))
+			continue
+		}
+		logger.Info("created partitions for kafka topic")
+	}
+	return errors.Join(createErrors...)
+}
+
+// reassignmentPollInterval is how often WaitForReassignments checks whether
+// the reassignments of a topic have completed.
+var reassignmentPollInterval = time.Second
+
+// SetReplicationFactor changes the replication factor of an existing topic
+// to rf, by reassigning the replicas of each partition. Replicas are added
+// on the brokers which don't hold a replica of the partition yet, and
+// removed from the end of the partition's replica list, so the preferred
+// leader is kept. No error is returned if every partition already has rf
+// replicas, and an error is returned if rf exceeds the number of brokers.
+//
+// The reassignment is carried out by the brokers in the background, use
+// WaitForReassignments to wait for it to complete.
+func (m *Manager) SetReplicationFactor(ctx context.Context, topic apmqueue.Topic, rf int) error {
+	ctx, span := m.tracer.Start(ctx, "SetReplicationFactor", trace.WithAttributes(
+		semconv.MessagingSystemKey.String("kafka"),
+		semconv.MessagingDestinationKey.String(string(topic)),
+	))
+	defer span.End()
+
+	fail := func(err error) error {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return err
+	}
+	if rf <= 0 {
+		return fail(fmt.Errorf("kafka: invalid replication factor %d for topic %q", rf, topic))
+	}
+	detail, err := m.topicDetail(ctx, topic)
+	if err != nil {
+		return fail(err)
+	}
+	metadata, err := m.adminClient.BrokerMetadata(ctx)
+	if err != nil {
+		return fail(fmt.Errorf("failed to fetch kafka brokers: %w", classifyError(err)))
+	}
+	brokers := metadata.Brokers.NodeIDs()
+	if rf > len(brokers) {
+		return fail(fmt.Errorf(
+			"kafka: replication factor %d of topic %q exceeds the %d available brokers",
+			rf, topic, len(brokers),
+		))
+	}
+	sort.Slice(brokers, func(i, j int) bool { return brokers[i] < brokers[j] })
+
+	var req kadm.AlterPartitionAssignmentsReq
+	for _, p := range detail.Partitions.Sorted() {
+		if len(p.Replicas) == rf {
+			continue
+		}
+		replicas := append([]int32(nil), p.Replicas...)
+		if len(replicas) > rf {
+			replicas = replicas[:rf]
+		}
+		// Spread the added replicas across the brokers, starting at a
+		// different broker for each partition.
+		for i := 0; len(replicas) < rf && i < len(brokers); i++ {
+			broker := brokers[(int(p.Partition)+i)%len(brokers)]
+			if !slices.Contains(replicas, broker) {
+				replicas = append(replicas, broker)
+			}
+		}
+		req.Assign(detail.Topic, p.Partition, replicas)
+	}
+	if len(req) == 0 {
+		return nil
+	}
+
+	logger := m.cfg.Logger.With(
+		zap.String("topic", string(topic)),
+		zap.Int("replication_factor", rf),
+	)
+	if m.cfg.TopicLogFieldFunc != nil {
+		logger = logger.With(m.cfg.TopicLogFieldFunc(string(topic)))
+	}
+	responses, err := m.adminClient.AlterPartitionAssignments(ctx, req)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "AlterPartitionAssignments returned an error")
+		return fmt.Errorf("failed to reassign partitions of topic %q: %w", topic, classifyError(err))
+	}
+	var assignErrors []error
+	for _, response := range responses.Sorted() {
+		if err := response.Err; err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, "failed to reassign one or more partitions")
+			assignErrors = append(assignErrors, fmt.Errorf(
+				"failed to reassign partition %d of topic %q: %w",
+				response.Partition, topic, classifyError(err),
+			))
+		}
+	}
+	if len(assignErrors) == 0 {
+		logger.Info("reassigning kafka topic partitions")
+	}
+	return errors.Join(assignErrors...)
+}
+
+// WaitForReassignments blocks until none of the partitions of the topic are
+// being reassigned, such as after SetReplicationFactor, polling the brokers
+// every second. It returns the context error if the context is done first.
+func (m *Manager) WaitForReassignments(ctx context.Context, topic apmqueue.Topic) error {
+	ctx, span := m.tracer.Start(ctx, "WaitForReassignments", trace.WithAttributes(
+		semconv.MessagingSystemKey.String("kafka"),
+		semconv.MessagingDestinationKey.String(string(topic)),
+	))
+	defer span.End()
+
+	detail, err := m.topicDetail(ctx, topic)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return err
+	}
+	var partitions kadm.TopicsSet
+	for p := range detail.Partitions {
+		partitions.Add(detail.Topic, p)
+	}
+	ticker := time.NewTicker(reassignmentPollInterval)
+	defer ticker.Stop()
+	for {
+		responses, err := m.adminClient.ListPartitionReassignments(ctx, partitions)
+		if err != nil {
+			err = fmt.Errorf("failed to list partition reassignments of topic %q: %w", topic, classifyError(err))
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+			return err
+		}
+		var pending bool
+		responses.Each(func(r kadm.ListPartitionReassignmentsResponse) {
+			if len(r.AddingReplicas) > 0 || len(r.RemovingReplicas) > 0 {
+				pending = true
+			}
+		})
+		if !pending {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			span.RecordError(ctx.Err())
+			span.SetStatus(codes.Error, ctx.Err().Error())
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// topicPollInterval and maxTopicPollInterval are the initial and maximum
+// intervals at which WaitForTopics checks whether the topics are available.
+var (
+	topicPollInterval    = 100 * time.Millisecond
+	maxTopicPollInterval = 5 * time.Second
+)
+
+// WaitForTopics blocks until each of the topics exists and every partition
+// of the topics has a leader, so records can be produced to them. The topic
+// metadata is polled with an exponentially increasing interval, retrying
+// any errors, until the topics are available or the context is done, in
+// which case the returned error lists the topics which weren't available.
+func (m *Manager) WaitForTopics(ctx context.Context, topics ...apmqueue.Topic) error {
+	ctx, span := m.tracer.Start(ctx, "WaitForTopics", trace.WithAttributes(
+		semconv.MessagingSystemKey.String("kafka"),
+	))
+	defer span.End()
+
+	if len(topics) == 0 {
+		return nil
+	}
+	interval := topicPollInterval
+	timer := time.NewTimer(interval)
+	defer timer.Stop()
+	for {
+		missing, err := m.unavailableTopics(ctx, topics)
+		if err == nil && len(missing) == 0 {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			err = fmt.Errorf("topics %q are not available: %w", missing, errors.Join(ctx.Err(), err))
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+			return err
+		case <-timer.C:
+		}
+		interval = min(interval*2, maxTopicPollInterval)
+		timer.Reset(interval)
+	}
+}
+
+// unavailableTopics returns the topics which don't exist, or have partitions
+// without a leader. All the topics are returned if the metadata request fails.
+func (m *Manager) unavailableTopics(ctx context.Context, topics []apmqueue.Topic) ([]apmqueue.Topic, error) {
+	namespacePrefix := m.cfg.namespacePrefix()
+	names := make([]string, len(topics))
+	for i, topic := range topics {
+		names[i] = namespacePrefix + string(topic)
+	}
+	details, err := m.adminClient.ListTopics(ctx, names...)
+	if err != nil {
+		return topics, fmt.Errorf("failed to list kafka topics: %w", classifyError(err))
+	}
+	var missing []apmqueue.Topic
+	for i, name := range names {
+		detail, ok := details[name]
+		if !ok || detail.Err != nil || len(detail.Partitions) == 0 {
+			missing = append(missing, topics[i])
+			continue
+		}
+		for _, p := range detail.Partitions {
+			if p.Err != nil || p.Leader < 0 {
+				missing = append(missing, topics[i])
+				break
+			}
+		}
+	}
+	return missing, nil
+}
+
+// DeleteRecords deletes all records of each partition before the given
+// offset, advancing the partition's low watermark to that offset.
+//
+// Offsets must be non-negative; no records are deleted if any offset is
+// negative. Per-partition errors returned by the brokers, such as when an
+// offset is beyond the high watermark, are returned as a joined error.
+func (m *Manager) DeleteRecords(ctx context.Context, offsets map[TopicPartition]int64) error {
+	ctx, span := m.tracer.Start(ctx, "DeleteRecords", trace.WithAttributes(
+		semconv.MessagingSystemKey.String("kafka"),
+	))
+	defer span.End()
+
+	tps := make([]TopicPartition, 0, len(offsets))
+	for tp := range offsets {
+		tps = append(tps, tp)
+	}
+	sort.Slice(tps, func(i, j int) bool {
+		if tps[i].Topic != tps[j].Topic {
+			return tps[i].Topic < tps[j].Topic
+		}
+		return tps[i].Partition < tps[j].Partition
+	})
+
+	namespacePrefix := m.cfg.namespacePrefix()
+	var invalidErrors []error
+	var kadmOffsets kadm.Offsets
+	for _, tp := range tps {
+		if offsets[tp] < 0 {
+			invalidErrors = append(invalidErrors, fmt.Errorf(
+				"kafka: invalid offset %d for topic %q partition %d",
+				offsets[tp], tp.Topic, tp.Partition,
+			))
+			continue
+		}
+		kadmOffsets.AddOffset(
+			fmt.Sprintf("%s%s", namespacePrefix, tp.Topic),
+			tp.Partition, offsets[tp], -1,
+		)
+	}
+	if err := errors.Join(invalidErrors...); err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "invalid offsets")
+		return err
+	}
+
+	responses, err := m.adminClient.DeleteRecords(ctx, kadmOffsets)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "DeleteRecords returned an error")
+		return fmt.Errorf("failed to delete kafka records: %w", classifyError(err))
+	}
+	var deleteErrors []error
+	for _, tp := range tps {
+		response, ok := responses.Lookup(
+			fmt.Sprintf("%s%s", namespacePrefix, tp.Topic), tp.Partition,
+		)
+		if !ok {
+			continue
+		}
+		logger := m.cfg.Logger.With(
+			zap.String("topic", string(tp.Topic)),
+			zap.Int32("partition", tp.Partition),
+		)
+		if m.cfg.TopicLogFieldFunc != nil {
+			logger = logger.With(m.cfg.TopicLogFieldFunc(string(tp.Topic)))
+		}
+		if err := response.Err; err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, "failed to delete records for one or more partitions")
+			deleteErrors = append(deleteErrors, fmt.Errorf(
+				"failed to delete records for topic %q partition %d: %w",
+				tp.Topic, tp.Partition, err,
+			))
+			continue
+		}
+		logger.Info("deleted kafka records", zap.Int64("low_watermark", response.LowWatermark))
+	}
+	return errors.Join(deleteErrors...)
+}
+
 // DeleteTopics deletes one or more topics.
 //
 // No error is returned for topics that do not exist.
@@ -117,7 +674,7 @@ func (m *Manager) DeleteTopics(ctx context.Context, topics ...apmqueue.Topic) er
 	if err != nil {
 		span.RecordError(err)
 		span.SetStatus(codes.Error, "DeleteTopics returned an error")
-		return fmt.Errorf("failed to delete kafka topics: %w", err)
+		return fmt.Errorf("failed to delete kafka topics: %w", classifyError(err))
 	}
 	var deleteErrors []error
 	for _, response := range responses.Sorted() {
@@ -134,38 +691,1096 @@ func (m *Manager) DeleteTopics(ctx context.Context, topics ...apmqueue.Topic) er
 				span.RecordError(err)
 				span.SetStatus(codes.Error, "failed to delete one or more topic")
 				deleteErrors = append(deleteErrors,
-					fmt.Errorf("failed to delete topic %q: %w", topic, err),
+					fmt.Errorf("failed to delete topic %q: %w", topic, classifyError(err)),
 				)
 				m.deleted.Add(context.Background(), 1, metric.WithAttributeSet(
-					attribute.NewSet(
+					attribute.NewSet(append(m.topicMetricAttributes(topic),
 						semconv.MessagingSystemKey.String("kafka"),
 						attribute.String("outcome", "failure"),
-						attribute.String("topic", topic),
-					),
+					)...),
 				))
 			}
 			continue
 		}
 		m.deleted.Add(context.Background(), 1, metric.WithAttributeSet(
-			attribute.NewSet(
+			attribute.NewSet(append(m.topicMetricAttributes(topic),
 				semconv.MessagingSystemKey.String("kafka"),
 				attribute.String("outcome", "success"),
-				attribute.String("topic", topic),
-			),
+			)...),
 		))
 		logger.Info("deleted kafka topic")
 	}
 	return errors.Join(deleteErrors...)
 }
 
-// Healthy returns an error if the Kafka client fails to reach a discovered broker.
-func (m *Manager) Healthy(ctx context.Context) error {
-	if err := m.client.Ping(ctx); err != nil {
-		return fmt.Errorf("failed to ping kafka brokers: %w", err)
+// DeleteConsumerGroups deletes one or more consumer groups, along with their
+// committed offsets.
+//
+// No error is returned for groups that do not exist. Groups which still have
+// active members cannot be deleted, and ErrGroupNotEmpty is returned for them.
+func (m *Manager) DeleteConsumerGroups(ctx context.Context, groups ...string) error {
+	ctx, span := m.tracer.Start(ctx, "DeleteConsumerGroups", trace.WithAttributes(
+		semconv.MessagingSystemKey.String("kafka"),
+	))
+	defer span.End()
+
+	responses, err := m.adminClient.DeleteGroups(ctx, groups...)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "DeleteGroups returned an error")
+		return fmt.Errorf("failed to delete kafka consumer groups: %w", classifyError(err))
+	}
+	var deleteErrors []error
+	for _, response := range responses.Sorted() {
+		logger := m.cfg.Logger.With(zap.String("group", response.Group))
+		if err := response.Err; err != nil {
+			switch {
+			case errors.Is(err, kerr.GroupIDNotFound):
+				logger.Debug("kafka consumer group does not exist")
+				continue
+			case errors.Is(err, kerr.NonEmptyGroup):
+				err = fmt.Errorf("%w: %w", ErrGroupNotEmpty, err)
+			}
+			span.RecordError(err)
+			span.SetStatus(codes.Error, "failed to delete one or more consumer groups")
+			deleteErrors = append(deleteErrors, fmt.Errorf(
+				"failed to delete consumer group %q: %w", response.Group, classifyError(err),
+			))
+			continue
+		}
+		logger.Info("deleted kafka consumer group")
+	}
+	return errors.Join(deleteErrors...)
+}
+
+// FetchOffsets returns the committed offsets of the consumer group. Only the
+// partitions of topics within the configured namespace are returned.
+func (m *Manager) FetchOffsets(ctx context.Context, group string) (map[TopicPartition]int64, error) {
+	ctx, span := m.tracer.Start(ctx, "FetchOffsets", trace.WithAttributes(
+		semconv.MessagingSystemKey.String("kafka"),
+		attribute.String("group", group),
+	))
+	defer span.End()
+
+	responses, err := m.adminClient.FetchOffsets(ctx, group)
+	if err == nil {
+		err = responses.Error()
+	}
+	if err != nil {
+		if errors.Is(err, kerr.GroupIDNotFound) {
+			err = fmt.Errorf("%w: %w", ErrGroupNotFound, err)
+		}
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return nil, fmt.Errorf("failed to fetch offsets for consumer group %q: %w", group, classifyError(err))
+	}
+	namespacePrefix := m.cfg.namespacePrefix()
+	offsets := make(map[TopicPartition]int64)
+	responses.Each(func(o kadm.OffsetResponse) {
+		if !strings.HasPrefix(o.Topic, namespacePrefix) {
+			// Ignore topics outside the namespace.
+			return
+		}
+		offsets[TopicPartition{
+			Topic:     apmqueue.Topic(o.Topic[len(namespacePrefix):]),
+			Partition: o.Partition,
+		}] = o.At
+	})
+	return offsets, nil
+}
+
+// CommitOffsets commits the offsets for the consumer group. The consumer
+// group must not have any active members, otherwise ErrGroupNotEmpty is
+// returned. If the group does not exist, it is created.
+func (m *Manager) CommitOffsets(ctx context.Context, group string, offsets map[TopicPartition]int64) error {
+	ctx, span := m.tracer.Start(ctx, "CommitOffsets", trace.WithAttributes(
+		semconv.MessagingSystemKey.String("kafka"),
+		attribute.String("group", group),
+	))
+	defer span.End()
+
+	if err := m.commitOffsets(ctx, group, offsets); err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return err
 	}
 	return nil
 }
 
+func (m *Manager) commitOffsets(ctx context.Context, group string, offsets map[TopicPartition]int64) error {
+	if len(offsets) == 0 {
+		return nil
+	}
+	described, err := m.adminClient.DescribeGroups(ctx, group)
+	if err != nil {
+		return fmt.Errorf("failed to describe consumer group %q: %w", group, classifyError(err))
+	}
+	if g, ok := described[group]; ok && g.Err == nil && len(g.Members) > 0 {
+		return fmt.Errorf("failed to commit offsets for consumer group %q: %w: %d members",
+			group, ErrGroupNotEmpty, len(g.Members),
+		)
+	}
+	namespacePrefix := m.cfg.namespacePrefix()
+	var kadmOffsets kadm.Offsets
+	for tp, offset := range offsets {
+		if offset < 0 {
+			return fmt.Errorf("failed to commit offsets for consumer group %q: invalid offset %d for topic %q partition %d",
+				group, offset, tp.Topic, tp.Partition,
+			)
+		}
+		kadmOffsets.Add(kadm.Offset{
+			Topic:       namespacePrefix + string(tp.Topic),
+			Partition:   tp.Partition,
+			At:          offset,
+			LeaderEpoch: -1,
+		})
+	}
+	responses, err := m.adminClient.CommitOffsets(ctx, group, kadmOffsets)
+	if err == nil {
+		err = responses.Error()
+	}
+	if err != nil {
+		// The broker rejects commits from outside of the group generation
+		// when the group has active members.
+		if errors.Is(err, kerr.UnknownMemberID) ||
+			errors.Is(err, kerr.IllegalGeneration) ||
+			errors.Is(err, kerr.RebalanceInProgress) {
+			err = fmt.Errorf("%w: %w", ErrGroupNotEmpty, err)
+		}
+		return fmt.Errorf("failed to commit offsets for consumer group %q: %w", group, classifyError(err))
+	}
+	m.cfg.Logger.Info("committed kafka consumer group offsets",
+		zap.String("group", group),
+		zap.Int("partitions", len(offsets)),
+	)
+	return nil
+}
+
+// OffsetResetPolicy defines the offsets that Manager.ResetOffsets resets a
+// consumer group to. Use ResetToEarliest, ResetToLatest or ResetToTimestamp.
+type OffsetResetPolicy struct {
+	at offsetReset
+	// timestamp is only used when at is offsetResetTimestamp.
+	timestamp time.Time
+}
+
+type offsetReset uint8
+
+const (
+	offsetResetEarliest offsetReset = iota
+	offsetResetLatest
+	offsetResetTimestamp
+)
+
+// ResetToEarliest resets the consumer group offsets to the earliest
+// offset of each partition.
+func ResetToEarliest() OffsetResetPolicy {
+	return OffsetResetPolicy{at: offsetResetEarliest}
+}
+
+// ResetToLatest resets the consumer group offsets to the end offset of
+// each partition.
+func ResetToLatest() OffsetResetPolicy {
+	return OffsetResetPolicy{at: offsetResetLatest}
+}
+
+// ResetToTimestamp resets the consumer group offsets to the offset of the
+// first record of each partition produced at or after ts, or to the end
+// offset if there are none.
+func ResetToTimestamp(ts time.Time) OffsetResetPolicy {
+	return OffsetResetPolicy{at: offsetResetTimestamp, timestamp: ts}
+}
+
+// ResetOffsets resets the offsets of all the partitions of the topics that
+// the consumer group has committed offsets for, as described by policy.
+// Like CommitOffsets, the group must not have any active members. If the
+// group hasn't committed any offsets, ErrGroupNotFound is returned.
+func (m *Manager) ResetOffsets(ctx context.Context, group string, policy OffsetResetPolicy) error {
+	ctx, span := m.tracer.Start(ctx, "ResetOffsets", trace.WithAttributes(
+		semconv.MessagingSystemKey.String("kafka"),
+		attribute.String("group", group),
+	))
+	defer span.End()
+
+	err := m.resetOffsets(ctx, group, policy)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	return err
+}
+
+func (m *Manager) resetOffsets(ctx context.Context, group string, policy OffsetResetPolicy) error {
+	committed, err := m.adminClient.FetchOffsets(ctx, group)
+	if err == nil {
+		err = committed.Error()
+	}
+	if err != nil && !errors.Is(err, kerr.GroupIDNotFound) {
+		return fmt.Errorf("failed to fetch offsets for consumer group %q: %w", group, classifyError(err))
+	}
+	namespacePrefix := m.cfg.namespacePrefix()
+	var topics []string
+	for topic := range committed {
+		if strings.HasPrefix(topic, namespacePrefix) {
+			topics = append(topics, topic)
+		}
+	}
+	if len(topics) == 0 {
+		return fmt.Errorf("failed to reset offsets for consumer group %q: %w", group, ErrGroupNotFound)
+	}
+	sort.Strings(topics)
+
+	var listed kadm.ListedOffsets
+	switch policy.at {
+	case offsetResetEarliest:
+		listed, err = m.adminClient.ListStartOffsets(ctx, topics...)
+	case offsetResetLatest:
+		listed, err = m.adminClient.ListEndOffsets(ctx, topics...)
+	case offsetResetTimestamp:
+		listed, err = m.adminClient.ListOffsetsAfterMilli(ctx, policy.timestamp.UnixMilli(), topics...)
+	default:
+		return fmt.Errorf("kafka: unknown offset reset policy %d", policy.at)
+	}
+	if err == nil {
+		err = listed.Error()
+	}
+	if err != nil {
+		return fmt.Errorf("failed to list offsets for consumer group %q: %w", group, classifyError(err))
+	}
+	offsets := make(map[TopicPartition]int64)
+	listed.Each(func(o kadm.ListedOffset) {
+		offsets[TopicPartition{
+			Topic:     apmqueue.Topic(o.Topic[len(namespacePrefix):]),
+			Partition: o.Partition,
+		}] = o.Offset
+	})
+	return m.commitOffsets(ctx, group, offsets)
+}
+
+// OffsetShift holds the committed offset of a partition before and after
+// Manager.ShiftOffsets.
+type OffsetShift struct {
+	// From is the offset committed before the shift.
+	From int64
+	// To is the offset committed by the shift.
+	To int64
+}
+
+// ShiftOffsets moves the committed offsets of the consumer group by delta
+// records on each partition it has committed offsets for, rewinding them
+// when delta is negative, and returns the applied shifts. Like CommitOffsets,
+// the group must not have any active members. If the group hasn't committed
+// any offsets, ErrGroupNotFound is returned.
+//
+// The shifted offsets are clamped to the partition's start and end offsets,
+// so the group can neither be rewound past the earliest available record nor
+// moved past the end of the partition. The shift of a clamped partition is
+// therefore smaller than delta.
+func (m *Manager) ShiftOffsets(ctx context.Context, group string, delta int64) (map[TopicPartition]OffsetShift, error) {
+	ctx, span := m.tracer.Start(ctx, "ShiftOffsets", trace.WithAttributes(
+		semconv.MessagingSystemKey.String("kafka"),
+		attribute.String("group", group),
+		attribute.Int64("delta", delta),
+	))
+	defer span.End()
+
+	shifts, err := m.shiftOffsets(ctx, group, delta)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return nil, err
+	}
+	return shifts, nil
+}
+
+func (m *Manager) shiftOffsets(ctx context.Context, group string, delta int64) (map[TopicPartition]OffsetShift, error) {
+	committed, err := m.adminClient.FetchOffsets(ctx, group)
+	if err == nil {
+		err = committed.Error()
+	}
+	if err != nil && !errors.Is(err, kerr.GroupIDNotFound) {
+		return nil, fmt.Errorf("failed to fetch offsets for consumer group %q: %w", group, classifyError(err))
+	}
+	namespacePrefix := m.cfg.namespacePrefix()
+	var topics []string
+	for topic := range committed {
+		if strings.HasPrefix(topic, namespacePrefix) {
+			topics = append(topics, topic)
+		}
+	}
+	if len(topics) == 0 {
+		return nil, fmt.Errorf("failed to shift offsets for consumer group %q: %w", group, ErrGroupNotFound)
+	}
+	sort.Strings(topics)
+
+	startOffsets, err := m.adminClient.ListStartOffsets(ctx, topics...)
+	if err == nil {
+		err = startOffsets.Error()
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to list start offsets for consumer group %q: %w", group, classifyError(err))
+	}
+	endOffsets, err := m.adminClient.ListEndOffsets(ctx, topics...)
+	if err == nil {
+		err = endOffsets.Error()
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to list end offsets for consumer group %q: %w", group, classifyError(err))
+	}
+	shifts := make(map[TopicPartition]OffsetShift)
+	offsets := make(map[TopicPartition]int64)
+	for _, topic := range topics {
+		for partition, o := range committed[topic] {
+			if o.At < 0 {
+				continue
+			}
+			start, ok := startOffsets.Lookup(topic, partition)
+			if !ok {
+				continue
+			}
+			end, ok := endOffsets.Lookup(topic, partition)
+			if !ok {
+				continue
+			}
+			tp := TopicPartition{
+				Topic:     apmqueue.Topic(topic[len(namespacePrefix):]),
+				Partition: partition,
+			}
+			// Clamp the delta rather than the offset, so it can't overflow.
+			to := o.At + max(min(delta, end.Offset-o.At), start.Offset-o.At)
+			shifts[tp] = OffsetShift{From: o.At, To: to}
+			offsets[tp] = to
+		}
+	}
+	if err := m.commitOffsets(ctx, group, offsets); err != nil {
+		return nil, err
+	}
+	return shifts, nil
+}
+
+// ListTopicsConfig holds optional filters for Manager.ListTopics.
+type ListTopicsConfig struct {
+	// Prefix, if non-empty, restricts the listed topics to those whose
+	// name starts with Prefix. The prefix is matched after the namespace
+	// has been removed from the topic name.
+	//
+	// Kafka has no server-side filtering for topic metadata, so topics
+	// are filtered after the metadata has been fetched.
+	Prefix string
+
+	// ExcludeInternal excludes internal topics, such as __consumer_offsets.
+	ExcludeInternal bool
+}
+
+// TopicInfo holds the metadata of a topic returned by Manager.ListTopics.
+type TopicInfo struct {
+	// Topic is the topic name, without the namespace.
+	Topic apmqueue.Topic
+	// PartitionCount is the number of partitions of the topic.
+	PartitionCount int
+	// ReplicationFactor is the number of replicas of each partition.
+	ReplicationFactor int
+	// Internal is true if the topic is internal to Kafka.
+	Internal bool
+}
+
+// ListTopics returns the metadata for existing topics matching cfg, sorted
+// by name. Only the topics within the configured namespace are returned.
+func (m *Manager) ListTopics(ctx context.Context, cfg ListTopicsConfig) ([]TopicInfo, error) {
+	ctx, span := m.tracer.Start(ctx, "ListTopics", trace.WithAttributes(
+		semconv.MessagingSystemKey.String("kafka"),
+	))
+	defer span.End()
+
+	details, err := m.adminClient.ListTopicsWithInternal(ctx)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return nil, fmt.Errorf("failed to list kafka topics: %w", classifyError(err))
+	}
+	namespacePrefix := m.cfg.namespacePrefix()
+	topics := make([]TopicInfo, 0, len(details))
+	for _, detail := range details.Sorted() {
+		if detail.Err != nil {
+			m.cfg.Logger.Warn("error listing kafka topic",
+				zap.String("topic", strings.TrimPrefix(detail.Topic, namespacePrefix)),
+				zap.Error(detail.Err),
+			)
+			continue
+		}
+		if !strings.HasPrefix(detail.Topic, namespacePrefix) {
+			// Ignore topics outside the namespace.
+			continue
+		}
+		topic := detail.Topic[len(namespacePrefix):]
+		if !strings.HasPrefix(topic, cfg.Prefix) {
+			continue
+		}
+		if cfg.ExcludeInternal && detail.IsInternal {
+			continue
+		}
+		topics = append(topics, TopicInfo{
+			Topic:             apmqueue.Topic(topic),
+			PartitionCount:    len(detail.Partitions),
+			ReplicationFactor: detail.Partitions.NumReplicas(),
+			Internal:          detail.IsInternal,
+		})
+	}
+	return topics, nil
+}
+
+// TopicExists returns whether the topic exists. No error is returned if the
+// topic doesn't exist.
+func (m *Manager) TopicExists(ctx context.Context, topic apmqueue.Topic) (bool, error) {
+	ctx, span := m.tracer.Start(ctx, "TopicExists", trace.WithAttributes(
+		semconv.MessagingSystemKey.String("kafka"),
+		semconv.MessagingDestinationKey.String(string(topic)),
+	))
+	defer span.End()
+
+	detail, err := m.topicDetail(ctx, topic)
+	if errors.Is(err, ErrTopicNotFound) {
+		return false, nil
+	}
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return false, err
+	}
+	return detail.Err == nil, nil
+}
+
+// TopicDescription holds the description of a topic returned by
+// Manager.DescribeTopic.
+type TopicDescription struct {
+	// Topic is the topic name, without the namespace.
+	Topic apmqueue.Topic
+	// PartitionCount is the number of partitions of the topic.
+	PartitionCount int
+	// ReplicationFactor is the number of replicas of each partition.
+	ReplicationFactor int
+	// Internal is true if the topic is internal to Kafka.
+	Internal bool
+	// Partitions holds the description of each partition, sorted by
+	// partition.
+	Partitions []PartitionDescription
+	// Configs holds the topic's configs, including the defaults.
+	Configs map[string]string
+}
+
+// PartitionDescription holds the leader and replica assignments of a topic
+// partition.
+type PartitionDescription struct {
+	// Partition is the partition number.
+	Partition int32
+	// Leader is the broker ID of the partition leader, or -1 if the
+	// partition has no leader.
+	Leader int32
+	// Replicas holds the broker IDs of the partition replicas.
+	Replicas []int32
+	// ISR holds the broker IDs of the in-sync replicas.
+	ISR []int32
+}
+
+// DescribeTopic returns the description of the topic, including its
+// partition assignments and configs. ErrTopicNotFound is returned if the
+// topic doesn't exist.
+func (m *Manager) DescribeTopic(ctx context.Context, topic apmqueue.Topic) (TopicDescription, error) {
+	ctx, span := m.tracer.Start(ctx, "DescribeTopic", trace.WithAttributes(
+		semconv.MessagingSystemKey.String("kafka"),
+		semconv.MessagingDestinationKey.String(string(topic)),
+	))
+	defer span.End()
+
+	detail, err := m.topicDetail(ctx, topic)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return TopicDescription{}, err
+	}
+	name := m.cfg.namespacePrefix() + string(topic)
+	rcs, err := m.adminClient.DescribeTopicConfigs(ctx, name)
+	if err == nil {
+		var rc kadm.ResourceConfig
+		rc, err = rcs.On(name, nil)
+		if err == nil {
+			err = rc.Err
+		}
+		if err == nil {
+			configs := make(map[string]string, len(rc.Configs))
+			for _, c := range rc.Configs {
+				configs[c.Key] = c.MaybeValue()
+			}
+			desc := TopicDescription{
+				Topic:             topic,
+				PartitionCount:    len(detail.Partitions),
+				ReplicationFactor: detail.Partitions.NumReplicas(),
+				Internal:          detail.IsInternal,
+				Partitions:        make([]PartitionDescription, 0, len(detail.Partitions)),
+				Configs:           configs,
+			}
+			for _, p := range detail.Partitions.Sorted() {
+				desc.Partitions = append(desc.Partitions, PartitionDescription{
+					Partition: p.Partition,
+					Leader:    p.Leader,
+					Replicas:  p.Replicas,
+					ISR:       p.ISR,
+				})
+			}
+			return desc, nil
+		}
+	}
+	err = fmt.Errorf("failed to describe kafka topic configs %q: %w", topic, classifyError(err))
+	span.RecordError(err)
+	span.SetStatus(codes.Error, err.Error())
+	return TopicDescription{}, err
+}
+
+// topicDetail returns the metadata of the topic, or ErrTopicNotFound if the
+// topic doesn't exist.
+func (m *Manager) topicDetail(ctx context.Context, topic apmqueue.Topic) (kadm.TopicDetail, error) {
+	name := m.cfg.namespacePrefix() + string(topic)
+	details, err := m.adminClient.ListTopics(ctx, name)
+	if err != nil {
+		return kadm.TopicDetail{}, fmt.Errorf("failed to list kafka topic %q: %w", topic, classifyError(err))
+	}
+	detail, ok := details[name]
+	if !ok || errors.Is(detail.Err, kerr.UnknownTopicOrPartition) {
+		return kadm.TopicDetail{}, fmt.Errorf("%w: %q", ErrTopicNotFound, topic)
+	}
+	if detail.Err != nil {
+		return kadm.TopicDetail{}, fmt.Errorf("failed to list kafka topic %q: %w", topic, classifyError(detail.Err))
+	}
+	return detail, nil
+}
+
+// TopicDiff holds the differences between the desired topic configs passed
+// to Manager.ValidateTopics and the actual state of the topics, i.e. the
+// changes which applying the topic configs would make.
+type TopicDiff struct {
+	// Missing holds the topics which don't exist, and would be created.
+	Missing []apmqueue.Topic
+	// PartitionIncreases holds the topics with fewer partitions than
+	// desired, whose partitions would be created.
+	PartitionIncreases []TopicCountChange
+	// PartitionDecreases holds the topics with more partitions than
+	// desired. Partitions can't be removed, so these changes can't be
+	// applied without recreating the topics.
+	PartitionDecreases []TopicCountChange
+	// ReplicationChanges holds the topics whose replication factor differs
+	// from the desired one.
+	ReplicationChanges []TopicCountChange
+	// ConfigChanges holds the topic-level configs whose value differs from
+	// the desired one.
+	ConfigChanges []TopicConfigChange
+}
+
+// Empty returns true if the diff holds no changes.
+func (d TopicDiff) Empty() bool {
+	return len(d.Missing) == 0 && len(d.PartitionIncreases) == 0 &&
+		len(d.PartitionDecreases) == 0 && len(d.ReplicationChanges) == 0 &&
+		len(d.ConfigChanges) == 0
+}
+
+// TopicCountChange holds a change of the partition count or replication
+// factor of a topic.
+type TopicCountChange struct {
+	// Topic is the topic name, without the namespace.
+	Topic apmqueue.Topic
+	// From is the actual count.
+	From int
+	// To is the desired count.
+	To int
+}
+
+// TopicConfigChange holds a change of a topic-level config.
+type TopicConfigChange struct {
+	// Topic is the topic name, without the namespace.
+	Topic apmqueue.Topic
+	// Key is the config name.
+	Key string
+	// From is the actual value, or nil if the config isn't set.
+	From *string
+	// To is the desired value, or nil if the config is to be removed,
+	// reverting to the default.
+	To *string
+}
+
+// ValidateTopics compares the topic configs with the actual state of the
+// topics, without modifying them, and returns the differences. Partition
+// counts and replication factors which are zero or -1, i.e. the broker's
+// default, aren't compared. Desired configs with a nil value only differ
+// from the actual configs when they're set on the topic, rather than
+// inherited from the broker or its defaults.
+//
+// Changes are listed in the order of the topics, and by config name.
+func (m *Manager) ValidateTopics(ctx context.Context, topics ...apmqueue.TopicConfig) (TopicDiff, error) {
+	ctx, span := m.tracer.Start(ctx, "ValidateTopics", trace.WithAttributes(
+		semconv.MessagingSystemKey.String("kafka"),
+	))
+	defer span.End()
+
+	diff, err := m.validateTopics(ctx, topics)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	return diff, err
+}
+
+func (m *Manager) validateTopics(ctx context.Context, topics []apmqueue.TopicConfig) (TopicDiff, error) {
+	var diff TopicDiff
+	if len(topics) == 0 {
+		return diff, nil
+	}
+	namespacePrefix := m.cfg.namespacePrefix()
+	names := make([]string, len(topics))
+	for i, topic := range topics {
+		names[i] = namespacePrefix + string(topic.Topic)
+	}
+	details, err := m.adminClient.ListTopics(ctx, names...)
+	if err != nil {
+		return diff, fmt.Errorf("failed to list kafka topics: %w", classifyError(err))
+	}
+	var existing []string
+	for i, topic := range topics {
+		detail, ok := details[names[i]]
+		if !ok || errors.Is(detail.Err, kerr.UnknownTopicOrPartition) {
+			diff.Missing = append(diff.Missing, topic.Topic)
+			continue
+		}
+		if detail.Err != nil {
+			return diff, fmt.Errorf("failed to list kafka topic %q: %w", topic.Topic, classifyError(detail.Err))
+		}
+		existing = append(existing, names[i])
+	}
+	if len(existing) == 0 {
+		return diff, nil
+	}
+	rcs, err := m.adminClient.DescribeTopicConfigs(ctx, existing...)
+	if err != nil {
+		return diff, fmt.Errorf("failed to describe kafka topic configs: %w", classifyError(err))
+	}
+	for i, topic := range topics {
+		detail, ok := details[names[i]]
+		if !ok || detail.Err != nil {
+			continue
+		}
+		partitions := len(detail.Partitions)
+		if want := topic.PartitionCount; want > 0 && want != partitions {
+			change := TopicCountChange{Topic: topic.Topic, From: partitions, To: want}
+			if want > partitions {
+				diff.PartitionIncreases = append(diff.PartitionIncreases, change)
+			} else {
+				diff.PartitionDecreases = append(diff.PartitionDecreases, change)
+			}
+		}
+		if want, rf := topic.ReplicationFactor, detail.Partitions.NumReplicas(); want > 0 && want != rf {
+			diff.ReplicationChanges = append(diff.ReplicationChanges,
+				TopicCountChange{Topic: topic.Topic, From: rf, To: want},
+			)
+		}
+		if len(topic.Configs) == 0 {
+			continue
+		}
+		rc, err := rcs.On(names[i], nil)
+		if err == nil {
+			err = rc.Err
+		}
+		if err != nil {
+			return diff, fmt.Errorf("failed to describe kafka topic configs %q: %w", topic.Topic, classifyError(err))
+		}
+		actual := make(map[string]kadm.Config, len(rc.Configs))
+		for _, c := range rc.Configs {
+			actual[c.Key] = c
+		}
+		keys := make([]string, 0, len(topic.Configs))
+		for k := range topic.Configs {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			want := topic.Configs[k]
+			c, ok := actual[k]
+			var changed bool
+			switch {
+			case want == nil:
+				// Only configs set on the topic can be removed.
+				changed = ok && c.Source == kmsg.ConfigSourceDynamicTopicConfig
+			default:
+				changed = !ok || c.Value == nil || *c.Value != *want
+			}
+			if changed {
+				diff.ConfigChanges = append(diff.ConfigChanges, TopicConfigChange{
+					Topic: topic.Topic, Key: k, From: c.Value, To: want,
+				})
+			}
+		}
+	}
+	return diff, nil
+}
+
+// ConsumerGroupLagConfig holds optional settings for Manager.ConsumerGroupLag.
+type ConsumerGroupLagConfig struct {
+	// SkipUncommitted excludes partitions which the group has never
+	// committed an offset for. By default, the lag for those partitions
+	// is reported as the partition's end offset.
+	SkipUncommitted bool
+}
+
+// ConsumerGroupLag returns the lag of the consumer group for each of the
+// partitions that are either assigned to the group's members or that the
+// group has committed offsets for. Only the partitions of topics within the
+// configured namespace are returned.
+//
+// ErrGroupNotFound is returned if the group does not exist. If the lag can't
+// be calculated for some partitions, the lag for the remaining partitions is
+// returned along with a joined error for the failed partitions.
+func (m *Manager) ConsumerGroupLag(ctx context.Context, group string, cfg ConsumerGroupLagConfig) (map[TopicPartition]int64, error) {
+	ctx, span := m.tracer.Start(ctx, "ConsumerGroupLag", trace.WithAttributes(
+		semconv.MessagingSystemKey.String("kafka"),
+		attribute.String("group", group),
+	))
+	defer span.End()
+
+	lags, err := m.adminClient.Lag(ctx, group)
+	if err == nil {
+		err = lags.Error()
+	}
+	if errors.Is(err, kerr.GroupIDNotFound) {
+		return nil, fmt.Errorf("failed to calculate consumer lag for group %q: %w", group, ErrGroupNotFound)
+	}
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return nil, fmt.Errorf("failed to calculate consumer lag for group %q: %w", group, classifyError(err))
+	}
+	groupLag, ok := lags[group]
+	if !ok || groupLag.State == "Dead" {
+		return nil, fmt.Errorf("failed to calculate consumer lag for group %q: %w", group, ErrGroupNotFound)
+	}
+	namespacePrefix := m.cfg.namespacePrefix()
+	result := make(map[TopicPartition]int64)
+	var lagErrors []error
+	for _, l := range groupLag.Lag.Sorted() {
+		if !strings.HasPrefix(l.Topic, namespacePrefix) {
+			// Ignore topics outside the namespace.
+			continue
+		}
+		topic := l.Topic[len(namespacePrefix):]
+		if l.Err != nil {
+			span.RecordError(l.Err)
+			span.SetStatus(codes.Error, "failed to calculate lag for one or more partitions")
+			lagErrors = append(lagErrors, fmt.Errorf(
+				"failed to calculate lag for topic %q partition %d: %w",
+				topic, l.Partition, classifyError(l.Err),
+			))
+			continue
+		}
+		if cfg.SkipUncommitted && l.Commit.At < 0 {
+			continue
+		}
+		result[TopicPartition{Topic: apmqueue.Topic(topic), Partition: l.Partition}] = l.Lag
+	}
+	return result, errors.Join(lagErrors...)
+}
+
+// GroupDescription holds the description of a consumer group returned by
+// Manager.DescribeConsumerGroup.
+type GroupDescription struct {
+	// Group is the consumer group ID.
+	Group string
+	// State is the state of the group, such as Stable, Empty or
+	// PreparingRebalance.
+	State string
+	// ProtocolType is the type of the group protocol, "consumer" for
+	// consumer groups.
+	ProtocolType string
+	// Protocol is the partition assignment strategy used by the group.
+	Protocol string
+	// Members holds the members of the group.
+	Members []GroupMemberDescription
+}
+
+// GroupMemberDescription holds the description of a consumer group member.
+type GroupMemberDescription struct {
+	// MemberID is the ID assigned to the member by the group coordinator.
+	MemberID string
+	// InstanceID is the static group instance ID of the member, or empty if
+	// the member isn't a static member.
+	InstanceID string
+	// ClientID and ClientHost identify the client of the member.
+	ClientID   string
+	ClientHost string
+	// Partitions holds the partitions assigned to the member, sorted by topic
+	// and partition. Only the partitions of topics within the configured
+	// namespace are included, without the namespace.
+	Partitions []TopicPartition
+}
+
+// DescribeConsumerGroup returns the state, protocol and members of the
+// consumer group, including the partitions assigned to each member.
+// ErrGroupNotFound is returned if the group doesn't exist.
+func (m *Manager) DescribeConsumerGroup(ctx context.Context, group string) (GroupDescription, error) {
+	ctx, span := m.tracer.Start(ctx, "DescribeConsumerGroup", trace.WithAttributes(
+		semconv.MessagingSystemKey.String("kafka"),
+		attribute.String("group", group),
+	))
+	defer span.End()
+
+	described, err := m.adminClient.DescribeGroups(ctx, group)
+	g, ok := described[group]
+	switch {
+	case err != nil:
+		err = fmt.Errorf("failed to describe consumer group %q: %w", group, classifyError(err))
+	case !ok || g.State == "Dead" || errors.Is(g.Err, kerr.GroupIDNotFound):
+		err = fmt.Errorf("failed to describe consumer group %q: %w", group, ErrGroupNotFound)
+	case g.Err != nil:
+		err = fmt.Errorf("failed to describe consumer group %q: %w", group, classifyError(g.Err))
+	}
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return GroupDescription{}, err
+	}
+	namespacePrefix := m.cfg.namespacePrefix()
+	desc := GroupDescription{
+		Group:        g.Group,
+		State:        g.State,
+		ProtocolType: g.ProtocolType,
+		Protocol:     g.Protocol,
+		Members:      make([]GroupMemberDescription, 0, len(g.Members)),
+	}
+	for _, member := range g.Members {
+		md := GroupMemberDescription{
+			MemberID:   member.MemberID,
+			ClientID:   member.ClientID,
+			ClientHost: member.ClientHost,
+		}
+		if member.InstanceID != nil {
+			md.InstanceID = *member.InstanceID
+		}
+		if assignment, ok := member.Assigned.AsConsumer(); ok {
+			for _, t := range assignment.Topics {
+				if !strings.HasPrefix(t.Topic, namespacePrefix) {
+					// Ignore topics outside the namespace.
+					continue
+				}
+				topic := apmqueue.Topic(t.Topic[len(namespacePrefix):])
+				for _, partition := range t.Partitions {
+					md.Partitions = append(md.Partitions, TopicPartition{
+						Topic: topic, Partition: partition,
+					})
+				}
+			}
+		}
+		sort.Slice(md.Partitions, func(i, j int) bool {
+			if md.Partitions[i].Topic != md.Partitions[j].Topic {
+				return md.Partitions[i].Topic < md.Partitions[j].Topic
+			}
+			return md.Partitions[i].Partition < md.Partitions[j].Partition
+		})
+		desc.Members = append(desc.Members, md)
+	}
+	return desc, nil
+}
+
+// topicMetricAttributes returns the attributes identifying topic, without the
+// namespace, in the Manager's metrics.
+func (m *Manager) topicMetricAttributes(topic string) []attribute.KeyValue {
+	return m.cfg.MetricAttributeFilter.topicAttributes(topic, attribute.String("topic", topic))
+}
+
+// Ping issues a metadata request without any topics, which is cheap for the
+// brokers to serve, returning an error if no broker responds to it.
+func (m *Manager) Ping(ctx context.Context) error {
+	ctx, span := m.tracer.Start(ctx, "Ping", trace.WithAttributes(
+		semconv.MessagingSystemKey.String("kafka"),
+	))
+	defer span.End()
+
+	req := kmsg.NewPtrMetadataRequest()
+	req.Topics = []kmsg.MetadataRequestTopic{}
+	if _, err := req.RequestWith(ctx, m.client); err != nil {
+		err = fmt.Errorf("failed to ping kafka brokers: %w", classifyError(err))
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return err
+	}
+	return nil
+}
+
+// Healthy returns an error if the Kafka client fails to reach a discovered broker.
+func (m *Manager) Healthy(ctx context.Context) error {
+	if err := m.client.Ping(ctx); err != nil {
+		return fmt.Errorf("failed to ping kafka brokers: %w", classifyError(err))
+	}
+	return nil
+}
+
+// ClusterInfo holds the description of a cluster returned by
+// Manager.DescribeCluster.
+type ClusterInfo struct {
+	// ClusterID is the ID of the cluster, which may be empty for clusters
+	// which don't report one.
+	ClusterID string
+	// ControllerID is the ID of the controller broker, or -1 if unknown.
+	ControllerID int32
+	// Brokers holds the brokers of the cluster, sorted by ID.
+	Brokers []BrokerInfo
+}
+
+// BrokerInfo holds the description of a broker returned by
+// Manager.DescribeCluster.
+type BrokerInfo struct {
+	// ID is the node ID of the broker.
+	ID int32
+	// Host and Port the broker is reachable at.
+	Host string
+	Port int32
+	// Rack is the rack of the broker, or empty if it has no rack.
+	Rack string
+}
+
+// DescribeCluster returns the ID, controller and brokers of the cluster.
+//
+// If the metadata can't be fetched from any broker, ErrBrokersUnreachable is
+// returned. If the metadata is missing the controller or the brokers, the
+// known cluster information is returned along with ErrIncompleteMetadata.
+func (m *Manager) DescribeCluster(ctx context.Context) (ClusterInfo, error) {
+	ctx, span := m.tracer.Start(ctx, "DescribeCluster", trace.WithAttributes(
+		semconv.MessagingSystemKey.String("kafka"),
+	))
+	defer span.End()
+
+	metadata, err := m.adminClient.BrokerMetadata(ctx)
+	if err != nil {
+		err = fmt.Errorf("%w: failed to fetch kafka cluster metadata: %w", ErrBrokersUnreachable, classifyError(err))
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return ClusterInfo{}, err
+	}
+	info := ClusterInfo{
+		ClusterID:    metadata.Cluster,
+		ControllerID: metadata.Controller,
+		Brokers:      make([]BrokerInfo, 0, len(metadata.Brokers)),
+	}
+	for _, b := range metadata.Brokers {
+		broker := BrokerInfo{ID: b.NodeID, Host: b.Host, Port: b.Port}
+		if b.Rack != nil {
+			broker.Rack = *b.Rack
+		}
+		info.Brokers = append(info.Brokers, broker)
+	}
+	sort.Slice(info.Brokers, func(i, j int) bool {
+		return info.Brokers[i].ID < info.Brokers[j].ID
+	})
+	if info.ControllerID < 0 || len(info.Brokers) == 0 {
+		err := fmt.Errorf("%w: controller %d, %d brokers",
+			ErrIncompleteMetadata, info.ControllerID, len(info.Brokers),
+		)
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return info, err
+	}
+	return info, nil
+}
+
+// ClusterDefaultBroker is the broker ID which Manager.DescribeBrokerConfigs
+// and Manager.AlterBrokerConfigs use for the cluster-wide default broker
+// configs, which apply to every broker without a broker-level override.
+const ClusterDefaultBroker int32 = -1
+
+// brokerConfigResource returns the brokers passed to the kadm broker config
+// requests for brokerID, and the name of the described resource.
+func brokerConfigResource(brokerID int32) ([]int32, string) {
+	if brokerID == ClusterDefaultBroker {
+		return nil, ""
+	}
+	return []int32{brokerID}, strconv.Itoa(int(brokerID))
+}
+
+// DescribeBrokerConfigs returns the configs of the broker, including the
+// defaults, or the cluster-wide default broker configs for
+// ClusterDefaultBroker. The values of sensitive configs are empty.
+func (m *Manager) DescribeBrokerConfigs(ctx context.Context, brokerID int32) (map[string]string, error) {
+	ctx, span := m.tracer.Start(ctx, "DescribeBrokerConfigs", trace.WithAttributes(
+		semconv.MessagingSystemKey.String("kafka"),
+		attribute.Int("messaging.kafka.broker_id", int(brokerID)),
+	))
+	defer span.End()
+
+	brokers, name := brokerConfigResource(brokerID)
+	rcs, err := m.adminClient.DescribeBrokerConfigs(ctx, brokers...)
+	if err == nil {
+		var rc kadm.ResourceConfig
+		rc, err = rcs.On(name, nil)
+		if err == nil {
+			err = rc.Err
+		}
+		if err == nil {
+			configs := make(map[string]string, len(rc.Configs))
+			for _, c := range rc.Configs {
+				configs[c.Key] = c.MaybeValue()
+			}
+			return configs, nil
+		}
+	}
+	err = fmt.Errorf("failed to describe kafka broker %d configs: %w", brokerID, classifyError(err))
+	span.RecordError(err)
+	span.SetStatus(codes.Error, err.Error())
+	return nil, err
+}
+
+// AlterBrokerConfigs alters the dynamic configs of the broker, or the
+// cluster-wide default broker configs for ClusterDefaultBroker. Configs with
+// a nil value are removed, reverting to the default.
+//
+// Each config is altered independently, so the configs that are accepted by
+// the broker are applied even if others are rejected, e.g. unknown or static
+// configs. Any rejected configs are returned as a joined error.
+func (m *Manager) AlterBrokerConfigs(ctx context.Context, brokerID int32, configs map[string]*string) error {
+	ctx, span := m.tracer.Start(ctx, "AlterBrokerConfigs", trace.WithAttributes(
+		semconv.MessagingSystemKey.String("kafka"),
+		attribute.Int("messaging.kafka.broker_id", int(brokerID)),
+	))
+	defer span.End()
+
+	logger := m.cfg.Logger.With(zap.Int32("broker_id", brokerID))
+	keys := make([]string, 0, len(configs))
+	for k := range configs {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	brokers, name := brokerConfigResource(brokerID)
+	var alterErrors []error
+	for _, k := range keys {
+		alterCfg := kadm.AlterConfig{Name: k, Value: configs[k]}
+		if alterCfg.Value == nil {
+			alterCfg.Op = kadm.DeleteConfig
+		}
+		responses, err := m.adminClient.AlterBrokerConfigs(ctx,
+			[]kadm.AlterConfig{alterCfg}, brokers...,
+		)
+		if err == nil {
+			_, err = responses.On(name, func(r *kadm.AlterConfigsResponse) error {
+				return r.Err
+			})
+		}
+		if err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, "failed to alter one or more broker configs")
+			alterErrors = append(alterErrors, fmt.Errorf(
+				"failed to alter config %q for broker %d: %w", k, brokerID, classifyError(err),
+			))
+			continue
+		}
+		logger.Info("altered configuration for kafka broker", zap.String("config", k))
+	}
+	return errors.Join(alterErrors...)
+}
+
 type memberTopic struct {
 	clientID string
 	topic    string
@@ -227,7 +1842,7 @@ func (m *Manager) MonitorConsumerLag(topicConsumers []apmqueue.TopicConsumer) (m
 		if err != nil {
 			span.RecordError(err)
 			span.SetStatus(codes.Error, err.Error())
-			return fmt.Errorf("failed to calculate consumer lag: %w", err)
+			return fmt.Errorf("failed to calculate consumer lag: %w", classifyError(err))
 		}
 		lag.Each(func(l kadm.DescribedGroupLag) {
 			if err := l.Error(); err != nil {
@@ -286,21 +1901,19 @@ func (m *Manager) MonitorConsumerLag(topicConsumers []apmqueue.TopicConsumer) (m
 					memberAssignments[key] = count
 					o.ObserveInt64(
 						consumerGroupLagMetric, lag.Lag,
-						metric.WithAttributeSet(attribute.NewSet(
+						metric.WithAttributeSet(attribute.NewSet(append(m.topicMetricAttributes(topic),
 							attribute.String("group", l.Group),
-							attribute.String("topic", topic),
 							attribute.Int("partition", int(partition)),
-						)),
+						)...)),
 					)
 				}
 			}
 			for key, count := range memberAssignments {
 				o.ObserveInt64(assignmentMetric, count, metric.WithAttributeSet(
-					attribute.NewSet(
+					attribute.NewSet(append(m.topicMetricAttributes(key.topic),
 						attribute.String("group", l.Group),
-						attribute.String("topic", key.topic),
 						attribute.String("client_id", key.clientID),
-					),
+					)...),
 				))
 			}
 		})
@@ -20,15 +20,24 @@ package kafka
 import (
 	"context"
 	"errors"
+	"fmt"
+	"maps"
+	"math"
 	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/google/go-cmp/cmp"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"github.com/twmb/franz-go/pkg/kadm"
 	"github.com/twmb/franz-go/pkg/kerr"
 	"github.com/twmb/franz-go/pkg/kfake"
+	"github.com/twmb/franz-go/pkg/kgo"
 	"github.com/twmb/franz-go/pkg/kmsg"
 	"go.opentelemetry.io/otel/attribute"
 	"go.opentelemetry.io/otel/codes"
@@ -55,6 +64,29 @@ func TestNewManager(t *testing.T) {
 	}, "\n"))
 }
 
+func TestManagerPing(t *testing.T) {
+	cluster, commonConfig := newFakeCluster(t)
+	m, err := NewManager(ManagerConfig{CommonConfig: commonConfig})
+	require.NoError(t, err)
+	t.Cleanup(func() { m.Close() })
+
+	var metadataRequest *kmsg.MetadataRequest
+	cluster.ControlKey(kmsg.Metadata.Int16(), func(req kmsg.Request) (kmsg.Response, error, bool) {
+		cluster.KeepControl()
+		metadataRequest = req.(*kmsg.MetadataRequest)
+		return nil, nil, false
+	})
+	require.NoError(t, m.Ping(context.Background()))
+	require.NotNil(t, metadataRequest)
+	assert.NotNil(t, metadataRequest.Topics)
+	assert.Empty(t, metadataRequest.Topics)
+
+	cluster.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+	assert.Error(t, m.Ping(ctx))
+}
+
 func TestManagerDeleteTopics(t *testing.T) {
 	exp := tracetest.NewInMemoryExporter()
 	tp := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exp))
@@ -167,6 +199,1027 @@ func TestManagerDeleteTopics(t *testing.T) {
 	}, gotMetrics))
 }
 
+func TestManagerCreateTopics(t *testing.T) {
+	exp := tracetest.NewInMemoryExporter()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exp))
+	defer tp.Shutdown(context.Background())
+
+	cluster, commonConfig := newFakeCluster(t)
+	core, observedLogs := observer.New(zapcore.DebugLevel)
+	commonConfig.Logger = zap.New(core)
+	commonConfig.TracerProvider = tp
+	m, err := NewManager(ManagerConfig{CommonConfig: commonConfig})
+	require.NoError(t, err)
+	t.Cleanup(func() { m.Close() })
+
+	var createTopicsRequests []*kmsg.CreateTopicsRequest
+	cluster.ControlKey(kmsg.CreateTopics.Int16(), func(req kmsg.Request) (kmsg.Response, error, bool) {
+		cluster.KeepControl()
+		createTopicsRequests = append(createTopicsRequests, req.(*kmsg.CreateTopicsRequest))
+		return nil, nil, false
+	})
+	topics := []apmqueue.TopicConfig{
+		{Topic: "topic1", PartitionCount: 3, ReplicationFactor: 1, Configs: map[string]*string{
+			"retention.ms": kadm.StringPtr("123"),
+		}},
+		{Topic: "topic2"},
+		// The fake cluster only has one broker.
+		{Topic: "topic3", PartitionCount: 1, ReplicationFactor: 2},
+	}
+	err = m.CreateTopics(context.Background(), topics...)
+	assert.EqualError(t, err, `failed to create topic "topic3": `+
+		`INVALID_REPLICATION_FACTOR: Replication factor is below 1 or larger than the number of available brokers.`,
+	)
+	require.Len(t, createTopicsRequests, 3)
+	for i, req := range createTopicsRequests {
+		require.Len(t, req.Topics, 1)
+		assert.Equal(t, "name_space-"+string(topics[i].Topic), req.Topics[0].Topic)
+	}
+	assert.Equal(t, int32(3), createTopicsRequests[0].Topics[0].NumPartitions)
+	assert.Equal(t, int16(1), createTopicsRequests[0].Topics[0].ReplicationFactor)
+	assert.Equal(t, []kmsg.CreateTopicsRequestTopicConfig{{
+		Name:  "retention.ms",
+		Value: kmsg.StringPtr("123"),
+	}}, createTopicsRequests[0].Topics[0].Configs)
+	assert.Equal(t, int32(-1), createTopicsRequests[1].Topics[0].NumPartitions)
+	assert.Equal(t, int16(-1), createTopicsRequests[1].Topics[0].ReplicationFactor)
+
+	// Creating topics which already exist doesn't return an error.
+	require.NoError(t, m.CreateTopics(context.Background(), topics[0]))
+	matchingLogs := observedLogs.FilterMessage("kafka topic already exists")
+	assert.Equal(t, []observer.LoggedEntry{{
+		Entry: zapcore.Entry{
+			Level:      zapcore.DebugLevel,
+			LoggerName: "kafka",
+			Message:    "kafka topic already exists",
+		},
+		Context: []zapcore.Field{
+			zap.String("namespace", "name_space"),
+			zap.String("topic", "topic1"),
+			zap.Int32("partition_count", 3),
+			zap.Int16("replication_factor", 1),
+		},
+	}}, matchingLogs.AllUntimed())
+
+	spans := exp.GetSpans()
+	require.Len(t, spans, 2)
+	assert.Equal(t, "CreateTopics", spans[0].Name)
+	assert.Equal(t, codes.Error, spans[0].Status.Code)
+	assert.Equal(t, "CreateTopics", spans[1].Name)
+	assert.Equal(t, codes.Unset, spans[1].Status.Code)
+}
+
+func TestManagerCreateTopicsWithDefaults(t *testing.T) {
+	_, commonConfig := newFakeCluster(t)
+	m, err := NewManager(ManagerConfig{CommonConfig: commonConfig})
+	require.NoError(t, err)
+	t.Cleanup(func() { m.Close() })
+	ctx := context.Background()
+	require.NoError(t, m.CreateTopics(ctx, apmqueue.TopicConfig{
+		Topic: "existing", PartitionCount: 1,
+	}))
+
+	retention := "3600000"
+	result, err := m.CreateTopicsWithDefaults(ctx, apmqueue.TopicConfig{
+		Topic:             "ignored",
+		PartitionCount:    2,
+		ReplicationFactor: 1,
+		Configs:           map[string]*string{"retention.ms": &retention},
+	},
+		TopicSpec{Topic: "a"},
+		TopicSpec{Topic: "b", PartitionCount: 4},
+		TopicSpec{Topic: "existing"},
+	)
+	require.NoError(t, err)
+	assert.Equal(t, CreateTopicsResult{
+		Created:  []apmqueue.Topic{"a", "b"},
+		Existing: []apmqueue.Topic{"existing"},
+	}, result)
+
+	for topic, partitions := range map[apmqueue.Topic]int{"a": 2, "b": 4, "existing": 1} {
+		desc, err := m.DescribeTopic(ctx, topic)
+		require.NoError(t, err)
+		assert.Equal(t, partitions, desc.PartitionCount, topic)
+		if topic != "existing" {
+			assert.Equal(t, retention, desc.Configs["retention.ms"], topic)
+		}
+	}
+	exists, err := m.TopicExists(ctx, "ignored")
+	require.NoError(t, err)
+	assert.False(t, exists)
+}
+
+func TestManagerAlterTopicConfigs(t *testing.T) {
+	exp := tracetest.NewInMemoryExporter()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exp))
+	defer tp.Shutdown(context.Background())
+
+	_, commonConfig := newFakeCluster(t)
+	commonConfig.TracerProvider = tp
+	m, err := NewManager(ManagerConfig{CommonConfig: commonConfig})
+	require.NoError(t, err)
+	t.Cleanup(func() { m.Close() })
+	require.NoError(t, m.CreateTopics(context.Background(), apmqueue.TopicConfig{
+		Topic: "topic", PartitionCount: 1,
+	}))
+
+	err = m.AlterTopicConfigs(context.Background(), "topic", map[string]*string{
+		"retention.ms":   kadm.StringPtr("123"),
+		"cleanup.policy": kadm.StringPtr("compact"),
+		"unknown.config": kadm.StringPtr("value"),
+	})
+	// Only the unknown config is rejected.
+	assert.EqualError(t, err, `failed to alter config "unknown.config" for topic "topic": `+
+		`INVALID_REQUEST: This most likely occurs because of a request being malformed `+
+		`by the client library or the message was sent to an incompatible broker. `+
+		`See the broker logs for more details.`,
+	)
+	configs, err := m.adminClient.DescribeTopicConfigs(context.Background(), "name_space-topic")
+	require.NoError(t, err)
+	rc, err := configs.On("name_space-topic", nil)
+	require.NoError(t, err)
+	values := make(map[string]string)
+	for _, c := range rc.Configs {
+		values[c.Key] = c.MaybeValue()
+	}
+	assert.Equal(t, "123", values["retention.ms"])
+	assert.Equal(t, "compact", values["cleanup.policy"])
+
+	spans := exp.GetSpans()
+	require.Len(t, spans, 2)
+	assert.Equal(t, "AlterTopicConfigs", spans[1].Name)
+	assert.Equal(t, codes.Error, spans[1].Status.Code)
+}
+
+func TestManagerListTopics(t *testing.T) {
+	cluster, commonConfig := newFakeCluster(t)
+	partitions := func(n int) []kmsg.MetadataResponseTopicPartition {
+		ps := make([]kmsg.MetadataResponseTopicPartition, n)
+		for i := range ps {
+			ps[i] = kmsg.MetadataResponseTopicPartition{
+				Partition: int32(i), Replicas: []int32{0},
+			}
+		}
+		return ps
+	}
+	// Allow some time for the ForceMetadataRefresh to run.
+	<-time.After(10 * time.Millisecond)
+	cluster.ControlKey(kmsg.Metadata.Int16(), func(r kmsg.Request) (kmsg.Response, error, bool) {
+		cluster.KeepControl()
+		return &kmsg.MetadataResponse{
+			Version: r.GetVersion(),
+			Topics: []kmsg.MetadataResponseTopic{{
+				Topic:      kmsg.StringPtr("name_space-b1"),
+				Partitions: partitions(1),
+			}, {
+				Topic:      kmsg.StringPtr("name_space-a1"),
+				Partitions: partitions(2),
+			}, {
+				Topic:      kmsg.StringPtr("other"),
+				Partitions: partitions(3),
+			}, {
+				Topic:      kmsg.StringPtr("__consumer_offsets"),
+				IsInternal: true,
+				Partitions: partitions(4),
+			}},
+		}, nil, true
+	})
+
+	t.Run("namespace", func(t *testing.T) {
+		m, err := NewManager(ManagerConfig{CommonConfig: commonConfig})
+		require.NoError(t, err)
+		t.Cleanup(func() { m.Close() })
+
+		topics, err := m.ListTopics(context.Background(), ListTopicsConfig{})
+		require.NoError(t, err)
+		assert.Equal(t, []TopicInfo{
+			{Topic: "a1", PartitionCount: 2, ReplicationFactor: 1},
+			{Topic: "b1", PartitionCount: 1, ReplicationFactor: 1},
+		}, topics)
+
+		topics, err = m.ListTopics(context.Background(), ListTopicsConfig{Prefix: "b"})
+		require.NoError(t, err)
+		assert.Equal(t, []TopicInfo{
+			{Topic: "b1", PartitionCount: 1, ReplicationFactor: 1},
+		}, topics)
+	})
+	t.Run("internal", func(t *testing.T) {
+		cfg := commonConfig
+		cfg.Namespace = ""
+		m, err := NewManager(ManagerConfig{CommonConfig: cfg})
+		require.NoError(t, err)
+		t.Cleanup(func() { m.Close() })
+
+		topics, err := m.ListTopics(context.Background(), ListTopicsConfig{Prefix: "__"})
+		require.NoError(t, err)
+		assert.Equal(t, []TopicInfo{{
+			Topic: "__consumer_offsets", PartitionCount: 4,
+			ReplicationFactor: 1, Internal: true,
+		}}, topics)
+
+		topics, err = m.ListTopics(context.Background(), ListTopicsConfig{
+			Prefix: "__", ExcludeInternal: true,
+		})
+		require.NoError(t, err)
+		assert.Empty(t, topics)
+	})
+}
+
+func TestManagerConsumerGroupLag(t *testing.T) {
+	_, commonConfig := newFakeCluster(t)
+	m, err := NewManager(ManagerConfig{CommonConfig: commonConfig})
+	require.NoError(t, err)
+	t.Cleanup(func() { m.Close() })
+	require.NoError(t, m.CreateTopics(context.Background(), apmqueue.TopicConfig{
+		Topic: "topic", PartitionCount: 2,
+	}))
+
+	topic := "name_space-topic"
+	producer, err := kgo.NewClient(
+		kgo.SeedBrokers(commonConfig.Brokers...),
+		kgo.RecordPartitioner(kgo.ManualPartitioner()),
+	)
+	require.NoError(t, err)
+	t.Cleanup(producer.Close)
+	for i := 0; i < 5; i++ {
+		// 3 records in partition 0, 2 records in partition 1.
+		produceRecord(context.Background(), t, producer, &kgo.Record{
+			Topic: topic, Partition: int32(i % 2), Value: []byte("x"),
+		})
+	}
+
+	// Join the group, commit an offset for partition 0 only, and leave.
+	member, err := kgo.NewClient(
+		kgo.SeedBrokers(commonConfig.Brokers...),
+		kgo.ConsumerGroup("group"),
+		kgo.ConsumeTopics(topic),
+		kgo.DisableAutoCommit(),
+		kgo.FetchMaxWait(100*time.Millisecond),
+	)
+	require.NoError(t, err)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	require.NoError(t, member.PollFetches(ctx).Err())
+	var commitErr error
+	member.CommitOffsetsSync(ctx, map[string]map[int32]kgo.EpochOffset{
+		topic: {0: {Epoch: -1, Offset: 1}},
+	}, func(_ *kgo.Client, _ *kmsg.OffsetCommitRequest, _ *kmsg.OffsetCommitResponse, err error) {
+		commitErr = err
+	})
+	require.NoError(t, commitErr)
+	member.Close()
+
+	lag, err := m.ConsumerGroupLag(context.Background(), "group", ConsumerGroupLagConfig{})
+	require.NoError(t, err)
+	assert.Equal(t, map[TopicPartition]int64{
+		{Topic: "topic", Partition: 0}: 2,
+		{Topic: "topic", Partition: 1}: 2,
+	}, lag)
+
+	lag, err = m.ConsumerGroupLag(context.Background(), "group", ConsumerGroupLagConfig{
+		SkipUncommitted: true,
+	})
+	require.NoError(t, err)
+	assert.Equal(t, map[TopicPartition]int64{
+		{Topic: "topic", Partition: 0}: 2,
+	}, lag)
+
+	_, err = m.ConsumerGroupLag(context.Background(), "unknown", ConsumerGroupLagConfig{})
+	assert.ErrorIs(t, err, ErrGroupNotFound)
+}
+
+func TestManagerDescribeConsumerGroup(t *testing.T) {
+	_, commonConfig := newFakeCluster(t)
+	m, err := NewManager(ManagerConfig{CommonConfig: commonConfig})
+	require.NoError(t, err)
+	t.Cleanup(func() { m.Close() })
+	require.NoError(t, m.CreateTopics(context.Background(), apmqueue.TopicConfig{
+		Topic: "topic", PartitionCount: 2,
+	}))
+
+	assigned := make(chan struct{})
+	member, err := kgo.NewClient(
+		kgo.SeedBrokers(commonConfig.Brokers...),
+		kgo.ClientID("member-client"),
+		kgo.ConsumerGroup("group"),
+		kgo.ConsumeTopics("name_space-topic"),
+		kgo.OnPartitionsAssigned(func(context.Context, *kgo.Client, map[string][]int32) {
+			close(assigned)
+		}),
+	)
+	require.NoError(t, err)
+	t.Cleanup(member.Close)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	go member.PollFetches(ctx)
+	select {
+	case <-assigned:
+	case <-ctx.Done():
+		t.Fatal("timed out waiting for partitions to be assigned")
+	}
+
+	var desc GroupDescription
+	require.Eventually(t, func() bool {
+		desc, err = m.DescribeConsumerGroup(ctx, "group")
+		require.NoError(t, err)
+		return desc.State == "Stable" && len(desc.Members) == 1 &&
+			len(desc.Members[0].Partitions) == 2
+	}, 5*time.Second, 50*time.Millisecond)
+	memberID, _ := member.GroupMetadata()
+	assert.Equal(t, "group", desc.Group)
+	assert.Equal(t, "consumer", desc.ProtocolType)
+	assert.NotEmpty(t, desc.Protocol)
+	assert.Equal(t, memberID, desc.Members[0].MemberID)
+	assert.Equal(t, "member-client", desc.Members[0].ClientID)
+	assert.NotEmpty(t, desc.Members[0].ClientHost)
+	assert.Equal(t, []TopicPartition{
+		{Topic: "topic", Partition: 0},
+		{Topic: "topic", Partition: 1},
+	}, desc.Members[0].Partitions)
+
+	_, err = m.DescribeConsumerGroup(ctx, "unknown")
+	assert.ErrorIs(t, err, ErrGroupNotFound)
+}
+
+func TestManagerTopicExists(t *testing.T) {
+	_, commonConfig := newFakeCluster(t)
+	m, err := NewManager(ManagerConfig{CommonConfig: commonConfig})
+	require.NoError(t, err)
+	t.Cleanup(func() { m.Close() })
+
+	ctx := context.Background()
+	exists, err := m.TopicExists(ctx, "topic")
+	require.NoError(t, err)
+	assert.False(t, exists)
+
+	require.NoError(t, m.CreateTopics(ctx, apmqueue.TopicConfig{Topic: "topic"}))
+	exists, err = m.TopicExists(ctx, "topic")
+	require.NoError(t, err)
+	assert.True(t, exists)
+}
+
+func TestManagerDescribeTopic(t *testing.T) {
+	_, commonConfig := newFakeCluster(t)
+	m, err := NewManager(ManagerConfig{CommonConfig: commonConfig})
+	require.NoError(t, err)
+	t.Cleanup(func() { m.Close() })
+
+	ctx := context.Background()
+	_, err = m.DescribeTopic(ctx, "topic")
+	assert.ErrorIs(t, err, ErrTopicNotFound)
+
+	retention := "1000"
+	require.NoError(t, m.CreateTopics(ctx, apmqueue.TopicConfig{
+		Topic:          "topic",
+		PartitionCount: 2,
+		Configs:        map[string]*string{"retention.ms": &retention},
+	}))
+	desc, err := m.DescribeTopic(ctx, "topic")
+	require.NoError(t, err)
+	assert.Equal(t, apmqueue.Topic("topic"), desc.Topic)
+	assert.Equal(t, 2, desc.PartitionCount)
+	assert.Equal(t, 1, desc.ReplicationFactor)
+	assert.False(t, desc.Internal)
+	require.Len(t, desc.Partitions, 2)
+	for i, p := range desc.Partitions {
+		assert.Equal(t, int32(i), p.Partition)
+		assert.Equal(t, []int32{p.Leader}, p.Replicas)
+		assert.Equal(t, []int32{p.Leader}, p.ISR)
+	}
+	assert.Equal(t, "1000", desc.Configs["retention.ms"])
+}
+
+func TestManagerValidateTopics(t *testing.T) {
+	_, commonConfig := newFakeCluster(t)
+	m, err := NewManager(ManagerConfig{CommonConfig: commonConfig})
+	require.NoError(t, err)
+	t.Cleanup(func() { m.Close() })
+
+	ctx := context.Background()
+	retention, compact := "1000", "compact"
+	require.NoError(t, m.CreateTopics(ctx,
+		apmqueue.TopicConfig{
+			Topic:          "a",
+			PartitionCount: 2,
+			Configs:        map[string]*string{"retention.ms": &retention},
+		},
+		apmqueue.TopicConfig{Topic: "b", PartitionCount: 3},
+	))
+
+	desired := []apmqueue.TopicConfig{
+		{
+			Topic:             "a",
+			PartitionCount:    2,
+			ReplicationFactor: 1,
+			Configs:           map[string]*string{"retention.ms": &retention},
+		},
+		{Topic: "b", PartitionCount: 3},
+	}
+	diff, err := m.ValidateTopics(ctx, desired...)
+	require.NoError(t, err)
+	assert.True(t, diff.Empty())
+	assert.Equal(t, TopicDiff{}, diff)
+
+	diff, err = m.ValidateTopics(ctx,
+		apmqueue.TopicConfig{
+			Topic:             "a",
+			PartitionCount:    4,
+			ReplicationFactor: 1,
+			Configs: map[string]*string{
+				"retention.ms":   nil,
+				"cleanup.policy": &compact,
+			},
+		},
+		apmqueue.TopicConfig{
+			Topic:             "b",
+			PartitionCount:    1,
+			ReplicationFactor: 3,
+			// Configs which aren't set on the topic can't be removed.
+			Configs: map[string]*string{"retention.ms": nil},
+		},
+		apmqueue.TopicConfig{Topic: "c", PartitionCount: 1},
+	)
+	require.NoError(t, err)
+	assert.False(t, diff.Empty())
+	deleteValue := "delete"
+	assert.Equal(t, TopicDiff{
+		Missing:            []apmqueue.Topic{"c"},
+		PartitionIncreases: []TopicCountChange{{Topic: "a", From: 2, To: 4}},
+		PartitionDecreases: []TopicCountChange{{Topic: "b", From: 3, To: 1}},
+		ReplicationChanges: []TopicCountChange{{Topic: "b", From: 1, To: 3}},
+		ConfigChanges: []TopicConfigChange{
+			{Topic: "a", Key: "cleanup.policy", From: &deleteValue, To: &compact},
+			{Topic: "a", Key: "retention.ms", From: &retention},
+		},
+	}, diff)
+
+	// Nothing is modified.
+	desc, err := m.DescribeTopic(ctx, "a")
+	require.NoError(t, err)
+	assert.Equal(t, 2, desc.PartitionCount)
+	assert.Equal(t, "1000", desc.Configs["retention.ms"])
+	exists, err := m.TopicExists(ctx, "c")
+	require.NoError(t, err)
+	assert.False(t, exists)
+}
+
+func TestManagerBrokerConfigs(t *testing.T) {
+	_, commonConfig := newFakeCluster(t)
+	m, err := NewManager(ManagerConfig{CommonConfig: commonConfig})
+	require.NoError(t, err)
+	t.Cleanup(func() { m.Close() })
+	ctx := context.Background()
+
+	cluster, err := m.DescribeCluster(ctx)
+	require.NoError(t, err)
+	require.NotEmpty(t, cluster.Brokers)
+	brokerID := cluster.Brokers[0].ID
+	configs, err := m.DescribeBrokerConfigs(ctx, brokerID)
+	require.NoError(t, err)
+	assert.Equal(t, strconv.Itoa(int(brokerID)), configs["broker.id"])
+
+	retention := "1000"
+	require.NoError(t, m.AlterBrokerConfigs(ctx, ClusterDefaultBroker, map[string]*string{
+		"log.retention.bytes": &retention,
+	}))
+	configs, err = m.DescribeBrokerConfigs(ctx, ClusterDefaultBroker)
+	require.NoError(t, err)
+	assert.Equal(t, "1000", configs["log.retention.bytes"])
+
+	// Rejected configs are returned, the others are still altered.
+	unknown := "x"
+	err = m.AlterBrokerConfigs(ctx, brokerID, map[string]*string{
+		"log.retention.bytes": nil,
+		"unknown.config":      &unknown,
+	})
+	assert.ErrorContains(t, err, fmt.Sprintf(`failed to alter config "unknown.config" for broker %d`, brokerID))
+	assert.NotContains(t, err.Error(), "log.retention.bytes")
+	configs, err = m.DescribeBrokerConfigs(ctx, ClusterDefaultBroker)
+	require.NoError(t, err)
+	assert.NotEqual(t, "1000", configs["log.retention.bytes"])
+
+	_, err = m.DescribeBrokerConfigs(ctx, brokerID+100)
+	assert.ErrorContains(t, err, fmt.Sprintf("failed to describe kafka broker %d configs", brokerID+100))
+}
+
+func TestManagerAdminClient(t *testing.T) {
+	_, commonConfig := newFakeCluster(t)
+	m, err := NewManager(ManagerConfig{CommonConfig: commonConfig})
+	require.NoError(t, err)
+	t.Cleanup(func() { m.Close() })
+	ctx := context.Background()
+	require.NoError(t, m.CreateTopics(ctx, apmqueue.TopicConfig{Topic: "topic"}))
+
+	// The admin client doesn't prefix topics with the namespace.
+	details, err := m.AdminClient().ListTopics(ctx, "name_space-topic")
+	require.NoError(t, err)
+	assert.NoError(t, details["name_space-topic"].Err)
+}
+
+func TestManagerCreatePartitions(t *testing.T) {
+	cluster, commonConfig := newFakeCluster(t)
+	// The total partition count is requested, rather than the number of
+	// partitions to add.
+	var requested []int32
+	cluster.ControlKey(kmsg.CreatePartitions.Int16(), func(r kmsg.Request) (kmsg.Response, error, bool) {
+		cluster.KeepControl()
+		for _, topic := range r.(*kmsg.CreatePartitionsRequest).Topics {
+			requested = append(requested, topic.Count)
+		}
+		return nil, nil, false
+	})
+	core, observedLogs := observer.New(zapcore.DebugLevel)
+	commonConfig.Logger = zap.New(core)
+	m, err := NewManager(ManagerConfig{CommonConfig: commonConfig})
+	require.NoError(t, err)
+	t.Cleanup(func() { m.Close() })
+
+	ctx := context.Background()
+	require.NoError(t, m.CreateTopics(ctx, apmqueue.TopicConfig{
+		Topic: "topic", PartitionCount: 2,
+	}))
+	adminClient := kadm.NewClient(m.client)
+	partitionCount := func() int {
+		details, err := adminClient.ListTopics(ctx, "name_space-topic")
+		require.NoError(t, err)
+		return len(details["name_space-topic"].Partitions)
+	}
+
+	require.NoError(t, m.CreatePartitions(ctx, "topic", 4))
+	assert.Equal(t, 4, partitionCount())
+	assert.Equal(t, []int32{4}, requested)
+	matchingLogs := observedLogs.FilterMessage("created partitions for kafka topic")
+	assert.Equal(t, []observer.LoggedEntry{{
+		Entry: zapcore.Entry{
+			Level:      zapcore.InfoLevel,
+			LoggerName: "kafka",
+			Message:    "created partitions for kafka topic",
+		},
+		Context: []zapcore.Field{
+			zap.String("namespace", "name_space"),
+			zap.String("topic", "topic"),
+			zap.Int("partition_count", 4),
+		},
+	}}, matchingLogs.AllUntimed())
+
+	// Same count is a no-op.
+	require.NoError(t, m.CreatePartitions(ctx, "topic", 4))
+	assert.Equal(t, 4, partitionCount())
+
+	err = m.CreatePartitions(ctx, "topic", 3)
+	assert.EqualError(t, err, `kafka: cannot decrease partitions of topic "topic" from 4 to 3`)
+	assert.Equal(t, 4, partitionCount())
+}
+
+// enableReassignmentKeys makes the cluster advertise support for the
+// partition reassignment requests, which kfake doesn't implement, so they
+// can be controlled.
+func enableReassignmentKeys(t testing.TB, cluster *kfake.Cluster) {
+	t.Helper()
+	advertiseKeys(t, cluster, kmsg.AlterPartitionAssignments, kmsg.ListPartitionReassignments)
+}
+
+// advertiseKeys makes the cluster advertise support for the requests, which
+// kfake doesn't implement, so they can be controlled.
+func advertiseKeys(t testing.TB, cluster *kfake.Cluster, additional ...kmsg.Key) {
+	t.Helper()
+	client, err := kgo.NewClient(kgo.SeedBrokers(cluster.ListenAddrs()...))
+	require.NoError(t, err)
+	defer client.Close()
+	versions, err := kmsg.NewPtrApiVersionsRequest().RequestWith(context.Background(), client)
+	require.NoError(t, err)
+	keys := versions.ApiKeys
+	for _, key := range additional {
+		keys = append(keys, kmsg.ApiVersionsResponseApiKey{
+			ApiKey:     key.Int16(),
+			MaxVersion: kmsg.RequestForKey(key.Int16()).MaxVersion(),
+		})
+	}
+	cluster.ControlKey(kmsg.ApiVersions.Int16(), func(req kmsg.Request) (kmsg.Response, error, bool) {
+		cluster.KeepControl()
+		return &kmsg.ApiVersionsResponse{Version: req.GetVersion(), ApiKeys: keys}, nil, true
+	})
+}
+
+func TestManagerSetReplicationFactor(t *testing.T) {
+	newManager := func(t *testing.T) (*Manager, *kfake.Cluster) {
+		cluster, err := kfake.NewCluster(kfake.NumBrokers(3))
+		require.NoError(t, err)
+		t.Cleanup(cluster.Close)
+		enableReassignmentKeys(t, cluster)
+		m, err := NewManager(ManagerConfig{CommonConfig: CommonConfig{
+			Brokers:   cluster.ListenAddrs(),
+			Logger:    zap.NewNop(),
+			Namespace: "name_space",
+		}})
+		require.NoError(t, err)
+		t.Cleanup(func() { m.Close() })
+		require.NoError(t, m.CreateTopics(context.Background(), apmqueue.TopicConfig{
+			Topic: "topic", PartitionCount: 2, ReplicationFactor: 1,
+		}))
+		return m, cluster
+	}
+	t.Run("reassign", func(t *testing.T) {
+		m, cluster := newManager(t)
+		desc, err := m.DescribeTopic(context.Background(), "topic")
+		require.NoError(t, err)
+		var mu sync.Mutex
+		assigned := make(map[int32][]int32)
+		cluster.ControlKey(kmsg.AlterPartitionAssignments.Int16(), func(r kmsg.Request) (kmsg.Response, error, bool) {
+			req := r.(*kmsg.AlterPartitionAssignmentsRequest)
+			resp := req.ResponseKind().(*kmsg.AlterPartitionAssignmentsResponse)
+			mu.Lock()
+			defer mu.Unlock()
+			for _, rt := range req.Topics {
+				assert.Equal(t, "name_space-topic", rt.Topic)
+				respTopic := kmsg.NewAlterPartitionAssignmentsResponseTopic()
+				respTopic.Topic = rt.Topic
+				for _, rp := range rt.Partitions {
+					assigned[rp.Partition] = rp.Replicas
+					respPartition := kmsg.NewAlterPartitionAssignmentsResponseTopicPartition()
+					respPartition.Partition = rp.Partition
+					respTopic.Partitions = append(respTopic.Partitions, respPartition)
+				}
+				resp.Topics = append(resp.Topics, respTopic)
+			}
+			return resp, nil, true
+		})
+
+		require.NoError(t, m.SetReplicationFactor(context.Background(), "topic", 3))
+		mu.Lock()
+		defer mu.Unlock()
+		require.Len(t, assigned, 2)
+		for _, p := range desc.Partitions {
+			replicas := assigned[p.Partition]
+			require.Len(t, replicas, 3)
+			// The preferred leader is kept.
+			assert.Equal(t, p.Replicas[0], replicas[0])
+			assert.ElementsMatch(t, []int32{0, 1, 2}, replicas)
+		}
+	})
+	t.Run("unchanged", func(t *testing.T) {
+		m, cluster := newManager(t)
+		cluster.ControlKey(kmsg.AlterPartitionAssignments.Int16(), func(kmsg.Request) (kmsg.Response, error, bool) {
+			t.Error("unexpected AlterPartitionAssignments request")
+			return nil, nil, false
+		})
+		require.NoError(t, m.SetReplicationFactor(context.Background(), "topic", 1))
+	})
+	t.Run("too many replicas", func(t *testing.T) {
+		m, _ := newManager(t)
+		err := m.SetReplicationFactor(context.Background(), "topic", 4)
+		assert.EqualError(t, err,
+			`kafka: replication factor 4 of topic "topic" exceeds the 3 available brokers`,
+		)
+	})
+	t.Run("topic not found", func(t *testing.T) {
+		m, _ := newManager(t)
+		err := m.SetReplicationFactor(context.Background(), "missing", 2)
+		assert.ErrorIs(t, err, ErrTopicNotFound)
+	})
+}
+
+func TestManagerWaitForReassignments(t *testing.T) {
+	defer func(d time.Duration) { reassignmentPollInterval = d }(reassignmentPollInterval)
+	reassignmentPollInterval = 10 * time.Millisecond
+
+	cluster, commonConfig := newFakeCluster(t)
+	enableReassignmentKeys(t, cluster)
+	m, err := NewManager(ManagerConfig{CommonConfig: commonConfig})
+	require.NoError(t, err)
+	t.Cleanup(func() { m.Close() })
+	require.NoError(t, m.CreateTopics(context.Background(), apmqueue.TopicConfig{
+		Topic: "topic", PartitionCount: 1,
+	}))
+
+	var lists atomic.Int32
+	cluster.ControlKey(kmsg.ListPartitionReassignments.Int16(), func(r kmsg.Request) (kmsg.Response, error, bool) {
+		cluster.KeepControl()
+		req := r.(*kmsg.ListPartitionReassignmentsRequest)
+		resp := req.ResponseKind().(*kmsg.ListPartitionReassignmentsResponse)
+		// The reassignment completes on the third request.
+		if lists.Add(1) < 3 {
+			respTopic := kmsg.NewListPartitionReassignmentsResponseTopic()
+			respTopic.Topic = "name_space-topic"
+			respPartition := kmsg.NewListPartitionReassignmentsResponseTopicPartition()
+			respPartition.Replicas = []int32{0}
+			respPartition.AddingReplicas = []int32{1}
+			respTopic.Partitions = append(respTopic.Partitions, respPartition)
+			resp.Topics = append(resp.Topics, respTopic)
+		}
+		return resp, nil, true
+	})
+	require.NoError(t, m.WaitForReassignments(context.Background(), "topic"))
+	assert.Equal(t, int32(3), lists.Load())
+
+	lists.Store(0)
+	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Millisecond)
+	defer cancel()
+	assert.ErrorIs(t, m.WaitForReassignments(ctx, "topic"), context.DeadlineExceeded)
+}
+
+func TestManagerWaitForTopics(t *testing.T) {
+	defer func(d time.Duration) { topicPollInterval = d }(topicPollInterval)
+	topicPollInterval = 10 * time.Millisecond
+
+	_, commonConfig := newFakeCluster(t)
+	m, err := NewManager(ManagerConfig{CommonConfig: commonConfig})
+	require.NoError(t, err)
+	t.Cleanup(func() { m.Close() })
+	ctx := context.Background()
+	require.NoError(t, m.CreateTopics(ctx, apmqueue.TopicConfig{
+		Topic: "a", PartitionCount: 2,
+	}))
+
+	errc := make(chan error, 1)
+	go func() { errc <- m.WaitForTopics(ctx, "a", "b") }()
+	time.Sleep(50 * time.Millisecond)
+	select {
+	case err := <-errc:
+		t.Fatalf("expected WaitForTopics to block, got %v", err)
+	default:
+	}
+	require.NoError(t, m.CreateTopics(ctx, apmqueue.TopicConfig{
+		Topic: "b", PartitionCount: 1,
+	}))
+	select {
+	case err := <-errc:
+		require.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for WaitForTopics to return")
+	}
+
+	timeoutCtx, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+	err = m.WaitForTopics(timeoutCtx, "a", "c", "d")
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.ErrorContains(t, err, `topics ["c" "d"] are not available`)
+}
+
+func TestManagerDeleteRecords(t *testing.T) {
+	_, commonConfig := newFakeCluster(t)
+	m, err := NewManager(ManagerConfig{CommonConfig: commonConfig})
+	require.NoError(t, err)
+	t.Cleanup(func() { m.Close() })
+
+	ctx := context.Background()
+	require.NoError(t, m.CreateTopics(ctx, apmqueue.TopicConfig{
+		Topic: "topic", PartitionCount: 1,
+	}))
+	for i := 0; i < 3; i++ {
+		produceRecord(ctx, t, m.client, &kgo.Record{
+			Topic: "name_space-topic", Value: []byte("x"),
+		})
+	}
+	adminClient := kadm.NewClient(m.client)
+	startOffset := func() int64 {
+		offsets, err := adminClient.ListStartOffsets(ctx, "name_space-topic")
+		require.NoError(t, err)
+		o, _ := offsets.Lookup("name_space-topic", 0)
+		return o.Offset
+	}
+
+	tp := TopicPartition{Topic: "topic", Partition: 0}
+	require.NoError(t, m.DeleteRecords(ctx, map[TopicPartition]int64{tp: 2}))
+	assert.Equal(t, int64(2), startOffset())
+
+	err = m.DeleteRecords(ctx, map[TopicPartition]int64{tp: -1})
+	assert.EqualError(t, err, `kafka: invalid offset -1 for topic "topic" partition 0`)
+
+	err = m.DeleteRecords(ctx, map[TopicPartition]int64{tp: 10})
+	assert.ErrorIs(t, err, kerr.OffsetOutOfRange)
+	assert.Equal(t, int64(2), startOffset())
+}
+
+func TestManagerDeleteConsumerGroups(t *testing.T) {
+	_, commonConfig := newFakeCluster(t)
+	core, observedLogs := observer.New(zapcore.DebugLevel)
+	commonConfig.Logger = zap.New(core)
+	m, err := NewManager(ManagerConfig{CommonConfig: commonConfig})
+	require.NoError(t, err)
+	t.Cleanup(func() { m.Close() })
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	require.NoError(t, m.CreateTopics(ctx, apmqueue.TopicConfig{Topic: "topic"}))
+	produceRecord(ctx, t, m.client, &kgo.Record{
+		Topic: "name_space-topic", Value: []byte("x"),
+	})
+	member, err := kgo.NewClient(
+		kgo.SeedBrokers(commonConfig.Brokers...),
+		kgo.ConsumerGroup("group"),
+		kgo.ConsumeTopics("name_space-topic"),
+		kgo.FetchMaxWait(100*time.Millisecond),
+	)
+	require.NoError(t, err)
+	require.NoError(t, member.PollFetches(ctx).Err())
+
+	err = m.DeleteConsumerGroups(ctx, "group", "unknown")
+	assert.ErrorIs(t, err, ErrGroupNotEmpty)
+	assert.ErrorIs(t, err, kerr.NonEmptyGroup)
+	assert.Equal(t, 1, observedLogs.FilterMessage("kafka consumer group does not exist").Len())
+
+	member.Close()
+	require.NoError(t, m.DeleteConsumerGroups(ctx, "group"))
+	assert.Equal(t, []observer.LoggedEntry{{
+		Entry: zapcore.Entry{
+			Level:      zapcore.InfoLevel,
+			LoggerName: "kafka",
+			Message:    "deleted kafka consumer group",
+		},
+		Context: []zapcore.Field{
+			zap.String("namespace", "name_space"),
+			zap.String("group", "group"),
+		},
+	}}, observedLogs.FilterMessage("deleted kafka consumer group").AllUntimed())
+
+	_, err = m.ConsumerGroupLag(ctx, "group", ConsumerGroupLagConfig{})
+	assert.ErrorIs(t, err, ErrGroupNotFound)
+}
+
+func TestManagerOffsets(t *testing.T) {
+	cluster, commonConfig := newFakeCluster(t)
+	m, err := NewManager(ManagerConfig{CommonConfig: commonConfig})
+	require.NoError(t, err)
+	t.Cleanup(func() { m.Close() })
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	require.NoError(t, m.CreateTopics(ctx, apmqueue.TopicConfig{
+		Topic: "topic", PartitionCount: 1,
+	}))
+	for i := 0; i < 3; i++ {
+		produceRecord(ctx, t, m.client, &kgo.Record{
+			Topic: "name_space-topic", Value: []byte("x"),
+		})
+	}
+	tp := TopicPartition{Topic: "topic", Partition: 0}
+
+	err = m.ResetOffsets(ctx, "group", ResetToEarliest())
+	assert.ErrorIs(t, err, ErrGroupNotFound)
+
+	member, err := kgo.NewClient(
+		kgo.SeedBrokers(commonConfig.Brokers...),
+		kgo.ConsumerGroup("group"),
+		kgo.ConsumeTopics("name_space-topic"),
+		kgo.FetchMaxWait(100*time.Millisecond),
+		kgo.DisableAutoCommit(),
+	)
+	require.NoError(t, err)
+	fetches := member.PollRecords(ctx, 1)
+	require.NoError(t, fetches.Err())
+	require.NoError(t, member.CommitRecords(ctx, fetches.Records()...))
+
+	err = m.CommitOffsets(ctx, "group", map[TopicPartition]int64{tp: 0})
+	assert.ErrorIs(t, err, ErrGroupNotEmpty)
+	err = m.ResetOffsets(ctx, "group", ResetToEarliest())
+	assert.ErrorIs(t, err, ErrGroupNotEmpty)
+	member.Close()
+
+	offsets, err := m.FetchOffsets(ctx, "group")
+	require.NoError(t, err)
+	assert.Equal(t, map[TopicPartition]int64{tp: 1}, offsets)
+
+	// kfake only accepts offset commits from group members, so fake the
+	// OffsetCommit responses, recording the committed offsets.
+	var mu sync.Mutex
+	committed := make(map[TopicPartition]int64)
+	cluster.ControlKey(kmsg.OffsetCommit.Int16(), func(req kmsg.Request) (kmsg.Response, error, bool) {
+		cluster.KeepControl()
+		r := req.(*kmsg.OffsetCommitRequest)
+		resp := r.ResponseKind().(*kmsg.OffsetCommitResponse)
+		mu.Lock()
+		defer mu.Unlock()
+		for _, rt := range r.Topics {
+			st := kmsg.NewOffsetCommitResponseTopic()
+			st.Topic = rt.Topic
+			for _, rp := range rt.Partitions {
+				committed[TopicPartition{
+					Topic:     apmqueue.Topic(strings.TrimPrefix(rt.Topic, "name_space-")),
+					Partition: rp.Partition,
+				}] = rp.Offset
+				sp := kmsg.NewOffsetCommitResponseTopicPartition()
+				sp.Partition = rp.Partition
+				st.Partitions = append(st.Partitions, sp)
+			}
+			resp.Topics = append(resp.Topics, st)
+		}
+		return resp, nil, true
+	})
+	committedOffsets := func() map[TopicPartition]int64 {
+		mu.Lock()
+		defer mu.Unlock()
+		return maps.Clone(committed)
+	}
+
+	require.NoError(t, m.CommitOffsets(ctx, "group", map[TopicPartition]int64{tp: 2}))
+	assert.Equal(t, map[TopicPartition]int64{tp: 2}, committedOffsets())
+	err = m.CommitOffsets(ctx, "group", map[TopicPartition]int64{tp: -1})
+	assert.EqualError(t, err, `failed to commit offsets for consumer group "group": invalid offset -1 for topic "topic" partition 0`)
+
+	require.NoError(t, m.ResetOffsets(ctx, "group", ResetToLatest()))
+	assert.Equal(t, map[TopicPartition]int64{tp: 3}, committedOffsets())
+	require.NoError(t, m.ResetOffsets(ctx, "group", ResetToEarliest()))
+	assert.Equal(t, map[TopicPartition]int64{tp: 0}, committedOffsets())
+
+	// kfake does not resolve timestamps to offsets correctly, so fake the
+	// ListOffsets response for timestamp lookups.
+	var listedTimestamp atomic.Int64
+	cluster.ControlKey(kmsg.ListOffsets.Int16(), func(req kmsg.Request) (kmsg.Response, error, bool) {
+		cluster.KeepControl()
+		r := req.(*kmsg.ListOffsetsRequest)
+		if len(r.Topics) != 1 || len(r.Topics[0].Partitions) != 1 || r.Topics[0].Partitions[0].Timestamp < 0 {
+			return nil, nil, false
+		}
+		listedTimestamp.Store(r.Topics[0].Partitions[0].Timestamp)
+		resp := r.ResponseKind().(*kmsg.ListOffsetsResponse)
+		respTopic := kmsg.NewListOffsetsResponseTopic()
+		respTopic.Topic = r.Topics[0].Topic
+		respPartition := kmsg.NewListOffsetsResponseTopicPartition()
+		respPartition.Offset = 1
+		respTopic.Partitions = append(respTopic.Partitions, respPartition)
+		resp.Topics = append(resp.Topics, respTopic)
+		return resp, nil, true
+	})
+	ts := time.Now().Add(-time.Minute)
+	require.NoError(t, m.ResetOffsets(ctx, "group", ResetToTimestamp(ts)))
+	assert.Equal(t, ts.UnixMilli(), listedTimestamp.Load())
+	assert.Equal(t, map[TopicPartition]int64{tp: 1}, committedOffsets())
+}
+
+func TestManagerShiftOffsets(t *testing.T) {
+	cluster, commonConfig := newFakeCluster(t)
+	m, err := NewManager(ManagerConfig{CommonConfig: commonConfig})
+	require.NoError(t, err)
+	t.Cleanup(func() { m.Close() })
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	require.NoError(t, m.CreateTopics(ctx, apmqueue.TopicConfig{
+		Topic: "topic", PartitionCount: 1,
+	}))
+	for i := 0; i < 3; i++ {
+		produceRecord(ctx, t, m.client, &kgo.Record{
+			Topic: "name_space-topic", Value: []byte("x"),
+		})
+	}
+	tp := TopicPartition{Topic: "topic", Partition: 0}
+
+	_, err = m.ShiftOffsets(ctx, "group", -1)
+	assert.ErrorIs(t, err, ErrGroupNotFound)
+
+	member, err := kgo.NewClient(
+		kgo.SeedBrokers(commonConfig.Brokers...),
+		kgo.ConsumerGroup("group"),
+		kgo.ConsumeTopics("name_space-topic"),
+		kgo.FetchMaxWait(100*time.Millisecond),
+		kgo.DisableAutoCommit(),
+	)
+	require.NoError(t, err)
+	fetches := member.PollRecords(ctx, 1)
+	require.NoError(t, fetches.Err())
+	require.NoError(t, member.CommitRecords(ctx, fetches.Records()...))
+	_, err = m.ShiftOffsets(ctx, "group", -1)
+	assert.ErrorIs(t, err, ErrGroupNotEmpty)
+	member.Close()
+
+	// kfake only accepts offset commits from group members, so fake the
+	// OffsetCommit responses, recording the committed offsets. The offset
+	// fetched by ShiftOffsets remains the offset committed by the member.
+	var committed atomic.Int64
+	cluster.ControlKey(kmsg.OffsetCommit.Int16(), func(req kmsg.Request) (kmsg.Response, error, bool) {
+		cluster.KeepControl()
+		r := req.(*kmsg.OffsetCommitRequest)
+		resp := r.ResponseKind().(*kmsg.OffsetCommitResponse)
+		for _, rt := range r.Topics {
+			st := kmsg.NewOffsetCommitResponseTopic()
+			st.Topic = rt.Topic
+			for _, rp := range rt.Partitions {
+				committed.Store(rp.Offset)
+				sp := kmsg.NewOffsetCommitResponseTopicPartition()
+				sp.Partition = rp.Partition
+				st.Partitions = append(st.Partitions, sp)
+			}
+			resp.Topics = append(resp.Topics, st)
+		}
+		return resp, nil, true
+	})
+
+	for delta, to := range map[int64]int64{
+		-1:            0,
+		1:             2,
+		-5:            0, // Clamped to the start offset.
+		10:            3, // Clamped to the end offset.
+		math.MaxInt64: 3,
+		math.MinInt64: 0,
+	} {
+		shifts, err := m.ShiftOffsets(ctx, "group", delta)
+		require.NoError(t, err)
+		assert.Equal(t, map[TopicPartition]OffsetShift{tp: {From: 1, To: to}}, shifts, delta)
+		assert.Equal(t, to, committed.Load(), delta)
+	}
+}
+
 func TestManagerMetrics(t *testing.T) {
 	exp := tracetest.NewInMemoryExporter()
 	tp := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exp))
@@ -614,6 +1667,62 @@ func TestManagerMetrics(t *testing.T) {
 	assert.Equal(t, "GatherMetrics", spans[0].Name)
 }
 
+func TestManagerDescribeCluster(t *testing.T) {
+	t.Run("ok", func(t *testing.T) {
+		cluster, err := kfake.NewCluster(kfake.NumBrokers(3), kfake.ClusterID("cluster-id"))
+		require.NoError(t, err)
+		t.Cleanup(cluster.Close)
+		m, err := NewManager(ManagerConfig{CommonConfig: CommonConfig{
+			Brokers: cluster.ListenAddrs(),
+			Logger:  zap.NewNop(),
+		}})
+		require.NoError(t, err)
+		t.Cleanup(func() { m.Close() })
+
+		info, err := m.DescribeCluster(context.Background())
+		require.NoError(t, err)
+		assert.Equal(t, "cluster-id", info.ClusterID)
+		require.Len(t, info.Brokers, 3)
+		ids := make([]int32, len(info.Brokers))
+		for i, b := range info.Brokers {
+			ids[i] = b.ID
+			assert.NotEmpty(t, b.Host)
+			assert.NotZero(t, b.Port)
+		}
+		assert.Equal(t, []int32{0, 1, 2}, ids)
+		assert.Contains(t, ids, info.ControllerID)
+	})
+	t.Run("incomplete", func(t *testing.T) {
+		cluster, commonConfig := newFakeCluster(t)
+		m, err := NewManager(ManagerConfig{CommonConfig: commonConfig})
+		require.NoError(t, err)
+		t.Cleanup(func() { m.Close() })
+		cluster.ControlKey(kmsg.Metadata.Int16(), func(r kmsg.Request) (kmsg.Response, error, bool) {
+			cluster.KeepControl()
+			return &kmsg.MetadataResponse{Version: r.GetVersion(), ControllerID: -1}, nil, true
+		})
+
+		info, err := m.DescribeCluster(context.Background())
+		assert.ErrorIs(t, err, ErrIncompleteMetadata)
+		assert.NotErrorIs(t, err, ErrBrokersUnreachable)
+		assert.Equal(t, int32(-1), info.ControllerID)
+		assert.Empty(t, info.Brokers)
+	})
+	t.Run("unreachable", func(t *testing.T) {
+		cluster, commonConfig := newFakeCluster(t)
+		m, err := NewManager(ManagerConfig{CommonConfig: commonConfig})
+		require.NoError(t, err)
+		t.Cleanup(func() { m.Close() })
+		cluster.Close()
+
+		ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+		defer cancel()
+		_, err = m.DescribeCluster(ctx)
+		assert.ErrorIs(t, err, ErrBrokersUnreachable)
+		assert.NotErrorIs(t, err, ErrIncompleteMetadata)
+	})
+}
+
 func newFakeCluster(t testing.TB) (*kfake.Cluster, CommonConfig) {
 	cluster, err := kfake.NewCluster(
 		// Just one broker to simplify dealing with sharded requests.
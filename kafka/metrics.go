@@ -23,6 +23,7 @@ import (
 	"fmt"
 	"net"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/twmb/franz-go/pkg/kgo"
@@ -30,6 +31,8 @@ import (
 	"go.opentelemetry.io/otel/attribute"
 	"go.opentelemetry.io/otel/metric"
 	semconv "go.opentelemetry.io/otel/semconv/v1.17.0"
+
+	apmqueue "github.com/elastic/apm-queue/v2"
 )
 
 const (
@@ -69,6 +72,19 @@ var (
 // and `producer.messages.count` metrics.
 type TopicAttributeFunc func(topic string) attribute.KeyValue
 
+// MetricAttributeFilter returns the attributes identifying a topic, without
+// the namespace, in metrics.
+type MetricAttributeFilter func(topic apmqueue.Topic) []attribute.KeyValue
+
+// topicAttributes returns the attributes identifying topic, without the
+// namespace, as returned by filter, or defaults if filter is nil.
+func (filter MetricAttributeFilter) topicAttributes(topic string, defaults ...attribute.KeyValue) []attribute.KeyValue {
+	if filter == nil {
+		return defaults
+	}
+	return filter(apmqueue.Topic(topic))
+}
+
 type metricHooks struct {
 	namespace   string
 	topicPrefix string
@@ -102,11 +118,13 @@ type metricHooks struct {
 	messageDelay                     metric.Float64Histogram
 	throttlingDuration               metric.Float64Histogram
 
-	topicAttributeFunc TopicAttributeFunc
+	topicAttributeFunc    TopicAttributeFunc
+	metricAttributeFilter MetricAttributeFilter
 }
 
 func newKgoHooks(mp metric.MeterProvider, namespace, topicPrefix string,
 	topicAttributeFunc TopicAttributeFunc,
+	metricAttributeFilter MetricAttributeFilter,
 ) (*metricHooks, error) {
 	m := mp.Meter(instrumentName)
 
@@ -338,7 +356,8 @@ func newKgoHooks(mp metric.MeterProvider, namespace, topicPrefix string,
 		messageDelay:                    messageDelayHistogram,
 		throttlingDuration:              throttlingDurationHistogram,
 
-		topicAttributeFunc: topicAttributeFunc,
+		topicAttributeFunc:    topicAttributeFunc,
+		metricAttributeFilter: metricAttributeFilter,
 	}, nil
 }
 
@@ -453,9 +472,13 @@ func (h *metricHooks) OnProduceBatchWritten(meta kgo.BrokerMetadata,
 	topic string, partition int32, m kgo.ProduceBatchMetrics,
 ) {
 	attrs := make([]attribute.KeyValue, 0, 7)
-	attrs = append(attrs, semconv.MessagingSystem("kafka"),
+	attrs = append(attrs, semconv.MessagingSystem("kafka"))
+	attrs = append(attrs, h.metricAttributeFilter.topicAttributes(
+		strings.TrimPrefix(topic, h.topicPrefix),
 		attribute.String("topic", topic),
 		semconv.MessagingDestinationName(strings.TrimPrefix(topic, h.topicPrefix)),
+	)...)
+	attrs = append(attrs,
 		semconv.MessagingKafkaDestinationPartition(int(partition)),
 		attribute.String("outcome", "success"),
 		attribute.String("compression.codec", compressionFromCodec(m.CompressionType)),
@@ -495,9 +518,13 @@ func (h *metricHooks) OnFetchBatchRead(meta kgo.BrokerMetadata,
 	topic string, partition int32, m kgo.FetchBatchMetrics,
 ) {
 	attrs := make([]attribute.KeyValue, 0, 6)
-	attrs = append(attrs, semconv.MessagingSystem("kafka"),
+	attrs = append(attrs, semconv.MessagingSystem("kafka"))
+	attrs = append(attrs, h.metricAttributeFilter.topicAttributes(
+		strings.TrimPrefix(topic, h.topicPrefix),
 		attribute.String("topic", topic),
 		semconv.MessagingSourceName(strings.TrimPrefix(topic, h.topicPrefix)),
+	)...)
+	attrs = append(attrs,
 		semconv.MessagingKafkaSourcePartition(int(partition)),
 		attribute.String("compression.codec", compressionFromCodec(m.CompressionType)),
 	)
@@ -537,12 +564,14 @@ func (h *metricHooks) OnProduceRecordUnbuffered(r *kgo.Record, err error) {
 	if err == nil {
 		return // Covered by OnProduceBatchWritten.
 	}
-	attrs := attributesFromRecord(r,
+	attrs := attributesFromRecord(r, append(h.metricAttributeFilter.topicAttributes(
+		strings.TrimPrefix(r.Topic, h.topicPrefix),
 		attribute.String("topic", r.Topic),
 		semconv.MessagingDestinationName(strings.TrimPrefix(r.Topic, h.topicPrefix)),
+	),
 		semconv.MessagingKafkaDestinationPartition(int(r.Partition)),
 		attribute.String("outcome", "failure"),
-	)
+	)...)
 	if kv := h.topicAttributeFunc(r.Topic); kv != (attribute.KeyValue{}) {
 		attrs = append(attrs, kv)
 	}
@@ -569,11 +598,13 @@ func (h *metricHooks) OnFetchRecordUnbuffered(r *kgo.Record, polled bool) {
 	if !polled {
 		return // Record metrics when polled by `client.PollRecords()`.
 	}
-	attrs := attributesFromRecord(r,
+	attrs := attributesFromRecord(r, append(h.metricAttributeFilter.topicAttributes(
+		strings.TrimPrefix(r.Topic, h.topicPrefix),
 		attribute.String("topic", r.Topic),
 		semconv.MessagingSourceName(strings.TrimPrefix(r.Topic, h.topicPrefix)),
+	),
 		semconv.MessagingKafkaSourcePartition(int(r.Partition)),
-	)
+	)...)
 	if kv := h.topicAttributeFunc(r.Topic); kv != (attribute.KeyValue{}) {
 		attrs = append(attrs, kv)
 	}
@@ -598,6 +629,134 @@ func (h *metricHooks) OnBrokerThrottle(meta kgo.BrokerMetadata, throttleInterval
 	)
 }
 
+// producerMetrics holds the instruments recorded by the Producer for each
+// produced record.
+type producerMetrics struct {
+	produced metric.Int64Counter
+	bytes    metric.Int64Counter
+	errored  metric.Int64Counter
+	latency  metric.Float64Histogram
+	// blocked counts the produce calls which waited for buffer space.
+	blocked metric.Int64Counter
+
+	meter           metric.Meter
+	bufferedRecords metric.Int64ObservableGauge
+	bufferedBytes   metric.Int64ObservableGauge
+
+	// attrs caches the measurement options by producerAttrsKey, to avoid
+	// allocating an attribute set for each record.
+	attrs  sync.Map
+	filter MetricAttributeFilter
+}
+
+type producerAttrsKey struct {
+	topic  string
+	failed bool
+}
+
+func newProducerMetrics(mp metric.MeterProvider, filter MetricAttributeFilter) (*producerMetrics, error) {
+	m := mp.Meter(instrumentName)
+	produced, err := m.Int64Counter("producer.messages.produced",
+		metric.WithUnit(unitCount),
+		metric.WithDescription("The number of messages successfully produced, by topic"),
+	)
+	if err != nil {
+		return nil, formatMetricError("producer.messages.produced", err)
+	}
+	bytes, err := m.Int64Counter("producer.bytes.produced",
+		metric.WithUnit(unitBytes),
+		metric.WithDescription("The number of key and value bytes produced, by topic and outcome"),
+	)
+	if err != nil {
+		return nil, formatMetricError("producer.bytes.produced", err)
+	}
+	errored, err := m.Int64Counter("producer.messages.errored",
+		metric.WithUnit(unitCount),
+		metric.WithDescription("The number of messages which failed to be produced, by topic"),
+	)
+	if err != nil {
+		return nil, formatMetricError("producer.messages.errored", err)
+	}
+	latency, err := m.Float64Histogram("producer.produce.latency",
+		metric.WithUnit("s"),
+		metric.WithDescription("The time taken to synchronously produce a message, by topic and outcome"),
+	)
+	if err != nil {
+		return nil, formatMetricError("producer.produce.latency", err)
+	}
+	blocked, err := m.Int64Counter("producer.produce.blocked",
+		metric.WithUnit(unitCount),
+		metric.WithDescription("The number of produce calls which waited for space in the producer buffer"),
+	)
+	if err != nil {
+		return nil, formatMetricError("producer.produce.blocked", err)
+	}
+	bufferedRecords, err := m.Int64ObservableGauge("producer.buffered.records",
+		metric.WithUnit(unitCount),
+		metric.WithDescription("The number of records buffered by the producer, which haven't been acknowledged yet"),
+	)
+	if err != nil {
+		return nil, formatMetricError("producer.buffered.records", err)
+	}
+	bufferedBytes, err := m.Int64ObservableGauge("producer.buffered.bytes",
+		metric.WithUnit(unitBytes),
+		metric.WithDescription("The number of key and value bytes buffered by the producer, which haven't been acknowledged yet"),
+	)
+	if err != nil {
+		return nil, formatMetricError("producer.buffered.bytes", err)
+	}
+	return &producerMetrics{
+		produced:        produced,
+		bytes:           bytes,
+		errored:         errored,
+		latency:         latency,
+		blocked:         blocked,
+		meter:           m,
+		bufferedRecords: bufferedRecords,
+		bufferedBytes:   bufferedBytes,
+		filter:          filter,
+	}, nil
+}
+
+// observeBuffered registers the callback observing the records and bytes
+// buffered by client.
+func (m *producerMetrics) observeBuffered(client *kgo.Client) (metric.Registration, error) {
+	return m.meter.RegisterCallback(func(_ context.Context, o metric.Observer) error {
+		o.ObserveInt64(m.bufferedRecords, client.BufferedProduceRecords())
+		o.ObserveInt64(m.bufferedBytes, client.BufferedProduceBytes())
+		return nil
+	}, m.bufferedRecords, m.bufferedBytes)
+}
+
+// record records the outcome of producing a record to topic. The latency is
+// only recorded when it's positive, for synchronously produced records.
+func (m *producerMetrics) record(ctx context.Context, topic string, size int, latency time.Duration, err error) {
+	key := producerAttrsKey{topic: topic, failed: err != nil}
+	opt, ok := m.attrs.Load(key)
+	if !ok {
+		outcome := "success"
+		if key.failed {
+			outcome = "failure"
+		}
+		attrs := m.filter.topicAttributes(topic, attribute.String("topic", topic))
+		opt, _ = m.attrs.LoadOrStore(key, metric.WithAttributeSet(attribute.NewSet(
+			append(attrs[:len(attrs):len(attrs)], attribute.String("outcome", outcome))...,
+		)))
+	}
+	attrs := opt.(metric.MeasurementOption)
+	// Failed records are only counted as errored, so that produced and
+	// errored add up to the number of records attempted.
+	if key.failed {
+		m.errored.Add(ctx, 1, attrs)
+	} else {
+		m.produced.Add(ctx, 1, attrs)
+	}
+	m.bytes.Add(ctx, int64(size), attrs)
+	if latency > 0 {
+		m.latency.Record(ctx, latency.Seconds(), attrs)
+	}
+}
+
 func attributesFromRecord(r *kgo.Record, extra ...attribute.KeyValue) []attribute.KeyValue {
 	attrs := make([]attribute.KeyValue, 0, 5) // Preallocate 5 elements.
 	attrs = append(attrs, semconv.MessagingSystem("kafka"))
@@ -20,13 +20,17 @@ package kafka
 import (
 	"context"
 	"fmt"
+	"strings"
 	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"github.com/twmb/franz-go/pkg/kerr"
+	"github.com/twmb/franz-go/pkg/kfake"
 	"github.com/twmb/franz-go/pkg/kgo"
+	"github.com/twmb/franz-go/pkg/kmsg"
 	"go.opentelemetry.io/otel/attribute"
 	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
 	"go.opentelemetry.io/otel/sdk/metric/metricdata"
@@ -369,6 +373,232 @@ func TestProducerMetrics(t *testing.T) {
 	})
 }
 
+func TestProducerRecordMetrics(t *testing.T) {
+	rdr := sdkmetric.NewManualReader()
+	_, brokers := newClusterWithTopics(t, 1, "name_space-topic")
+	producer := newProducer(t, ProducerConfig{
+		CommonConfig: CommonConfig{
+			Brokers:       brokers,
+			Logger:        zap.NewNop(),
+			Namespace:     "name_space",
+			MeterProvider: sdkmetric.NewMeterProvider(sdkmetric.WithReader(rdr)),
+		},
+		ProducerBatchMaxBytes: 1024,
+	})
+	_, err := producer.ProduceSync(context.Background(),
+		apmqueue.Record{Topic: "topic", OrderingKey: []byte("k"), Value: []byte("12")},
+		apmqueue.Record{Topic: "topic", Value: []byte("123")},
+		apmqueue.Record{Topic: "topic", Value: make([]byte, 2048)},
+	)
+	require.Error(t, err)
+
+	var rm metricdata.ResourceMetrics
+	require.NoError(t, rdr.Collect(context.Background(), &rm))
+	metrics := make(map[string]metricdata.Metrics)
+	for _, sm := range rm.ScopeMetrics {
+		for _, m := range sm.Metrics {
+			metrics[m.Name] = m
+		}
+	}
+	success := attribute.NewSet(
+		attribute.String("topic", "topic"),
+		attribute.String("outcome", "success"),
+	)
+	failure := attribute.NewSet(
+		attribute.String("topic", "topic"),
+		attribute.String("outcome", "failure"),
+	)
+	sum := func(name string, dps ...metricdata.DataPoint[int64]) metricdata.Metrics {
+		return metricdata.Metrics{
+			Name:        name,
+			Description: metrics[name].Description,
+			Unit:        metrics[name].Unit,
+			Data: metricdata.Sum[int64]{
+				Temporality: metricdata.CumulativeTemporality,
+				IsMonotonic: true,
+				DataPoints:  dps,
+			},
+		}
+	}
+	metricdatatest.AssertEqual(t, sum("producer.messages.produced",
+		metricdata.DataPoint[int64]{Attributes: success, Value: 2},
+	), metrics["producer.messages.produced"], metricdatatest.IgnoreTimestamp())
+	metricdatatest.AssertEqual(t, sum("producer.bytes.produced",
+		metricdata.DataPoint[int64]{Attributes: success, Value: 6},
+		metricdata.DataPoint[int64]{Attributes: failure, Value: 2048},
+	), metrics["producer.bytes.produced"], metricdatatest.IgnoreTimestamp())
+	metricdatatest.AssertEqual(t, sum("producer.messages.errored",
+		metricdata.DataPoint[int64]{Attributes: failure, Value: 1},
+	), metrics["producer.messages.errored"], metricdatatest.IgnoreTimestamp())
+
+	latency, ok := metrics["producer.produce.latency"].Data.(metricdata.Histogram[float64])
+	require.True(t, ok)
+	counts := make(map[attribute.Distinct]uint64)
+	for _, dp := range latency.DataPoints {
+		counts[dp.Attributes.Equivalent()] = dp.Count
+	}
+	assert.Equal(t, map[attribute.Distinct]uint64{
+		success.Equivalent(): 2,
+		failure.Equivalent(): 1,
+	}, counts)
+}
+
+func TestProducerBufferMetrics(t *testing.T) {
+	cluster, err := kfake.NewCluster(kfake.SeedTopics(1, "topic"))
+	require.NoError(t, err)
+	t.Cleanup(cluster.Close)
+	// The broker rejects the produced records until accept is set.
+	var accept atomic.Bool
+	cluster.ControlKey(kmsg.Produce.Int16(), func(r kmsg.Request) (kmsg.Response, error, bool) {
+		cluster.KeepControl()
+		if accept.Load() {
+			return nil, nil, false
+		}
+		req := r.(*kmsg.ProduceRequest)
+		resp := req.ResponseKind().(*kmsg.ProduceResponse)
+		for _, t := range req.Topics {
+			respTopic := kmsg.NewProduceResponseTopic()
+			respTopic.Topic = t.Topic
+			for _, p := range t.Partitions {
+				respPartition := kmsg.NewProduceResponseTopicPartition()
+				respPartition.Partition = p.Partition
+				respPartition.ErrorCode = kerr.NotEnoughReplicas.Code
+				respTopic.Partitions = append(respTopic.Partitions, respPartition)
+			}
+			resp.Topics = append(resp.Topics, respTopic)
+		}
+		return resp, nil, true
+	})
+	rdr := sdkmetric.NewManualReader()
+	producer := newProducer(t, ProducerConfig{
+		CommonConfig: CommonConfig{
+			Brokers:       cluster.ListenAddrs(),
+			Logger:        zap.NewNop(),
+			MeterProvider: sdkmetric.NewMeterProvider(sdkmetric.WithReader(rdr)),
+			// Retry the failed produce requests sooner.
+			MetadataMaxAge: 100 * time.Millisecond,
+		},
+		MaxBufferedRecords: 1,
+	})
+	collect := func() map[string]metricdata.Metrics {
+		var rm metricdata.ResourceMetrics
+		require.NoError(t, rdr.Collect(context.Background(), &rm))
+		metrics := make(map[string]metricdata.Metrics)
+		for _, sm := range rm.ScopeMetrics {
+			for _, m := range sm.Metrics {
+				metrics[m.Name] = m
+			}
+		}
+		return metrics
+	}
+	gauge := func(metrics map[string]metricdata.Metrics, name string) int64 {
+		g, ok := metrics[name].Data.(metricdata.Gauge[int64])
+		require.True(t, ok)
+		require.Len(t, g.DataPoints, 1)
+		return g.DataPoints[0].Value
+	}
+
+	require.NoError(t, producer.Produce(context.Background(),
+		apmqueue.Record{Topic: "topic", Value: []byte("a")},
+	))
+	produced := make(chan error)
+	go func() {
+		// Blocks until the first record is acknowledged.
+		produced <- producer.Produce(context.Background(),
+			apmqueue.Record{Topic: "topic", Value: []byte("bc")},
+		)
+	}()
+	require.Eventually(t, func() bool {
+		return gauge(collect(), "producer.buffered.records") == 2
+	}, 5*time.Second, 10*time.Millisecond)
+	metrics := collect()
+	assert.Equal(t, int64(3), gauge(metrics, "producer.buffered.bytes"))
+	_, ok := metrics["producer.produce.blocked"]
+	assert.False(t, ok)
+
+	accept.Store(true)
+	select {
+	case err := <-produced:
+		require.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the blocked produce")
+	}
+	require.NoError(t, producer.Flush(context.Background()))
+	metrics = collect()
+	assert.Equal(t, int64(0), gauge(metrics, "producer.buffered.records"))
+	assert.Equal(t, int64(0), gauge(metrics, "producer.buffered.bytes"))
+	metricdatatest.AssertEqual(t, metricdata.Metrics{
+		Name:        "producer.produce.blocked",
+		Description: metrics["producer.produce.blocked"].Description,
+		Unit:        "1",
+		Data: metricdata.Sum[int64]{
+			Temporality: metricdata.CumulativeTemporality,
+			IsMonotonic: true,
+			DataPoints:  []metricdata.DataPoint[int64]{{Value: 1}},
+		},
+	}, metrics["producer.produce.blocked"], metricdatatest.IgnoreTimestamp())
+}
+
+func TestMetricAttributeFilter(t *testing.T) {
+	rdr := sdkmetric.NewManualReader()
+	_, brokers := newClusterWithTopics(t, 1, "name_space-topic-a", "name_space-topic-b")
+	filter := func(topic apmqueue.Topic) []attribute.KeyValue {
+		name, _, _ := strings.Cut(string(topic), "-")
+		return []attribute.KeyValue{attribute.String("topic", name)}
+	}
+	producer := newProducer(t, ProducerConfig{
+		CommonConfig: CommonConfig{
+			Brokers:               brokers,
+			Logger:                zap.NewNop(),
+			Namespace:             "name_space",
+			MeterProvider:         sdkmetric.NewMeterProvider(sdkmetric.WithReader(rdr)),
+			MetricAttributeFilter: filter,
+		},
+	})
+	_, err := producer.ProduceSync(context.Background(),
+		apmqueue.Record{Topic: "topic-a", Value: []byte("1")},
+		apmqueue.Record{Topic: "topic-b", Value: []byte("2")},
+	)
+	require.NoError(t, err)
+
+	metrics := make(map[string]metricdata.Metrics)
+	// The batch metrics may be recorded after the records are acknowledged.
+	require.Eventually(t, func() bool {
+		var rm metricdata.ResourceMetrics
+		require.NoError(t, rdr.Collect(context.Background(), &rm))
+		for _, sm := range rm.ScopeMetrics {
+			for _, m := range sm.Metrics {
+				metrics[m.Name] = m
+			}
+		}
+		_, ok := metrics["producer.messages.count"]
+		return ok
+	}, time.Second, 10*time.Millisecond)
+	produced, ok := metrics["producer.messages.produced"].Data.(metricdata.Sum[int64])
+	require.True(t, ok)
+	metricdatatest.AssertEqual(t, metricdata.Sum[int64]{
+		Temporality: metricdata.CumulativeTemporality,
+		IsMonotonic: true,
+		DataPoints: []metricdata.DataPoint[int64]{{
+			Attributes: attribute.NewSet(
+				attribute.String("topic", "topic"),
+				attribute.String("outcome", "success"),
+			),
+			Value: 2,
+		}},
+	}, produced, metricdatatest.IgnoreTimestamp())
+
+	count, ok := metrics["producer.messages.count"].Data.(metricdata.Sum[int64])
+	require.True(t, ok)
+	for _, dp := range count.DataPoints {
+		v, ok := dp.Attributes.Value("topic")
+		require.True(t, ok)
+		assert.Equal(t, "topic", v.AsString())
+		assert.False(t, dp.Attributes.HasValue(semconv.MessagingDestinationNameKey))
+	}
+	assert.NotEmpty(t, count.DataPoints)
+}
+
 func TestConsumerMetrics(t *testing.T) {
 	records := 10
 
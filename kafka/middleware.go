@@ -0,0 +1,114 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package kafka
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+
+	apmqueue "github.com/elastic/apm-queue/v2"
+)
+
+// ErrProcessorPanic is returned by the Processor wrapped by RecoverMiddleware
+// when processing a record panics.
+var ErrProcessorPanic = errors.New("kafka: processor panicked")
+
+// ProcessorMiddleware wraps a Processor to run code before and after each
+// record is processed. See ConsumerConfig.ProcessorMiddleware.
+type ProcessorMiddleware func(apmqueue.Processor) apmqueue.Processor
+
+// RecoverMiddleware recovers from panics in the wrapped Processor, returning
+// an error wrapping ErrProcessorPanic instead, so the record is handled like
+// any other failed record rather than crashing the consumer.
+func RecoverMiddleware(next apmqueue.Processor) apmqueue.Processor {
+	return apmqueue.ProcessorFunc(func(ctx context.Context, r apmqueue.Record) (err error) {
+		defer func() {
+			if v := recover(); v != nil {
+				err = fmt.Errorf("%w: topic %q partition %d: %v",
+					ErrProcessorPanic, r.Topic, r.Partition, v,
+				)
+			}
+		}()
+		return next.Process(ctx, r)
+	})
+}
+
+// NewProcessDurationMiddleware returns a middleware which records the time
+// taken by the wrapped Processor to process each record in the
+// `consumer.messages.process.duration` histogram, by topic and outcome. If
+// mp is nil, the global meter provider is used.
+func NewProcessDurationMiddleware(mp metric.MeterProvider) (ProcessorMiddleware, error) {
+	if mp == nil {
+		mp = otel.GetMeterProvider()
+	}
+	duration, err := mp.Meter(instrumentName).Float64Histogram(
+		"consumer.messages.process.duration",
+		metric.WithUnit("s"),
+		metric.WithDescription("The time taken to process a record, by topic and outcome"),
+	)
+	if err != nil {
+		return nil, formatMetricError("consumer.messages.process.duration", err)
+	}
+	return func(next apmqueue.Processor) apmqueue.Processor {
+		return apmqueue.ProcessorFunc(func(ctx context.Context, r apmqueue.Record) error {
+			start := time.Now()
+			err := next.Process(ctx, r)
+			outcome := "success"
+			if err != nil {
+				outcome = "failure"
+			}
+			duration.Record(ctx, time.Since(start).Seconds(), metric.WithAttributes(
+				attribute.String("topic", string(r.Topic)),
+				attribute.String("outcome", outcome),
+			))
+			return err
+		})
+	}, nil
+}
+
+// wrapProcessor wraps p with the middleware, the first being the outermost.
+func wrapProcessor(p apmqueue.Processor, middleware []ProcessorMiddleware) apmqueue.Processor {
+	if p == nil {
+		return nil
+	}
+	for i := len(middleware) - 1; i >= 0; i-- {
+		p = middleware[i](p)
+	}
+	return p
+}
+
+// wrapTopicProcessors returns a copy of processors with each Processor
+// wrapped with the middleware.
+func wrapTopicProcessors(processors map[apmqueue.Topic]apmqueue.Processor,
+	middleware []ProcessorMiddleware,
+) map[apmqueue.Topic]apmqueue.Processor {
+	if len(middleware) == 0 || processors == nil {
+		return processors
+	}
+	wrapped := make(map[apmqueue.Topic]apmqueue.Processor, len(processors))
+	for topic, p := range processors {
+		wrapped[topic] = wrapProcessor(p, middleware)
+	}
+	return wrapped
+}
@@ -0,0 +1,139 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package kafka
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/twmb/franz-go/pkg/kgo"
+	"go.opentelemetry.io/otel/attribute"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
+	"go.uber.org/zap"
+
+	apmqueue "github.com/elastic/apm-queue/v2"
+)
+
+func TestRecoverMiddleware(t *testing.T) {
+	p := RecoverMiddleware(apmqueue.ProcessorFunc(func(_ context.Context, r apmqueue.Record) error {
+		if string(r.Value) == "panic" {
+			panic("boom")
+		}
+		return nil
+	}))
+	assert.NoError(t, p.Process(context.Background(), apmqueue.Record{Value: []byte("ok")}))
+	err := p.Process(context.Background(), apmqueue.Record{
+		Topic: "topic", Partition: 1, Value: []byte("panic"),
+	})
+	assert.ErrorIs(t, err, ErrProcessorPanic)
+	assert.EqualError(t, err, `kafka: processor panicked: topic "topic" partition 1: boom`)
+}
+
+func TestProcessDurationMiddleware(t *testing.T) {
+	rdr := sdkmetric.NewManualReader()
+	mw, err := NewProcessDurationMiddleware(sdkmetric.NewMeterProvider(sdkmetric.WithReader(rdr)))
+	require.NoError(t, err)
+	p := mw(apmqueue.ProcessorFunc(func(_ context.Context, r apmqueue.Record) error {
+		if string(r.Value) == "fail" {
+			return errors.New("failed")
+		}
+		return nil
+	}))
+	ctx := context.Background()
+	assert.NoError(t, p.Process(ctx, apmqueue.Record{Topic: "topic", Value: []byte("ok")}))
+	assert.NoError(t, p.Process(ctx, apmqueue.Record{Topic: "topic", Value: []byte("ok")}))
+	assert.Error(t, p.Process(ctx, apmqueue.Record{Topic: "topic", Value: []byte("fail")}))
+
+	var rm metricdata.ResourceMetrics
+	require.NoError(t, rdr.Collect(ctx, &rm))
+	require.Len(t, rm.ScopeMetrics, 1)
+	require.Len(t, rm.ScopeMetrics[0].Metrics, 1)
+	m := rm.ScopeMetrics[0].Metrics[0]
+	assert.Equal(t, "consumer.messages.process.duration", m.Name)
+	counts := make(map[attribute.Set]uint64)
+	for _, dp := range m.Data.(metricdata.Histogram[float64]).DataPoints {
+		counts[dp.Attributes] = dp.Count
+	}
+	assert.Equal(t, map[attribute.Set]uint64{
+		attribute.NewSet(attribute.String("topic", "topic"), attribute.String("outcome", "success")): 2,
+		attribute.NewSet(attribute.String("topic", "topic"), attribute.String("outcome", "failure")): 1,
+	}, counts)
+}
+
+func TestConsumerProcessorMiddleware(t *testing.T) {
+	topic := "topic"
+	client, addrs := newClusterWithTopics(t, 1, topic)
+	var mu sync.Mutex
+	var calls []string
+	record := func(call string) {
+		mu.Lock()
+		defer mu.Unlock()
+		calls = append(calls, call)
+	}
+	middleware := func(name string) ProcessorMiddleware {
+		return func(next apmqueue.Processor) apmqueue.Processor {
+			return apmqueue.ProcessorFunc(func(ctx context.Context, r apmqueue.Record) error {
+				record(name + ":" + string(r.Value))
+				return next.Process(ctx, r)
+			})
+		}
+	}
+	consumer := newConsumer(t, ConsumerConfig{
+		CommonConfig: CommonConfig{
+			Brokers: addrs,
+			Logger:  zap.NewNop(),
+		},
+		Topics:  []apmqueue.Topic{apmqueue.Topic(topic)},
+		GroupID: "groupid",
+		ProcessorMiddleware: []ProcessorMiddleware{
+			RecoverMiddleware, middleware("first"), middleware("second"),
+		},
+		Processor: apmqueue.ProcessorFunc(func(_ context.Context, r apmqueue.Record) error {
+			if string(r.Value) == "panic" {
+				panic("boom")
+			}
+			record("processor:" + string(r.Value))
+			return nil
+		}),
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	produceRecord(ctx, t, client, &kgo.Record{Topic: topic, Value: []byte("panic")})
+	produceRecord(ctx, t, client, &kgo.Record{Topic: topic, Value: []byte("ok")})
+	go consumer.Run(ctx)
+
+	// The panicking record is recovered from, and the next record is still
+	// processed.
+	require.Eventually(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(calls) == 5
+	}, 5*time.Second, 10*time.Millisecond)
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Equal(t, []string{
+		"first:panic", "second:panic",
+		"first:ok", "second:ok", "processor:ok",
+	}, calls)
+}
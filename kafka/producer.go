@@ -18,16 +18,25 @@
 package kafka
 
 import (
+	"bytes"
 	"context"
 	"errors"
 	"fmt"
 	"os"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
-	"go.uber.org/zap"
-
+	"github.com/twmb/franz-go/pkg/kadm"
 	"github.com/twmb/franz-go/pkg/kgo"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/metric"
+	semconv "go.opentelemetry.io/otel/semconv/v1.4.0"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
 
 	apmqueue "github.com/elastic/apm-queue/v2"
 	"github.com/elastic/apm-queue/v2/queuecontext"
@@ -53,22 +62,81 @@ func Lz4Compression() CompressionCodec { return kgo.Lz4Compression() }
 // ZstdCompression enables zstd compression with the default compression level.
 func ZstdCompression() CompressionCodec { return kgo.ZstdCompression() }
 
+// compressionCodecName returns the name of the codec, as accepted by
+// $KAFKA_PRODUCER_COMPRESSION_CODEC, ignoring its compression level.
+func compressionCodecName(codec CompressionCodec) string {
+	for name, f := range map[string]func() CompressionCodec{
+		"none":   NoCompression,
+		"gzip":   GzipCompression,
+		"snappy": SnappyCompression,
+		"lz4":    Lz4Compression,
+		"zstd":   ZstdCompression,
+	} {
+		if codec.WithLevel(0) == f().WithLevel(0) {
+			return name
+		}
+	}
+	return "unknown"
+}
+
 // ProducerConfig holds configuration for publishing events to Kafka.
 type ProducerConfig struct {
 	CommonConfig
 
-	// MaxBufferedRecords sets the max amount of records the client will buffer
+	// MaxBufferedRecords sets the max amount of records the client will
+	// buffer, blocking produces until records are acknowledged once the
+	// limit is reached. If zero, defaults to 10000.
+	//
+	// The buffered records and bytes are reported by the
+	// producer.buffered.records and producer.buffered.bytes metrics, and
+	// the produce calls which block by producer.produce.blocked.
 	MaxBufferedRecords int
 
-	// ProducerBatchMaxBytes upper bounds the size of a record batch
+	// ProducerBatchMaxBytes upper bounds the size of a record batch. If
+	// zero, defaults to 1000012 bytes, Kafka's max.message.bytes default.
 	ProducerBatchMaxBytes int32
 
+	// MaxRecordBytes, if positive, is the maximum size of a produced record:
+	// the size of its key, value and headers, including the headers added
+	// from the context metadata, after any Transform. Records which exceed
+	// it aren't buffered, they fail with an error wrapping ErrRecordTooLarge
+	// which Produce returns even if the Producer is asynchronous, while the
+	// other records are still produced. This surfaces oversized records to
+	// the caller, instead of them being rejected by the brokers later.
+	//
+	// If negative, it's discovered in the background from the brokers'
+	// `message.max.bytes` config when the Producer is created: records
+	// aren't checked until then, or at all if it can't be discovered. Topic
+	// `max.message.bytes` overrides aren't accounted for. If zero, record
+	// sizes aren't checked.
+	MaxRecordBytes int
+
+	// Linger sets how long each topic partition waits for more records
+	// before a batch is sent, trading latency for larger batches. Lingering
+	// is only worthwhile for low volume producers; high volume producers
+	// fill batches without lingering. Lingers longer than 1m are capped to
+	// 1m, logging a warning. If zero, batches are sent without lingering.
+	Linger time.Duration
+
 	// ManualFlushing disables auto-flushing when producing.
 	ManualFlushing bool
 
 	// Sync can be used to indicate whether production should be synchronous.
 	Sync bool
 
+	// WaitForDeliveryWithContext, if set, makes ProduceWithContext wait
+	// until the records are acknowledged by the brokers or ctx is done,
+	// whichever comes first, regardless of Sync, bounding the latency of
+	// producing to the deadline of ctx.
+	// When ctx is done first, ProduceWithContext returns an error wrapping
+	// the context error, e.g. context.DeadlineExceeded, but the records are
+	// not failed: they remain buffered and may still be delivered, which is
+	// reported to OnDelivery and ProduceCallback as usual.
+	//
+	// Callers which retry records after a deadline error may therefore
+	// produce them more than once, so their consumers must be idempotent.
+	WaitForDeliveryWithContext bool
+
 	// CompressionCodec specifies a list of compression codecs.
 	// See kgo.ProducerBatchCompression for more details.
 	//
@@ -80,20 +148,217 @@ type ProducerConfig struct {
 	//
 	// If $KAFKA_PRODUCER_COMPRESSION_CODEC is not specified, then
 	// the default behaviour of franz-go is to use [snappy, none].
+	//
+	// Codecs are listed in order of preference, falling back to the next
+	// codec if the broker does not support a codec. The configured codecs
+	// are recorded in the `messaging.kafka.compression_codecs` attribute
+	// of producer spans.
+	//
+	// The codecs compress record batches with their default settings, and
+	// custom zstd dictionaries aren't supported, since the brokers must be
+	// able to decompress the batches. To compress record values with a
+	// dictionary, use Transform.
 	CompressionCodec []CompressionCodec
 
+	// Transform, if set, is called with the context passed to Produce or
+	// ProduceSync for each record before it's produced, and may modify the
+	// record, e.g. to encrypt record values, to compress them with a
+	// trained zstd dictionary, which is more efficient than CompressionCodec
+	// for small and similar records, or to add headers. The record is a
+	// copy, but its Value and Headers share memory with the record passed
+	// to Produce, so they must be replaced rather than modified in place.
+	//
+	// If Transform returns an error, the record isn't produced, and the
+	// error is returned by ProduceSync, reported to OnDelivery and to any
+	// Flush in progress, while the other records are still produced.
+	//
+	// Consumers can reverse the transformation with ConsumerConfig.Transform.
+	Transform func(context.Context, *apmqueue.Record) error
+
+	// Serializer, if set, serializes the values produced with
+	// Producer.ProduceValues, e.g. with a schema registry client. Consumers
+	// can deserialize them with ConsumerConfig.Deserializer.
+	Serializer Serializer
+
 	// ProduceCallback is a hook called after the record has been produced
 	ProduceCallback func(*kgo.Record, error)
 
+	// OnDelivery, if set, is called exactly once for each produced record
+	// after the broker has acknowledged it, or once producing the record has
+	// failed, with the metadata assigned to the record and any error. The
+	// error describes the record's index in the produced records, topic and
+	// ordering key, and wraps the broker error, e.g. ErrRecordTooLarge.
+	//
+	// OnDelivery is called from the producer's internal goroutines, which
+	// are blocked until it returns, so it must not block for long.
+	OnDelivery func(apmqueue.Record, RecordMetadata, error)
+
 	// BatchListener is called per topic/partition after a batch is
 	// successfully produced to a Kafka broker.
 	BatchListener BatchWriteListener
 
 	// RecordPartitioner is a function that returns the partition to which
 	// a record should be sent. If nil, the default partitioner is used.
+	// RecordPartitioner partitions records by the key they're produced
+	// with, so a record's Key takes precedence over its OrderingKey.
 	RecordPartitioner kgo.Partitioner
+
+	// Partitioner, if set, returns the partition a record is produced to,
+	// given the number of partitions of the record's topic. The returned
+	// partition must be in the range [0, numPartitions). The record's
+	// Headers include any headers added from the context metadata. If nil,
+	// records are partitioned by the hash of their OrderingKey.
+	//
+	// If the number of partitions of a topic is increased, the partition
+	// that records are mapped to may change, so records which were produced
+	// to the same partition may be produced to different partitions.
+	//
+	// Only one of Partitioner or RecordPartitioner can be set.
+	Partitioner func(record apmqueue.Record, numPartitions int32) int32
+
+	// KeyExtractor, if set, returns the key that a record is produced with,
+	// instead of its OrderingKey, so the key can be derived from the record
+	// when it is produced, e.g. from a field of its Value. The key
+	// determines the record's partition, so records with the same key are
+	// consumed in the order they're produced. When a record has an
+	// OrderingKey, the key returned by KeyExtractor takes precedence. When a
+	// record has a Key, it's produced with its Key, and partitioned by the
+	// key returned by KeyExtractor.
+	KeyExtractor func(apmqueue.Record) []byte
+
+	// HotKeys holds the ordering keys which are too hot to be produced to a
+	// single partition. Records with a hot key are spread round-robin over
+	// a small set of consecutive partitions, starting at the partition the
+	// key hashes to, instead of all being produced to that partition.
+	//
+	// Strict per-key ordering is sacrificed for hot keys: records with a hot
+	// key are only ordered within each partition of the set, so they may be
+	// consumed in a different order than they're produced.
+	//
+	// HotKeys can't be set with Partitioner or RecordPartitioner.
+	HotKeys []HotKey
+
+	// PropagateTraceContext injects the trace context of the context passed
+	// to Produce into the headers of the produced records, using the
+	// configured TextMapPropagator. For the W3C trace context propagator,
+	// the `traceparent` and `tracestate` headers are added.
+	PropagateTraceContext bool
+
+	// TransactionalID, if set, makes the producer transactional, using the
+	// value as the producer's `transactional.id`. Records produced by a
+	// transactional producer must be produced within a transaction, see
+	// Producer.BeginTransaction. Consumers only skip the records of aborted
+	// and open transactions with ConsumerConfig.IsolationLevel set to
+	// ReadCommitted.
+	TransactionalID string
+
+	// Acks sets the acknowledgements the brokers must make before a record
+	// is considered produced. If unset, defaults to AllISRAcks. The acks are
+	// recorded in the `messaging.kafka.acks` attribute of producer spans,
+	// using the values of Kafka's `acks` setting: `all`, `1` or `0`.
+	Acks ProducerAcks
+
+	// Idempotent enables idempotent producing, so records are not duplicated
+	// when produce requests are retried, which requires Acks to be
+	// AllISRAcks. Idempotent producing is only used if the brokers support
+	// it, and requires the IDEMPOTENT_WRITE permission on older brokers.
+	//
+	// If nil, defaults to true unless Acks is set to LeaderAck or NoAck.
+	// Transactional producers are always idempotent.
+	Idempotent *bool
+
+	// AllowAutoTopicCreation allows the brokers to create the topics which
+	// records are produced to when they don't exist, if the brokers have
+	// `auto.create.topics.enable` set, using the brokers' default partition
+	// count and replication factor. It can be enabled for convenience in
+	// development and staging environments, where topics may not have been
+	// created with a Manager or TopicCreator beforehand.
+	//
+	// By default, producing to a topic which doesn't exist fails with an
+	// error wrapping ErrTopicNotFound, so missing topics are noticed.
+	AllowAutoTopicCreation bool
+
+	// RecordTimeout, if set, is the maximum time a record can spend being
+	// produced, including the time it's buffered by the producer and any
+	// retries, e.g. while the brokers are unavailable. Records which can't
+	// be produced within RecordTimeout fail with an error wrapping
+	// ErrRecordTimeout, instead of being retried until they're produced,
+	// so stale records aren't produced. All the records buffered for the
+	// same partition fail along with a timed out record, to keep the
+	// produced records in order.
+	//
+	// RecordTimeout must be at least 1s. Linger counts towards
+	// RecordTimeout, so it should be set well above Linger.
+	// Kafka producer setting: delivery.timeout.ms
+	RecordTimeout time.Duration
+}
+
+// HotKey is an ordering key which is spread over multiple partitions of a
+// topic, see ProducerConfig.HotKeys.
+type HotKey struct {
+	// Topic is the topic the key is hot in. If empty, the key is hot in
+	// all topics.
+	Topic apmqueue.Topic
+
+	// Key is the ordering key of the records.
+	Key []byte
+
+	// Partitions is the number of partitions the records are spread over.
+	// It's capped by the number of partitions of the topic.
+	Partitions int
+}
+
+// ProducerAcks identifies the acknowledgements required to produce records.
+type ProducerAcks uint8
+
+const (
+	// AllISRAcks waits for all in-sync replicas to acknowledge records.
+	AllISRAcks ProducerAcks = iota
+	// LeaderAck waits only for the partition leader to acknowledge records.
+	LeaderAck
+	// NoAck doesn't wait for records to be acknowledged.
+	NoAck
+)
+
+func (a ProducerAcks) kgoAcks() kgo.Acks {
+	switch a {
+	case LeaderAck:
+		return kgo.LeaderAck()
+	case NoAck:
+		return kgo.NoAck()
+	default:
+		return kgo.AllISRAcks()
+	}
+}
+
+// configValue returns the value of Kafka's `acks` producer setting for a.
+func (a ProducerAcks) configValue() string {
+	switch a {
+	case LeaderAck:
+		return "1"
+	case NoAck:
+		return "0"
+	default:
+		return "all"
+	}
+}
+
+func (a ProducerAcks) String() string {
+	switch a {
+	case AllISRAcks:
+		return "AllISRAcks"
+	case LeaderAck:
+		return "LeaderAck"
+	case NoAck:
+		return "NoAck"
+	default:
+		return fmt.Sprintf("ProducerAcks(%d)", a)
+	}
 }
 
+// maxProducerLinger is the maximum ProducerConfig.Linger.
+const maxProducerLinger = time.Minute
+
 // BatchWriteListener specifies a callback function that is invoked after a batch is
 // successfully produced to a Kafka broker. It is invoked with the corresponding topic and the
 // amount of bytes written to that topic (taking compression into account, when applicable).
@@ -121,6 +386,49 @@ func (cfg *ProducerConfig) finalize() error {
 	if cfg.ProducerBatchMaxBytes < 0 {
 		errs = append(errs, fmt.Errorf("kafka: producer batch max bytes cannot be negative: %d", cfg.ProducerBatchMaxBytes))
 	}
+	if cfg.Linger < 0 {
+		errs = append(errs, fmt.Errorf("kafka: linger cannot be negative: %s", cfg.Linger))
+	} else if cfg.Linger > maxProducerLinger {
+		cfg.Logger.Warn("producer linger exceeds the maximum, capping it",
+			zap.Duration("linger", cfg.Linger),
+			zap.Duration("max_linger", maxProducerLinger),
+		)
+		cfg.Linger = maxProducerLinger
+	}
+	switch {
+	case cfg.RecordTimeout < 0:
+		errs = append(errs, fmt.Errorf("kafka: record timeout cannot be negative: %s", cfg.RecordTimeout))
+	case cfg.RecordTimeout > 0 && cfg.RecordTimeout < time.Second:
+		// kgo rejects record timeouts below 1s.
+		errs = append(errs, fmt.Errorf("kafka: record timeout must be at least 1s: %s", cfg.RecordTimeout))
+	}
+	if cfg.Partitioner != nil && cfg.RecordPartitioner != nil {
+		errs = append(errs, errors.New("kafka: only one of Partitioner or RecordPartitioner can be set"))
+	}
+	if len(cfg.HotKeys) > 0 && (cfg.Partitioner != nil || cfg.RecordPartitioner != nil) {
+		errs = append(errs, errors.New("kafka: hot keys cannot be set with Partitioner or RecordPartitioner"))
+	}
+	for _, hk := range cfg.HotKeys {
+		switch {
+		case len(hk.Key) == 0:
+			errs = append(errs, errors.New("kafka: hot key cannot be empty"))
+		case hk.Partitions < 1:
+			errs = append(errs, fmt.Errorf("kafka: hot key %q partitions must be at least 1: %d", hk.Key, hk.Partitions))
+		}
+	}
+	if cfg.Acks > NoAck {
+		errs = append(errs, fmt.Errorf("kafka: unknown acks %s", cfg.Acks))
+	}
+	if cfg.Idempotent == nil {
+		idempotent := cfg.Acks == AllISRAcks || cfg.TransactionalID != ""
+		cfg.Idempotent = &idempotent
+	}
+	switch {
+	case *cfg.Idempotent && cfg.Acks != AllISRAcks:
+		errs = append(errs, fmt.Errorf("kafka: idempotent producing requires AllISRAcks, acks set to %s", cfg.Acks))
+	case !*cfg.Idempotent && cfg.TransactionalID != "":
+		errs = append(errs, errors.New("kafka: transactional producing requires idempotent producing"))
+	}
 	if len(cfg.CompressionCodec) == 0 {
 		if v := os.Getenv("KAFKA_PRODUCER_COMPRESSION_CODEC"); v != "" {
 			names := strings.Split(v, ",")
@@ -151,10 +459,42 @@ var _ apmqueue.Producer = &Producer{}
 
 // Producer publishes events to Kafka. Implements the Producer interface.
 type Producer struct {
-	cfg    ProducerConfig
-	client *kgo.Client
+	cfg     ProducerConfig
+	client  *kgo.Client
+	tracer  trace.Tracer
+	metrics *producerMetrics
+	// bufferedRegistration observes the producer.buffered.* metrics.
+	bufferedRegistration metric.Registration
+	// maxBufferedRecords holds the number of buffered records after which
+	// producing blocks.
+	maxBufferedRecords int64
+	// codecs holds the names of the configured compression codecs.
+	codecs []string
+	// maxRecordBytes, if positive, is the maximum size of the produced
+	// records, set from MaxRecordBytes or discovered from the brokers.
+	maxRecordBytes atomic.Int64
+	// stopDiscovery stops discovering the brokers' max record size, and
+	// discovered is closed once discovery is done, if it was started.
+	stopDiscovery context.CancelFunc
+	discovered    chan struct{}
 
 	mu sync.RWMutex
+
+	// flushMu guards flushes, which holds the Flush calls in progress that
+	// are notified of any produce errors.
+	flushMu sync.Mutex
+	flushes map[*flushObserver]struct{}
+
+	// fanoutMu serializes the transactions of ProduceFanout.
+	fanoutMu sync.Mutex
+	// txnMu serializes transactions, guarding the fields below.
+	txnMu           sync.Mutex
+	inTxn           bool
+	txnOffsetsAdded bool
+	// txnProduced records whether any records have been produced in the
+	// current transaction. It is written by produce, which does not hold
+	// txnMu.
+	txnProduced atomic.Bool
 }
 
 // NewProducer returns a new Producer with the given config.
@@ -172,6 +512,9 @@ func NewProducer(cfg ProducerConfig) (*Producer, error) {
 	if cfg.ProducerBatchMaxBytes != 0 {
 		opts = append(opts, kgo.ProducerBatchMaxBytes(cfg.ProducerBatchMaxBytes))
 	}
+	if cfg.Linger > 0 {
+		opts = append(opts, kgo.ProducerLinger(cfg.Linger))
+	}
 	if cfg.ManualFlushing {
 		opts = append(opts, kgo.ManualFlushing())
 	}
@@ -181,14 +524,143 @@ func NewProducer(cfg ProducerConfig) (*Producer, error) {
 	if cfg.RecordPartitioner != nil {
 		opts = append(opts, kgo.RecordPartitioner(cfg.RecordPartitioner))
 	}
+	if cfg.Partitioner != nil {
+		opts = append(opts, kgo.RecordPartitioner(recordPartitioner{
+			fn:          cfg.Partitioner,
+			topicPrefix: cfg.namespacePrefix(),
+		}))
+	}
+	if cfg.Partitioner == nil && cfg.RecordPartitioner == nil {
+		var partitioner kgo.Partitioner = orderingKeyPartitioner{
+			// franz-go default.
+			Partitioner: kgo.UniformBytesPartitioner(64<<10, true, true, nil),
+		}
+		if len(cfg.HotKeys) > 0 {
+			partitioner = hotKeyPartitioner{
+				Partitioner: partitioner,
+				hotKeys:     cfg.HotKeys,
+				topicPrefix: cfg.namespacePrefix(),
+			}
+		}
+		opts = append(opts, kgo.RecordPartitioner(partitioner))
+	}
+	if cfg.TransactionalID != "" {
+		opts = append(opts, kgo.TransactionalID(cfg.TransactionalID))
+	}
+	if cfg.AllowAutoTopicCreation {
+		opts = append(opts, kgo.AllowAutoTopicCreation())
+	}
+	if cfg.RecordTimeout > 0 {
+		opts = append(opts, kgo.RecordDeliveryTimeout(cfg.RecordTimeout))
+	}
+	opts = append(opts, kgo.RequiredAcks(cfg.Acks.kgoAcks()))
+	if !*cfg.Idempotent {
+		opts = append(opts, kgo.DisableIdempotentWrite())
+	}
+	metrics, err := newProducerMetrics(cfg.meterProvider(), cfg.MetricAttributeFilter)
+	if err != nil {
+		return nil, fmt.Errorf("kafka: failed creating producer metrics: %w", err)
+	}
 	client, err := cfg.newClient(cfg.TopicAttributeFunc, opts...)
 	if err != nil {
 		return nil, fmt.Errorf("kafka: failed creating producer: %w", err)
 	}
-	return &Producer{
-		cfg:    cfg,
-		client: client,
-	}, nil
+	bufferedRegistration, err := metrics.observeBuffered(client)
+	if err != nil {
+		client.Close()
+		return nil, fmt.Errorf("kafka: failed registering producer metrics callback: %w", err)
+	}
+	codecs := []string{"snappy", "none"} // franz-go default
+	if len(cfg.CompressionCodec) > 0 {
+		codecs = make([]string, len(cfg.CompressionCodec))
+		for i, codec := range cfg.CompressionCodec {
+			codecs[i] = compressionCodecName(codec)
+		}
+	}
+	p := &Producer{
+		cfg:                  cfg,
+		client:               client,
+		tracer:               cfg.tracerProvider().Tracer("kafka"),
+		metrics:              metrics,
+		bufferedRegistration: bufferedRegistration,
+		maxBufferedRecords:   client.OptValue(kgo.MaxBufferedRecords).(int64),
+		codecs:               codecs,
+	}
+	switch {
+	case cfg.MaxRecordBytes > 0:
+		p.maxRecordBytes.Store(int64(cfg.MaxRecordBytes))
+	case cfg.MaxRecordBytes < 0:
+		ctx, cancel := context.WithCancel(context.Background())
+		p.stopDiscovery = cancel
+		p.discovered = make(chan struct{})
+		go p.discoverMaxRecordBytes(ctx)
+	}
+	return p, nil
+}
+
+// discoverMaxRecordBytes sets maxRecordBytes from the `message.max.bytes`
+// config of one of the brokers, leaving it unset if it can't be described.
+func (p *Producer) discoverMaxRecordBytes(ctx context.Context) {
+	defer close(p.discovered)
+	adm := kadm.NewClient(p.client)
+	maxBytes, err := func() (int64, error) {
+		brokers, err := adm.ListBrokers(ctx)
+		if err != nil {
+			return 0, err
+		}
+		if len(brokers) == 0 {
+			return 0, errors.New("no brokers found")
+		}
+		id := brokers[0].NodeID
+		rcs, err := adm.DescribeBrokerConfigs(ctx, id)
+		if err != nil {
+			return 0, err
+		}
+		rc, err := rcs.On(strconv.Itoa(int(id)), nil)
+		if err == nil {
+			err = rc.Err
+		}
+		if err != nil {
+			return 0, err
+		}
+		for _, c := range rc.Configs {
+			if c.Key == "message.max.bytes" {
+				return strconv.ParseInt(c.MaybeValue(), 10, 64)
+			}
+		}
+		return 0, errors.New("message.max.bytes not found")
+	}()
+	if err != nil {
+		p.cfg.Logger.Debug("failed to discover the brokers' max message bytes, not checking record sizes",
+			zap.Error(classifyError(err)),
+		)
+		return
+	}
+	p.maxRecordBytes.CompareAndSwap(0, maxBytes)
+}
+
+// checkSize returns an error wrapping ErrRecordTooLarge if the size of the
+// record exceeds the maximum record size.
+func (p *Producer) checkSize(r *kgo.Record) error {
+	maxBytes := p.maxRecordBytes.Load()
+	if maxBytes <= 0 {
+		return nil
+	}
+	if size := recordSize(r); int64(size) > maxBytes {
+		return fmt.Errorf("%w: record of %d bytes exceeds the maximum of %d bytes",
+			ErrRecordTooLarge, size, maxBytes,
+		)
+	}
+	return nil
+}
+
+// recordSize returns the size of the key, value and headers of r.
+func recordSize(r *kgo.Record) int {
+	size := len(r.Key) + len(r.Value)
+	for _, h := range r.Headers {
+		size += len(h.Key) + len(h.Value)
+	}
+	return size
 }
 
 // Close stops the producer
@@ -197,13 +669,122 @@ func NewProducer(cfg ProducerConfig) (*Producer, error) {
 // producing. If producing is asynchronous, it'll block until all messages
 // have been produced. After Close() is called, Producer cannot be reused.
 func (p *Producer) Close() error {
+	_, _, err := p.CloseWithContext(context.Background())
+	return err
+}
+
+// CloseWithContext stops the producer like Close, but only flushes the
+// buffered records until ctx is done. It returns the number of records
+// which were buffered when it was called, and either flushed or dropped.
+//
+// If ctx is done before all the records are flushed, the producer is closed
+// anyway, failing the remaining buffered records, and an error is returned.
+// After CloseWithContext is called, Producer cannot be reused.
+func (p *Producer) CloseWithContext(ctx context.Context) (flushed, dropped int, err error) {
 	p.mu.Lock()
 	defer p.mu.Unlock()
-	if err := p.client.Flush(context.Background()); err != nil {
-		return fmt.Errorf("cannot flush on close: %w", err)
+	if p.stopDiscovery != nil {
+		p.stopDiscovery()
+		<-p.discovered
+	}
+	buffered := int(p.client.BufferedProduceRecords())
+	if ferr := p.client.Flush(ctx); ferr != nil {
+		dropped = min(int(p.client.BufferedProduceRecords()), buffered)
+		err = fmt.Errorf("cannot flush on close: %w", ferr)
 	}
 	p.client.Close()
-	return nil
+	if err := p.bufferedRegistration.Unregister(); err != nil {
+		p.cfg.Logger.Warn("failed to unregister producer buffer metrics", zap.Error(err))
+	}
+	if dropped > 0 {
+		p.cfg.Logger.Warn("dropped buffered records on close", zap.Int("dropped", dropped))
+	}
+	return buffered - dropped, dropped, err
+}
+
+// Flush blocks until all the buffered records have been acknowledged by the
+// brokers, or the context is done. Flush is safe to call concurrently with
+// Produce, and unlike Close, the producer can still be used afterwards.
+//
+// The first error of the records which fail to be produced while flushing
+// is returned, even if the records were produced before Flush was called.
+func (p *Producer) Flush(ctx context.Context) error {
+	ctx, span := p.tracer.Start(ctx, "Flush", trace.WithAttributes(
+		semconv.MessagingSystemKey.String("kafka"),
+	))
+	defer span.End()
+
+	// Take a read lock to prevent Close from closing the client while
+	// flushing.
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	o := &flushObserver{}
+	p.flushMu.Lock()
+	if p.flushes == nil {
+		p.flushes = make(map[*flushObserver]struct{})
+	}
+	p.flushes[o] = struct{}{}
+	p.flushMu.Unlock()
+	defer func() {
+		p.flushMu.Lock()
+		delete(p.flushes, o)
+		p.flushMu.Unlock()
+	}()
+
+	err := p.client.Flush(ctx)
+	if err != nil {
+		err = fmt.Errorf("failed to flush records: %w", classifyError(err))
+	} else {
+		err = o.error()
+	}
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "failed to flush records")
+	}
+	return err
+}
+
+// flushObserver records the first produce error observed during a Flush.
+type flushObserver struct {
+	mu  sync.Mutex
+	err error
+}
+
+func (o *flushObserver) observe(err error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.err == nil {
+		o.err = err
+	}
+}
+
+func (o *flushObserver) error() error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.err
+}
+
+// notifyFlushes notifies the Flush calls in progress of a produce error.
+func (p *Producer) notifyFlushes(err error) {
+	p.flushMu.Lock()
+	defer p.flushMu.Unlock()
+	for o := range p.flushes {
+		o.observe(err)
+	}
+}
+
+// RecordMetadata holds the metadata assigned to a record by the broker
+// once it has been produced.
+type RecordMetadata struct {
+	// Topic is the topic the record was produced to, without the namespace.
+	Topic apmqueue.Topic
+	// Partition is the partition the record was produced to.
+	Partition int32
+	// Offset is the offset assigned to the record.
+	Offset int64
+	// Timestamp is the timestamp of the record.
+	Timestamp time.Time
 }
 
 // Produce produces N records. If the Producer is synchronous, waits until
@@ -211,12 +792,171 @@ func (p *Producer) Close() error {
 // stored in the producer buffer, or when the records are produced to the
 // queue if sync producing is configured.
 // If the context has been enriched with metadata, each entry will be added
-// as a record's header.
+// as a record's header. The record's Headers are added after
+// the context metadata.
 // Produce takes ownership of Record and any modifications after Produce is
 // called may cause an unhandled exception.
+//
+// If the Producer is synchronous, any records which fail to be produced are
+// returned as a joined error.
 func (p *Producer) Produce(ctx context.Context, rs ...apmqueue.Record) error {
+	if !p.cfg.Sync {
+		ctx = queuecontext.DetachedContext(ctx)
+	}
+	_, err := p.produce(ctx, p.cfg.Sync, rs)
+	return err
+}
+
+// ProduceWithContext produces N records like Produce, but the records remain
+// bound to ctx even if the Producer is asynchronous: records which are still
+// buffered, and haven't been acknowledged by the brokers, when ctx is
+// canceled fail with the context error, which is passed to OnDelivery and
+// ProduceCallback. Produce instead detaches the context of asynchronous
+// produces from its cancellation, keeping only its values.
+//
+// Records are batched per partition, and a batch is only failed when the
+// context of its first record is canceled.
+//
+// If ProducerConfig.WaitForDeliveryWithContext is set, ProduceWithContext
+// instead waits for the records to be delivered until ctx is done, and
+// returns an error wrapping the context error if ctx is done first. ctx being
+// done doesn't fail the records then: they remain buffered and may still be
+// delivered.
+func (p *Producer) ProduceWithContext(ctx context.Context, rs ...apmqueue.Record) error {
+	if p.cfg.WaitForDeliveryWithContext {
+		_, err := p.produceUntil(queuecontext.DetachedContext(ctx), ctx, rs)
+		return err
+	}
+	_, err := p.produce(ctx, p.cfg.Sync, rs)
+	return err
+}
+
+// ProduceSync produces N records and waits until all of them have been
+// acknowledged by the brokers, regardless of whether the Producer is
+// configured to be synchronous. The metadata of each record is returned in
+// the same order as rs.
+//
+// Any records which fail to be produced are returned as a joined error,
+// and their metadata is returned with the zero value for Offset.
+func (p *Producer) ProduceSync(ctx context.Context, rs ...apmqueue.Record) ([]RecordMetadata, error) {
+	ctx, span := p.tracer.Start(ctx, "ProduceSync", trace.WithAttributes(
+		semconv.MessagingSystemKey.String("kafka"),
+		attribute.Int("messaging.batch.message_count", len(rs)),
+		attribute.StringSlice("messaging.kafka.compression_codecs", p.codecs),
+		attribute.Bool("messaging.kafka.idempotent", *p.cfg.Idempotent),
+		attribute.String("messaging.kafka.acks", p.cfg.Acks.configValue()),
+	))
+	defer span.End()
+
+	metadata, err := p.produce(ctx, true, rs)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "failed to produce one or more records")
+	}
+	return metadata, err
+}
+
+// ProduceFanout produces a copy of the record to each of the topics, e.g. to
+// publish an event to a canonical topic and its projections, and waits until
+// the copies have been acknowledged by the brokers. The record's Topic is
+// ignored.
+//
+// If the Producer is transactional, the copies are produced atomically in a
+// transaction, which is committed once they are produced, or aborted if any
+// of them fails, so that either all or none of the copies are committed.
+// Concurrent ProduceFanout calls are serialized. If a transaction is already
+// open, the copies are produced in it instead, and are committed or aborted
+// with it.
+//
+// Otherwise, the copies are produced on a best-effort basis: the copies
+// which fail to be produced are returned as a joined error, one per topic,
+// while the others are still produced.
+func (p *Producer) ProduceFanout(ctx context.Context, record apmqueue.Record, topics ...apmqueue.Topic) error {
+	if len(topics) == 0 {
+		return errors.New("kafka: no topics to fan out the record to")
+	}
+	transactional := p.cfg.TransactionalID != ""
+	ctx, span := p.tracer.Start(ctx, "ProduceFanout", trace.WithAttributes(
+		semconv.MessagingSystemKey.String("kafka"),
+		attribute.Int("messaging.batch.message_count", len(topics)),
+		attribute.Bool("messaging.kafka.transactional", transactional),
+	))
+	defer span.End()
+
+	rs := make([]apmqueue.Record, len(topics))
+	for i, topic := range topics {
+		rs[i] = record
+		rs[i].Topic = topic
+	}
+	var err error
+	if transactional {
+		err = p.produceTransaction(ctx, rs)
+	} else {
+		_, err = p.produce(ctx, true, rs)
+	}
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "failed to fan out record")
+	}
+	return err
+}
+
+// ValueRecord holds a record value to be serialized by
+// ProducerConfig.Serializer, produced with Producer.ProduceValues.
+type ValueRecord struct {
+	// Topic is the topic to produce the record to, without the namespace.
+	Topic apmqueue.Topic
+	// OrderingKey, if set, is used to partition the record.
+	OrderingKey []byte
+	// Value is the value to serialize into the record value.
+	Value any
+}
+
+// ProduceValues serializes the values of the records with
+// ProducerConfig.Serializer, and produces them like Produce.
+//
+// If any of the values fail to be serialized, none of the records are
+// produced and the serialization errors are returned as a joined error.
+func (p *Producer) ProduceValues(ctx context.Context, vs ...ValueRecord) error {
+	if p.cfg.Serializer == nil {
+		return errors.New("kafka: producer serializer not set")
+	}
+	namespacePrefix := p.cfg.namespacePrefix()
+	rs := make([]apmqueue.Record, len(vs))
+	var errs []error
+	for i, v := range vs {
+		value, err := p.cfg.Serializer.Serialize(ctx,
+			valueSubject(namespacePrefix+string(v.Topic)), v.Value,
+		)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("failed to serialize record %d for topic %q: %w",
+				i, v.Topic, err,
+			))
+			continue
+		}
+		rs[i] = apmqueue.Record{Topic: v.Topic, OrderingKey: v.OrderingKey, Value: value}
+	}
+	if err := errors.Join(errs...); err != nil {
+		return err
+	}
+	return p.Produce(ctx, rs...)
+}
+
+func (p *Producer) produce(ctx context.Context, wait bool, rs []apmqueue.Record) ([]RecordMetadata, error) {
+	var until context.Context
+	if wait {
+		until = context.Background()
+	}
+	return p.produceUntil(ctx, until, rs)
+}
+
+// produceUntil produces the records with ctx and, if until is not nil, waits
+// until they are produced or until is done. When until is done first, an
+// error wrapping its error is returned, and the records are still produced.
+func (p *Producer) produceUntil(ctx, until context.Context, rs []apmqueue.Record) ([]RecordMetadata, error) {
+	wait := until != nil
 	if len(rs) == 0 {
-		return nil
+		return nil, nil
 	}
 
 	// Take a read lock to prevent Close from closing the client
@@ -233,25 +973,105 @@ func (p *Producer) Produce(ctx context.Context, rs ...apmqueue.Record) error {
 			})
 		}
 	}
+	if p.cfg.PropagateTraceContext {
+		p.cfg.textMapPropagator().Inject(ctx, (*headerCarrier)(&headers))
+	}
 
 	var wg sync.WaitGroup
 	wg.Add(len(rs))
-	if !p.cfg.Sync {
-		ctx = queuecontext.DetachedContext(ctx)
+	// metadata and errs are only populated when waiting for the records to
+	// be produced.
+	var metadata []RecordMetadata
+	var errs []error
+	if wait {
+		metadata = make([]RecordMetadata, len(rs))
+		errs = make([]error, len(rs))
+	}
+	if p.cfg.TransactionalID != "" {
+		p.txnProduced.Store(true)
 	}
 	namespacePrefix := p.cfg.namespacePrefix()
-	for _, record := range rs {
+	var start time.Time
+	if wait {
+		start = time.Now()
+	}
+	// fail fails a record which isn't buffered.
+	fail := func(i int, record apmqueue.Record, err error) {
+		recordMetadata := RecordMetadata{Topic: record.Topic}
+		if wait {
+			errs[i] = err
+			metadata[i] = recordMetadata
+		}
+		p.notifyFlushes(err)
+		if p.cfg.OnDelivery != nil {
+			p.cfg.OnDelivery(record, recordMetadata, err)
+		}
+		wg.Done()
+	}
+	// tooLarge holds the errors of the records which exceed the maximum
+	// record size, which are returned even if not waiting.
+	var tooLarge []error
+	// blocked is set if producing any of the records waits for buffer space.
+	var blocked bool
+	for i, record := range rs {
+		if p.cfg.Transform != nil {
+			if err := p.cfg.Transform(ctx, &record); err != nil {
+				fail(i, record, fmt.Errorf("failed to transform record %d for topic %q: %w",
+					i, record.Topic, err,
+				))
+				continue
+			}
+		}
+		recordHeaders := headers
+		if len(record.Headers) > 0 {
+			recordHeaders = make([]kgo.RecordHeader, 0, len(headers)+len(record.Headers))
+			recordHeaders = append(recordHeaders, headers...)
+			for _, h := range record.Headers {
+				recordHeaders = append(recordHeaders, kgo.RecordHeader{
+					Key: h.Key, Value: h.Value,
+				})
+			}
+		}
+		key := record.OrderingKey
+		if p.cfg.KeyExtractor != nil {
+			key = p.cfg.KeyExtractor(record)
+		}
 		kgoRecord := &kgo.Record{
-			Headers: headers,
-			Topic:   fmt.Sprintf("%s%s", namespacePrefix, record.Topic),
-			Key:     record.OrderingKey,
-			Value:   record.Value,
+			Headers:   recordHeaders,
+			Topic:     fmt.Sprintf("%s%s", namespacePrefix, record.Topic),
+			Key:       key,
+			Value:     record.Value,
+			Timestamp: record.Timestamp,
+		}
+		if len(record.Key) > 0 {
+			kgoRecord.Key = record.Key
+			if len(key) > 0 && !bytes.Equal(key, record.Key) {
+				// The record is partitioned by its ordering key.
+				kgoRecord.Context = context.WithValue(ctx, orderingKeyContextKey{}, key)
+			}
+		}
+		if err := p.checkSize(kgoRecord); err != nil {
+			err = fmt.Errorf("failed to produce record %d to topic %q with key %q: %w",
+				i, record.Topic, kgoRecord.Key, err,
+			)
+			tooLarge = append(tooLarge, err)
+			fail(i, record, err)
+			continue
+		}
+		if !p.cfg.ManualFlushing && p.client.BufferedProduceRecords() >= p.maxBufferedRecords {
+			// The client blocks until a buffered record is acknowledged.
+			blocked = true
 		}
 		p.client.Produce(ctx, kgoRecord, func(r *kgo.Record, err error) {
 			defer wg.Done()
+			topicName := strings.TrimPrefix(r.Topic, namespacePrefix)
+			var latency time.Duration
+			if wait {
+				latency = time.Since(start)
+			}
+			p.metrics.record(ctx, topicName, len(r.Key)+len(r.Value), latency, err)
 			// kotel already marks spans as errors. No need to handle it here.
 			if err != nil {
-				topicName := strings.TrimPrefix(r.Topic, namespacePrefix)
 				logger := p.cfg.Logger
 				if p.cfg.TopicLogFieldFunc != nil {
 					logger = logger.With(p.cfg.TopicLogFieldFunc(topicName))
@@ -265,22 +1085,272 @@ func (p *Producer) Produce(ctx context.Context, rs ...apmqueue.Record) error {
 					zap.Any("headers", headers),
 				)
 			}
+			recordMetadata := RecordMetadata{
+				Topic:     apmqueue.Topic(topicName),
+				Partition: r.Partition,
+				Timestamp: r.Timestamp,
+			}
+			if err == nil {
+				recordMetadata.Offset = r.Offset
+			}
 			if p.cfg.ProduceCallback != nil {
 				p.cfg.ProduceCallback(r, err)
 			}
+			if err != nil {
+				err = fmt.Errorf(
+					"failed to produce record %d to topic %q with key %q: %w",
+					i, topicName, r.Key, classifyError(err),
+				)
+				if wait {
+					errs[i] = err
+				}
+				p.notifyFlushes(err)
+			}
+			if wait {
+				metadata[i] = recordMetadata
+			}
+			if p.cfg.OnDelivery != nil {
+				p.cfg.OnDelivery(record, recordMetadata, err)
+			}
 		})
 	}
-	if p.cfg.Sync {
+	if blocked {
+		p.metrics.blocked.Add(ctx, 1)
+	}
+	if wait && until.Done() == nil {
 		wg.Wait()
+	} else if wait {
+		produced := make(chan struct{})
+		go func() {
+			defer close(produced)
+			wg.Wait()
+		}()
+		select {
+		case <-produced:
+		case <-until.Done():
+			// The records are still produced in the background, and the
+			// callbacks may still write to metadata and errs.
+			return nil, errors.Join(append(tooLarge, fmt.Errorf(
+				"kafka: records not acknowledged before the context was done: %w",
+				until.Err(),
+			))...)
+		}
 	}
-	return nil
+	if !wait {
+		return nil, errors.Join(tooLarge...)
+	}
+	return metadata, errors.Join(errs...)
 }
 
 // Healthy returns an error if the Kafka client fails to reach a discovered
 // broker.
 func (p *Producer) Healthy(ctx context.Context) error {
 	if err := p.client.Ping(ctx); err != nil {
-		return fmt.Errorf("health probe: %w", err)
+		return fmt.Errorf("health probe: %w", classifyError(err))
 	}
 	return nil
 }
+
+// KafkaClient returns the underlying kgo.Client, for features which the
+// Producer doesn't expose. It must only be used for read-only operations:
+// closing the client, changing its configuration or producing records with
+// it is unsupported and may break the Producer.
+func (p *Producer) KafkaClient() *kgo.Client {
+	return p.client
+}
+
+// recordPartitioner adapts ProducerConfig.Partitioner to a kgo.Partitioner.
+type recordPartitioner struct {
+	fn          func(apmqueue.Record, int32) int32
+	topicPrefix string
+}
+
+func (p recordPartitioner) ForTopic(topic string) kgo.TopicPartitioner {
+	return topicRecordPartitioner{
+		fn:    p.fn,
+		topic: apmqueue.Topic(strings.TrimPrefix(topic, p.topicPrefix)),
+	}
+}
+
+type topicRecordPartitioner struct {
+	fn    func(apmqueue.Record, int32) int32
+	topic apmqueue.Topic
+}
+
+// RequiresConsistency returns true, records are always produced to the
+// partition returned by the function.
+func (topicRecordPartitioner) RequiresConsistency(*kgo.Record) bool { return true }
+
+func (p topicRecordPartitioner) Partition(r *kgo.Record, n int) int {
+	var headers []apmqueue.Header
+	if len(r.Headers) > 0 {
+		headers = make([]apmqueue.Header, len(r.Headers))
+		for i, h := range r.Headers {
+			headers[i] = apmqueue.Header{Key: h.Key, Value: h.Value}
+		}
+	}
+	partition := int(p.fn(apmqueue.Record{
+		Topic:       p.topic,
+		OrderingKey: orderingKey(r),
+		Key:         r.Key,
+		Value:       r.Value,
+		Headers:     headers,
+		Timestamp:   r.Timestamp,
+	}, int32(n)))
+	if partition < 0 || partition >= n {
+		// Keep the partition in range if the function misbehaves.
+		partition = ((partition % n) + n) % n
+	}
+	return partition
+}
+
+// orderingKeyContextKey is the record context key which holds the ordering
+// key of records which are produced with a different Key.
+type orderingKeyContextKey struct{}
+
+// orderingKey returns the key which r is partitioned by.
+func orderingKey(r *kgo.Record) []byte {
+	if r.Context != nil {
+		if key, ok := r.Context.Value(orderingKeyContextKey{}).([]byte); ok {
+			return key
+		}
+	}
+	return r.Key
+}
+
+// orderingKeyPartitioner wraps a kgo.Partitioner, partitioning the records
+// which are produced with a different Key by their ordering key.
+type orderingKeyPartitioner struct {
+	kgo.Partitioner
+}
+
+func (p orderingKeyPartitioner) ForTopic(topic string) kgo.TopicPartitioner {
+	return orderingKeyTopicPartitioner{p.Partitioner.ForTopic(topic)}
+}
+
+type orderingKeyTopicPartitioner struct {
+	kgo.TopicPartitioner
+}
+
+// keyed returns r with its ordering key as the key, if it differs.
+func (orderingKeyTopicPartitioner) keyed(r *kgo.Record) *kgo.Record {
+	key := orderingKey(r)
+	if bytes.Equal(key, r.Key) {
+		return r
+	}
+	keyed := *r
+	keyed.Key = key
+	return &keyed
+}
+
+func (p orderingKeyTopicPartitioner) RequiresConsistency(r *kgo.Record) bool {
+	return p.TopicPartitioner.RequiresConsistency(p.keyed(r))
+}
+
+func (p orderingKeyTopicPartitioner) Partition(r *kgo.Record, n int) int {
+	return p.TopicPartitioner.Partition(p.keyed(r), n)
+}
+
+// OnNewBatch calls the wrapped kgo.TopicPartitionerOnNewBatch, if any.
+func (p orderingKeyTopicPartitioner) OnNewBatch() {
+	if tp, ok := p.TopicPartitioner.(kgo.TopicPartitionerOnNewBatch); ok {
+		tp.OnNewBatch()
+	}
+}
+
+// PartitionByBackup calls the wrapped kgo.TopicBackupPartitioner, if any.
+func (p orderingKeyTopicPartitioner) PartitionByBackup(r *kgo.Record, n int, backup kgo.TopicBackupIter) int {
+	if tp, ok := p.TopicPartitioner.(kgo.TopicBackupPartitioner); ok {
+		return tp.PartitionByBackup(p.keyed(r), n, backup)
+	}
+	return p.Partition(r, n)
+}
+
+// hotKeyPartitioner wraps a kgo.Partitioner, spreading the records with a
+// hot ordering key round-robin over a set of consecutive partitions, starting
+// at the partition the wrapped partitioner returns for the key.
+type hotKeyPartitioner struct {
+	kgo.Partitioner
+	hotKeys     []HotKey
+	topicPrefix string
+}
+
+func (p hotKeyPartitioner) ForTopic(topic string) kgo.TopicPartitioner {
+	tp := p.Partitioner.ForTopic(topic)
+	trimmed := apmqueue.Topic(strings.TrimPrefix(topic, p.topicPrefix))
+	keys := make(map[string]*hotKeyPartitions)
+	for _, hk := range p.hotKeys {
+		if hk.Topic == "" || hk.Topic == trimmed {
+			keys[string(hk.Key)] = &hotKeyPartitions{n: hk.Partitions}
+		}
+	}
+	if len(keys) == 0 {
+		return tp
+	}
+	return hotKeyTopicPartitioner{TopicPartitioner: tp, keys: keys}
+}
+
+// hotKeyPartitions holds the number of partitions a hot key is spread over,
+// and the offset in the set of partitions of the next record with the key.
+// kgo partitions the records of a topic sequentially, so it's not guarded.
+type hotKeyPartitions struct {
+	n    int
+	next int
+	// last and partition hold the last record partitioned with the key,
+	// and its partition, since kgo partitions a record again when it
+	// starts a new batch for it.
+	last      *kgo.Record
+	partition int
+}
+
+type hotKeyTopicPartitioner struct {
+	kgo.TopicPartitioner
+	keys map[string]*hotKeyPartitions
+}
+
+func (p hotKeyTopicPartitioner) hotKey(r *kgo.Record) *hotKeyPartitions {
+	return p.keys[string(orderingKey(r))]
+}
+
+// RequiresConsistency returns true for records with a hot key, which are
+// always produced to the partition returned by Partition.
+func (p hotKeyTopicPartitioner) RequiresConsistency(r *kgo.Record) bool {
+	if p.hotKey(r) != nil {
+		return true
+	}
+	return p.TopicPartitioner.RequiresConsistency(r)
+}
+
+func (p hotKeyTopicPartitioner) Partition(r *kgo.Record, n int) int {
+	return p.spread(r, n, p.TopicPartitioner.Partition(r, n))
+}
+
+// spread returns the next partition of the set of partitions r is spread
+// over, starting at partition, if r has a hot key.
+func (p hotKeyTopicPartitioner) spread(r *kgo.Record, n, partition int) int {
+	hk := p.hotKey(r)
+	if hk == nil {
+		return partition
+	}
+	if hk.last != r {
+		hk.last = r
+		hk.partition = (partition + hk.next) % n
+		hk.next = (hk.next + 1) % min(hk.n, n)
+	}
+	return hk.partition
+}
+
+// OnNewBatch calls the wrapped kgo.TopicPartitionerOnNewBatch, if any.
+func (p hotKeyTopicPartitioner) OnNewBatch() {
+	if tp, ok := p.TopicPartitioner.(kgo.TopicPartitionerOnNewBatch); ok {
+		tp.OnNewBatch()
+	}
+}
+
+// PartitionByBackup calls the wrapped kgo.TopicBackupPartitioner, if any.
+func (p hotKeyTopicPartitioner) PartitionByBackup(r *kgo.Record, n int, backup kgo.TopicBackupIter) int {
+	if tp, ok := p.TopicPartitioner.(kgo.TopicBackupPartitioner); ok {
+		return p.spread(r, n, tp.PartitionByBackup(r, n, backup))
+	}
+	return p.Partition(r, n)
+}
@@ -20,8 +20,10 @@ package kafka
 import (
 	"bytes"
 	"context"
+	"errors"
 	"fmt"
 	"sort"
+	"strconv"
 	"strings"
 	"sync"
 	"sync/atomic"
@@ -32,12 +34,19 @@ import (
 	"github.com/google/go-cmp/cmp/cmpopts"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"github.com/twmb/franz-go/pkg/kadm"
+	"github.com/twmb/franz-go/pkg/kerr"
+	"github.com/twmb/franz-go/pkg/kfake"
 	"github.com/twmb/franz-go/pkg/kgo"
+	"github.com/twmb/franz-go/pkg/kmsg"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
 	sdktrace "go.opentelemetry.io/otel/sdk/trace"
 	"go.opentelemetry.io/otel/sdk/trace/tracetest"
 	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
 	"go.uber.org/zap/zaptest"
+	"go.uber.org/zap/zaptest/observer"
 
 	apmqueue "github.com/elastic/apm-queue/v2"
 	"github.com/elastic/apm-queue/v2/queuecontext"
@@ -77,9 +86,78 @@ func TestNewProducer(t *testing.T) {
 			GzipCompression(),
 			NoCompression(),
 		}, p.cfg.CompressionCodec)
+		assert.Equal(t, []string{"zstd", "gzip", "none"}, p.codecs)
 		require.NoError(t, p.Close())
 	})
 
+	t.Run("compression_default", func(t *testing.T) {
+		p, err := NewProducer(validConfig)
+		require.NoError(t, err)
+		assert.Equal(t, []string{"snappy", "none"}, p.codecs)
+		require.NoError(t, p.Close())
+	})
+
+	t.Run("compression_with_level", func(t *testing.T) {
+		cfg := validConfig
+		cfg.CompressionCodec = []CompressionCodec{Lz4Compression().WithLevel(9), SnappyCompression()}
+		p, err := NewProducer(cfg)
+		require.NoError(t, err)
+		assert.Equal(t, []string{"lz4", "snappy"}, p.codecs)
+		require.NoError(t, p.Close())
+	})
+
+	t.Run("record_timeout", func(t *testing.T) {
+		cfg := validConfig
+		cfg.RecordTimeout = -time.Second
+		_, err := NewProducer(cfg)
+		assert.EqualError(t, err, "kafka: invalid producer config: kafka: record timeout cannot be negative: -1s")
+		cfg.RecordTimeout = time.Millisecond
+		_, err = NewProducer(cfg)
+		assert.EqualError(t, err, "kafka: invalid producer config: kafka: record timeout must be at least 1s: 1ms")
+	})
+
+	t.Run("linger", func(t *testing.T) {
+		cfg := validConfig
+		cfg.Linger = -time.Second
+		_, err := NewProducer(cfg)
+		assert.EqualError(t, err, "kafka: invalid producer config: kafka: linger cannot be negative: -1s")
+
+		core, logs := observer.New(zapcore.WarnLevel)
+		cfg.Logger = zap.New(core)
+		cfg.Linger = time.Hour
+		p, err := NewProducer(cfg)
+		require.NoError(t, err)
+		assert.Equal(t, time.Minute, p.cfg.Linger)
+		assert.Equal(t, 1, logs.FilterMessage("producer linger exceeds the maximum, capping it").Len())
+		require.NoError(t, p.Close())
+	})
+
+	t.Run("idempotent", func(t *testing.T) {
+		p, err := NewProducer(validConfig)
+		require.NoError(t, err)
+		assert.True(t, *p.cfg.Idempotent)
+		require.NoError(t, p.Close())
+
+		cfg := validConfig
+		cfg.Acks = LeaderAck
+		p, err = NewProducer(cfg)
+		require.NoError(t, err)
+		assert.False(t, *p.cfg.Idempotent)
+		require.NoError(t, p.Close())
+
+		idempotent := true
+		cfg.Idempotent = &idempotent
+		_, err = NewProducer(cfg)
+		assert.EqualError(t, err, "kafka: invalid producer config: kafka: idempotent producing requires AllISRAcks, acks set to LeaderAck")
+
+		notIdempotent := false
+		cfg = validConfig
+		cfg.Idempotent = &notIdempotent
+		cfg.TransactionalID = "txn"
+		_, err = NewProducer(cfg)
+		assert.EqualError(t, err, "kafka: invalid producer config: kafka: transactional producing requires idempotent producing")
+	})
+
 	t.Run("invalid_compression_from_environment", func(t *testing.T) {
 		t.Setenv("KAFKA_PRODUCER_COMPRESSION_CODEC", "huffman,bson")
 		_, err := NewProducer(validConfig)
@@ -222,6 +300,786 @@ func TestNewProducerBasic(t *testing.T) {
 	test(t, false)
 }
 
+func TestProducerProduceSync(t *testing.T) {
+	exp := tracetest.NewInMemoryExporter()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exp))
+	defer tp.Shutdown(context.Background())
+
+	_, brokers := newClusterWithTopics(t, 2, "name_space-topic")
+	producer := newProducer(t, ProducerConfig{
+		CommonConfig: CommonConfig{
+			Brokers:        brokers,
+			Logger:         zap.NewNop(),
+			Namespace:      "name_space",
+			TracerProvider: tp,
+		},
+		ProducerBatchMaxBytes: 1024,
+		RecordPartitioner:     kgo.ManualPartitioner(),
+	})
+
+	metadata, err := producer.ProduceSync(context.Background(),
+		apmqueue.Record{Topic: "topic", Value: []byte("1")},
+		apmqueue.Record{Topic: "topic", Value: []byte("2")},
+	)
+	require.NoError(t, err)
+	require.Len(t, metadata, 2)
+	for i, m := range metadata {
+		assert.Equal(t, apmqueue.Topic("topic"), m.Topic)
+		assert.Equal(t, int32(0), m.Partition)
+		assert.Equal(t, int64(i), m.Offset)
+		assert.False(t, m.Timestamp.IsZero())
+	}
+
+	metadata, err = producer.ProduceSync(context.Background(),
+		apmqueue.Record{Topic: "topic", Value: []byte("3")},
+		apmqueue.Record{Topic: "topic", OrderingKey: []byte("key"), Value: make([]byte, 2048)},
+	)
+	assert.EqualError(t, err, `failed to produce record 1 to topic "topic" with key "key": `+
+		`kafka: record too large: `+kerr.MessageTooLarge.Error())
+	assert.ErrorIs(t, err, ErrRecordTooLarge)
+	assert.ErrorIs(t, err, kerr.MessageTooLarge)
+	require.Len(t, metadata, 2)
+	assert.Equal(t, int64(2), metadata[0].Offset)
+	assert.Equal(t, int64(0), metadata[1].Offset)
+
+	spans := exp.GetSpans()
+	require.Len(t, spans, 2)
+	assert.Contains(t, spans[0].Attributes,
+		attribute.StringSlice("messaging.kafka.compression_codecs", []string{"snappy", "none"}),
+	)
+	assert.Contains(t, spans[0].Attributes, attribute.Bool("messaging.kafka.idempotent", true))
+	assert.Contains(t, spans[0].Attributes, attribute.String("messaging.kafka.acks", "all"))
+	assert.Equal(t, "ProduceSync", spans[0].Name)
+	assert.Equal(t, codes.Unset, spans[0].Status.Code)
+	assert.Equal(t, "ProduceSync", spans[1].Name)
+	assert.Equal(t, codes.Error, spans[1].Status.Code)
+}
+
+func TestProducerProduceFanout(t *testing.T) {
+	client, brokers := newClusterWithTopics(t, 1, "canonical", "projection")
+	producer := newProducer(t, ProducerConfig{
+		CommonConfig: CommonConfig{
+			Brokers: brokers,
+			Logger:  zap.NewNop(),
+		},
+	})
+	ctx := context.Background()
+	assert.EqualError(t, producer.ProduceFanout(ctx, apmqueue.Record{Value: []byte("1")}),
+		"kafka: no topics to fan out the record to",
+	)
+
+	// The copies produced to the existing topics are still produced.
+	err := producer.ProduceFanout(ctx,
+		apmqueue.Record{Topic: "ignored", OrderingKey: []byte("key"), Value: []byte("1")},
+		"canonical", "missing", "projection",
+	)
+	assert.ErrorIs(t, err, ErrTopicNotFound)
+	assert.ErrorContains(t, err, `failed to produce record 1 to topic "missing" with key "key"`)
+	assert.NotContains(t, err.Error(), "canonical")
+
+	client.AddConsumeTopics("canonical", "projection")
+	fetchCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	topics := make(map[string][]byte)
+	for len(topics) < 2 && fetchCtx.Err() == nil {
+		fetches := client.PollFetches(fetchCtx)
+		fetches.EachRecord(func(r *kgo.Record) {
+			assert.Equal(t, []byte("key"), r.Key)
+			topics[r.Topic] = r.Value
+		})
+	}
+	assert.Equal(t, map[string][]byte{"canonical": []byte("1"), "projection": []byte("1")}, topics)
+}
+
+func TestProducerOnDelivery(t *testing.T) {
+	_, brokers := newClusterWithTopics(t, 1, "name_space-topic")
+	type delivery struct {
+		record   apmqueue.Record
+		metadata RecordMetadata
+		err      error
+	}
+	deliveries := make(chan delivery, 10)
+	producer := newProducer(t, ProducerConfig{
+		CommonConfig: CommonConfig{
+			Brokers:   brokers,
+			Logger:    zap.NewNop(),
+			Namespace: "name_space",
+		},
+		ProducerBatchMaxBytes: 1024,
+		OnDelivery: func(r apmqueue.Record, m RecordMetadata, err error) {
+			deliveries <- delivery{record: r, metadata: m, err: err}
+		},
+	})
+
+	records := []apmqueue.Record{
+		{Topic: "topic", Value: []byte("1")},
+		{Topic: "topic", Value: make([]byte, 2048)},
+		{Topic: "topic", Value: []byte("2")},
+	}
+	require.NoError(t, producer.Produce(context.Background(), records...))
+	require.NoError(t, producer.Close())
+	close(deliveries)
+
+	var ok, failed []delivery
+	for d := range deliveries {
+		if d.err != nil {
+			failed = append(failed, d)
+		} else {
+			ok = append(ok, d)
+		}
+	}
+	require.Len(t, ok, 2)
+	require.Len(t, failed, 1)
+	assert.ErrorIs(t, failed[0].err, kerr.MessageTooLarge)
+	assert.ErrorIs(t, failed[0].err, ErrRecordTooLarge)
+	assert.ErrorContains(t, failed[0].err, `failed to produce record 1 to topic "topic"`)
+	assert.Equal(t, records[1], failed[0].record)
+	sort.Slice(ok, func(i, j int) bool { return ok[i].metadata.Offset < ok[j].metadata.Offset })
+	for i, d := range ok {
+		assert.Equal(t, apmqueue.Topic("topic"), d.metadata.Topic)
+		assert.Equal(t, int32(0), d.metadata.Partition)
+		assert.Equal(t, int64(i), d.metadata.Offset)
+		assert.False(t, d.metadata.Timestamp.IsZero())
+	}
+}
+
+func TestProducerRecordHeaders(t *testing.T) {
+	client, brokers := newClusterWithTopics(t, 1, "name_space-topic")
+	producer := newProducer(t, ProducerConfig{
+		CommonConfig: CommonConfig{
+			Brokers:   brokers,
+			Logger:    zap.NewNop(),
+			Namespace: "name_space",
+		},
+		Sync: true,
+	})
+	ctx := queuecontext.WithMetadata(context.Background(), map[string]string{"a": "b"})
+	require.NoError(t, producer.Produce(ctx, apmqueue.Record{
+		Topic: "topic",
+		Value: []byte("1"),
+		Headers: []apmqueue.Header{
+			{Key: "tenant", Value: []byte("x")},
+			{Key: "binary", Value: []byte{0, 1}},
+		},
+	}))
+
+	client.AddConsumeTopics("name_space-topic")
+	fetches := client.PollRecords(ctx, 1)
+	require.NoError(t, fetches.Err())
+	records := fetches.Records()
+	require.Len(t, records, 1)
+	assert.Equal(t, []kgo.RecordHeader{
+		{Key: "a", Value: []byte("b")},
+		{Key: "tenant", Value: []byte("x")},
+		{Key: "binary", Value: []byte{0, 1}},
+	}, records[0].Headers)
+}
+
+func TestProducerPartitioner(t *testing.T) {
+	_, brokers := newClusterWithTopics(t, 4, "name_space-topic")
+	var numPartitions atomic.Int32
+	producer := newProducer(t, ProducerConfig{
+		CommonConfig: CommonConfig{
+			Brokers:   brokers,
+			Logger:    zap.NewNop(),
+			Namespace: "name_space",
+		},
+		Partitioner: func(r apmqueue.Record, n int32) int32 {
+			assert.Equal(t, apmqueue.Topic("topic"), r.Topic)
+			numPartitions.Store(n)
+			for _, h := range r.Headers {
+				if h.Key == "tenant" {
+					p, _ := strconv.Atoi(string(h.Value))
+					return int32(p)
+				}
+			}
+			return 0
+		},
+	})
+	metadata, err := producer.ProduceSync(context.Background(),
+		apmqueue.Record{Topic: "topic", OrderingKey: []byte("a"), Value: []byte("1"),
+			Headers: []apmqueue.Header{{Key: "tenant", Value: []byte("2")}},
+		},
+		apmqueue.Record{Topic: "topic", OrderingKey: []byte("b"), Value: []byte("2"),
+			Headers: []apmqueue.Header{{Key: "tenant", Value: []byte("2")}},
+		},
+		// Out of range partitions are kept in range.
+		apmqueue.Record{Topic: "topic", Value: []byte("3"),
+			Headers: []apmqueue.Header{{Key: "tenant", Value: []byte("5")}},
+		},
+		apmqueue.Record{Topic: "topic", Value: []byte("4")},
+	)
+	require.NoError(t, err)
+	assert.Equal(t, int32(4), numPartitions.Load())
+	partitions := make([]int32, len(metadata))
+	for i, m := range metadata {
+		partitions[i] = m.Partition
+	}
+	assert.Equal(t, []int32{2, 2, 1, 0}, partitions)
+
+	_, err = NewProducer(ProducerConfig{
+		CommonConfig: CommonConfig{
+			Brokers: brokers,
+			Logger:  zap.NewNop(),
+		},
+		Partitioner:       func(apmqueue.Record, int32) int32 { return 0 },
+		RecordPartitioner: kgo.ManualPartitioner(),
+	})
+	assert.ErrorContains(t, err, "only one of Partitioner or RecordPartitioner can be set")
+}
+
+func TestProducerHotKeys(t *testing.T) {
+	_, brokers := newClusterWithTopics(t, 8, "name_space-topic", "name_space-other")
+	producer := newProducer(t, ProducerConfig{
+		CommonConfig: CommonConfig{
+			Brokers:   brokers,
+			Logger:    zap.NewNop(),
+			Namespace: "name_space",
+		},
+		HotKeys: []HotKey{{Topic: "topic", Key: []byte("hot"), Partitions: 3}},
+	})
+	var rs []apmqueue.Record
+	for i := 0; i < 6; i++ {
+		rs = append(rs,
+			apmqueue.Record{Topic: "topic", OrderingKey: []byte("hot"), Value: []byte(strconv.Itoa(i))},
+			apmqueue.Record{Topic: "topic", OrderingKey: []byte("cold"), Value: []byte(strconv.Itoa(i))},
+			// The key is only hot in "topic".
+			apmqueue.Record{Topic: "other", OrderingKey: []byte("hot"), Value: []byte(strconv.Itoa(i))},
+		)
+	}
+	metadata, err := producer.ProduceSync(context.Background(), rs...)
+	require.NoError(t, err)
+	partitions := make(map[string][]int32)
+	for i, m := range metadata {
+		k := string(rs[i].Topic) + "/" + string(rs[i].OrderingKey)
+		partitions[k] = append(partitions[k], m.Partition)
+	}
+	assertSamePartition := func(partitions []int32) {
+		t.Helper()
+		for _, p := range partitions {
+			assert.Equal(t, partitions[0], p)
+		}
+	}
+	assertSamePartition(partitions["topic/cold"])
+	assertSamePartition(partitions["other/hot"])
+
+	// Hot keys are spread round-robin over consecutive partitions, starting
+	// at the partition the key hashes to.
+	hot := partitions["topic/hot"]
+	require.Len(t, hot, 6)
+	assert.Equal(t, partitions["other/hot"][0], hot[0])
+	for i, p := range hot {
+		assert.Equal(t, (hot[0]+int32(i%3))%8, p)
+	}
+
+	_, err = NewProducer(ProducerConfig{
+		CommonConfig: CommonConfig{
+			Brokers: brokers,
+			Logger:  zap.NewNop(),
+		},
+		HotKeys:     []HotKey{{Key: []byte("hot"), Partitions: 2}},
+		Partitioner: func(apmqueue.Record, int32) int32 { return 0 },
+	})
+	assert.ErrorContains(t, err, "kafka: hot keys cannot be set with Partitioner or RecordPartitioner")
+	_, err = NewProducer(ProducerConfig{
+		CommonConfig: CommonConfig{
+			Brokers: brokers,
+			Logger:  zap.NewNop(),
+		},
+		HotKeys: []HotKey{{Partitions: 2}, {Key: []byte("hot")}},
+	})
+	assert.ErrorContains(t, err, "kafka: hot key cannot be empty")
+	assert.ErrorContains(t, err, `kafka: hot key "hot" partitions must be at least 1: 0`)
+}
+
+func TestProducerKeyExtractor(t *testing.T) {
+	client, brokers := newClusterWithTopics(t, 4, "name_space-topic")
+	producer := newProducer(t, ProducerConfig{
+		CommonConfig: CommonConfig{
+			Brokers:   brokers,
+			Logger:    zap.NewNop(),
+			Namespace: "name_space",
+		},
+		KeyExtractor: func(r apmqueue.Record) []byte {
+			tenant, _, _ := bytes.Cut(r.Value, []byte("/"))
+			return tenant
+		},
+	})
+	metadata, err := producer.ProduceSync(context.Background(),
+		apmqueue.Record{Topic: "topic", Value: []byte("a/1")},
+		// The extracted key takes precedence over the OrderingKey.
+		apmqueue.Record{Topic: "topic", OrderingKey: []byte("b"), Value: []byte("a/2")},
+		apmqueue.Record{Topic: "topic", Value: []byte("a/3")},
+	)
+	require.NoError(t, err)
+	require.Len(t, metadata, 3)
+	for _, m := range metadata[1:] {
+		assert.Equal(t, metadata[0].Partition, m.Partition)
+	}
+
+	ctx := context.Background()
+	client.AddConsumeTopics("name_space-topic")
+	var records []*kgo.Record
+	for len(records) < 3 {
+		fetches := client.PollRecords(ctx, 3)
+		require.NoError(t, fetches.Err())
+		records = append(records, fetches.Records()...)
+	}
+	for i, r := range records {
+		assert.Equal(t, []byte("a"), r.Key)
+		assert.Equal(t, fmt.Sprintf("a/%d", i+1), string(r.Value))
+	}
+}
+
+func TestProducerTransform(t *testing.T) {
+	client, brokers := newClusterWithTopics(t, 1, "name_space-topic")
+	errInvalid := errors.New("invalid record")
+	var mu sync.Mutex
+	var delivered []error
+	producer := newProducer(t, ProducerConfig{
+		CommonConfig: CommonConfig{
+			Brokers:   brokers,
+			Logger:    zap.NewNop(),
+			Namespace: "name_space",
+		},
+		Transform: func(_ context.Context, r *apmqueue.Record) error {
+			if len(r.Value) == 0 {
+				return errInvalid
+			}
+			r.Value = bytes.ToUpper(r.Value)
+			r.Headers = append(r.Headers, apmqueue.Header{Key: "transformed", Value: []byte("true")})
+			return nil
+		},
+		OnDelivery: func(_ apmqueue.Record, _ RecordMetadata, err error) {
+			mu.Lock()
+			defer mu.Unlock()
+			delivered = append(delivered, err)
+		},
+	})
+	ctx := context.Background()
+	records := []apmqueue.Record{
+		{Topic: "topic", Value: []byte("a")},
+		{Topic: "topic"},
+		{Topic: "topic", Value: []byte("b")},
+	}
+	// Only the record which fails to be transformed isn't produced.
+	_, err := producer.ProduceSync(ctx, records...)
+	assert.ErrorIs(t, err, errInvalid)
+	assert.ErrorContains(t, err, "failed to transform record 1")
+	// The records passed to Produce are not modified.
+	assert.Equal(t, []byte("a"), records[0].Value)
+	assert.Empty(t, records[0].Headers)
+	mu.Lock()
+	require.Len(t, delivered, 3)
+	var failed int
+	for _, err := range delivered {
+		if err != nil {
+			assert.ErrorIs(t, err, errInvalid)
+			failed++
+		}
+	}
+	assert.Equal(t, 1, failed)
+	mu.Unlock()
+
+	client.AddConsumeTopics("name_space-topic")
+	var values []string
+	for len(values) < 2 {
+		fetches := client.PollRecords(ctx, 2)
+		require.NoError(t, fetches.Err())
+		for _, r := range fetches.Records() {
+			values = append(values, string(r.Value))
+			assert.Equal(t, []kgo.RecordHeader{{Key: "transformed", Value: []byte("true")}}, r.Headers)
+		}
+	}
+	assert.Equal(t, []string{"A", "B"}, values)
+}
+
+func TestProducerRecordKey(t *testing.T) {
+	client, brokers := newClusterWithTopics(t, 8, "name_space-topic")
+	producer := newProducer(t, ProducerConfig{
+		CommonConfig: CommonConfig{
+			Brokers:   brokers,
+			Logger:    zap.NewNop(),
+			Namespace: "name_space",
+		},
+	})
+	var rs []apmqueue.Record
+	for i := 0; i < 8; i++ {
+		rs = append(rs, apmqueue.Record{
+			Topic:       "topic",
+			OrderingKey: []byte("tenant"),
+			Key:         []byte(strconv.Itoa(i)),
+			Value:       []byte(strconv.Itoa(i)),
+		})
+	}
+	// Records with only a Key are partitioned by it.
+	rs = append(rs, apmqueue.Record{Topic: "topic", Key: []byte("tenant"), Value: []byte("key")})
+	metadata, err := producer.ProduceSync(context.Background(), rs...)
+	require.NoError(t, err)
+	require.Len(t, metadata, len(rs))
+	for _, m := range metadata[1:] {
+		assert.Equal(t, metadata[0].Partition, m.Partition)
+	}
+
+	client.AddConsumeTopics("name_space-topic")
+	var records []*kgo.Record
+	for len(records) < len(rs) {
+		fetches := client.PollRecords(context.Background(), len(rs))
+		require.NoError(t, fetches.Err())
+		records = append(records, fetches.Records()...)
+	}
+	for i, r := range records[:8] {
+		assert.Equal(t, strconv.Itoa(i), string(r.Key))
+	}
+	assert.Equal(t, "tenant", string(records[8].Key))
+}
+
+func TestProducerRecordTimeout(t *testing.T) {
+	cluster, err := kfake.NewCluster(kfake.SeedTopics(1, "topic"))
+	require.NoError(t, err)
+	t.Cleanup(cluster.Close)
+	// The broker never accepts the produced records.
+	cluster.ControlKey(kmsg.Produce.Int16(), func(r kmsg.Request) (kmsg.Response, error, bool) {
+		cluster.KeepControl()
+		req := r.(*kmsg.ProduceRequest)
+		resp := req.ResponseKind().(*kmsg.ProduceResponse)
+		for _, t := range req.Topics {
+			respTopic := kmsg.NewProduceResponseTopic()
+			respTopic.Topic = t.Topic
+			for _, p := range t.Partitions {
+				respPartition := kmsg.NewProduceResponseTopicPartition()
+				respPartition.Partition = p.Partition
+				respPartition.ErrorCode = kerr.NotEnoughReplicas.Code
+				respTopic.Partitions = append(respTopic.Partitions, respPartition)
+			}
+			resp.Topics = append(resp.Topics, respTopic)
+		}
+		return resp, nil, true
+	})
+	var delivered atomic.Pointer[error]
+	producer := newProducer(t, ProducerConfig{
+		CommonConfig: CommonConfig{
+			Brokers: cluster.ListenAddrs(),
+			Logger:  zap.NewNop(),
+			// Retry the failed produce requests sooner.
+			MetadataMaxAge: 100 * time.Millisecond,
+		},
+		RecordTimeout: time.Second,
+		OnDelivery: func(_ apmqueue.Record, _ RecordMetadata, err error) {
+			delivered.Store(&err)
+		},
+	})
+	start := time.Now()
+	_, err = producer.ProduceSync(context.Background(),
+		apmqueue.Record{Topic: "topic", Value: []byte("stale")},
+	)
+	assert.ErrorIs(t, err, ErrRecordTimeout)
+	assert.Less(t, time.Since(start), 3*time.Second)
+	require.NotNil(t, delivered.Load())
+	assert.ErrorIs(t, *delivered.Load(), ErrRecordTimeout)
+}
+
+func TestProducerMaxRecordBytes(t *testing.T) {
+	t.Run("configured", func(t *testing.T) {
+		_, addrs := newClusterWithTopics(t, 1, "topic")
+		var mu sync.Mutex
+		delivered := make(map[string]error)
+		producer := newProducer(t, ProducerConfig{
+			CommonConfig: CommonConfig{
+				Brokers: addrs,
+				Logger:  zap.NewNop(),
+			},
+			MaxRecordBytes: 10,
+			OnDelivery: func(r apmqueue.Record, _ RecordMetadata, err error) {
+				mu.Lock()
+				defer mu.Unlock()
+				delivered[string(r.Value)] = err
+			},
+		})
+		ctx := queuecontext.WithMetadata(context.Background(), map[string]string{"k": "v"})
+		// The context metadata headers count towards the record size.
+		err := producer.Produce(ctx,
+			apmqueue.Record{Topic: "topic", Value: []byte("12345678")},
+			apmqueue.Record{Topic: "topic", Value: []byte("123456789")},
+		)
+		assert.ErrorIs(t, err, ErrRecordTooLarge)
+		assert.EqualError(t, err, `failed to produce record 1 to topic "topic" with key "": `+
+			`kafka: record too large: record of 11 bytes exceeds the maximum of 10 bytes`)
+		require.NoError(t, producer.Flush(context.Background()))
+
+		mu.Lock()
+		defer mu.Unlock()
+		require.Len(t, delivered, 2)
+		assert.NoError(t, delivered["12345678"])
+		assert.ErrorIs(t, delivered["123456789"], ErrRecordTooLarge)
+	})
+	t.Run("discovered", func(t *testing.T) {
+		client, addrs := newClusterWithTopics(t, 1, "topic")
+		maxBytes := "100"
+		_, err := kadm.NewClient(client).AlterBrokerConfigs(context.Background(), []kadm.AlterConfig{
+			{Name: "message.max.bytes", Value: &maxBytes},
+		})
+		require.NoError(t, err)
+		producer := newProducer(t, ProducerConfig{
+			CommonConfig: CommonConfig{
+				Brokers: addrs,
+				Logger:  zap.NewNop(),
+			},
+			MaxRecordBytes: -1,
+		})
+		<-producer.discovered
+		assert.Equal(t, int64(100), producer.maxRecordBytes.Load())
+		err = producer.Produce(context.Background(),
+			apmqueue.Record{Topic: "topic", Value: make([]byte, 101)},
+		)
+		assert.ErrorIs(t, err, ErrRecordTooLarge)
+	})
+	t.Run("disabled", func(t *testing.T) {
+		_, addrs := newClusterWithTopics(t, 1, "topic")
+		producer := newProducer(t, ProducerConfig{
+			CommonConfig: CommonConfig{
+				Brokers: addrs,
+				Logger:  zap.NewNop(),
+			},
+		})
+		assert.Nil(t, producer.discovered)
+		assert.NoError(t, producer.Produce(context.Background(),
+			apmqueue.Record{Topic: "topic", Value: make([]byte, 1024)},
+		))
+	})
+}
+
+func TestProducerProduceWithContext(t *testing.T) {
+	cluster, err := kfake.NewCluster(kfake.SeedTopics(1, "topic"))
+	require.NoError(t, err)
+	t.Cleanup(cluster.Close)
+	// The broker never accepts the produced records.
+	cluster.ControlKey(kmsg.Produce.Int16(), func(r kmsg.Request) (kmsg.Response, error, bool) {
+		cluster.KeepControl()
+		req := r.(*kmsg.ProduceRequest)
+		resp := req.ResponseKind().(*kmsg.ProduceResponse)
+		for _, t := range req.Topics {
+			respTopic := kmsg.NewProduceResponseTopic()
+			respTopic.Topic = t.Topic
+			for _, p := range t.Partitions {
+				respPartition := kmsg.NewProduceResponseTopicPartition()
+				respPartition.Partition = p.Partition
+				respPartition.ErrorCode = kerr.NotEnoughReplicas.Code
+				respTopic.Partitions = append(respTopic.Partitions, respPartition)
+			}
+			resp.Topics = append(resp.Topics, respTopic)
+		}
+		return resp, nil, true
+	})
+	delivered := make(chan error, 1)
+	producer := newProducer(t, ProducerConfig{
+		CommonConfig: CommonConfig{
+			Brokers: cluster.ListenAddrs(),
+			Logger:  zap.NewNop(),
+			// Retry the failed produce requests sooner.
+			MetadataMaxAge: 100 * time.Millisecond,
+		},
+		Sync: false,
+		OnDelivery: func(_ apmqueue.Record, _ RecordMetadata, err error) {
+			delivered <- err
+		},
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	require.NoError(t, producer.ProduceWithContext(ctx,
+		apmqueue.Record{Topic: "topic", Value: []byte("canceled")},
+	))
+	select {
+	case err := <-delivered:
+		t.Fatalf("record delivered before the context was canceled: %v", err)
+	case <-time.After(200 * time.Millisecond):
+	}
+	cancel()
+	select {
+	case err := <-delivered:
+		assert.ErrorIs(t, err, context.Canceled)
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the record to fail")
+	}
+}
+
+func TestProducerWaitForDeliveryWithContext(t *testing.T) {
+	cluster, err := kfake.NewCluster(kfake.SeedTopics(1, "topic"))
+	require.NoError(t, err)
+	t.Cleanup(cluster.Close)
+	// The broker doesn't accept the produced records until accept is set.
+	var accept atomic.Bool
+	cluster.ControlKey(kmsg.Produce.Int16(), func(r kmsg.Request) (kmsg.Response, error, bool) {
+		cluster.KeepControl()
+		if accept.Load() {
+			return nil, nil, false
+		}
+		req := r.(*kmsg.ProduceRequest)
+		resp := req.ResponseKind().(*kmsg.ProduceResponse)
+		for _, t := range req.Topics {
+			respTopic := kmsg.NewProduceResponseTopic()
+			respTopic.Topic = t.Topic
+			for _, p := range t.Partitions {
+				respPartition := kmsg.NewProduceResponseTopicPartition()
+				respPartition.Partition = p.Partition
+				respPartition.ErrorCode = kerr.NotEnoughReplicas.Code
+				respTopic.Partitions = append(respTopic.Partitions, respPartition)
+			}
+			resp.Topics = append(resp.Topics, respTopic)
+		}
+		return resp, nil, true
+	})
+	delivered := make(chan error, 2)
+	producer := newProducer(t, ProducerConfig{
+		CommonConfig: CommonConfig{
+			Brokers: cluster.ListenAddrs(),
+			Logger:  zap.NewNop(),
+			// Retry the failed produce requests sooner.
+			MetadataMaxAge: 100 * time.Millisecond,
+		},
+		WaitForDeliveryWithContext: true,
+		OnDelivery: func(_ apmqueue.Record, _ RecordMetadata, err error) {
+			delivered <- err
+		},
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	err = producer.ProduceWithContext(ctx, apmqueue.Record{Topic: "topic", Value: []byte("late")})
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	select {
+	case err := <-delivered:
+		t.Fatalf("record delivered before the broker accepted it: %v", err)
+	default:
+	}
+
+	// The record isn't failed by the deadline, and is eventually delivered.
+	accept.Store(true)
+	select {
+	case err := <-delivered:
+		assert.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the record to be delivered")
+	}
+
+	// ProduceWithContext waits for the records to be acknowledged.
+	ctx, cancel = context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	require.NoError(t, producer.ProduceWithContext(ctx,
+		apmqueue.Record{Topic: "topic", Value: []byte("acknowledged")},
+	))
+	select {
+	case err := <-delivered:
+		assert.NoError(t, err)
+	default:
+		t.Fatal("record not delivered when ProduceWithContext returned")
+	}
+}
+
+func TestProducerRecordTimestamp(t *testing.T) {
+	client, brokers := newClusterWithTopics(t, 1, "name_space-topic")
+	producer := newProducer(t, ProducerConfig{
+		CommonConfig: CommonConfig{
+			Brokers:   brokers,
+			Logger:    zap.NewNop(),
+			Namespace: "name_space",
+		},
+	})
+	ts := time.Now().Add(-time.Hour).Truncate(time.Millisecond)
+	metadata, err := producer.ProduceSync(context.Background(),
+		apmqueue.Record{Topic: "topic", Value: []byte("1"), Timestamp: ts},
+	)
+	require.NoError(t, err)
+	require.Len(t, metadata, 1)
+
+	client.AddConsumeTopics("name_space-topic")
+	fetches := client.PollRecords(context.Background(), 1)
+	require.NoError(t, fetches.Err())
+	records := fetches.Records()
+	require.Len(t, records, 1)
+	assert.True(t, ts.Equal(records[0].Timestamp), "expected %s, got %s", ts, records[0].Timestamp)
+}
+
+func TestProducerKafkaClient(t *testing.T) {
+	_, brokers := newClusterWithTopics(t, 1, "topic")
+	producer := newProducer(t, ProducerConfig{
+		CommonConfig: CommonConfig{Brokers: brokers, Logger: zap.NewNop()},
+	})
+	require.NotNil(t, producer.KafkaClient())
+	assert.NoError(t, producer.KafkaClient().Ping(context.Background()))
+}
+
+func TestProducerAllowAutoTopicCreation(t *testing.T) {
+	cluster, err := kfake.NewCluster(kfake.AllowAutoTopicCreation())
+	require.NoError(t, err)
+	t.Cleanup(cluster.Close)
+	newAutoProducer := func(t *testing.T, allow bool) *Producer {
+		return newProducer(t, ProducerConfig{
+			CommonConfig: CommonConfig{
+				Brokers: cluster.ListenAddrs(),
+				Logger:  zap.NewNop(),
+			},
+			Sync:                   true,
+			AllowAutoTopicCreation: allow,
+		})
+	}
+	t.Run("disallowed", func(t *testing.T) {
+		producer := newAutoProducer(t, false)
+		err := producer.Produce(context.Background(),
+			apmqueue.Record{Topic: "missing", Value: []byte("1")},
+		)
+		assert.ErrorIs(t, err, ErrTopicNotFound)
+	})
+	t.Run("allowed", func(t *testing.T) {
+		producer := newAutoProducer(t, true)
+		require.NoError(t, producer.Produce(context.Background(),
+			apmqueue.Record{Topic: "created", Value: []byte("1")},
+		))
+	})
+}
+
+func TestProducerFlush(t *testing.T) {
+	client, brokers := newClusterWithTopics(t, 1, "name_space-topic")
+	producer := newProducer(t, ProducerConfig{
+		CommonConfig: CommonConfig{
+			Brokers:   brokers,
+			Logger:    zap.NewNop(),
+			Namespace: "name_space",
+		},
+		ProducerBatchMaxBytes: 1024,
+		ManualFlushing:        true,
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	require.NoError(t, producer.Produce(ctx,
+		apmqueue.Record{Topic: "topic", Value: []byte("1")},
+		apmqueue.Record{Topic: "topic", Value: []byte("2")},
+	))
+	require.NoError(t, producer.Flush(ctx))
+	client.AddConsumeTopics("name_space-topic")
+	fetches := client.PollRecords(ctx, 2)
+	require.NoError(t, fetches.Err())
+	assert.Equal(t, 2, fetches.NumRecords())
+
+	require.NoError(t, producer.Produce(ctx,
+		apmqueue.Record{Topic: "topic", OrderingKey: []byte("key"), Value: make([]byte, 2048)},
+		apmqueue.Record{Topic: "topic", Value: []byte("3")},
+	))
+	err := producer.Flush(ctx)
+	assert.EqualError(t, err, `failed to produce record 0 to topic "topic" with key "key": `+
+		`kafka: record too large: `+kerr.MessageTooLarge.Error())
+	assert.ErrorIs(t, err, ErrRecordTooLarge)
+	assert.ErrorIs(t, err, kerr.MessageTooLarge)
+
+	// Errors are only returned by the Flush calls in progress.
+	assert.NoError(t, producer.Flush(ctx))
+
+	canceled, cancel := context.WithCancel(ctx)
+	cancel()
+	require.NoError(t, producer.Produce(ctx, apmqueue.Record{Topic: "topic", Value: []byte("4")}))
+	assert.ErrorIs(t, producer.Flush(canceled), context.Canceled)
+}
+
 func testVerboseLogger(t testing.TB) *zap.Logger {
 	t.Helper()
 	if testing.Verbose() {
@@ -301,6 +1159,74 @@ func TestProducerGracefulShutdown(t *testing.T) {
 	})
 }
 
+func TestProducerCloseWithContext(t *testing.T) {
+	t.Run("flushed", func(t *testing.T) {
+		brokers := newClusterAddrWithTopics(t, 1, "topic")
+		producer := newProducer(t, ProducerConfig{
+			CommonConfig: CommonConfig{Brokers: brokers, Logger: zap.NewNop()},
+		})
+		require.NoError(t, producer.Produce(context.Background(),
+			apmqueue.Record{Topic: "topic", Value: []byte("a")},
+			apmqueue.Record{Topic: "topic", Value: []byte("b")},
+		))
+		flushed, dropped, err := producer.CloseWithContext(context.Background())
+		require.NoError(t, err)
+		assert.Equal(t, 2, flushed)
+		assert.Zero(t, dropped)
+	})
+	t.Run("dropped", func(t *testing.T) {
+		cluster, err := kfake.NewCluster(kfake.SeedTopics(1, "topic"))
+		require.NoError(t, err)
+		t.Cleanup(cluster.Close)
+		// The broker rejects all the produced records, so they're retried
+		// until the producer is closed.
+		cluster.ControlKey(kmsg.Produce.Int16(), func(r kmsg.Request) (kmsg.Response, error, bool) {
+			cluster.KeepControl()
+			req := r.(*kmsg.ProduceRequest)
+			resp := req.ResponseKind().(*kmsg.ProduceResponse)
+			for _, t := range req.Topics {
+				respTopic := kmsg.NewProduceResponseTopic()
+				respTopic.Topic = t.Topic
+				for _, p := range t.Partitions {
+					respPartition := kmsg.NewProduceResponseTopicPartition()
+					respPartition.Partition = p.Partition
+					respPartition.ErrorCode = kerr.NotEnoughReplicas.Code
+					respTopic.Partitions = append(respTopic.Partitions, respPartition)
+				}
+				resp.Topics = append(resp.Topics, respTopic)
+			}
+			return resp, nil, true
+		})
+		core, observed := observer.New(zap.WarnLevel)
+		delivered := make(chan error, 2)
+		producer := newProducer(t, ProducerConfig{
+			CommonConfig: CommonConfig{
+				Brokers: cluster.ListenAddrs(),
+				Logger:  zap.New(core),
+			},
+			OnDelivery: func(_ apmqueue.Record, _ RecordMetadata, err error) {
+				delivered <- err
+			},
+		})
+		require.NoError(t, producer.Produce(context.Background(),
+			apmqueue.Record{Topic: "topic", Value: []byte("a")},
+			apmqueue.Record{Topic: "topic", Value: []byte("b")},
+		))
+
+		ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+		defer cancel()
+		flushed, dropped, err := producer.CloseWithContext(ctx)
+		assert.ErrorIs(t, err, context.DeadlineExceeded)
+		assert.Zero(t, flushed)
+		assert.Equal(t, 2, dropped)
+		assert.Equal(t, 1, observed.FilterMessage("dropped buffered records on close").Len())
+		// The dropped records fail when the producer is closed.
+		for i := 0; i < 2; i++ {
+			assert.ErrorIs(t, <-delivered, kgo.ErrClientClosed)
+		}
+	})
+}
+
 func TestProducerConcurrentClose(t *testing.T) {
 	brokers := newClusterAddrWithTopics(t, 1, "topic")
 	producer := newProducer(t, ProducerConfig{
@@ -0,0 +1,94 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package kafka
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	apmqueue "github.com/elastic/apm-queue/v2"
+)
+
+// ErrMarshalValue is returned by ProduceJSON when the value can't be
+// marshaled, in which case no record is produced.
+var ErrMarshalValue = errors.New("kafka: failed to marshal record value")
+
+// ProduceJSON marshals value to JSON and produces it to topic with the
+// ordering key, like Producer.Produce. Errors marshaling the value wrap
+// ErrMarshalValue and the encoding/json error, while any other error is
+// returned by Produce.
+func ProduceJSON[T any](ctx context.Context, p *Producer, topic apmqueue.Topic, key []byte, value T) error {
+	b, err := json.Marshal(value)
+	if err != nil {
+		return fmt.Errorf("%w for topic %q: %w", ErrMarshalValue, topic, err)
+	}
+	return p.Produce(ctx, apmqueue.Record{Topic: topic, OrderingKey: key, Value: b})
+}
+
+// Serializer serializes the values produced with Producer.ProduceValues into
+// record values, e.g. encoding them with a schema registry's wire format,
+// which frames the encoded value with a magic byte and the schema ID.
+type Serializer interface {
+	// Serialize serializes v, where subject is the schema registry subject
+	// of the record value: the namespaced topic name followed by "-value",
+	// as in the schema registry's default TopicNameStrategy.
+	Serialize(ctx context.Context, subject string, v any) ([]byte, error)
+}
+
+// Deserializer deserializes the values of consumed records before they're
+// passed to a ValueProcessor.
+type Deserializer interface {
+	// Deserialize deserializes the record value data.
+	Deserialize(ctx context.Context, data []byte) (any, error)
+}
+
+// ValueProcessor processes the consumed records along with their values
+// deserialized by ConsumerConfig.Deserializer.
+type ValueProcessor interface {
+	ProcessValue(ctx context.Context, r apmqueue.Record, v any) error
+}
+
+// ValueProcessorFunc is a function type that implements ValueProcessor.
+type ValueProcessorFunc func(ctx context.Context, r apmqueue.Record, v any) error
+
+// ProcessValue calls f(ctx, r, v).
+func (f ValueProcessorFunc) ProcessValue(ctx context.Context, r apmqueue.Record, v any) error {
+	return f(ctx, r, v)
+}
+
+// valueSubject returns the schema registry subject of the values of the
+// namespaced topic.
+func valueSubject(topic string) string {
+	return topic + "-value"
+}
+
+// deserializingProcessor adapts a ValueProcessor to an apmqueue.Processor.
+type deserializingProcessor struct {
+	deserializer Deserializer
+	processor    ValueProcessor
+}
+
+func (p deserializingProcessor) Process(ctx context.Context, r apmqueue.Record) error {
+	v, err := p.deserializer.Deserialize(ctx, r.Value)
+	if err != nil {
+		return fmt.Errorf("failed to deserialize record: %w", err)
+	}
+	return p.processor.ProcessValue(ctx, r, v)
+}
@@ -0,0 +1,183 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package kafka
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/twmb/franz-go/pkg/kgo"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+
+	apmqueue "github.com/elastic/apm-queue/v2"
+)
+
+// framingSerializer frames the string values with a magic byte and a schema
+// ID, like the schema registry wire format, assigning an ID to each subject.
+type framingSerializer struct {
+	mu       sync.Mutex
+	subjects []string
+}
+
+func (s *framingSerializer) Serialize(_ context.Context, subject string, v any) ([]byte, error) {
+	str, ok := v.(string)
+	if !ok {
+		return nil, fmt.Errorf("unsupported value type %T", v)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	id := len(s.subjects)
+	for i, existing := range s.subjects {
+		if existing == subject {
+			id = i
+		}
+	}
+	if id == len(s.subjects) {
+		s.subjects = append(s.subjects, subject)
+	}
+	b := []byte{0}
+	b = binary.BigEndian.AppendUint32(b, uint32(id))
+	return append(b, str...), nil
+}
+
+func (s *framingSerializer) Deserialize(_ context.Context, data []byte) (any, error) {
+	if len(data) < 5 || data[0] != 0 {
+		return nil, errors.New("unknown magic byte")
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	id := binary.BigEndian.Uint32(data[1:5])
+	if int(id) >= len(s.subjects) {
+		return nil, fmt.Errorf("unknown schema ID %d", id)
+	}
+	return string(data[5:]), nil
+}
+
+func TestSerializer(t *testing.T) {
+	topic := "name_space-topic"
+	client, addrs := newClusterWithTopics(t, 1, topic)
+	commonConfig := CommonConfig{
+		Brokers:   addrs,
+		Logger:    zap.NewNop(),
+		Namespace: "name_space",
+	}
+	serializer := &framingSerializer{}
+	producer := newProducer(t, ProducerConfig{
+		CommonConfig: commonConfig,
+		Sync:         true,
+		Serializer:   serializer,
+	})
+	require.NoError(t, producer.ProduceValues(context.Background(),
+		ValueRecord{Topic: "topic", Value: "a"},
+		ValueRecord{Topic: "topic", Value: "b"},
+	))
+	assert.Equal(t, []string{"name_space-topic-value"}, serializer.subjects)
+
+	// Records which fail to be serialized fail all the records.
+	err := producer.ProduceValues(context.Background(),
+		ValueRecord{Topic: "topic", Value: "c"},
+		ValueRecord{Topic: "topic", Value: 1},
+	)
+	assert.EqualError(t, err, `failed to serialize record 1 for topic "topic": unsupported value type int`)
+	// A record which can't be deserialized.
+	produceRecord(context.Background(), t, client, &kgo.Record{Topic: topic, Value: []byte("x")})
+
+	core, logs := observer.New(zapcore.ErrorLevel)
+	consumerConfig := commonConfig
+	consumerConfig.Logger = zap.New(core)
+	var mu sync.Mutex
+	var processed []any
+	consumer := newConsumer(t, ConsumerConfig{
+		CommonConfig: consumerConfig,
+		Topics:       []apmqueue.Topic{"topic"},
+		GroupID:      "groupid",
+		Deserializer: serializer,
+		ValueProcessor: ValueProcessorFunc(func(_ context.Context, r apmqueue.Record, v any) error {
+			mu.Lock()
+			defer mu.Unlock()
+			assert.Equal(t, apmqueue.Topic("topic"), r.Topic)
+			processed = append(processed, v)
+			return nil
+		}),
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go consumer.Run(ctx)
+	require.Eventually(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(processed) == 2 &&
+			logs.FilterMessage("data loss: unable to process event").Len() == 1
+	}, 5*time.Second, 10*time.Millisecond)
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Equal(t, []any{"a", "b"}, processed)
+	failed := logs.FilterMessage("data loss: unable to process event").AllUntimed()
+	assert.Equal(t, "failed to deserialize record: unknown magic byte", failed[0].ContextMap()["error"])
+}
+
+func TestProducerProduceValuesNoSerializer(t *testing.T) {
+	_, addrs := newClusterWithTopics(t, 1, "topic")
+	producer := newProducer(t, ProducerConfig{
+		CommonConfig: CommonConfig{Brokers: addrs, Logger: zap.NewNop()},
+	})
+	err := producer.ProduceValues(context.Background(), ValueRecord{Topic: "topic", Value: "a"})
+	assert.EqualError(t, err, "kafka: producer serializer not set")
+}
+
+func TestProduceJSON(t *testing.T) {
+	client, addrs := newClusterWithTopics(t, 1, "topic")
+	producer := newProducer(t, ProducerConfig{
+		CommonConfig: CommonConfig{Brokers: addrs, Logger: zap.NewNop()},
+		Sync:         true,
+	})
+	type event struct {
+		Name  string `json:"name"`
+		Count int    `json:"count"`
+	}
+	ctx := context.Background()
+	require.NoError(t, ProduceJSON(ctx, producer, "topic", []byte("key"), event{Name: "a", Count: 1}))
+
+	err := ProduceJSON(ctx, producer, "topic", nil, make(chan int))
+	assert.ErrorIs(t, err, ErrMarshalValue)
+	var unsupported *json.UnsupportedTypeError
+	assert.ErrorAs(t, err, &unsupported)
+	assert.EqualError(t, err,
+		`kafka: failed to marshal record value for topic "topic": json: unsupported type: chan int`,
+	)
+
+	client.AddConsumeTopics("topic")
+	fetchCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	fetches := client.PollRecords(fetchCtx, 2)
+	require.NoError(t, fetches.Err())
+	records := fetches.Records()
+	require.Len(t, records, 1)
+	assert.Equal(t, []byte("key"), records[0].Key)
+	assert.JSONEq(t, `{"name":"a","count":1}`, string(records[0].Value))
+}
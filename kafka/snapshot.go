@@ -0,0 +1,143 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package kafka
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/twmb/franz-go/pkg/kgo"
+
+	apmqueue "github.com/elastic/apm-queue/v2"
+)
+
+// snapshotKey identifies the records collapsed into a snapshot entry.
+type snapshotKey struct {
+	topic apmqueue.Topic
+	key   string
+}
+
+// snapshotEntry holds the latest record of a key, and its processing
+// context.
+type snapshotEntry struct {
+	ctx    context.Context
+	record apmqueue.Record
+	offset int64
+}
+
+// snapshot collects the latest record of each key of the consumed
+// partitions, when ConsumerConfig.Snapshot is set.
+type snapshot struct {
+	mu      sync.Mutex
+	entries map[snapshotKey]snapshotEntry
+	// unkeyed holds the records without a key, which can't be collapsed.
+	unkeyed []snapshotEntry
+}
+
+func newSnapshot() *snapshot {
+	return &snapshot{entries: make(map[snapshotKey]snapshotEntry)}
+}
+
+// addSnapshot collapses the fetched records of the partition into the
+// snapshot, in offset order, removing the keys of tombstones.
+func (c *pc) addSnapshot(msgs []*kgo.Record) {
+	s := c.consumer.snapshot
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, msg := range msgs {
+		ctx, record := c.newRecord(msg)
+		entry := snapshotEntry{ctx: ctx, record: record, offset: msg.Offset}
+		if len(msg.Key) == 0 {
+			if msg.Value != nil {
+				s.unkeyed = append(s.unkeyed, entry)
+			}
+			continue
+		}
+		key := snapshotKey{topic: c.topic, key: string(msg.Key)}
+		if msg.Value == nil {
+			delete(s.entries, key)
+			continue
+		}
+		s.entries[key] = entry
+	}
+	c.settle(len(msgs))
+}
+
+// deliverSnapshot delivers the snapshot to the processor, sorted by topic,
+// partition and offset. With a BatchProcessor, the records of each
+// partition are delivered in batches of up to BatchMaxSize records.
+func (c *consumer) deliverSnapshot(ctx context.Context) error {
+	s := c.snapshot
+	s.mu.Lock()
+	entries := make([]snapshotEntry, 0, len(s.entries)+len(s.unkeyed))
+	for _, entry := range s.entries {
+		entries = append(entries, entry)
+	}
+	entries = append(entries, s.unkeyed...)
+	s.mu.Unlock()
+	sort.Slice(entries, func(i, j int) bool {
+		a, b := entries[i].record, entries[j].record
+		if a.Topic != b.Topic {
+			return a.Topic < b.Topic
+		}
+		if a.Partition != b.Partition {
+			return a.Partition < b.Partition
+		}
+		return entries[i].offset < entries[j].offset
+	})
+
+	records := make([]apmqueue.Record, 0, len(entries))
+	for _, entry := range entries {
+		record := entry.record
+		var err error
+		if c.transform != nil {
+			if err = c.transform(entry.ctx, &record); err != nil {
+				err = fmt.Errorf("failed to transform record: %w", err)
+			}
+		}
+		if err == nil && c.batch == nil {
+			err = c.processor.Process(entry.ctx, record)
+		}
+		if err != nil {
+			return fmt.Errorf(
+				"failed to process snapshot record of topic %q partition %d offset %d: %w",
+				record.Topic, record.Partition, entry.offset, err,
+			)
+		}
+		if c.batch != nil {
+			records = append(records, record)
+		}
+	}
+	for len(records) > 0 {
+		n := 1
+		for n < len(records) && records[n].Topic == records[0].Topic &&
+			records[n].Partition == records[0].Partition &&
+			(c.batchMaxSize <= 0 || n < c.batchMaxSize) {
+			n++
+		}
+		if err := c.batch.ProcessBatch(ctx, records[:n:n]); err != nil {
+			return fmt.Errorf("failed to process snapshot records of topic %q partition %d: %w",
+				records[0].Topic, records[0].Partition, err,
+			)
+		}
+		records = records[n:]
+	}
+	return nil
+}
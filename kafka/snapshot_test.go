@@ -0,0 +1,154 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package kafka
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/twmb/franz-go/pkg/kfake"
+	"github.com/twmb/franz-go/pkg/kgo"
+	"go.uber.org/zap"
+
+	apmqueue "github.com/elastic/apm-queue/v2"
+)
+
+func TestConsumerSnapshot(t *testing.T) {
+	topic := "topic"
+	addrs := newClusterAddrWithTopics(t, 3, topic)
+	client, err := kgo.NewClient(
+		kgo.SeedBrokers(addrs...),
+		kgo.RecordPartitioner(kgo.ManualPartitioner()),
+	)
+	require.NoError(t, err)
+	t.Cleanup(client.Close)
+	ctx := context.Background()
+	for _, r := range []struct {
+		partition int32
+		key       string
+		value     []byte
+	}{
+		{0, "a", []byte("a1")},
+		{0, "b", []byte("b1")},
+		{0, "a", []byte("a2")},
+		{0, "c", []byte("c1")},
+		{0, "c", nil}, // tombstone
+		{1, "d", []byte("d1")},
+		{1, "", []byte("unkeyed")},
+		{1, "d", []byte("d2")},
+	} {
+		record := &kgo.Record{Topic: topic, Partition: r.partition, Value: r.value}
+		if r.key != "" {
+			record.Key = []byte(r.key)
+		}
+		produceRecord(ctx, t, client, record)
+	}
+
+	run := func(t *testing.T, cfg ConsumerConfig) {
+		cfg.CommonConfig = CommonConfig{Brokers: addrs, Logger: zap.NewNop()}
+		// Partition 2 is empty, so it's read right away.
+		cfg.Partitions = map[string][]int32{topic: {0, 1, 2}}
+		cfg.Snapshot = true
+		consumer := newConsumer(t, cfg)
+		runCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
+		defer cancel()
+		require.NoError(t, consumer.Run(runCtx))
+	}
+	t.Run("processor", func(t *testing.T) {
+		var values []string
+		run(t, ConsumerConfig{
+			Processor: apmqueue.ProcessorFunc(func(_ context.Context, r apmqueue.Record) error {
+				values = append(values, string(r.Value))
+				return nil
+			}),
+		})
+		assert.Equal(t, []string{"b1", "a2", "unkeyed", "d2"}, values)
+	})
+	t.Run("batch processor", func(t *testing.T) {
+		var mu sync.Mutex
+		var batches [][]string
+		run(t, ConsumerConfig{
+			BatchProcessor: apmqueue.BatchProcessorFunc(func(_ context.Context, rs []apmqueue.Record) error {
+				mu.Lock()
+				defer mu.Unlock()
+				var batch []string
+				for _, r := range rs {
+					batch = append(batch, string(r.Value))
+				}
+				batches = append(batches, batch)
+				return nil
+			}),
+		})
+		assert.Equal(t, [][]string{{"b1", "a2"}, {"unkeyed", "d2"}}, batches)
+	})
+	t.Run("processing error", func(t *testing.T) {
+		cfg := ConsumerConfig{
+			CommonConfig: CommonConfig{Brokers: addrs, Logger: zap.NewNop()},
+			Partitions:   map[string][]int32{topic: {0}},
+			Snapshot:     true,
+			Processor: apmqueue.ProcessorFunc(func(context.Context, apmqueue.Record) error {
+				return assert.AnError
+			}),
+		}
+		consumer := newConsumer(t, cfg)
+		runCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
+		defer cancel()
+		err := consumer.Run(runCtx)
+		assert.ErrorIs(t, err, assert.AnError)
+		assert.ErrorContains(t, err, `failed to process snapshot record of topic "topic" partition 0 offset 1`)
+	})
+}
+
+func TestConsumerSnapshotControlRecord(t *testing.T) {
+	topic := "topic"
+	cluster, err := kfake.NewCluster(kfake.SeedTopics(1, topic))
+	require.NoError(t, err)
+	t.Cleanup(cluster.Close)
+	addrs := cluster.ListenAddrs()
+	client, err := kgo.NewClient(kgo.SeedBrokers(addrs...))
+	require.NoError(t, err)
+	t.Cleanup(client.Close)
+	ctx := context.Background()
+	for _, key := range []string{"a", "b", "a"} {
+		produceRecord(ctx, t, client, &kgo.Record{
+			Topic: topic, Key: []byte(key), Value: []byte(key),
+		})
+	}
+	// The last record of the partition is a transaction marker.
+	fakeControlRecord(t, cluster, 3)
+
+	var values []string
+	consumer := newConsumer(t, ConsumerConfig{
+		CommonConfig: CommonConfig{Brokers: addrs, Logger: zap.NewNop()},
+		Partitions:   map[string][]int32{topic: {0}},
+		Snapshot:     true,
+		Processor: apmqueue.ProcessorFunc(func(_ context.Context, r apmqueue.Record) error {
+			values = append(values, string(r.Value))
+			return nil
+		}),
+	})
+	runCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	require.NoError(t, consumer.Run(runCtx))
+	require.NoError(t, runCtx.Err(), "timed out waiting for Run to return")
+	assert.Equal(t, []string{"b", "a"}, values)
+}
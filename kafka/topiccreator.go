@@ -124,7 +124,7 @@ func (c *TopicCreator) CreateTopics(ctx context.Context, topics ...apmqueue.Topi
 	if err != nil {
 		span.RecordError(err)
 		span.SetStatus(codes.Error, err.Error())
-		return fmt.Errorf("failed to list kafka topics: %w", err)
+		return fmt.Errorf("failed to list kafka topics: %w", classifyError(err))
 	}
 
 	// missingTopics contains topics which need to be created.
@@ -153,7 +153,7 @@ func (c *TopicCreator) CreateTopics(ctx context.Context, topics ...apmqueue.Topi
 	if err != nil {
 		span.RecordError(err)
 		span.SetStatus(codes.Error, err.Error())
-		return fmt.Errorf("failed to create kafka topics: %w", err)
+		return fmt.Errorf("failed to create kafka topics: %w", classifyError(err))
 	}
 	loggerFields := []zap.Field{
 		zap.Int("partition_count", c.partitionCount),
@@ -185,24 +185,22 @@ func (c *TopicCreator) CreateTopics(ctx context.Context, topics ...apmqueue.Topi
 				span.RecordError(err)
 				span.SetStatus(codes.Error, err.Error())
 				updateErrors = append(updateErrors, fmt.Errorf(
-					"failed to create topic %q: %w", topicName, err,
+					"failed to create topic %q: %w", topicName, classifyError(err),
 				))
 				c.created.Add(context.Background(), 1, metric.WithAttributeSet(
-					attribute.NewSet(
+					attribute.NewSet(append(c.m.topicMetricAttributes(topicName),
 						semconv.MessagingSystemKey.String("kafka"),
 						attribute.String("outcome", "failure"),
-						attribute.String("topic", topicName),
-					),
+					)...),
 				))
 			}
 			continue
 		}
 		c.created.Add(context.Background(), 1, metric.WithAttributeSet(
-			attribute.NewSet(
+			attribute.NewSet(append(c.m.topicMetricAttributes(topicName),
 				semconv.MessagingSystemKey.String("kafka"),
 				attribute.String("outcome", "success"),
-				attribute.String("topic", topicName),
-			),
+			)...),
 		))
 		logger.Info("created kafka topic", zap.String("topic", topicName))
 	}
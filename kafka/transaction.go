@@ -0,0 +1,248 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package kafka
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/twmb/franz-go/pkg/kerr"
+	"github.com/twmb/franz-go/pkg/kgo"
+	"github.com/twmb/franz-go/pkg/kmsg"
+
+	apmqueue "github.com/elastic/apm-queue/v2"
+)
+
+var (
+	// ErrNotTransactional is returned by the Producer's transaction methods
+	// when ProducerConfig.TransactionalID is not set.
+	ErrNotTransactional = errors.New("kafka: producer is not transactional")
+
+	// ErrTransactionInProgress is returned by Producer.BeginTransaction when
+	// a transaction is already open.
+	ErrTransactionInProgress = errors.New("kafka: transaction already in progress")
+
+	// ErrNoTransaction is returned by the Producer's transaction methods
+	// when no transaction is open.
+	ErrNoTransaction = errors.New("kafka: no transaction in progress")
+)
+
+// BeginTransaction begins a new transaction. All records produced until the
+// transaction is committed or aborted are part of the transaction.
+//
+// Only one transaction may be open at a time: ErrTransactionInProgress is
+// returned if a transaction is already open.
+func (p *Producer) BeginTransaction(ctx context.Context) error {
+	if p.cfg.TransactionalID == "" {
+		return ErrNotTransactional
+	}
+	p.txnMu.Lock()
+	defer p.txnMu.Unlock()
+	if p.inTxn {
+		return ErrTransactionInProgress
+	}
+	if err := p.client.BeginTransaction(); err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", classifyError(err))
+	}
+	p.inTxn = true
+	p.txnOffsetsAdded = false
+	p.txnProduced.Store(false)
+	return nil
+}
+
+// AddOffsetsToTransaction commits the consumer group offsets as part of the
+// open transaction, so that they are only committed if the transaction is
+// committed. This enables consume-transform-produce pipelines with
+// exactly-once semantics.
+//
+// Offsets are the offsets of the next records to consume. The group's
+// consumer must not commit the offsets itself.
+func (p *Producer) AddOffsetsToTransaction(ctx context.Context, group string, offsets map[TopicPartition]int64) error {
+	if p.cfg.TransactionalID == "" {
+		return ErrNotTransactional
+	}
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	p.txnMu.Lock()
+	defer p.txnMu.Unlock()
+	if !p.inTxn {
+		return ErrNoTransaction
+	}
+
+	id, epoch, err := p.client.ProducerID(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to initialize producer ID: %w", classifyError(err))
+	}
+	addReq := kmsg.NewPtrAddOffsetsToTxnRequest()
+	addReq.TransactionalID = p.cfg.TransactionalID
+	addReq.ProducerID = id
+	addReq.ProducerEpoch = epoch
+	addReq.Group = group
+	addResp, err := addReq.RequestWith(ctx, p.client)
+	if err == nil {
+		err = kerr.ErrorForCode(addResp.ErrorCode)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to add offsets for group %q to transaction: %w", group, classifyError(err))
+	}
+	p.txnOffsetsAdded = true
+
+	namespacePrefix := p.cfg.namespacePrefix()
+	commitReq := kmsg.NewPtrTxnOffsetCommitRequest()
+	commitReq.TransactionalID = p.cfg.TransactionalID
+	commitReq.Group = group
+	commitReq.ProducerID = id
+	commitReq.ProducerEpoch = epoch
+	commitReq.Generation = -1
+	topics := make(map[string]int)
+	for tp, offset := range offsets {
+		topic := namespacePrefix + string(tp.Topic)
+		i, ok := topics[topic]
+		if !ok {
+			i = len(commitReq.Topics)
+			topics[topic] = i
+			reqTopic := kmsg.NewTxnOffsetCommitRequestTopic()
+			reqTopic.Topic = topic
+			commitReq.Topics = append(commitReq.Topics, reqTopic)
+		}
+		reqPartition := kmsg.NewTxnOffsetCommitRequestTopicPartition()
+		reqPartition.Partition = tp.Partition
+		reqPartition.Offset = offset
+		commitReq.Topics[i].Partitions = append(commitReq.Topics[i].Partitions, reqPartition)
+	}
+	commitResp, err := commitReq.RequestWith(ctx, p.client)
+	if err != nil {
+		return fmt.Errorf("failed to commit offsets for group %q in transaction: %w", group, classifyError(err))
+	}
+	var commitErrors []error
+	for _, topic := range commitResp.Topics {
+		for _, partition := range topic.Partitions {
+			if err := kerr.ErrorForCode(partition.ErrorCode); err != nil {
+				commitErrors = append(commitErrors, fmt.Errorf(
+					"failed to commit offset for topic %q partition %d in transaction: %w",
+					strings.TrimPrefix(topic.Topic, namespacePrefix), partition.Partition, classifyError(err),
+				))
+			}
+		}
+	}
+	return errors.Join(commitErrors...)
+}
+
+// CommitTransaction flushes all records produced in the open transaction,
+// and commits the transaction.
+//
+// If the records cannot be flushed, the transaction remains open and should
+// be aborted with AbortTransaction.
+func (p *Producer) CommitTransaction(ctx context.Context) error {
+	if p.cfg.TransactionalID == "" {
+		return ErrNotTransactional
+	}
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	p.txnMu.Lock()
+	defer p.txnMu.Unlock()
+	if !p.inTxn {
+		return ErrNoTransaction
+	}
+	if err := p.client.Flush(ctx); err != nil {
+		return fmt.Errorf("failed to flush transaction: %w", classifyError(err))
+	}
+	if err := p.endTransaction(ctx, kgo.TryCommit); err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", classifyError(err))
+	}
+	return nil
+}
+
+// AbortTransaction aborts the open transaction, discarding any records that
+// are still buffered.
+func (p *Producer) AbortTransaction(ctx context.Context) error {
+	if p.cfg.TransactionalID == "" {
+		return ErrNotTransactional
+	}
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	p.txnMu.Lock()
+	defer p.txnMu.Unlock()
+	if !p.inTxn {
+		return ErrNoTransaction
+	}
+	if err := p.client.AbortBufferedRecords(ctx); err != nil {
+		return fmt.Errorf("failed to abort buffered records: %w", classifyError(err))
+	}
+	if err := p.endTransaction(ctx, kgo.TryAbort); err != nil {
+		return fmt.Errorf("failed to abort transaction: %w", classifyError(err))
+	}
+	return nil
+}
+
+// produceTransaction produces the records in a transaction, committing it
+// once they are produced, or aborting it if any of them fails. If a
+// transaction is already open, the records are produced in it instead.
+func (p *Producer) produceTransaction(ctx context.Context, rs []apmqueue.Record) error {
+	p.fanoutMu.Lock()
+	defer p.fanoutMu.Unlock()
+	err := p.BeginTransaction(ctx)
+	if errors.Is(err, ErrTransactionInProgress) {
+		// The records are committed or aborted with the open transaction.
+		_, err = p.produce(ctx, true, rs)
+		return err
+	}
+	if err != nil {
+		return err
+	}
+	if _, err = p.produce(ctx, true, rs); err == nil {
+		if err = p.CommitTransaction(ctx); err == nil {
+			return nil
+		}
+	}
+	// The transaction remains open if it fails to be committed before being
+	// ended, e.g. if the records can't be flushed.
+	if abortErr := p.AbortTransaction(ctx); abortErr != nil && !errors.Is(abortErr, ErrNoTransaction) {
+		return errors.Join(err, abortErr)
+	}
+	return err
+}
+
+// endTransaction ends the open transaction. It must be called with txnMu
+// held.
+func (p *Producer) endTransaction(ctx context.Context, try kgo.TransactionEndTry) error {
+	p.inTxn = false
+	err := p.client.EndTransaction(ctx, try)
+	if err == nil && p.txnOffsetsAdded && !p.txnProduced.Load() {
+		// The client only ends transactions which records were produced
+		// in, so end offsets-only transactions explicitly.
+		var id int64
+		var epoch int16
+		if id, epoch, err = p.client.ProducerID(ctx); err == nil {
+			req := kmsg.NewPtrEndTxnRequest()
+			req.TransactionalID = p.cfg.TransactionalID
+			req.ProducerID = id
+			req.ProducerEpoch = epoch
+			req.Commit = bool(try)
+			var resp *kmsg.EndTxnResponse
+			if resp, err = req.RequestWith(ctx, p.client); err == nil {
+				err = kerr.ErrorForCode(resp.ErrorCode)
+			}
+		}
+	}
+	p.txnOffsetsAdded = false
+	p.txnProduced.Store(false)
+	return err
+}
@@ -0,0 +1,254 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package kafka
+
+import (
+	"context"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/twmb/franz-go/pkg/kerr"
+	"github.com/twmb/franz-go/pkg/kfake"
+	"github.com/twmb/franz-go/pkg/kgo"
+	"github.com/twmb/franz-go/pkg/kmsg"
+	"go.uber.org/zap"
+
+	apmqueue "github.com/elastic/apm-queue/v2"
+)
+
+func TestProducerTransactionNotTransactional(t *testing.T) {
+	_, commonConfig := newFakeCluster(t)
+	producer := newProducer(t, ProducerConfig{CommonConfig: commonConfig})
+	ctx := context.Background()
+	assert.ErrorIs(t, producer.BeginTransaction(ctx), ErrNotTransactional)
+	assert.ErrorIs(t, producer.AddOffsetsToTransaction(ctx, "group", nil), ErrNotTransactional)
+	assert.ErrorIs(t, producer.CommitTransaction(ctx), ErrNotTransactional)
+	assert.ErrorIs(t, producer.AbortTransaction(ctx), ErrNotTransactional)
+}
+
+func TestProducerTransaction(t *testing.T) {
+	cluster, commonConfig := newFakeCluster(t)
+
+	// kfake does not support transactions, so fake the transaction
+	// coordinator's responses and record the requests.
+	var mu sync.Mutex
+	var requests []kmsg.Request
+	control := func(key int16, respond func(kmsg.Request) kmsg.Response) {
+		cluster.ControlKey(key, func(req kmsg.Request) (kmsg.Response, error, bool) {
+			cluster.KeepControl()
+			mu.Lock()
+			defer mu.Unlock()
+			requests = append(requests, req)
+			return respond(req), nil, true
+		})
+	}
+	// Advertise support for the transaction requests.
+	apiVersions := fakeClusterAPIVersions(t, commonConfig.Brokers)
+	for _, key := range []kmsg.Key{kmsg.AddOffsetsToTxn, kmsg.EndTxn, kmsg.TxnOffsetCommit} {
+		apiVersionsKey := kmsg.NewApiVersionsResponseApiKey()
+		apiVersionsKey.ApiKey = key.Int16()
+		apiVersionsKey.MaxVersion = 3
+		apiVersions.ApiKeys = append(apiVersions.ApiKeys, apiVersionsKey)
+	}
+	cluster.ControlKey(kmsg.ApiVersions.Int16(), func(req kmsg.Request) (kmsg.Response, error, bool) {
+		cluster.KeepControl()
+		resp := *apiVersions
+		resp.Version = req.GetVersion()
+		return &resp, nil, true
+	})
+	control(kmsg.InitProducerID.Int16(), func(req kmsg.Request) kmsg.Response {
+		resp := req.ResponseKind().(*kmsg.InitProducerIDResponse)
+		resp.ProducerID = 1
+		resp.ProducerEpoch = 2
+		return resp
+	})
+	control(kmsg.AddOffsetsToTxn.Int16(), func(req kmsg.Request) kmsg.Response {
+		return req.ResponseKind()
+	})
+	control(kmsg.TxnOffsetCommit.Int16(), func(req kmsg.Request) kmsg.Response {
+		r := req.(*kmsg.TxnOffsetCommitRequest)
+		resp := r.ResponseKind().(*kmsg.TxnOffsetCommitResponse)
+		for _, topic := range r.Topics {
+			respTopic := kmsg.NewTxnOffsetCommitResponseTopic()
+			respTopic.Topic = topic.Topic
+			for _, partition := range topic.Partitions {
+				respPartition := kmsg.NewTxnOffsetCommitResponseTopicPartition()
+				respPartition.Partition = partition.Partition
+				respTopic.Partitions = append(respTopic.Partitions, respPartition)
+			}
+			resp.Topics = append(resp.Topics, respTopic)
+		}
+		return resp
+	})
+	control(kmsg.EndTxn.Int16(), func(req kmsg.Request) kmsg.Response {
+		return req.ResponseKind()
+	})
+
+	producer := newProducer(t, ProducerConfig{
+		CommonConfig:    commonConfig,
+		TransactionalID: "txn",
+	})
+	ctx := context.Background()
+	assert.ErrorIs(t, producer.CommitTransaction(ctx), ErrNoTransaction)
+	assert.ErrorIs(t, producer.AbortTransaction(ctx), ErrNoTransaction)
+	assert.ErrorIs(t, producer.AddOffsetsToTransaction(ctx, "group", nil), ErrNoTransaction)
+
+	require.NoError(t, producer.BeginTransaction(ctx))
+	assert.ErrorIs(t, producer.BeginTransaction(ctx), ErrTransactionInProgress)
+	require.NoError(t, producer.AddOffsetsToTransaction(ctx, "group", map[TopicPartition]int64{
+		{Topic: "topic", Partition: 0}: 10,
+	}))
+	require.NoError(t, producer.CommitTransaction(ctx))
+	assert.ErrorIs(t, producer.CommitTransaction(ctx), ErrNoTransaction)
+
+	mu.Lock()
+	defer mu.Unlock()
+	var txnOffsetCommit *kmsg.TxnOffsetCommitRequest
+	var endTxn *kmsg.EndTxnRequest
+	for _, req := range requests {
+		switch req := req.(type) {
+		case *kmsg.AddOffsetsToTxnRequest:
+			assert.Equal(t, "txn", req.TransactionalID)
+			assert.Equal(t, "group", req.Group)
+		case *kmsg.TxnOffsetCommitRequest:
+			txnOffsetCommit = req
+		case *kmsg.EndTxnRequest:
+			endTxn = req
+		}
+	}
+	require.NotNil(t, txnOffsetCommit)
+	assert.Equal(t, int64(1), txnOffsetCommit.ProducerID)
+	assert.Equal(t, int16(2), txnOffsetCommit.ProducerEpoch)
+	require.Len(t, txnOffsetCommit.Topics, 1)
+	assert.Equal(t, "name_space-topic", txnOffsetCommit.Topics[0].Topic)
+	require.Len(t, txnOffsetCommit.Topics[0].Partitions, 1)
+	assert.Equal(t, int64(10), txnOffsetCommit.Topics[0].Partitions[0].Offset)
+	require.NotNil(t, endTxn, "offsets-only transactions must be ended")
+	assert.True(t, endTxn.Commit)
+}
+
+func TestProducerProduceFanoutTransaction(t *testing.T) {
+	// test fans out a record with a transactional producer, failing the
+	// records produced to failTopic, and returns the EndTxn request.
+	test := func(t *testing.T, failTopic string) (*kmsg.EndTxnRequest, error) {
+		cluster, err := kfake.NewCluster(kfake.NumBrokers(1),
+			kfake.SeedTopics(1, "name_space-canonical", "name_space-projection"),
+		)
+		require.NoError(t, err)
+		t.Cleanup(cluster.Close)
+		// kfake does not support transactions, so fake the transaction
+		// coordinator and the transactional produce responses.
+		advertiseKeys(t, cluster, kmsg.AddPartitionsToTxn, kmsg.EndTxn)
+		var mu sync.Mutex
+		var endTxn *kmsg.EndTxnRequest
+		control := func(key kmsg.Key, respond func(kmsg.Request) kmsg.Response) {
+			cluster.ControlKey(key.Int16(), func(req kmsg.Request) (kmsg.Response, error, bool) {
+				cluster.KeepControl()
+				mu.Lock()
+				defer mu.Unlock()
+				return respond(req), nil, true
+			})
+		}
+		control(kmsg.InitProducerID, func(req kmsg.Request) kmsg.Response {
+			resp := req.ResponseKind().(*kmsg.InitProducerIDResponse)
+			resp.ProducerID = 1
+			return resp
+		})
+		control(kmsg.AddPartitionsToTxn, func(req kmsg.Request) kmsg.Response {
+			r := req.(*kmsg.AddPartitionsToTxnRequest)
+			resp := r.ResponseKind().(*kmsg.AddPartitionsToTxnResponse)
+			for _, topic := range r.Topics {
+				respTopic := kmsg.NewAddPartitionsToTxnResponseTopic()
+				respTopic.Topic = topic.Topic
+				for _, partition := range topic.Partitions {
+					respPartition := kmsg.NewAddPartitionsToTxnResponseTopicPartition()
+					respPartition.Partition = partition
+					respTopic.Partitions = append(respTopic.Partitions, respPartition)
+				}
+				resp.Topics = append(resp.Topics, respTopic)
+			}
+			return resp
+		})
+		control(kmsg.Produce, func(req kmsg.Request) kmsg.Response {
+			r := req.(*kmsg.ProduceRequest)
+			resp := r.ResponseKind().(*kmsg.ProduceResponse)
+			for _, topic := range r.Topics {
+				respTopic := kmsg.NewProduceResponseTopic()
+				respTopic.Topic = topic.Topic
+				for _, partition := range topic.Partitions {
+					respPartition := kmsg.NewProduceResponseTopicPartition()
+					respPartition.Partition = partition.Partition
+					if topic.Topic == "name_space-"+failTopic {
+						respPartition.ErrorCode = kerr.InvalidRecord.Code
+					}
+					respTopic.Partitions = append(respTopic.Partitions, respPartition)
+				}
+				resp.Topics = append(resp.Topics, respTopic)
+			}
+			return resp
+		})
+		control(kmsg.EndTxn, func(req kmsg.Request) kmsg.Response {
+			endTxn = req.(*kmsg.EndTxnRequest)
+			return req.ResponseKind()
+		})
+
+		producer := newProducer(t, ProducerConfig{
+			CommonConfig: CommonConfig{
+				Brokers:   cluster.ListenAddrs(),
+				Logger:    zap.NewNop(),
+				Namespace: "name_space",
+			},
+			TransactionalID: "txn",
+		})
+		err = producer.ProduceFanout(context.Background(),
+			apmqueue.Record{Value: []byte("1")}, "canonical", "projection",
+		)
+		// The transaction is ended either way.
+		assert.ErrorIs(t, producer.CommitTransaction(context.Background()), ErrNoTransaction)
+		mu.Lock()
+		defer mu.Unlock()
+		return endTxn, err
+	}
+	t.Run("committed", func(t *testing.T) {
+		endTxn, err := test(t, "")
+		require.NoError(t, err)
+		require.NotNil(t, endTxn)
+		assert.Equal(t, "txn", endTxn.TransactionalID)
+		assert.True(t, endTxn.Commit)
+	})
+	t.Run("aborted", func(t *testing.T) {
+		endTxn, err := test(t, "projection")
+		assert.ErrorIs(t, err, kerr.InvalidRecord)
+		assert.ErrorContains(t, err, `failed to produce record 1 to topic "projection"`)
+		require.NotNil(t, endTxn)
+		assert.False(t, endTxn.Commit)
+	})
+}
+
+// fakeClusterAPIVersions returns the ApiVersions response of the brokers.
+func fakeClusterAPIVersions(t testing.TB, brokers []string) *kmsg.ApiVersionsResponse {
+	t.Helper()
+	client, err := kgo.NewClient(kgo.SeedBrokers(brokers...))
+	require.NoError(t, err)
+	defer client.Close()
+	resp, err := kmsg.NewPtrApiVersionsRequest().RequestWith(context.Background(), client)
+	require.NoError(t, err)
+	return resp
+}
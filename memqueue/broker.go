@@ -0,0 +1,158 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package memqueue
+
+import (
+	"context"
+	"errors"
+	"hash/fnv"
+	"slices"
+	"sync"
+
+	apmqueue "github.com/elastic/apm-queue/v2"
+)
+
+// ErrClosed is returned by the Producer and Consumer methods once they have
+// been closed.
+var ErrClosed = errors.New("memqueue: closed")
+
+// Broker holds the in-memory topics which records are produced to and
+// consumed from. The zero value isn't usable, use NewBroker instead.
+type Broker struct {
+	mu      sync.Mutex
+	topics  map[apmqueue.Topic]*topic
+	changed chan struct{}
+}
+
+type topic struct {
+	partitions [][]apmqueue.Record
+	// next is the partition the next record without an ordering key is
+	// appended to.
+	next int
+}
+
+// NewBroker returns a new Broker with no topics.
+func NewBroker() *Broker {
+	return &Broker{
+		topics:  make(map[apmqueue.Topic]*topic),
+		changed: make(chan struct{}),
+	}
+}
+
+// CreateTopics creates the topics with the configured number of partitions,
+// or a single partition if PartitionCount isn't set. Topics which already
+// exist are left unchanged.
+func (b *Broker) CreateTopics(_ context.Context, topics ...apmqueue.TopicConfig) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, cfg := range topics {
+		if _, ok := b.topics[cfg.Topic]; !ok {
+			b.topics[cfg.Topic] = newTopic(cfg.PartitionCount)
+		}
+	}
+	return nil
+}
+
+// DeleteTopics deletes the topics and all of their records. Topics which
+// don't exist are ignored.
+func (b *Broker) DeleteTopics(_ context.Context, topics ...apmqueue.Topic) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, t := range topics {
+		delete(b.topics, t)
+	}
+	return nil
+}
+
+// Records returns a copy of all the records produced to the topic, ordered by
+// partition and then by offset.
+func (b *Broker) Records(t apmqueue.Topic) []apmqueue.Record {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	tp, ok := b.topics[t]
+	if !ok {
+		return nil
+	}
+	var records []apmqueue.Record
+	for _, p := range tp.partitions {
+		records = append(records, p...)
+	}
+	return records
+}
+
+func newTopic(partitions int) *topic {
+	if partitions <= 0 {
+		partitions = 1
+	}
+	return &topic{partitions: make([][]apmqueue.Record, partitions)}
+}
+
+// produce appends the records to their topics, creating any topic which
+// doesn't exist with a single partition. Records with the same ordering key,
+// or key if they have no ordering key, are appended to the same partition,
+// the rest are distributed round robin.
+func (b *Broker) produce(records []apmqueue.Record) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, r := range records {
+		tp, ok := b.topics[r.Topic]
+		if !ok {
+			tp = newTopic(1)
+			b.topics[r.Topic] = tp
+		}
+		key := r.OrderingKey
+		if key == nil {
+			key = r.Key
+		}
+		var partition int
+		if key != nil {
+			h := fnv.New32a()
+			h.Write(key)
+			partition = int(h.Sum32() % uint32(len(tp.partitions)))
+		} else {
+			partition = tp.next
+			tp.next = (tp.next + 1) % len(tp.partitions)
+		}
+		r.Partition = int32(partition)
+		tp.partitions[partition] = append(tp.partitions[partition], r)
+	}
+	close(b.changed)
+	b.changed = make(chan struct{})
+}
+
+// fetch returns the records of the topic partition from offset onwards, and
+// the number of partitions of the topic.
+func (b *Broker) fetch(t apmqueue.Topic, partition int, offset int64) ([]apmqueue.Record, int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	tp, ok := b.topics[t]
+	if !ok {
+		return nil, 0
+	}
+	if partition >= len(tp.partitions) || offset >= int64(len(tp.partitions[partition])) {
+		return nil, len(tp.partitions)
+	}
+	return slices.Clone(tp.partitions[partition][offset:]), len(tp.partitions)
+}
+
+// wait returns a channel which is closed when records are next produced.
+func (b *Broker) wait() <-chan struct{} {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.changed
+}
@@ -0,0 +1,212 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package memqueue
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+
+	apmqueue "github.com/elastic/apm-queue/v2"
+)
+
+// ConsumerConfig holds configuration for consuming records from a Broker.
+type ConsumerConfig struct {
+	// Broker is the broker which records are consumed from.
+	Broker *Broker
+	// Topics holds the topics which records are consumed from. Topics which
+	// don't exist yet are consumed from once they're created.
+	Topics []apmqueue.Topic
+	// Processor that will be used to process each record individually.
+	Processor apmqueue.Processor
+	// BatchProcessor, if set instead of Processor, is used to process all
+	// the records fetched from each partition in a single batch.
+	BatchProcessor apmqueue.BatchProcessor
+}
+
+func (cfg ConsumerConfig) finalize() error {
+	var errs []error
+	if cfg.Broker == nil {
+		errs = append(errs, errors.New("memqueue: broker must be set"))
+	}
+	if len(cfg.Topics) == 0 {
+		errs = append(errs, errors.New("memqueue: at least one topic must be set"))
+	}
+	if cfg.Processor == nil && cfg.BatchProcessor == nil {
+		errs = append(errs, errors.New("memqueue: processor must be set"))
+	}
+	if cfg.Processor != nil && cfg.BatchProcessor != nil {
+		errs = append(errs, errors.New("memqueue: only one of processor or batch processor can be set"))
+	}
+	return errors.Join(errs...)
+}
+
+var _ apmqueue.Consumer = &Consumer{}
+
+// Consumer consumes records from the topics of a Broker. Each Consumer keeps
+// track of its own offsets, starting at the beginning of each partition.
+type Consumer struct {
+	cfg ConsumerConfig
+
+	// mu serializes Consume calls, and guards offsets.
+	mu      sync.Mutex
+	offsets map[topicPartition]int64
+
+	closeOnce sync.Once
+	closed    chan struct{}
+	running   chan struct{}
+}
+
+type topicPartition struct {
+	topic     apmqueue.Topic
+	partition int
+}
+
+// NewConsumer returns a new Consumer with the given config.
+func NewConsumer(cfg ConsumerConfig) (*Consumer, error) {
+	if err := cfg.finalize(); err != nil {
+		return nil, err
+	}
+	return &Consumer{
+		cfg:     cfg,
+		offsets: make(map[topicPartition]int64),
+		closed:  make(chan struct{}),
+		running: make(chan struct{}),
+	}, nil
+}
+
+// Consume processes all the records which have been produced to the topics
+// since the last call, in topic, partition and offset order, and returns the
+// number of records processed. Records which fail to be processed aren't
+// retried, their errors are returned once all the records have been
+// processed. Consume can be used instead of Run to drive the consumer
+// deterministically.
+func (c *Consumer) Consume(ctx context.Context) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	select {
+	case <-c.closed:
+		return 0, ErrClosed
+	default:
+	}
+	var processed int
+	var errs []error
+	for _, t := range c.cfg.Topics {
+		for p := 0; ; p++ {
+			if err := ctx.Err(); err != nil {
+				return processed, err
+			}
+			tp := topicPartition{topic: t, partition: p}
+			records, partitions := c.cfg.Broker.fetch(t, p, c.offsets[tp])
+			if p >= partitions {
+				break
+			}
+			if len(records) == 0 {
+				continue
+			}
+			c.offsets[tp] += int64(len(records))
+			processed += len(records)
+			errs = append(errs, c.process(ctx, records)...)
+		}
+	}
+	return processed, errors.Join(errs...)
+}
+
+func (c *Consumer) process(ctx context.Context, records []apmqueue.Record) []error {
+	if c.cfg.BatchProcessor != nil {
+		if err := c.cfg.BatchProcessor.ProcessBatch(ctx, records); err != nil && !skipped(err) {
+			return []error{fmt.Errorf("failed to process batch of topic %q partition %d: %w",
+				records[0].Topic, records[0].Partition, err,
+			)}
+		}
+		return nil
+	}
+	var errs []error
+	for _, r := range records {
+		if err := c.cfg.Processor.Process(ctx, r); err != nil && !skipped(err) {
+			errs = append(errs, fmt.Errorf("failed to process record of topic %q partition %d: %w",
+				r.Topic, r.Partition, err,
+			))
+		}
+	}
+	return errs
+}
+
+// skipped returns whether err skips the processed records, i.e. it is, or is
+// a BatchError whose record errors all are, apmqueue.ErrSkip.
+func skipped(err error) bool {
+	var batchErr *apmqueue.BatchError
+	if errors.As(err, &batchErr) {
+		for _, recordErr := range batchErr.Errors {
+			if !errors.Is(recordErr, apmqueue.ErrSkip) {
+				return false
+			}
+		}
+		return true
+	}
+	return errors.Is(err, apmqueue.ErrSkip)
+}
+
+// Run consumes records as they're produced until the context is canceled or
+// the consumer is closed. Records which fail to be processed aren't retried,
+// use Consume to observe processing errors. Returns
+// apmqueue.ErrConsumerAlreadyRunning when it has already been called.
+func (c *Consumer) Run(ctx context.Context) error {
+	c.mu.Lock()
+	select {
+	case <-c.running:
+		c.mu.Unlock()
+		return apmqueue.ErrConsumerAlreadyRunning
+	default:
+		close(c.running)
+	}
+	c.mu.Unlock()
+	for {
+		// Wait on the broker before consuming, so that records produced
+		// while consuming aren't missed.
+		changed := c.cfg.Broker.wait()
+		if _, err := c.Consume(ctx); errors.Is(err, ErrClosed) || ctx.Err() != nil {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-c.closed:
+			return nil
+		case <-changed:
+		}
+	}
+}
+
+// Healthy returns ErrClosed if the consumer has been closed.
+func (c *Consumer) Healthy(context.Context) error {
+	select {
+	case <-c.closed:
+		return ErrClosed
+	default:
+		return nil
+	}
+}
+
+// Close closes the consumer, stopping Run once the records being processed
+// have been processed.
+func (c *Consumer) Close() error {
+	c.closeOnce.Do(func() { close(c.closed) })
+	return nil
+}
@@ -0,0 +1,192 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package memqueue
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	apmqueue "github.com/elastic/apm-queue/v2"
+)
+
+func newConsumer(t testing.TB, cfg ConsumerConfig) *Consumer {
+	consumer, err := NewConsumer(cfg)
+	require.NoError(t, err)
+	t.Cleanup(func() { consumer.Close() })
+	return consumer
+}
+
+func TestNewConsumer(t *testing.T) {
+	noop := apmqueue.ProcessorFunc(func(context.Context, apmqueue.Record) error { return nil })
+	testCases := map[string]struct {
+		cfg    ConsumerConfig
+		expErr string
+	}{
+		"empty": {
+			expErr: "memqueue: broker must be set\n" +
+				"memqueue: at least one topic must be set\n" +
+				"memqueue: processor must be set",
+		},
+		"both processors": {
+			cfg: ConsumerConfig{
+				Broker:    NewBroker(),
+				Topics:    []apmqueue.Topic{"topic"},
+				Processor: noop,
+				BatchProcessor: apmqueue.BatchProcessorFunc(func(context.Context, []apmqueue.Record) error {
+					return nil
+				}),
+			},
+			expErr: "memqueue: only one of processor or batch processor can be set",
+		},
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			_, err := NewConsumer(tc.cfg)
+			assert.EqualError(t, err, tc.expErr)
+		})
+	}
+}
+
+func TestConsumerConsume(t *testing.T) {
+	b := NewBroker()
+	require.NoError(t, b.CreateTopics(context.Background(),
+		apmqueue.TopicConfig{Topic: "a", PartitionCount: 2},
+	))
+	producer := newProducer(t, b)
+	var processed []apmqueue.Record
+	consumer := newConsumer(t, ConsumerConfig{
+		Broker: b,
+		Topics: []apmqueue.Topic{"a", "b"},
+		Processor: apmqueue.ProcessorFunc(func(_ context.Context, r apmqueue.Record) error {
+			processed = append(processed, r)
+			switch string(r.Value) {
+			case "fail":
+				return errors.New("boom")
+			case "skip":
+				return fmt.Errorf("skipped: %w", apmqueue.ErrSkip)
+			}
+			return nil
+		}),
+	})
+	ctx := context.Background()
+
+	n, err := consumer.Consume(ctx)
+	require.NoError(t, err)
+	assert.Zero(t, n)
+
+	require.NoError(t, producer.Produce(ctx,
+		apmqueue.Record{Topic: "a", Value: []byte("1")},
+		apmqueue.Record{Topic: "a", Value: []byte("2")},
+		apmqueue.Record{Topic: "b", Value: []byte("fail")},
+		apmqueue.Record{Topic: "a", Value: []byte("3")},
+	))
+	n, err = consumer.Consume(ctx)
+	assert.EqualError(t, err, `failed to process record of topic "b" partition 0: boom`)
+	assert.Equal(t, 4, n)
+	// Records are processed in topic, partition and offset order.
+	var values []string
+	for _, r := range processed {
+		values = append(values, string(r.Value))
+	}
+	assert.Equal(t, []string{"1", "3", "2", "fail"}, values)
+
+	// Failed records aren't retried, only new records are processed, and
+	// skipped records aren't reported as failed.
+	processed = nil
+	require.NoError(t, producer.Produce(ctx,
+		apmqueue.Record{Topic: "b", Value: []byte("4")},
+		apmqueue.Record{Topic: "b", Value: []byte("skip")},
+	))
+	n, err = consumer.Consume(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, 2, n)
+	require.Len(t, processed, 2)
+	assert.Equal(t, []byte("4"), processed[0].Value)
+
+	require.NoError(t, consumer.Close())
+	_, err = consumer.Consume(ctx)
+	assert.ErrorIs(t, err, ErrClosed)
+	assert.ErrorIs(t, consumer.Healthy(ctx), ErrClosed)
+}
+
+func TestConsumerBatchProcessor(t *testing.T) {
+	b := NewBroker()
+	producer := newProducer(t, b)
+	var batches [][]apmqueue.Record
+	consumer := newConsumer(t, ConsumerConfig{
+		Broker: b,
+		Topics: []apmqueue.Topic{"topic"},
+		BatchProcessor: apmqueue.BatchProcessorFunc(func(_ context.Context, rs []apmqueue.Record) error {
+			batches = append(batches, rs)
+			return nil
+		}),
+	})
+	ctx := context.Background()
+	require.NoError(t, producer.Produce(ctx,
+		apmqueue.Record{Topic: "topic", Value: []byte("1")},
+		apmqueue.Record{Topic: "topic", Value: []byte("2")},
+	))
+	n, err := consumer.Consume(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, 2, n)
+	require.Len(t, batches, 1)
+	assert.Len(t, batches[0], 2)
+}
+
+func TestConsumerRun(t *testing.T) {
+	b := NewBroker()
+	producer := newProducer(t, b)
+	records := make(chan apmqueue.Record, 1)
+	consumer := newConsumer(t, ConsumerConfig{
+		Broker: b,
+		Topics: []apmqueue.Topic{"topic"},
+		Processor: apmqueue.ProcessorFunc(func(_ context.Context, r apmqueue.Record) error {
+			records <- r
+			return nil
+		}),
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	done := make(chan error, 1)
+	go func() { done <- consumer.Run(ctx) }()
+
+	for _, v := range []string{"1", "2"} {
+		require.NoError(t, producer.Produce(ctx, apmqueue.Record{Topic: "topic", Value: []byte(v)}))
+		select {
+		case r := <-records:
+			assert.Equal(t, []byte(v), r.Value)
+		case <-time.After(time.Second):
+			t.Fatal("timed out waiting for record to be processed")
+		}
+	}
+	assert.ErrorIs(t, consumer.Run(ctx), apmqueue.ErrConsumerAlreadyRunning)
+
+	require.NoError(t, consumer.Close())
+	select {
+	case err := <-done:
+		assert.NoError(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for Run to return")
+	}
+}
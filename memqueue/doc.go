@@ -0,0 +1,26 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+// Package memqueue provides an in-memory implementation of the apmqueue
+// Producer and Consumer, meant for testing code which uses apmqueue without
+// running Kafka.
+//
+// Records are stored in the partitions of the topics of a Broker, which are
+// shared by the Producers and Consumers created from it. Consumers can be
+// driven deterministically with Consumer.Consume, and the produced records
+// can be inspected with Broker.Records.
+package memqueue
@@ -0,0 +1,96 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package memqueue
+
+import (
+	"context"
+	"errors"
+	"sync"
+
+	apmqueue "github.com/elastic/apm-queue/v2"
+	"github.com/elastic/apm-queue/v2/internal/recordutil"
+)
+
+// ProducerConfig holds configuration for producing records to a Broker.
+type ProducerConfig struct {
+	// Broker is the broker which records are produced to.
+	Broker *Broker
+}
+
+func (cfg ProducerConfig) finalize() error {
+	if cfg.Broker == nil {
+		return errors.New("memqueue: broker must be set")
+	}
+	return nil
+}
+
+var _ apmqueue.Producer = &Producer{}
+
+// Producer produces records to the topics of a Broker. Records are appended
+// to their topic synchronously, and can be consumed once Produce returns.
+type Producer struct {
+	cfg ProducerConfig
+
+	mu     sync.RWMutex
+	closed bool
+}
+
+// NewProducer returns a new Producer with the given config.
+func NewProducer(cfg ProducerConfig) (*Producer, error) {
+	if err := cfg.finalize(); err != nil {
+		return nil, err
+	}
+	return &Producer{cfg: cfg}, nil
+}
+
+// Produce appends the records to their topics. Topics which don't exist are
+// created with a single partition. The context metadata is added to each
+// record's headers followed by the record's own headers, and the timestamp
+// of records with no Timestamp is set to the current time.
+func (p *Producer) Produce(ctx context.Context, rs ...apmqueue.Record) error {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if p.closed {
+		return ErrClosed
+	}
+	defaults := recordutil.ContextDefaults(ctx)
+	records := make([]apmqueue.Record, len(rs))
+	for i, r := range rs {
+		records[i] = defaults.Apply(r)
+	}
+	p.cfg.Broker.produce(records)
+	return nil
+}
+
+// Healthy returns ErrClosed if the producer has been closed.
+func (p *Producer) Healthy(context.Context) error {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if p.closed {
+		return ErrClosed
+	}
+	return nil
+}
+
+// Close closes the producer. Records can't be produced after Close.
+func (p *Producer) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.closed = true
+	return nil
+}
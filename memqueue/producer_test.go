@@ -0,0 +1,107 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package memqueue
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	apmqueue "github.com/elastic/apm-queue/v2"
+	"github.com/elastic/apm-queue/v2/queuecontext"
+)
+
+func newProducer(t testing.TB, b *Broker) *Producer {
+	producer, err := NewProducer(ProducerConfig{Broker: b})
+	require.NoError(t, err)
+	t.Cleanup(func() { producer.Close() })
+	return producer
+}
+
+func TestNewProducer(t *testing.T) {
+	_, err := NewProducer(ProducerConfig{})
+	assert.EqualError(t, err, "memqueue: broker must be set")
+}
+
+func TestProducerOrderingKey(t *testing.T) {
+	b := NewBroker()
+	require.NoError(t, b.CreateTopics(context.Background(),
+		apmqueue.TopicConfig{Topic: "topic", PartitionCount: 4},
+	))
+	producer := newProducer(t, b)
+	require.NoError(t, producer.Produce(context.Background(),
+		apmqueue.Record{Topic: "topic", OrderingKey: []byte("a"), Value: []byte("1")},
+		apmqueue.Record{Topic: "topic", Value: []byte("x")},
+		apmqueue.Record{Topic: "topic", OrderingKey: []byte("a"), Value: []byte("2")},
+		apmqueue.Record{Topic: "topic", Value: []byte("y")},
+		apmqueue.Record{Topic: "topic", OrderingKey: []byte("a"), Value: []byte("3")},
+	))
+
+	records := b.Records("topic")
+	require.Len(t, records, 5)
+	var keyed []apmqueue.Record
+	for _, r := range records {
+		if r.OrderingKey != nil {
+			keyed = append(keyed, r)
+		}
+	}
+	require.Len(t, keyed, 3)
+	for i, r := range keyed {
+		assert.Equal(t, keyed[0].Partition, r.Partition)
+		assert.Equal(t, []byte{byte('1' + i)}, r.Value)
+	}
+}
+
+func TestProducerRecord(t *testing.T) {
+	b := NewBroker()
+	producer := newProducer(t, b)
+	ts := time.Now().Add(-time.Hour)
+	ctx := queuecontext.WithMetadata(context.Background(), map[string]string{"a": "b"})
+	before := time.Now()
+	require.NoError(t, producer.Produce(ctx,
+		apmqueue.Record{Topic: "topic", Value: []byte("1"), Timestamp: ts},
+		apmqueue.Record{Topic: "topic", Value: []byte("2"),
+			Headers: []apmqueue.Header{{Key: "c", Value: []byte("d")}},
+		},
+	))
+
+	// The topic is created with a single partition.
+	records := b.Records("topic")
+	require.Len(t, records, 2)
+	assert.Equal(t, []apmqueue.Header{{Key: "a", Value: []byte("b")}}, records[0].Headers)
+	assert.Equal(t, ts, records[0].Timestamp)
+	assert.Equal(t, []apmqueue.Header{
+		{Key: "a", Value: []byte("b")},
+		{Key: "c", Value: []byte("d")},
+	}, records[1].Headers)
+	assert.False(t, records[1].Timestamp.Before(before))
+	assert.Empty(t, b.Records("unknown"))
+}
+
+func TestProducerClose(t *testing.T) {
+	producer := newProducer(t, NewBroker())
+	require.NoError(t, producer.Healthy(context.Background()))
+	require.NoError(t, producer.Close())
+	assert.ErrorIs(t, producer.Healthy(context.Background()), ErrClosed)
+	assert.ErrorIs(t, producer.Produce(context.Background(),
+		apmqueue.Record{Topic: "topic", Value: []byte("1")},
+	), ErrClosed)
+}
@@ -22,12 +22,27 @@ package apmqueue
 import (
 	"context"
 	"errors"
+	"fmt"
+	"sort"
+	"time"
 )
 
 var (
 	// ErrConsumerAlreadyRunning is returned by consumer.Run if it has already
 	// been called.
 	ErrConsumerAlreadyRunning = errors.New("consumer.Run: consumer already running")
+
+	// ErrSkip may be returned, or wrapped, by a Processor or BatchProcessor,
+	// or by the record errors of a BatchError, to skip the record: it's
+	// considered processed, and its offset can be committed, without being
+	// retried or reported as a processing failure.
+	ErrSkip = errors.New("apmqueue: skip record")
+	// ErrRetry may be returned, or wrapped, by a Processor or BatchProcessor,
+	// or by the record errors of a BatchError, to retry processing the
+	// record regardless of the consumer's retry policy, until the processor
+	// returns another error or the consumer stops. Consumers which don't
+	// retry records handle it like any other error.
+	ErrRetry = errors.New("apmqueue: retry record")
 )
 
 const (
@@ -63,7 +78,8 @@ type Producer interface {
 	// stored in the producer buffer, or when the records are produced to the
 	// queue if sync producing is configured.
 	// If the context has been enriched with metadata, each entry will be added
-	// as a record's header.
+	// as a record's header. The record's Headers are added after
+	// the context metadata.
 	// Produce takes ownership of Record and any modifications after Produce is
 	// called may cause an unhandled exception.
 	Produce(ctx context.Context, rs ...Record) error
@@ -78,6 +94,16 @@ type Record struct {
 	// OrderingKey is an optional field that is hashed to map to a partition.
 	// Records with same ordering key are routed to the same partition.
 	OrderingKey []byte
+	// Key is an optional field that holds the key the record is produced
+	// with, which identifies the record in compacted topics, where only the
+	// latest record with each key is retained. If Key is empty, the record
+	// is produced with its OrderingKey as the key.
+	//
+	// When both are set, Key is the record's identity for compaction, and
+	// OrderingKey determines the record's partition. If only Key is set,
+	// the record is partitioned by Key. Consumers populate both Key and
+	// OrderingKey with the key of the consumed record.
+	Key []byte
 	// Value holds the record's content. It must not be mutated after Produce.
 	Value []byte
 	// Topics holds the topic where the record will be produced.
@@ -86,6 +112,23 @@ type Record struct {
 	// It is optional and only used for consumers.
 	// When not specified, the zero value for int32 (0) identifies the only partition.
 	Partition int32
+	// Headers holds optional headers which are produced alongside the
+	// record, such as trace context or tenant IDs. Consumers populate the
+	// headers of the consumed record.
+	Headers []Header
+	// Timestamp holds the record's timestamp. Producers set the timestamp
+	// of the produced record to it, or to the time the record is produced
+	// if it's zero. Consumers populate the timestamp of the consumed record,
+	// which is the time the record was created by its producer, unless the
+	// topic's `message.timestamp.type` is `LogAppendTime`, in which case
+	// it's the time the record was appended to the log by the broker.
+	Timestamp time.Time
+}
+
+// Header is a key / value pair attached to a Record.
+type Header struct {
+	Key   string
+	Value []byte
 }
 
 // Processor defines record processing signature.
@@ -104,6 +147,62 @@ func (f ProcessorFunc) Process(ctx context.Context, rs Record) error {
 	return f(ctx, rs)
 }
 
+// BatchProcessor defines the bulk record processing signature.
+type BatchProcessor interface {
+	// ProcessBatch processes the records within the passed context. The
+	// records belong to the same topic and partition, and are ordered by
+	// offset.
+	//
+	// If only some of the records fail to be processed, ProcessBatch should
+	// return a *BatchError identifying them, the rest of the records are then
+	// considered processed. Any other error fails all the records.
+	// ProcessBatch takes ownership of the passed records, callers must not
+	// mutate a record after ProcessBatch has been called.
+	ProcessBatch(context.Context, []Record) error
+}
+
+// BatchProcessorFunc is a function type that implements the BatchProcessor
+// interface.
+type BatchProcessorFunc func(context.Context, []Record) error
+
+// ProcessBatch returns f(ctx, records).
+func (f BatchProcessorFunc) ProcessBatch(ctx context.Context, rs []Record) error {
+	return f(ctx, rs)
+}
+
+// BatchError is returned by a BatchProcessor when some of the records of a
+// batch fail to be processed.
+type BatchError struct {
+	// Errors holds the error of each record which failed to be processed,
+	// keyed by the record's index in the batch.
+	Errors map[int]error
+}
+
+// Error returns the first record error.
+func (e *BatchError) Error() string {
+	errs := e.Unwrap()
+	if len(errs) == 0 {
+		return "batch: no records failed"
+	}
+	return fmt.Sprintf("batch: %d records failed, first error: %s",
+		len(errs), errs[0],
+	)
+}
+
+// Unwrap returns the record errors, ordered by index.
+func (e *BatchError) Unwrap() []error {
+	indices := make([]int, 0, len(e.Errors))
+	for i := range e.Errors {
+		indices = append(indices, i)
+	}
+	sort.Ints(indices)
+	errs := make([]error, len(indices))
+	for i, idx := range indices {
+		errs[i] = e.Errors[idx]
+	}
+	return errs
+}
+
 // Topic represents a destination topic where to produce a message/record.
 type Topic string
 
@@ -116,3 +215,18 @@ type TopicConsumer struct {
 	// Required consumer name.
 	Consumer string
 }
+
+// TopicConfig holds the configuration used to create a topic.
+type TopicConfig struct {
+	// Topic is the name of the topic to create.
+	Topic Topic
+	// PartitionCount is the number of partitions to assign to the topic.
+	// If PartitionCount is zero or -1, the broker's default is used.
+	PartitionCount int
+	// ReplicationFactor is the number of replicas for each partition.
+	// If ReplicationFactor is zero or -1, the broker's default is used.
+	ReplicationFactor int
+	// Configs holds any topic-level configs to set on the topic, such as
+	// `retention.ms`, `cleanup.policy` or `max.message.bytes`.
+	Configs map[string]*string
+}
@@ -0,0 +1,234 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+// Package testproducer provides an apmqueue.Producer which records the
+// produced records, and asserts them against expectations, for testing code
+// which produces records without running Kafka.
+package testproducer
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+
+	apmqueue "github.com/elastic/apm-queue/v2"
+	"github.com/elastic/apm-queue/v2/internal/recordutil"
+)
+
+// ErrClosed is returned when producing with a closed Producer.
+var ErrClosed = errors.New("testproducer: producer closed")
+
+// Matcher returns whether a produced record matches an expectation.
+type Matcher func(apmqueue.Record) bool
+
+// Any matches all records.
+func Any() Matcher {
+	return func(apmqueue.Record) bool { return true }
+}
+
+// WithValue matches records with the given value.
+func WithValue(value []byte) Matcher {
+	return func(r apmqueue.Record) bool { return bytes.Equal(r.Value, value) }
+}
+
+// WithKey matches records with the given key.
+func WithKey(key []byte) Matcher {
+	return func(r apmqueue.Record) bool { return bytes.Equal(r.Key, key) }
+}
+
+// WithOrderingKey matches records with the given ordering key.
+func WithOrderingKey(key []byte) Matcher {
+	return func(r apmqueue.Record) bool { return bytes.Equal(r.OrderingKey, key) }
+}
+
+// WithHeader matches records with a header with the given key and value.
+func WithHeader(key string, value []byte) Matcher {
+	return func(r apmqueue.Record) bool {
+		for _, h := range r.Headers {
+			if h.Key == key && bytes.Equal(h.Value, value) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+var _ apmqueue.Producer = &Producer{}
+
+// Producer records the produced records, in the order they're produced. The
+// context metadata is added to each record's headers followed by the
+// record's own headers, and the timestamp of records with no Timestamp is
+// set to the current time, as with the Kafka producer.
+type Producer struct {
+	t testing.TB
+
+	mu       sync.Mutex
+	records  []apmqueue.Record
+	failures []failure
+	closed   bool
+}
+
+// failure is a simulated produce error.
+type failure struct {
+	topic apmqueue.Topic
+	key   []byte
+	err   error
+}
+
+// New returns a new Producer, which reports failed assertions to t.
+func New(t testing.TB) *Producer {
+	return &Producer{t: t}
+}
+
+// FailProduce makes the records produced to topic fail with err, instead of
+// being recorded. If key is non-nil, only the records with key as their
+// ordering key fail.
+func (p *Producer) FailProduce(topic apmqueue.Topic, key []byte, err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.failures = append(p.failures, failure{topic: topic, key: key, err: err})
+}
+
+// Produce records the records, except for the ones which fail to be produced
+// as configured with FailProduce, returning their errors.
+func (p *Producer) Produce(ctx context.Context, rs ...apmqueue.Record) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		return ErrClosed
+	}
+	defaults := recordutil.ContextDefaults(ctx)
+	var errs []error
+	for _, r := range rs {
+		if err := p.failure(r); err != nil {
+			errs = append(errs, fmt.Errorf(
+				"failed to produce record to topic %q: %w", r.Topic, err,
+			))
+			continue
+		}
+		p.records = append(p.records, defaults.Apply(r))
+	}
+	return errors.Join(errs...)
+}
+
+// failure returns the simulated error of r, if any.
+func (p *Producer) failure(r apmqueue.Record) error {
+	for _, f := range p.failures {
+		if f.topic == r.Topic && (f.key == nil || bytes.Equal(f.key, r.OrderingKey)) {
+			return f.err
+		}
+	}
+	return nil
+}
+
+// Healthy returns ErrClosed if the producer has been closed.
+func (p *Producer) Healthy(context.Context) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		return ErrClosed
+	}
+	return nil
+}
+
+// Close closes the producer. Records can't be produced after Close.
+func (p *Producer) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.closed = true
+	return nil
+}
+
+// ProducedRecords returns the records produced to topic, in the order they
+// were produced.
+func (p *Producer) ProducedRecords(topic apmqueue.Topic) []apmqueue.Record {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var records []apmqueue.Record
+	for _, r := range p.records {
+		if r.Topic == topic {
+			records = append(records, r)
+		}
+	}
+	return records
+}
+
+// ProducedByKey returns the records produced to topic grouped by their
+// ordering key, in the order they were produced. Records with the same
+// ordering key are produced to the same partition by the Kafka producer, so
+// they're consumed in this order.
+func (p *Producer) ProducedByKey(topic apmqueue.Topic) map[string][]apmqueue.Record {
+	records := make(map[string][]apmqueue.Record)
+	for _, r := range p.ProducedRecords(topic) {
+		records[string(r.OrderingKey)] = append(records[string(r.OrderingKey)], r)
+	}
+	return records
+}
+
+// AssertProduced asserts that a record matching m was produced to topic,
+// and returns whether the assertion succeeded.
+func (p *Producer) AssertProduced(topic apmqueue.Topic, m Matcher) bool {
+	p.t.Helper()
+	records := p.ProducedRecords(topic)
+	for _, r := range records {
+		if m(r) {
+			return true
+		}
+	}
+	p.t.Errorf("no matching record produced to topic %q, produced records:\n%s",
+		topic, formatRecords(records),
+	)
+	return false
+}
+
+// AssertProducedInOrder asserts that exactly len(ms) records were produced
+// to topic with key as their ordering key, and that they match ms in the
+// order they were produced. It returns whether the assertion succeeded.
+func (p *Producer) AssertProducedInOrder(topic apmqueue.Topic, key []byte, ms ...Matcher) bool {
+	p.t.Helper()
+	records := p.ProducedByKey(topic)[string(key)]
+	ok := len(records) == len(ms)
+	for i := 0; ok && i < len(ms); i++ {
+		ok = ms[i](records[i])
+	}
+	if !ok {
+		p.t.Errorf("records produced to topic %q with ordering key %q don't match the %d expected records, produced records:\n%s",
+			topic, key, len(ms), formatRecords(records),
+		)
+	}
+	return ok
+}
+
+// formatRecords formats the records for assertion failure messages.
+func formatRecords(records []apmqueue.Record) string {
+	if len(records) == 0 {
+		return "\t(none)"
+	}
+	var b strings.Builder
+	for i, r := range records {
+		fmt.Fprintf(&b, "\t%d: ordering_key=%q value=%q", i, r.OrderingKey, r.Value)
+		for _, h := range r.Headers {
+			fmt.Fprintf(&b, " header[%s]=%q", h.Key, h.Value)
+		}
+		b.WriteByte('\n')
+	}
+	return strings.TrimSuffix(b.String(), "\n")
+}
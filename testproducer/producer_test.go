@@ -0,0 +1,129 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package testproducer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	apmqueue "github.com/elastic/apm-queue/v2"
+	"github.com/elastic/apm-queue/v2/queuecontext"
+)
+
+// recordingT records the errors of failed assertions.
+type recordingT struct {
+	testing.TB
+	errors []string
+}
+
+func (t *recordingT) Helper() {}
+
+func (t *recordingT) Errorf(format string, args ...any) {
+	t.errors = append(t.errors, fmt.Sprintf(format, args...))
+}
+
+func TestProducerProducedRecords(t *testing.T) {
+	p := New(t)
+	ctx := queuecontext.WithMetadata(context.Background(), map[string]string{"a": "b"})
+	require.NoError(t, p.Produce(ctx,
+		apmqueue.Record{Topic: "topic", Value: []byte("1")},
+		apmqueue.Record{Topic: "other", Value: []byte("2")},
+		apmqueue.Record{Topic: "topic", Value: []byte("3"), Key: []byte("k"),
+			Headers: []apmqueue.Header{{Key: "c", Value: []byte("d")}},
+		},
+	))
+	records := p.ProducedRecords("topic")
+	require.Len(t, records, 2)
+	assert.Equal(t, []byte("1"), records[0].Value)
+	assert.Equal(t, []byte("3"), records[1].Value)
+	assert.Equal(t, []apmqueue.Header{
+		{Key: "a", Value: []byte("b")}, {Key: "c", Value: []byte("d")},
+	}, records[1].Headers)
+	assert.False(t, records[0].Timestamp.IsZero())
+	assert.Empty(t, p.ProducedRecords("missing"))
+
+	assert.True(t, p.AssertProduced("topic", WithValue([]byte("3"))))
+	assert.True(t, p.AssertProduced("topic", WithHeader("c", []byte("d"))))
+	assert.True(t, p.AssertProduced("topic", WithKey([]byte("k"))))
+
+	require.NoError(t, p.Close())
+	assert.ErrorIs(t, p.Produce(ctx, apmqueue.Record{Topic: "topic"}), ErrClosed)
+	assert.ErrorIs(t, p.Healthy(ctx), ErrClosed)
+}
+
+func TestProducerAssertProducedFails(t *testing.T) {
+	rt := &recordingT{TB: t}
+	p := New(rt)
+	require.NoError(t, p.Produce(context.Background(),
+		apmqueue.Record{Topic: "topic", OrderingKey: []byte("k"), Value: []byte("1")},
+	))
+	assert.False(t, p.AssertProduced("topic", WithValue([]byte("2"))))
+	assert.False(t, p.AssertProduced("other", Any()))
+	assert.Equal(t, []string{
+		"no matching record produced to topic \"topic\", produced records:\n\t0: ordering_key=\"k\" value=\"1\"",
+		"no matching record produced to topic \"other\", produced records:\n\t(none)",
+	}, rt.errors)
+}
+
+func TestProducerAssertProducedInOrder(t *testing.T) {
+	rt := &recordingT{TB: t}
+	p := New(rt)
+	require.NoError(t, p.Produce(context.Background(),
+		apmqueue.Record{Topic: "topic", OrderingKey: []byte("a"), Value: []byte("1")},
+		apmqueue.Record{Topic: "topic", OrderingKey: []byte("b"), Value: []byte("2")},
+		apmqueue.Record{Topic: "topic", OrderingKey: []byte("a"), Value: []byte("3")},
+	))
+	byKey := p.ProducedByKey("topic")
+	assert.Len(t, byKey, 2)
+	assert.Len(t, byKey["a"], 2)
+
+	assert.True(t, p.AssertProducedInOrder("topic", []byte("a"),
+		WithValue([]byte("1")), WithValue([]byte("3")),
+	))
+	assert.Empty(t, rt.errors)
+	assert.False(t, p.AssertProducedInOrder("topic", []byte("a"),
+		WithValue([]byte("3")), WithValue([]byte("1")),
+	))
+	assert.False(t, p.AssertProducedInOrder("topic", []byte("b")))
+	assert.Len(t, rt.errors, 2)
+}
+
+func TestProducerFailProduce(t *testing.T) {
+	p := New(t)
+	errBoom := errors.New("boom")
+	p.FailProduce("topic", []byte("bad"), errBoom)
+	p.FailProduce("failing", nil, errBoom)
+	err := p.Produce(context.Background(),
+		apmqueue.Record{Topic: "topic", OrderingKey: []byte("bad"), Value: []byte("1")},
+		apmqueue.Record{Topic: "topic", OrderingKey: []byte("good"), Value: []byte("2")},
+		apmqueue.Record{Topic: "failing", Value: []byte("3")},
+	)
+	assert.ErrorIs(t, err, errBoom)
+	assert.EqualError(t, err, "failed to produce record to topic \"topic\": boom\n"+
+		"failed to produce record to topic \"failing\": boom")
+
+	// Only the records which didn't fail are recorded.
+	assert.True(t, p.AssertProducedInOrder("topic", []byte("good"), WithValue([]byte("2"))))
+	assert.Len(t, p.ProducedRecords("topic"), 1)
+	assert.Empty(t, p.ProducedRecords("failing"))
+}